@@ -11,6 +11,8 @@ const (
 	MongoStorageType = "mongo"
 	// PostgresStorageType represents the SQL storage type.
 	PostgresStorageType = "postgres"
+	// SQLiteStorageType represents the embedded SQLite storage type.
+	SQLiteStorageType = "sqlite"
 )
 
 // Orcaloop represents the configuration for the Orcaloop service.
@@ -20,6 +22,9 @@ const (
 //	Name: The name of the service.
 //	Storage: The storage configuration.
 //	Listener: The listener configuration.
+//	Callback: The configuration of the step completion callbacks.
+//	Messaging: The messaging configuration.
+//	WorkQueue: The configuration of the workers executing the instances.
 type Orcaloop struct {
 	// The name of the service
 	Name string `json:"name" yaml:"name"`
@@ -27,6 +32,56 @@ type Orcaloop struct {
 	StorageConfig *StorageConfig `json:"storage" yaml:"storage"`
 	// ApiSrvConfig configuration
 	ApiSrvConfig *rest.SrvOptions `json:"api_server" yaml:"api_server"`
+	// Callback configuration
+	Callback *CallbackConfig `json:"callback" yaml:"callback"`
+	// Messaging configuration
+	Messaging *MessagingConfig `json:"messaging" yaml:"messaging"`
+	// WorkQueue configuration
+	WorkQueue *WorkQueueConfig `json:"workQueue,omitempty" yaml:"workQueue,omitempty"`
+}
+
+// MessagingConfig represents the messaging configuration of the service.
+// The topics are golly messaging urls, e.g. chan://orcaloop/replies for the in-process provider.
+//
+// Fields:
+//
+//	ReplyTopic: The topic the messaging actions publish their step change events to.
+//	DeadLetterTopic: The topic the events not matching any running step are sent to.
+//	                 The events are dropped if no dead letter topic is configured.
+type MessagingConfig struct {
+	// The url of the reply topic
+	ReplyTopic string `json:"replyTopic" yaml:"replyTopic"`
+	// The url of the dead letter topic
+	DeadLetterTopic string `json:"deadLetterTopic,omitempty" yaml:"deadLetterTopic,omitempty"`
+}
+
+// WorkQueueConfig represents the configuration of the workers processing the persisted tasks of the instances.
+// The defaults of the runtime are used for the values that are not set.
+//
+// Fields:
+//
+//	Workers: The number of workers of the service.
+//	LeaseTimeout: The time (in seconds) a leased task stays invisible to the other workers without a heartbeat.
+//	PollInterval: The interval (in milliseconds) at which an idle worker looks for new tasks.
+type WorkQueueConfig struct {
+	// The number of workers
+	Workers int `json:"workers,omitempty" yaml:"workers,omitempty"`
+	// The lease timeout in seconds
+	LeaseTimeout int `json:"leaseTimeout,omitempty" yaml:"leaseTimeout,omitempty"`
+	// The poll interval in milliseconds
+	PollInterval int `json:"pollInterval,omitempty" yaml:"pollInterval,omitempty"`
+}
+
+// CallbackConfig represents the configuration of the route used by asynchronous actions
+// to report the completion of a step.
+//
+// Fields:
+//
+//	Token: The bearer token the action endpoints have to send in the Authorization header.
+//	       Callbacks are rejected if no token is configured.
+type CallbackConfig struct {
+	// The bearer token of the callbacks
+	Token string `json:"token" yaml:"token"`
 }
 
 // StorageConfig represents the configuration for a storage system.
@@ -49,6 +104,7 @@ type StorageConfig struct {
 //   - Local: Local storage configuration (pointer to LocalStorage).
 //   - Mongo: MongoDB storage configuration (pointer to MongoStorage).
 //   - SQL: SQL storage configuration (pointer to SQLStorage).
+//   - SQLite: SQLite storage configuration (pointer to SQLiteStorage).
 type Provider struct {
 	// Local storage configuration
 	Local *LocalStorage `json:"local" yaml:"local"`
@@ -56,6 +112,8 @@ type Provider struct {
 	Mongo *MongoStorage `json:"mongo" yaml:"mongo"`
 	// SQL storage configuration
 	PostgreSQL *PostgresStorage `json:"sql" yaml:"sql"`
+	// SQLite storage configuration
+	SQLite *SQLiteStorage `json:"sqlite" yaml:"sqlite"`
 }
 
 // LocalStorage represents the configuration for local storage.
@@ -102,6 +160,8 @@ type PostgresStorage struct {
 	User     string `json:"user,omitempty" yaml:"user,omitempty"`
 	Password string `json:"password,omitempty" yaml:"password,omitempty"`
 	SSLMode  string `json:"sslMode,omitempty" yaml:"sslMode,omitempty"`
+	// Apply the pending migrations of db/postgres to the schema on startup
+	AutoMigrate bool `json:"autoMigrate,omitempty" yaml:"autoMigrate,omitempty"`
 	//Limits for the connection pool
 	MaxLifetimeMs     int   `json:"maxLifetimeMs" yaml:"maxLifetimeMs"`
 	MaxIdleTimeMs     int   `json:"maxIdleTimeMs" yaml:"maxIdleTimeMs"`
@@ -113,6 +173,20 @@ type PostgresStorage struct {
 	MaxLifetimeClosed int64 `json:"maxLifetimeClosed" yaml:"maxLifetimeClosed"`
 }
 
+// SQLiteStorage represents the configuration for the embedded SQLite storage.
+// The data is kept in a single file that is created along with its schema if it does not exist.
+//
+// Fields:
+//
+//	Path: The path of the database file.
+//	BusyTimeoutMs: The time (in milliseconds) a write waits for the lock of the database held by another write.
+type SQLiteStorage struct {
+	// The path of the database file
+	Path string `json:"path" yaml:"path"`
+	// The busy timeout in milliseconds
+	BusyTimeoutMs int `json:"busyTimeoutMs,omitempty" yaml:"busyTimeoutMs,omitempty"`
+}
+
 // FirestoreStorage represents the configuration for Firestore storage.
 //
 // Fields:
@@ -145,12 +219,13 @@ func DefaultConfig() *Orcaloop {
 			Type: PostgresStorageType,
 			Provider: &Provider{
 				PostgreSQL: &PostgresStorage{
-					Host:     "localhost",
-					Port:     5432,
-					Database: "orcaloop-dev",
-					User:     "pgadmin_user",
-					Password: "pgadmin_password",
-					SSLMode:  "disable",
+					Host:        "localhost",
+					Port:        5432,
+					Database:    "orcaloop-dev",
+					User:        "pgadmin_user",
+					Password:    "pgadmin_password",
+					SSLMode:     "disable",
+					AutoMigrate: true,
 				},
 			},
 		},
@@ -0,0 +1,10 @@
+// Package db embeds the schema migrations of the storages.
+package db
+
+import "embed"
+
+// Postgres holds the migrations of the PostgresStorage. Each migration is a directory named after its version, the sql
+// files of a migration are applied in the order of their names.
+//
+//go:embed postgres
+var Postgres embed.FS
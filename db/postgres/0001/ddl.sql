@@ -1,25 +1,25 @@
--- DROP SCHEMA public;
-
-CREATE SCHEMA public AUTHORIZATION pg_database_owner;
-
-COMMENT ON SCHEMA public IS 'standard public schema';
-
--- DROP TYPE public.status;
-
-CREATE TYPE public.status AS ENUM (
-	'Pending',
-	'Running',
-	'Completed',
-	'Failed',
-	'Skipped',
-	'Unknown');
--- public.actions definition
+-- The schema is created by the migration runner, the objects are created in the schema on the search_path.
+
+-- DROP TYPE status;
+
+DO $$ BEGIN
+	CREATE TYPE status AS ENUM (
+		'Pending',
+		'Running',
+		'Completed',
+		'Failed',
+		'Skipped',
+		'Unknown');
+EXCEPTION
+	WHEN duplicate_object THEN NULL;
+END $$;
+-- actions definition
 
 -- Drop table
 
--- DROP TABLE public.actions;
+-- DROP TABLE actions;
 
-CREATE TABLE public.actions (
+CREATE TABLE IF NOT EXISTS actions (
 	id varchar NOT NULL,
 	"name" varchar NOT NULL,
 	description text NULL,
@@ -33,13 +33,13 @@ CREATE TABLE public.actions (
 );
 
 
--- public.workflow_data definition
+-- workflow_data definition
 
 -- Drop table
 
--- DROP TABLE public.workflow_data;
+-- DROP TABLE workflow_data;
 
-CREATE TABLE public.workflow_data (
+CREATE TABLE IF NOT EXISTS workflow_data (
 	instance_id varchar NOT NULL,
 	workflow_id varchar NOT NULL,
 	workflow_version int4 NOT NULL,
@@ -52,13 +52,13 @@ CREATE TABLE public.workflow_data (
 );
 
 
--- public.workflows definition
+-- workflows definition
 
 -- Drop table
 
--- DROP TABLE public.workflows;
+-- DROP TABLE workflows;
 
-CREATE TABLE public.workflows (
+CREATE TABLE IF NOT EXISTS workflows (
 	workflow_id varchar NOT NULL,
 	"version" int4 NOT NULL,
 	"name" varchar NOT NULL,
@@ -71,13 +71,13 @@ CREATE TABLE public.workflows (
 );
 
 
--- public.pending_steps definition
+-- pending_steps definition
 
 -- Drop table
 
--- DROP TABLE public.pending_steps;
+-- DROP TABLE pending_steps;
 
-CREATE TABLE public.pending_steps (
+CREATE TABLE IF NOT EXISTS pending_steps (
 	id varchar NOT NULL,
 	instance_id varchar NOT NULL,
 	step_id varchar NOT NULL,
@@ -86,65 +86,65 @@ CREATE TABLE public.pending_steps (
 	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	CONSTRAINT pending_steps_pkey PRIMARY KEY (id),
-	CONSTRAINT fk_pending_steps_instance FOREIGN KEY (instance_id) REFERENCES public.workflow_data(instance_id) ON DELETE CASCADE
+	CONSTRAINT fk_pending_steps_instance FOREIGN KEY (instance_id) REFERENCES workflow_data(instance_id) ON DELETE CASCADE
 );
 
 
--- public.step_change_event definition
+-- step_change_event definition
 
 -- Drop table
 
--- DROP TABLE public.step_change_event;
+-- DROP TABLE step_change_event;
 
-CREATE TABLE public.step_change_event (
+CREATE TABLE IF NOT EXISTS step_change_event (
 	instance_id varchar NOT NULL,
 	event_id varchar NOT NULL,
 	step_id varchar NOT NULL,
-	status public.status NULL,
+	status status NULL,
 	"data" jsonb NULL,
 	is_deleted bool DEFAULT false NOT NULL,
 	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	CONSTRAINT step_change_event_pkey PRIMARY KEY (instance_id, event_id),
-	CONSTRAINT fk_step_change_event_instance FOREIGN KEY (instance_id) REFERENCES public.workflow_data(instance_id) ON DELETE CASCADE
+	CONSTRAINT fk_step_change_event_instance FOREIGN KEY (instance_id) REFERENCES workflow_data(instance_id) ON DELETE CASCADE
 );
 
 
--- public.step_state definition
+-- step_state definition
 
 -- Drop table
 
--- DROP TABLE public.step_state;
+-- DROP TABLE step_state;
 
-CREATE TABLE public.step_state (
+CREATE TABLE IF NOT EXISTS step_state (
 	instance_id varchar NOT NULL,
 	step_id varchar NOT NULL,
 	iteration int4 DEFAULT 0 NOT NULL,
 	parent_step varchar NULL,
 	child_count int4 NULL,
-	status public.status NULL,
+	status status NULL,
 	step_state jsonb NULL,
 	CONSTRAINT step_state_pkey PRIMARY KEY (instance_id, step_id, iteration),
-	CONSTRAINT fk_step_state_instance FOREIGN KEY (instance_id) REFERENCES public.workflow_data(instance_id) ON DELETE CASCADE
+	CONSTRAINT fk_step_state_instance FOREIGN KEY (instance_id) REFERENCES workflow_data(instance_id) ON DELETE CASCADE
 );
 
 
--- public.workflow_state definition
+-- workflow_state definition
 
 -- Drop table
 
--- DROP TABLE public.workflow_state;
+-- DROP TABLE workflow_state;
 
-CREATE TABLE public.workflow_state (
+CREATE TABLE IF NOT EXISTS workflow_state (
 	instance_id varchar NOT NULL,
 	workflow_id varchar NOT NULL,
 	workflow_version int4 NOT NULL,
 	instance_version int4 NULL,
-	status public.status NULL,
+	status status NULL,
 	"error" text NULL,
 	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	CONSTRAINT workflow_state_pkey PRIMARY KEY (instance_id, workflow_id, workflow_version),
-	CONSTRAINT fk_workflow_state_instance FOREIGN KEY (instance_id) REFERENCES public.workflow_data(instance_id) ON DELETE CASCADE,
-	CONSTRAINT fk_workflow_state_workflow FOREIGN KEY (workflow_id,workflow_version) REFERENCES public.workflows(workflow_id,"version") ON DELETE CASCADE
+	CONSTRAINT fk_workflow_state_instance FOREIGN KEY (instance_id) REFERENCES workflow_data(instance_id) ON DELETE CASCADE,
+	CONSTRAINT fk_workflow_state_workflow FOREIGN KEY (workflow_id,workflow_version) REFERENCES workflows(workflow_id,"version") ON DELETE CASCADE
 );
\ No newline at end of file
@@ -0,0 +1,16 @@
+-- workflow_options definition
+
+-- Drop table
+
+-- DROP TABLE workflow_options;
+
+CREATE TABLE IF NOT EXISTS workflow_options (
+	workflow_id varchar NOT NULL,
+	"version" int4 NOT NULL,
+	"options" jsonb NULL,
+	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT workflow_options_pkey PRIMARY KEY (workflow_id, version),
+	CONSTRAINT fk_workflow_options_workflow FOREIGN KEY (workflow_id,"version") REFERENCES workflows(workflow_id,"version") ON DELETE CASCADE
+);
+
@@ -0,0 +1,24 @@
+-- workflow_state reason column
+
+ALTER TABLE workflow_state ADD COLUMN IF NOT EXISTS reason varchar NULL;
+
+
+-- timers definition
+
+-- Drop table
+
+-- DROP TABLE timers;
+
+CREATE TABLE IF NOT EXISTS timers (
+	id varchar NOT NULL,
+	instance_id varchar NOT NULL,
+	step_id varchar NULL,
+	iteration int4 DEFAULT 0 NOT NULL,
+	timer_type varchar NOT NULL,
+	fire_at timestamp NOT NULL,
+	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT timers_pkey PRIMARY KEY (id),
+	CONSTRAINT fk_timers_instance FOREIGN KEY (instance_id) REFERENCES workflow_data(instance_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS timers_fire_at_idx ON timers USING btree (fire_at);
@@ -0,0 +1,7 @@
+-- workflow_state parent instance link of child instances
+
+ALTER TABLE workflow_state ADD COLUMN IF NOT EXISTS parent_instance_id varchar NULL;
+ALTER TABLE workflow_state ADD COLUMN IF NOT EXISTS parent_step_id varchar NULL;
+ALTER TABLE workflow_state ADD COLUMN IF NOT EXISTS parent_iteration int4 NULL;
+
+CREATE INDEX IF NOT EXISTS workflow_state_parent_instance_id_idx ON workflow_state USING btree (parent_instance_id);
@@ -0,0 +1,17 @@
+-- signals definition
+
+-- Drop table
+
+-- DROP TABLE signals;
+
+CREATE TABLE IF NOT EXISTS signals (
+	id varchar NOT NULL,
+	instance_id varchar NOT NULL,
+	"name" varchar NOT NULL,
+	payload jsonb NULL,
+	received_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT signals_pkey PRIMARY KEY (id),
+	CONSTRAINT fk_signals_instance FOREIGN KEY (instance_id) REFERENCES workflow_data(instance_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS signals_instance_id_idx ON signals USING btree (instance_id, received_at);
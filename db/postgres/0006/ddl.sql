@@ -0,0 +1,20 @@
+-- schedules definition
+
+-- Drop table
+
+-- DROP TABLE schedules;
+
+CREATE TABLE IF NOT EXISTS schedules (
+	id varchar NOT NULL,
+	workflow_id varchar NOT NULL,
+	schedule jsonb NOT NULL,
+	next_run_at timestamp NOT NULL,
+	paused bool DEFAULT false NOT NULL,
+	queued int4 DEFAULT 0 NOT NULL,
+	"version" int4 DEFAULT 0 NOT NULL,
+	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT schedules_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS schedules_next_run_at_idx ON schedules USING btree (next_run_at);
@@ -0,0 +1,30 @@
+-- triggers definition
+
+-- Drop table
+
+-- DROP TABLE triggers;
+
+CREATE TABLE IF NOT EXISTS triggers (
+	id varchar NOT NULL,
+	topic varchar NOT NULL,
+	"data" jsonb NOT NULL,
+	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT triggers_pkey PRIMARY KEY (id)
+);
+
+
+-- trigger_messages definition
+
+-- Drop table
+
+-- DROP TABLE trigger_messages;
+
+CREATE TABLE IF NOT EXISTS trigger_messages (
+	trigger_id varchar NOT NULL,
+	message_id varchar NOT NULL,
+	created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT trigger_messages_pkey PRIMARY KEY (trigger_id, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS trigger_messages_created_at_idx ON trigger_messages USING btree (created_at);
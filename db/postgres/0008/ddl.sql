@@ -0,0 +1,3 @@
+-- workflow_state compensation phase of failed instances
+
+ALTER TABLE workflow_state ADD COLUMN IF NOT EXISTS compensation jsonb NULL;
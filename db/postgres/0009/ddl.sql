@@ -0,0 +1,18 @@
+-- tasks definition
+
+-- Drop table
+
+-- DROP TABLE tasks;
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id varchar NOT NULL,
+	instance_id varchar NOT NULL,
+	task_type varchar NOT NULL,
+	"event" jsonb NULL,
+	attempts int4 DEFAULT 0 NOT NULL,
+	lease_owner varchar NULL,
+	lease_until timestamp NOT NULL,
+	created_at timestamp NOT NULL,
+	CONSTRAINT tasks_pkey PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS tasks_lease_until_idx ON tasks USING btree (lease_until, created_at);
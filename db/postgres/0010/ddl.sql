@@ -0,0 +1 @@
+ALTER TABLE workflow_data ADD COLUMN IF NOT EXISTS locked_at timestamp NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE workflow_data ADD COLUMN IF NOT EXISTS lock_owner varchar NULL;
+ALTER TABLE workflow_data ADD COLUMN IF NOT EXISTS lock_until timestamp NULL;
@@ -0,0 +1,5 @@
+-- versions of the optimistic concurrency control
+
+ALTER TABLE step_state ADD COLUMN IF NOT EXISTS "version" int4 DEFAULT 0 NOT NULL;
+ALTER TABLE workflow_data ADD COLUMN IF NOT EXISTS pipeline_version int4 DEFAULT 0 NOT NULL;
+UPDATE workflow_state SET instance_version = 1 WHERE instance_version IS NULL;
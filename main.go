@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	"oss.nandlabs.io/golly/cli"
@@ -8,6 +9,7 @@ import (
 	"oss.nandlabs.io/golly/ioutils"
 	"oss.nandlabs.io/golly/l3" // Add this line
 	"oss.nandlabs.io/orcaloop/config"
+	"oss.nandlabs.io/orcaloop/runtime"
 	"oss.nandlabs.io/orcaloop/service"
 )
 
@@ -26,37 +28,9 @@ func main() {
 		Description: "Starts the  Service",
 		// Aliases:     []string{"st"}, TODO
 		Handler: func(ctx *cli.Context) (err error) {
-			configFile, exists := ctx.GetFlag(ConfigFile)
-			logger.Info(exists)
-			var options *config.Orcaloop
-			if exists && configFile != "" {
-
-				logger.InfoF("Using Configuration File %v", configFile)
-				mime := ioutils.GetMimeFromExt(configFile)
-				var c codec.Codec
-				var f *os.File
-				f, err = os.Open(configFile)
-				if err != nil {
-					logger.ErrorF("Unable to open the file", err)
-					return
-				}
-				c, err = codec.GetDefault(mime)
-				if err != nil {
-					logger.ErrorF("Unable to determine the file content", err)
-					return
-				}
-				options = &config.Orcaloop{}
-
-				err = c.Read(f, options)
-				if err != nil {
-					logger.ErrorF("Unable to read the file", err)
-					return
-				}
-
-			} else {
-				logger.InfoF("No Configuration File found using default configuration")
-				options = config.DefaultConfig()
-
+			options, err := loadConfig(ctx)
+			if err != nil {
+				return
 			}
 			logger.InfoF("Starting Orcaloop service")
 			// builtin.InitActions()
@@ -78,9 +52,87 @@ func main() {
 		},
 	}
 
+	migrateCmd := &cli.Command{
+		Name:        "migrate",
+		Description: "Applies the pending schema migrations to the Postgres storage",
+		Handler: func(ctx *cli.Context) (err error) {
+			options, err := loadConfig(ctx)
+			if err != nil {
+				return
+			}
+			if options.StorageConfig == nil || options.StorageConfig.Type != config.PostgresStorageType ||
+				options.StorageConfig.Provider == nil || options.StorageConfig.Provider.PostgreSQL == nil {
+				err = errors.New("migrations are only supported by the postgres storage")
+				logger.ErrorF("Unable to migrate the storage: %v", err)
+				return
+			}
+			// The migrations are applied below to report their count
+			options.StorageConfig.Provider.PostgreSQL.AutoMigrate = false
+			storage, err := runtime.ConnectPostgres(options.StorageConfig)
+			if err != nil {
+				logger.ErrorF("Unable to connect to Postgres: %v", err)
+				return
+			}
+			defer storage.Database.Close()
+			applied, err := storage.Migrate(options.StorageConfig.Provider.PostgreSQL.Schema)
+			if err != nil {
+				logger.ErrorF("Unable to migrate the storage: %v", err)
+				return
+			}
+			logger.InfoF("Applied %d migrations", applied)
+			return
+		},
+		Flags: []cli.Flag{
+			{
+				Name:    ConfigFile,
+				Aliases: []string{"cf"},
+				Default: "",
+				Usage:   "Configuration File",
+			},
+		},
+	}
+
 	app.AddCommand(startCmd)
+	app.AddCommand(migrateCmd)
 
 	if err := app.Execute(); err != nil {
 		logger.ErrorF("Error executing the command", err)
 	}
 }
+
+// loadConfig reads the configuration from the file of the config-file flag, or returns the default configuration.
+func loadConfig(ctx *cli.Context) (options *config.Orcaloop, err error) {
+	configFile, exists := ctx.GetFlag(ConfigFile)
+	logger.Info(exists)
+	if exists && configFile != "" {
+
+		logger.InfoF("Using Configuration File %v", configFile)
+		mime := ioutils.GetMimeFromExt(configFile)
+		var c codec.Codec
+		var f *os.File
+		f, err = os.Open(configFile)
+		if err != nil {
+			logger.ErrorF("Unable to open the file", err)
+			return
+		}
+		defer f.Close()
+		c, err = codec.GetDefault(mime)
+		if err != nil {
+			logger.ErrorF("Unable to determine the file content", err)
+			return
+		}
+		options = &config.Orcaloop{}
+
+		err = c.Read(f, options)
+		if err != nil {
+			logger.ErrorF("Unable to read the file", err)
+			return
+		}
+
+	} else {
+		logger.InfoF("No Configuration File found using default configuration")
+		options = config.DefaultConfig()
+
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"oss.nandlabs.io/golly/messaging"
 	"oss.nandlabs.io/golly/rest"
@@ -14,6 +15,9 @@ import (
 	"oss.nandlabs.io/orcaloop-sdk/models"
 )
 
+// CancelHeader is the message header set on the cancel requests sent to messaging actions.
+const CancelHeader = "x-orcaloop-cancel"
+
 type ActionExecutor struct {
 	storage Storage
 }
@@ -35,6 +39,10 @@ func (ae *ActionExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (e
 	if err != nil {
 		return
 	}
+	if actionSpec == nil {
+		err = errors.New("no action found by id " + step.Action.Id)
+		return
+	}
 	actionPipeline := pipeline.Clone()
 	parametersMap := make(map[string]*models.Schema)
 	if actionSpec.Parameters != nil {
@@ -42,11 +50,6 @@ func (ae *ActionExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (e
 			parametersMap[param.Name] = param
 		}
 	}
-	if actionSpec == nil {
-		err = errors.New("action action found by id " + step.Action.Name)
-		return
-	}
-	stepChangeHandler := &StepChangeHander{storage: ae.storage}
 	// Validate the parameters for any missing required parameters
 	for _, param := range step.Action.Parameters {
 		var inVal any
@@ -67,47 +70,69 @@ func (ae *ActionExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (e
 		actionPipeline.Set(param.Name, inVal)
 	}
 
-	switch actionSpec.Endpoint.Type {
-	case models.EndpointTypeLocal:
-		handler := handlers.ActionRegistry.Get(step.Action.Id)
-		if handler == nil {
-			err = errors.New("action handler not found for action id " + step.Action.Id)
-			return
-		}
-		err = handler.Handle(actionPipeline)
-		if err != nil {
-			return
-		}
+	err = ae.invoke(step, actionSpec, actionPipeline)
+	var actionErr *ActionError
+	if errors.As(err, &actionErr) {
+		err = ae.onFailure(step, pipeline, actionErr)
+	}
+	return
+}
+
+// invoke calls the action endpoint and queues the result for the StepChangeHander.
+// Failures of the action itself are returned as ActionError.
+func (ae *ActionExecutor) invoke(step *models.Step, actionSpec *models.ActionSpec, actionPipeline *data.Pipeline) (err error) {
+	var result map[string]any
+	result, err = ae.send(step.Action.Id, actionSpec, actionPipeline)
+	if err != nil || result == nil {
+		return
+	}
+	if actionSpec.Endpoint.Type == models.EndpointTypeLocal {
+		// Local handlers write their results to the pipeline
 		retMap := make(map[string]any)
-		for _, result := range step.Action.Results {
+		for _, res := range step.Action.Results {
 			var outVal any
-			outVal, err = actionPipeline.Get(result.OutputVar)
+			outVal, err = actionPipeline.Get(res.OutputVar)
 			if err != nil {
 				return
 			}
-			retMap[result.PipelineVar] = outVal
+			retMap[res.PipelineVar] = outVal
 		}
-		if actionPipeline.Has(data.StepIterationKey) {
-			iteration, err := actionPipeline.Get(data.StepIterationKey)
-			if err != nil {
-				return err
-			}
-			retMap[data.StepIterationKey] = iteration
-		} else {
-			retMap[data.StepIterationKey] = 0
-		}
-		event := &events.StepChangeEvent{
-			EventId:    CreateId(),
-			InstanceId: actionPipeline.Id(),
-			StepId:     step.Id,
-			Status:     models.StatusCompleted,
-			Data:       retMap,
+		result = retMap
+	}
+	result[data.StepIterationKey] = getIteration(actionPipeline)
+	event := &events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: actionPipeline.Id(),
+		StepId:     step.Id,
+		Status:     models.StatusCompleted,
+		Data:       result,
+	}
+	// The workers continue the instance instead of recursing into the next step
+	err = queueStepChange(ae.storage, event)
+	if err != nil {
+		return
+	}
+	logger.DebugF("Event queued for the stepChangeHandler %v", event)
+	return
+}
+
+// send calls the action endpoint with the pipeline.
+// It returns the result of the actions that complete synchronously and nil for the actions that report back later.
+// Failures of the action itself are returned as ActionError.
+func (ae *ActionExecutor) send(actionId string, actionSpec *models.ActionSpec, actionPipeline *data.Pipeline) (result map[string]any, err error) {
+	switch actionSpec.Endpoint.Type {
+	case models.EndpointTypeLocal:
+		handler := handlers.ActionRegistry.Get(actionId)
+		if handler == nil {
+			err = errors.New("action handler not found for action id " + actionId)
+			return
 		}
-		err = stepChangeHandler.Handle(event)
+		err = handler.Handle(actionPipeline)
 		if err != nil {
+			err = &ActionError{Class: ErrorClassHandler, Err: err}
 			return
 		}
-		logger.DebugF("Event Sent to stepChangeHandler %v", event)
+		result = actionPipeline.Map()
 	case models.EndpointTypeRest:
 		var res *rest.Response
 		var req *rest.Request
@@ -119,44 +144,38 @@ func (ae *ActionExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (e
 		req.SetBody(actionPipeline.Map())
 		res, err = client.Execute(req)
 		if err != nil {
+			err = &ActionError{Class: ErrorClassNetwork, Err: err}
 			return
 		}
-		switch res.StatusCode() {
-		case http.StatusOK:
+		switch {
+		case res.StatusCode() == http.StatusOK:
 			// This is a sync call, so we can expect the action to be available.
 			resMap := make(map[string]any)
 			err = res.Decode(&resMap)
 			if err != nil {
-				return errors.New("failed to decode response for action " + step.Action.Id + " with error " + err.Error())
-			}
-			status := models.StatusFailed
-			if _, ok := resMap[data.ErrorKey]; !ok {
-
-				status = models.StatusCompleted
-			}
-			event := &events.StepChangeEvent{
-				EventId:    CreateId(),
-				InstanceId: actionPipeline.Id(),
-				StepId:     step.Id,
-				Status:     status,
-				Data:       resMap,
+				err = errors.New("failed to decode response for action " + actionId + " with error " + err.Error())
+				return
 			}
-			err = stepChangeHandler.Handle(event)
-			if err != nil {
+			if errMsg, ok := resMap[data.ErrorKey]; ok {
+				err = &ActionError{Class: ErrorClassAction, Err: fmt.Errorf("%v", errMsg), Data: resMap}
 				return
 			}
-		case http.StatusAccepted:
-			// This is an async call, we just fire and forget
-			logger.InfoF("action %s accepted", step.Action.Id)
-		case http.StatusInternalServerError:
+			result = resMap
+		case res.StatusCode() == http.StatusAccepted:
+			// This is an async call, the result is reported through the step completion route
+			logger.InfoF("action %s accepted, waiting for the completion of instance %s", actionId, actionPipeline.Id())
+		case res.StatusCode() >= http.StatusInternalServerError:
 			// try parsing the error message
 			var errMessage *models.Error = &models.Error{}
 			err = res.Decode(errMessage)
 			if err != nil {
-				err = errors.New("Unable to execute the rest action for  " + actionSpec.Id)
+				err = &ActionError{Class: ErrorClassServer, Err: errors.New("Unable to execute the rest action for  " + actionSpec.Id)}
 				return
 			}
-			err = fmt.Errorf("unable to execute the rest action for  %s with error %s", actionSpec.Id, errMessage.Message)
+			err = &ActionError{Class: ErrorClassServer, Err: fmt.Errorf("unable to execute the rest action for  %s with error %s", actionSpec.Id, errMessage.Message)}
+			return
+		default:
+			err = &ActionError{Class: ErrorClassAction, Err: fmt.Errorf("unexpected status code %d from the rest action %s", res.StatusCode(), actionSpec.Id)}
 			return
 		}
 	case models.EndpointTypeMessaging:
@@ -165,7 +184,8 @@ func (ae *ActionExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (e
 		var manager messaging.Manager = messaging.GetManager()
 		u, err = url.Parse(actionSpec.Endpoint.Messaging.Url)
 		if err != nil {
-			return fmt.Errorf("invalid url %s for action %s", actionSpec.Endpoint.Messaging.Url, actionSpec.Id)
+			err = fmt.Errorf("invalid url %s for action %s", actionSpec.Endpoint.Messaging.Url, actionSpec.Id)
+			return
 		}
 		// Publish the message to the messaging system
 		message, err = manager.NewMessage(u.Scheme)
@@ -177,7 +197,179 @@ func (ae *ActionExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (e
 			return
 		}
 		err = manager.Send(u, message)
+		if err != nil {
+			err = &ActionError{Class: ErrorClassNetwork, Err: err}
+			return
+		}
+	}
+	return
+}
+
+// Compensate calls the compensating action of a completed action step.
+// The parameters of the compensating action are mapped from the pipeline of the instance. Actions that report
+// back asynchronously are considered compensated once the endpoint accepted the call.
+func (ae *ActionExecutor) Compensate(compensation *CompensateAction, stepState *StepState, pipeline *data.Pipeline) (err error) {
+	var actionSpec *models.ActionSpec
+	actionSpec, err = ae.storage.ActionSpec(compensation.ActionId)
+	if err != nil {
+		return
+	}
+	if actionSpec == nil {
+		err = errors.New("no action found by id " + compensation.ActionId)
+		return
+	}
+	actionPipeline := pipeline.Clone()
+	actionPipeline.Set(data.StepIdKey, stepState.StepId)
+	actionPipeline.Set(data.StepIterationKey, stepState.Iteration)
+	for name, value := range compensation.Values {
+		actionPipeline.Set(name, value)
+	}
+	for name, pipelineVar := range compensation.Parameters {
+		var inVal any
+		if pipeline.Has(pipelineVar) {
+			inVal, err = pipeline.Get(pipelineVar)
+			if err != nil {
+				return
+			}
+		}
+		actionPipeline.Set(name, inVal)
+	}
+	_, err = ae.send(compensation.ActionId, actionSpec, actionPipeline)
+	return
+}
+
+// Cancel calls the cancel hook of the action endpoint for a running step.
+// Rest endpoints receive a DELETE request on the action url and messaging endpoints a message with the
+// CancelHeader set. Both carry the instance id, step id and iteration of the cancelled step.
+// Local actions run synchronously and are not notified.
+func (ae *ActionExecutor) Cancel(step *models.Step, stepState *StepState) (err error) {
+	if step.Action == nil {
+		return
+	}
+	var actionSpec *models.ActionSpec
+	actionSpec, err = ae.storage.ActionSpec(step.Action.Id)
+	if err != nil {
+		return
+	}
+	if actionSpec == nil {
+		err = errors.New("no action found by id " + step.Action.Id)
+		return
+	}
+	body := map[string]any{
+		data.InstanceIdKey:    stepState.InstanceId,
+		data.StepIdKey:        stepState.StepId,
+		data.StepIterationKey: stepState.Iteration,
+	}
+	switch actionSpec.Endpoint.Type {
+	case models.EndpointTypeRest:
+		var res *rest.Response
+		var req *rest.Request
+		client := rest.NewClient()
+		req, err = client.NewRequest(actionSpec.Endpoint.Rest.Url, http.MethodDelete)
+		if err != nil {
+			return
+		}
+		req.SetBody(body)
+		res, err = client.Execute(req)
+		if err != nil {
+			return
+		}
+		if res.StatusCode() >= http.StatusBadRequest {
+			err = fmt.Errorf("unexpected status code %d from the cancel hook of action %s", res.StatusCode(), actionSpec.Id)
+		}
+	case models.EndpointTypeMessaging:
+		var u *url.URL
+		var message messaging.Message
+		var manager messaging.Manager = messaging.GetManager()
+		u, err = url.Parse(actionSpec.Endpoint.Messaging.Url)
+		if err != nil {
+			return fmt.Errorf("invalid url %s for action %s", actionSpec.Endpoint.Messaging.Url, actionSpec.Id)
+		}
+		message, err = manager.NewMessage(u.Scheme)
+		if err != nil {
+			return
+		}
+		err = message.SetStrHeader(CancelHeader, "true")
+		if err != nil {
+			return
+		}
+		err = message.WriteJSON(body)
+		if err != nil {
+			return
+		}
+		err = manager.Send(u, message)
+	}
+	return
+}
+
+// onFailure records the failed attempt in the StepState and schedules a retry if the retry policy of the step allows it.
+// Otherwise a failed StepChangeEvent is sent to the StepChangeHander.
+func (ae *ActionExecutor) onFailure(step *models.Step, pipeline *data.Pipeline, actionErr *ActionError) (err error) {
+	var stepState *StepState
+	var stepOptions *StepOptions
+	instanceId := pipeline.Id()
+	iteration := getIteration(pipeline)
+	stepOptions, err = getStepOptions(ae.storage, instanceId, step.Id)
+	if err != nil {
 		return
 	}
+	var retry bool
+	// The attempt is saved along with the timer of the retry
+	err = ae.storage.WithTx(func(tx Storage) (err error) {
+		// The step state is read again if it was saved concurrently, e.g. by the timeout of the step
+		err = retryOnConflict(func() (err error) {
+			stepState, err = tx.GetStepState(instanceId, step.Id, iteration)
+			if err != nil {
+				return
+			}
+			if stepState == nil {
+				err = ErrStepStateNotFound(step.Id)
+				return
+			}
+			stepState.Attempts = append(stepState.Attempts, &Attempt{
+				Number:   len(stepState.Attempts) + 1,
+				Class:    actionErr.Class,
+				Error:    actionErr.Err.Error(),
+				FailedAt: time.Now(),
+			})
+			retry = stepOptions != nil && stepOptions.Retry.ShouldRetry(len(stepState.Attempts), actionErr.Class)
+			if retry {
+				stepState.NextRetryAt = time.Now().Add(stepOptions.Retry.Delay(len(stepState.Attempts)))
+				stepState.Input = pipeline
+			}
+			err = tx.SaveStepState(stepState)
+			return
+		})
+		if err != nil || !retry {
+			return
+		}
+		logger.InfoF("Attempt %d of step %s for instance %s failed with %v, retrying at %v", len(stepState.Attempts), step.Id, instanceId, actionErr, stepState.NextRetryAt)
+		err = tx.AddTimer(&Timer{
+			Id:         CreateId(),
+			InstanceId: instanceId,
+			StepId:     step.Id,
+			Iteration:  iteration,
+			Type:       TimerTypeRetry,
+			FireAt:     stepState.NextRetryAt,
+		})
+		return
+	})
+	if err != nil || retry {
+		return
+	}
+	eventData := actionErr.Data
+	if eventData == nil {
+		eventData = map[string]any{data.ErrorKey: actionErr.Err.Error()}
+	}
+	eventData[data.StepIterationKey] = iteration
+	event := &events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: instanceId,
+		StepId:     step.Id,
+		Status:     models.StatusFailed,
+		Data:       eventData,
+	}
+	stepChangeHandler := &StepChangeHander{storage: ae.storage}
+	err = stepChangeHandler.Handle(event)
 	return
 }
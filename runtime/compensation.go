@@ -0,0 +1,174 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// CompensateAction holds the action that undoes the effect of a completed action step.
+//
+// Fields:
+// - ActionId: The unique identifier of the compensating action.
+// - Parameters: Maps the parameters of the compensating action to the variables of the pipeline.
+// - Values: The parameters of the compensating action that have a fixed value.
+type CompensateAction struct {
+	ActionId   string            `json:"action_id" yaml:"action_id"`
+	Parameters map[string]string `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	Values     map[string]any    `json:"values,omitempty" yaml:"values,omitempty"`
+}
+
+// Validate checks the compensating action for missing values.
+func (ca *CompensateAction) Validate() (err error) {
+	if ca.ActionId == "" {
+		err = errors.New("action_id is required")
+	}
+	return
+}
+
+// Compensation tracks the compensation phase of a failed instance.
+// The compensating actions of the completed steps are executed in the reverse order of their completion.
+//
+// Fields:
+// - Status: The status of the compensation phase.
+// - Steps: The steps to compensate in the order they are compensated.
+// - Error: The error of the first compensating action that failed.
+type Compensation struct {
+	Status models.Status       `json:"status" yaml:"status"`
+	Steps  []*CompensationStep `json:"steps,omitempty" yaml:"steps,omitempty"`
+	Error  string              `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// CompensationStep tracks the compensating action of a single step.
+//
+// Fields:
+// - StepId: The identifier of the compensated step.
+// - Iteration: The iteration of the compensated step.
+// - Status: The status of the compensating action.
+// - Error: The error of the compensating action if it failed.
+type CompensationStep struct {
+	StepId    string        `json:"step_id" yaml:"step_id"`
+	Iteration int           `json:"iteration" yaml:"iteration"`
+	Status    models.Status `json:"status" yaml:"status"`
+	Error     string        `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// planCompensation sets the compensation phase of a failed instance with the completed action steps to compensate,
+// in the reverse order of their completion. The compensating actions are run by the workers once the final state of
+// the instance is committed, so that the remote calls are not made while a transaction is open.
+// Terminated instances are not compensated.
+func planCompensation(storage Storage, workflowState *WorkflowState) (err error) {
+	var options *WorkflowOptions
+	var stepStates map[string][]*StepState
+	if workflowState.Reason == ReasonTerminated || workflowState.Compensation != nil {
+		return
+	}
+	options, err = storage.GetWorkflowOptions(workflowState.WorkflowId, workflowState.WorkflowVersion)
+	if err != nil {
+		return
+	}
+	stepStates, err = storage.GetStepStates(workflowState.InstanceId)
+	if err != nil {
+		return
+	}
+	var completed []*StepState
+	for _, stepStateArr := range stepStates {
+		for _, stepState := range stepStateArr {
+			stepOptions := options.Step(stepState.StepId)
+			if stepState.Status == models.StatusCompleted && stepOptions != nil && stepOptions.Compensate != nil {
+				completed = append(completed, stepState)
+			}
+		}
+	}
+	if len(completed) == 0 {
+		return
+	}
+	sort.SliceStable(completed, func(i, j int) bool {
+		return completed[i].CompletedAt.After(completed[j].CompletedAt)
+	})
+	compensation := &Compensation{Status: models.StatusRunning}
+	for _, stepState := range completed {
+		compensation.Steps = append(compensation.Steps, &CompensationStep{
+			StepId:    stepState.StepId,
+			Iteration: stepState.Iteration,
+			Status:    models.StatusPending,
+		})
+	}
+	workflowState.Compensation = compensation
+	err = queueCompensation(storage, workflowState.InstanceId)
+	return
+}
+
+// compensate executes the pending compensating actions of a failed instance, outside of any transaction.
+// The result of every compensating action is saved right away, so a compensation that was interrupted continues with
+// the steps that were not compensated yet. A compensating action that fails does not stop the compensation of the
+// remaining steps, the failure is recorded in the compensation phase instead.
+func compensate(storage Storage, instanceId string) (err error) {
+	var workflowState *WorkflowState
+	var options *WorkflowOptions
+	var stepStates map[string][]*StepState
+	var pipeline *VersionedPipeline
+	workflowState, err = storage.GetState(instanceId)
+	if err != nil {
+		return
+	}
+	compensation := workflowState.Compensation
+	if compensation == nil || compensation.Status != models.StatusRunning {
+		return
+	}
+	options, err = storage.GetWorkflowOptions(workflowState.WorkflowId, workflowState.WorkflowVersion)
+	if err != nil {
+		return
+	}
+	stepStates, err = storage.GetStepStates(instanceId)
+	if err != nil {
+		return
+	}
+	pipeline, err = storage.GetPipeline(instanceId)
+	if err != nil {
+		return
+	}
+	logger.InfoF("Compensating %d steps of instance %s", len(compensation.Steps), instanceId)
+	actionExecutor := &ActionExecutor{storage: storage}
+	for _, compensationStep := range compensation.Steps {
+		if compensationStep.Status != models.StatusPending {
+			continue
+		}
+		var stepState *StepState
+		for _, state := range stepStates[compensationStep.StepId] {
+			if state.Iteration == compensationStep.Iteration {
+				stepState = state
+			}
+		}
+		var compensateErr error
+		stepOptions := options.Step(compensationStep.StepId)
+		if stepState == nil || stepOptions == nil || stepOptions.Compensate == nil {
+			compensateErr = fmt.Errorf("no compensating action found for step %s", compensationStep.StepId)
+		} else {
+			compensateErr = actionExecutor.Compensate(stepOptions.Compensate, stepState, pipeline.Pipeline)
+		}
+		if compensateErr != nil {
+			logger.ErrorF("Unable to compensate step %s of instance %s: %v", compensationStep.StepId, instanceId, compensateErr)
+			compensationStep.Status = models.StatusFailed
+			compensationStep.Error = compensateErr.Error()
+			if compensation.Error == "" {
+				compensation.Error = fmt.Sprintf("compensation of step %s failed: %v", compensationStep.StepId, compensateErr)
+			}
+		} else {
+			compensationStep.Status = models.StatusCompleted
+		}
+		err = storage.SaveState(workflowState)
+		if err != nil {
+			return
+		}
+	}
+	if compensation.Error != "" {
+		compensation.Status = models.StatusFailed
+	} else {
+		compensation.Status = models.StatusCompleted
+	}
+	err = storage.SaveState(workflowState)
+	return
+}
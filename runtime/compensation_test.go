@@ -0,0 +1,87 @@
+package runtime
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/golly/messaging"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestCompensationRunsAfterCommit(t *testing.T) {
+	// The listeners of the in-process provider outlive the test, each run uses its own topic
+	topic := "chan://orcaloop-test/" + CreateId() + "/undo"
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveAction(&models.ActionSpec{
+		Id:       "undo",
+		Name:     "undo",
+		Endpoint: &models.Endpoint{Type: models.EndpointTypeMessaging, Messaging: &models.MessagingEndpoint{Url: topic}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveWorkflow(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps:   []*models.Step{{Id: "step-1", Type: models.StepTypeAction}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveWorkflowOptions(&WorkflowOptions{
+		WorkflowId:      "workflow-1",
+		WorkflowVersion: 1,
+		Steps:           map[string]*StepOptions{"step-1": {Compensate: &CompensateAction{ActionId: "undo"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusCompleted})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	compensated := make(chan string, 1)
+	topicUrl, _ := url.Parse(topic)
+	err = messaging.GetManager().AddListener(topicUrl, func(msg messaging.Message) { compensated <- msg.ReadAsStr() })
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	workflowState := &WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusFailed}
+	err = finishInstance(storage, workflowState)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stored, _ := storage.GetState("instance-1")
+	if stored.Compensation == nil || stored.Compensation.Status != models.StatusRunning || stored.Compensation.Steps[0].Status != models.StatusPending {
+		t.Fatalf("expected the compensation to be planned with the final state, got %+v", stored.Compensation)
+	}
+	select {
+	case <-compensated:
+		t.Fatal("expected the compensating action not to be called before the final state is committed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	wq := NewWorkQueue(storage, nil)
+	tasks, err := storage.LeaseTasks(wq.owner, 1, time.Minute)
+	if err != nil || len(tasks) != 1 || tasks[0].Type != TaskTypeCompensate {
+		t.Fatalf("expected a compensation task, got %v %v", tasks, err)
+	}
+	wq.process(tasks[0])
+	select {
+	case <-compensated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the compensating action to be called")
+	}
+	stored, _ = storage.GetState("instance-1")
+	if stored.Compensation.Status != models.StatusCompleted || stored.Compensation.Steps[0].Status != models.StatusCompleted {
+		t.Errorf("expected the compensation to be completed, got %+v", stored.Compensation)
+	}
+}
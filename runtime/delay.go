@@ -0,0 +1,110 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// Delay holds the configuration of a step of type StepTypeDelay.
+// Exactly one of DurationMs and UntilVar must be set.
+//
+// Fields:
+// - DurationMs: The time in milliseconds the step waits before it completes.
+// - UntilVar: The pipeline variable holding the time until which the step waits.
+// The value is either an RFC 3339 timestamp or a Unix time in milliseconds.
+type Delay struct {
+	DurationMs int64  `json:"duration_ms,omitempty" yaml:"duration_ms,omitempty"`
+	UntilVar   string `json:"until_var,omitempty" yaml:"until_var,omitempty"`
+}
+
+// Validate checks the delay configuration for missing or invalid values.
+func (d *Delay) Validate() (err error) {
+	switch {
+	case d.DurationMs < 0:
+		err = errors.New("duration_ms must not be negative")
+	case d.DurationMs == 0 && d.UntilVar == "":
+		err = errors.New("either duration_ms or until_var is required")
+	case d.DurationMs > 0 && d.UntilVar != "":
+		err = errors.New("only one of duration_ms and until_var is allowed")
+	}
+	return
+}
+
+// WakeUpAt returns the time at which the delay ends for the given pipeline.
+func (d *Delay) WakeUpAt(pipeline *data.Pipeline) (wakeUpAt time.Time, err error) {
+	if d.UntilVar == "" {
+		wakeUpAt = time.Now().Add(time.Duration(d.DurationMs) * time.Millisecond)
+		return
+	}
+	var until any
+	until, err = pipeline.Get(d.UntilVar)
+	if err != nil {
+		return
+	}
+	switch v := until.(type) {
+	case time.Time:
+		wakeUpAt = v
+	case string:
+		wakeUpAt, err = time.Parse(time.RFC3339, v)
+	case int:
+		wakeUpAt = time.UnixMilli(int64(v))
+	case int64:
+		wakeUpAt = time.UnixMilli(v)
+	case float64:
+		wakeUpAt = time.UnixMilli(int64(v))
+	default:
+		err = fmt.Errorf("unsupported value %v of type %T in variable %s", until, until, d.UntilVar)
+	}
+	return
+}
+
+// startDelay adds the timer that wakes up the delay step once the delay ends.
+func startDelay(storage Storage, stepState *StepState, pipeline *data.Pipeline) (err error) {
+	var stepOptions *StepOptions
+	var wakeUpAt time.Time
+	stepOptions, err = getStepOptions(storage, stepState.InstanceId, stepState.StepId)
+	if err != nil {
+		return
+	}
+	if stepOptions == nil || stepOptions.Delay == nil {
+		err = errors.New("no delay configured for step " + stepState.StepId)
+		return
+	}
+	wakeUpAt, err = stepOptions.Delay.WakeUpAt(pipeline)
+	if err != nil {
+		return
+	}
+	logger.InfoF("Step %s of instance %s sleeps until %v", stepState.StepId, stepState.InstanceId, wakeUpAt)
+	err = storage.AddTimer(&Timer{
+		Id:         CreateId(),
+		InstanceId: stepState.InstanceId,
+		StepId:     stepState.StepId,
+		Iteration:  stepState.Iteration,
+		Type:       TimerTypeWakeUp,
+		FireAt:     wakeUpAt,
+	})
+	return
+}
+
+func (ts *TimerScheduler) wakeUp(timer *Timer) (err error) {
+	var stepState *StepState
+	stepState, err = ts.storage.GetStepState(timer.InstanceId, timer.StepId, timer.Iteration)
+	if err != nil || stepState == nil || stepState.Status != models.StatusRunning {
+		return
+	}
+	logger.InfoF("Step %s of instance %s woke up", timer.StepId, timer.InstanceId)
+	stepChangeHandler := &StepChangeHander{storage: ts.storage}
+	err = stepChangeHandler.Handle(&events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: timer.InstanceId,
+		StepId:     timer.StepId,
+		Status:     models.StatusCompleted,
+		Data:       map[string]any{data.StepIterationKey: timer.Iteration},
+	})
+	return
+}
@@ -0,0 +1,129 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// startDelayInstance starts an instance of a workflow whose only step is a delay with the given configuration.
+func startDelayInstance(t *testing.T, storage Storage, delay *Delay, input map[string]any) (wfm *WorkflowManager, instanceId string) {
+	t.Helper()
+	wfm = NewWorkflowManager(storage)
+	err := wfm.Save(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1, Steps: []*models.Step{{Id: "delay-1", Type: StepTypeDelay}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Steps: map[string]*StepOptions{"delay-1": {Delay: delay}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	instanceId, err = wfm.Start("workflow-1", 1, input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	return
+}
+
+func TestDelayWakeUp(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	started := time.Now()
+	_, instanceId := startDelayInstance(t, storage, &Delay{DurationMs: 100}, nil)
+	timers, err := storage.GetDueTimers(started.Add(time.Hour), timerBatchSize)
+	if err != nil || len(timers) != 1 || timers[0].Type != TimerTypeWakeUp {
+		t.Fatalf("expected a wake up timer, got %v %v", timers, err)
+	}
+	if timers[0].FireAt.Before(started.Add(100 * time.Millisecond)) {
+		t.Errorf("expected the timer to fire after the delay, got %v", timers[0].FireAt.Sub(started))
+	}
+	ts := NewTimerScheduler(storage, time.Minute)
+	ts.fireDue()
+	stepState, err := storage.GetStepState(instanceId, "delay-1", 0)
+	if err != nil || stepState.Status != models.StatusRunning {
+		t.Fatalf("expected the step to sleep until the delay ends, got %v %v", stepState, err)
+	}
+	woke := waitFor(t, 5*time.Second, func() bool {
+		ts.fireDue()
+		stepState, err = storage.GetStepState(instanceId, "delay-1", 0)
+		return err == nil && stepState.Status == models.StatusCompleted
+	})
+	if !woke {
+		t.Fatalf("expected the step to wake up, got %v %v", stepState, err)
+	}
+	if time.Since(started) < 100*time.Millisecond {
+		t.Errorf("expected the step to wake up after the delay, got %v", time.Since(started))
+	}
+	runTasks(t, storage)
+	workflowState, err := storage.GetState(instanceId)
+	if err != nil || workflowState.Status != models.StatusCompleted {
+		t.Errorf("expected the instance to complete, got %v %v", workflowState, err)
+	}
+	timers, err = storage.GetDueTimers(time.Now().Add(time.Hour), timerBatchSize)
+	if err != nil || len(timers) != 0 {
+		t.Errorf("expected the timer to be deleted, got %v %v", timers, err)
+	}
+}
+
+func TestDelayUntilVariable(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	_, instanceId := startDelayInstance(t, storage, &Delay{UntilVar: "until"}, map[string]any{
+		"until": time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+	NewTimerScheduler(storage, time.Minute).fireDue()
+	runTasks(t, storage)
+	workflowState, err := storage.GetState(instanceId)
+	if err != nil || workflowState.Status != models.StatusCompleted {
+		t.Errorf("expected the elapsed delay to complete the instance, got %v %v", workflowState, err)
+	}
+}
+
+func TestDelayWakeUpStoppedInstance(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	wfm, instanceId := startDelayInstance(t, storage, &Delay{UntilVar: "until"}, map[string]any{
+		"until": time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+	err := wfm.Cancel(instanceId, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	NewTimerScheduler(storage, time.Minute).fireDue()
+	stepState, err := storage.GetStepState(instanceId, "delay-1", 0)
+	if err != nil || stepState.Status != models.StatusFailed {
+		t.Errorf("expected the cancelled step not to wake up, got %v %v", stepState, err)
+	}
+	timers, err := storage.GetDueTimers(time.Now(), timerBatchSize)
+	if err != nil || len(timers) != 0 {
+		t.Errorf("expected the timer to be deleted, got %v %v", timers, err)
+	}
+}
+
+func TestDelayWakeUpAt(t *testing.T) {
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := map[string]struct {
+		value any
+		valid bool
+	}{
+		"time":         {value: until, valid: true},
+		"rfc 3339":     {value: until.Format(time.RFC3339), valid: true},
+		"unix millis":  {value: until.UnixMilli(), valid: true},
+		"int millis":   {value: int(until.UnixMilli()), valid: true},
+		"float millis": {value: float64(until.UnixMilli()), valid: true},
+		"invalid text": {value: "tomorrow"},
+		"unsupported":  {value: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			delay := &Delay{UntilVar: "until"}
+			wakeUpAt, err := delay.WakeUpAt(data.NewPipelineFrom(map[string]any{"until": tt.value}))
+			if tt.valid && (err != nil || !wakeUpAt.Equal(until)) {
+				t.Errorf("expected to wake up at %v, got %v %v", until, wakeUpAt, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected the value to be rejected, got %v", wakeUpAt)
+			}
+		})
+	}
+}
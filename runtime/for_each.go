@@ -0,0 +1,160 @@
+package runtime
+
+import (
+	"errors"
+	"strconv"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// ForEach holds the runtime options of a step of type models.StepTypeForLoop.
+//
+// Fields:
+// - Parallelism: The number of iterations that run at the same time. The iterations run one after the other if it
+// is 0 or 1.
+// - ResultVar: The pipeline variable the results of the iterations are collected in, ordered by iteration.
+// - OutputVar: The output variable of the last step of an iteration that is collected as its result. The whole
+// output of the step is collected if empty.
+type ForEach struct {
+	Parallelism int    `json:"parallelism,omitempty" yaml:"parallelism,omitempty"`
+	ResultVar   string `json:"result_var,omitempty" yaml:"result_var,omitempty"`
+	OutputVar   string `json:"output_var,omitempty" yaml:"output_var,omitempty"`
+}
+
+// Validate checks the for each options for invalid values.
+func (fe *ForEach) Validate() (err error) {
+	switch {
+	case fe.Parallelism < 0:
+		err = errors.New("parallelism must not be negative")
+	case fe.OutputVar != "" && fe.ResultVar == "":
+		err = errors.New("output_var requires a result_var")
+	}
+	return
+}
+
+// getForEach returns the for each options of the for loop step or nil if there are none.
+func getForEach(storage Storage, instanceId, stepId string) (forEach *ForEach, err error) {
+	var stepOptions *StepOptions
+	stepOptions, err = getStepOptions(storage, instanceId, stepId)
+	if err != nil || stepOptions == nil {
+		return
+	}
+	forEach = stepOptions.ForEach
+	return
+}
+
+// forIndexVar returns the pipeline variable holding the index of the iteration of a for loop.
+func forIndexVar(step *models.Step) string {
+	if step.For.IndexVar == "" {
+		return "idx-" + step.Id
+	}
+	return step.For.IndexVar
+}
+
+// startForEach starts the first step of as many iterations as the parallelism allows.
+// The following steps and iterations are queued by advanceForEach as the children complete.
+func (se *StepExecutor) startForEach(step *models.Step, stepState *StepState, forEach *ForEach, items int, pipeline *data.Pipeline) (err error) {
+	stepState.NextIteration = min(forEach.Parallelism, items)
+	err = se.storage.SaveStepState(stepState)
+	if err != nil {
+		return
+	}
+	firstStep := step.For.Steps[0]
+	for idx := 0; idx < stepState.NextIteration; idx++ {
+		childPipeline := cloneFor(pipeline, firstStep, step.Id)
+		childPipeline.Set(forIndexVar(step), strconv.Itoa(idx))
+		childPipeline.Set(data.StepIterationKey, idx)
+		err = se.Execute(firstStep, childPipeline)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// advanceForEach queues the step that follows a completed child of a for loop that runs its iterations in parallel.
+// This is the next step of the same iteration or the first step of the next iteration that was not started yet.
+func advanceForEach(storage Storage, workflow *models.Workflow, stepState *StepState) (err error) {
+	var options *WorkflowOptions
+	var stepStates map[string][]*StepState
+	if stepState.ParentStep == "" {
+		return
+	}
+	options, err = storage.GetWorkflowOptions(workflow.Id, workflow.Version)
+	if err != nil {
+		return
+	}
+	parent := options.findStep(workflow, stepState.ParentStep)
+	forEach := options.Step(stepState.ParentStep)
+	if parent == nil || parent.Type != models.StepTypeForLoop || forEach == nil || forEach.ForEach == nil || forEach.ForEach.Parallelism <= 1 {
+		return
+	}
+	stepStates, err = storage.GetStepStates(stepState.InstanceId)
+	if err != nil {
+		return
+	}
+	parentState := runningState(stepStates, parent.Id)
+	if parentState == nil {
+		return
+	}
+	steps := parent.For.Steps
+	next := &PendingStep{
+		Id:        CreateId(),
+		ParentId:  parent.Id,
+		Iteration: stepState.Iteration,
+		VarName:   forIndexVar(parent),
+		VarValue:  strconv.Itoa(stepState.Iteration),
+	}
+	for i, step := range steps {
+		if step.Id == stepState.StepId && i+1 < len(steps) {
+			next.StepId = steps[i+1].Id
+		}
+	}
+	if next.StepId == "" {
+		// The iteration completed, start the next one if there is any
+		if parentState.NextIteration >= parentState.ChildCount/len(steps) {
+			return
+		}
+		next.StepId = steps[0].Id
+		next.Iteration = parentState.NextIteration
+		next.VarValue = strconv.Itoa(parentState.NextIteration)
+		parentState.NextIteration++
+		err = storage.SaveStepState(parentState)
+		if err != nil {
+			return
+		}
+	}
+	err = storage.AddPendingSteps(stepState.InstanceId, next)
+	return
+}
+
+// collectResults sets the results of the iterations of a completed for loop in the pipeline, ordered by iteration.
+func collectResults(storage Storage, step *models.Step, loopState *StepState, stepStates map[string][]*StepState, pipeline *VersionedPipeline) (err error) {
+	var forEach *ForEach
+	forEach, err = getForEach(storage, pipeline.Id(), step.Id)
+	if err != nil || forEach == nil || forEach.ResultVar == "" || len(step.For.Steps) == 0 {
+		return
+	}
+	lastStep := step.For.Steps[len(step.For.Steps)-1]
+	results := make([]any, loopState.ChildCount/len(step.For.Steps))
+	for _, stepState := range stepStates[lastStep.Id] {
+		if stepState.ParentStep != step.Id || stepState.Status != models.StatusCompleted || stepState.Output == nil {
+			continue
+		}
+		if stepState.Iteration < 0 || stepState.Iteration >= len(results) {
+			continue
+		}
+		if forEach.OutputVar == "" {
+			results[stepState.Iteration] = stepState.Output.Map()
+		} else if stepState.Output.Has(forEach.OutputVar) {
+			results[stepState.Iteration], err = stepState.Output.Get(forEach.OutputVar)
+			if err != nil {
+				return
+			}
+		}
+	}
+	pipeline.Set(forEach.ResultVar, results)
+	err = storage.SavePipeline(pipeline)
+	return
+}
@@ -0,0 +1,121 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// runningIterations returns the iterations of the step that are running, in ascending order.
+func runningIterations(t *testing.T, storage Storage, instanceId, stepId string) (iterations []int) {
+	t.Helper()
+	stepStates, err := storage.GetStepStates(instanceId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, stepState := range stepStates[stepId] {
+		if stepState.Status == models.StatusRunning {
+			iterations = append(iterations, stepState.Iteration)
+		}
+	}
+	sort.Ints(iterations)
+	return
+}
+
+func TestForEachParallelism(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	wfm := NewWorkflowManager(storage)
+	err := wfm.Save(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps: []*models.Step{{
+			Id:   "for-1",
+			Type: models.StepTypeForLoop,
+			For: &models.For{
+				ItemsArr: []any{"a", "b", "c", "d"},
+				ItemsVar: "item",
+				Steps:    []*models.Step{{Id: "wait-1", Type: StepTypeWait}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Steps: map[string]*StepOptions{
+		"for-1":  {ForEach: &ForEach{Parallelism: 2, ResultVar: "results", OutputVar: "value"}},
+		"wait-1": {Wait: &WaitSignal{Signal: "go"}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	instanceId, err := wfm.Start("workflow-1", 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	// The iterations complete out of order, a new one starts as soon as one completes
+	steps := []struct {
+		complete int
+		running  []int
+	}{
+		{complete: 1, running: []int{0, 2}},
+		{complete: 2, running: []int{0, 3}},
+		{complete: 3, running: []int{0}},
+		{complete: 0},
+	}
+	running := runningIterations(t, storage, instanceId, "wait-1")
+	if !reflect.DeepEqual(running, []int{0, 1}) {
+		t.Fatalf("expected the first two iterations to run, got %v", running)
+	}
+	for _, step := range steps {
+		err = wfm.CompleteStep(instanceId, "wait-1", step.complete, models.StatusCompleted, map[string]any{"value": fmt.Sprintf("result-%d", step.complete)})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		runTasks(t, storage)
+		running = runningIterations(t, storage, instanceId, "wait-1")
+		if !reflect.DeepEqual(running, step.running) {
+			t.Fatalf("expected iterations %v to run after iteration %d completed, got %v", step.running, step.complete, running)
+		}
+	}
+	workflowState, err := storage.GetState(instanceId)
+	if err != nil || workflowState.Status != models.StatusCompleted {
+		t.Fatalf("expected the instance to complete, got %v %v", workflowState, err)
+	}
+	pipeline, err := storage.GetPipeline(instanceId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	results, _ := pipeline.Get("results")
+	expected := []any{"result-0", "result-1", "result-2", "result-3"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected the results ordered by iteration %v, got %v", expected, results)
+	}
+}
+
+func TestForEachValidate(t *testing.T) {
+	tests := map[string]struct {
+		forEach *ForEach
+		valid   bool
+	}{
+		"parallel":              {forEach: &ForEach{Parallelism: 4}, valid: true},
+		"results":               {forEach: &ForEach{ResultVar: "results", OutputVar: "value"}, valid: true},
+		"negative parallelism":  {forEach: &ForEach{Parallelism: -1}},
+		"output without result": {forEach: &ForEach{OutputVar: "value"}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.forEach.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected the options to be invalid")
+			}
+		})
+	}
+}
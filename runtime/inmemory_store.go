@@ -1,7 +1,14 @@
 package runtime
 
 import (
+	"bytes"
+	"container/heap"
 	"errors"
+	goruntime "runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"oss.nandlabs.io/orcaloop-sdk/data"
 	"oss.nandlabs.io/orcaloop-sdk/events"
@@ -9,47 +16,132 @@ import (
 	"oss.nandlabs.io/orcaloop/config"
 )
 
+// InMemoryStorage is a Storage keeping all its data in memory. It is safe for concurrent use.
+// The stored objects are copied when they are saved and read, so the callers never share them with the storage.
+// The workflows, workflow options and actions are the exception as they are not changed once saved.
 type InMemoryStorage struct {
+	*inMemoryData
+	mu              *sync.RWMutex            // guards inMemoryData
+	inTx            bool                     // true for the Storage passed to a transaction
+	undo            *inMemoryUndo            // data changed by the transaction, nil outside of a transaction
+	txGoroutine     *atomic.Uint64           // id of the goroutine running a transaction on the storage, 0 if none
+	lockMutex       *sync.Mutex              // guards lockedInstances
+	purgeTimeout    time.Duration            // time after which finished instances are purged, 0 keeps them
+	lockedInstances map[string]*instanceLock // instanceId -> lock
+}
+
+// inMemoryData is the data of the InMemoryStorage. It is shared with the Storage passed to the transactions.
+type inMemoryData struct {
 	actionSpecs      map[string]*models.ActionSpec
 	workflows        map[string]map[int]*models.Workflow  // workflowId -> version -> Workflow
+	workflowOptions  map[string]map[int]*WorkflowOptions  // workflowId -> version -> WorkflowOptions
 	instances        map[string]*data.Pipeline            // instanceId -> Pipeline
+	pipelineVersions map[string]int                       // instanceId -> version of the Pipeline
 	workflowStates   map[string]*WorkflowState            // instanceId -> WorkflowState
 	stepStates       map[string]map[string][]*StepState   // instanceId -> stepId -> StepState
 	stepChangeEvents map[string][]*events.StepChangeEvent // instanceId -> StepChangeEvents
 	pendingSteps     map[string][]*PendingStep
-	lockedInstances  map[string]bool // instanceId -> locked (true/false)
+	schedules        map[string]*Schedule // scheduleId -> Schedule
+	signals          map[string][]*Signal // instanceId -> Signals in the order they were received
+	triggers         map[string]*Trigger  // triggerId -> Trigger
+	triggerMessages  map[string]time.Time // triggerId/messageId -> time the message was processed
+	timers           timerHeap            // timers ordered by the time they fire
+	tasks            []*Task              // tasks in the order they were queued
+	finishedAt       map[string]time.Time // instanceId -> time the instance completed or failed
+}
+
+// instanceLock is the lock of an instance held by the owner until the lease expires.
+type instanceLock struct {
+	owner string
+	until time.Time
 }
 
 // NewInMemoryStorage creates a new instance of InMemoryStorage
 func NewInMemoryStorage(c *config.StorageConfig) *InMemoryStorage {
+	var purgeTimeout time.Duration
+	if c != nil && c.Provider != nil && c.Provider.Local != nil {
+		purgeTimeout = time.Duration(c.Provider.Local.PurgeTimeout) * time.Second
+	}
 	return &InMemoryStorage{
-		actionSpecs:      make(map[string]*models.ActionSpec),
-		workflows:        make(map[string]map[int]*models.Workflow),
-		instances:        make(map[string]*data.Pipeline),
-		workflowStates:   make(map[string]*WorkflowState),
-		stepStates:       make(map[string]map[string][]*StepState),
-		stepChangeEvents: make(map[string][]*events.StepChangeEvent),
-		pendingSteps:     make(map[string][]*PendingStep),
-		lockedInstances:  make(map[string]bool),
+		inMemoryData: &inMemoryData{
+			actionSpecs:      make(map[string]*models.ActionSpec),
+			workflows:        make(map[string]map[int]*models.Workflow),
+			workflowOptions:  make(map[string]map[int]*WorkflowOptions),
+			instances:        make(map[string]*data.Pipeline),
+			pipelineVersions: make(map[string]int),
+			workflowStates:   make(map[string]*WorkflowState),
+			stepStates:       make(map[string]map[string][]*StepState),
+			stepChangeEvents: make(map[string][]*events.StepChangeEvent),
+			pendingSteps:     make(map[string][]*PendingStep),
+			schedules:        make(map[string]*Schedule),
+			signals:          make(map[string][]*Signal),
+			triggers:         make(map[string]*Trigger),
+			triggerMessages:  make(map[string]time.Time),
+			finishedAt:       make(map[string]time.Time),
+		},
+		mu:              &sync.RWMutex{},
+		txGoroutine:     &atomic.Uint64{},
+		lockMutex:       &sync.Mutex{},
+		purgeTimeout:    purgeTimeout,
+		lockedInstances: make(map[string]*instanceLock),
 	}
 }
 
+// PurgeTimeout returns the time after which the completed and failed instances are purged. 0 keeps them.
+func (s *InMemoryStorage) PurgeTimeout() time.Duration {
+	return s.purgeTimeout
+}
+
 // Implementation of Storage interface methods
 
 func (s *InMemoryStorage) ActionSpec(id string) (*models.ActionSpec, error) {
-
+	s.rlock()
+	defer s.mu.RUnlock()
 	action, ok := s.actionSpecs[id]
 	if !ok {
 		return nil, errors.New("action not found")
 	}
 	return action, nil
 }
-func (s *InMemoryStorage) AddPendingSteps(instanceId string, pendingStep ...*PendingStep) error {
+func (s *InMemoryStorage) AddTask(task *Task) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.tasks()
+	s.tasks = append(s.tasks, copyTask(task))
+	return nil
+}
 
-	if _, ok := s.pendingSteps[instanceId]; !ok {
-		s.pendingSteps[instanceId] = make([]*PendingStep, 0)
+func (s *InMemoryStorage) AddTimer(timer *Timer) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.timers()
+	timerCopy := *timer
+	heap.Push(&s.timers, &timerCopy)
+	return nil
+}
+
+func (s *InMemoryStorage) AddTriggerMessage(triggerId, messageId string) (bool, error) {
+	s.lock()
+	defer s.mu.Unlock()
+	key := triggerId + "/" + messageId
+	if _, ok := s.triggerMessages[key]; ok {
+		return false, nil
 	}
-	s.pendingSteps[instanceId] = append(pendingStep, s.pendingSteps[instanceId]...)
+	s.undo.triggerMessage(key)
+	s.triggerMessages[key] = time.Now()
+	return true, nil
+}
+
+func (s *InMemoryStorage) AddPendingSteps(instanceId string, pendingStep ...*PendingStep) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(instanceId)
+	pSteps := make([]*PendingStep, 0, len(pendingStep)+len(s.pendingSteps[instanceId]))
+	for _, pStep := range pendingStep {
+		pStepCopy := *pStep
+		pSteps = append(pSteps, &pStepCopy)
+	}
+	s.pendingSteps[instanceId] = append(pSteps, s.pendingSteps[instanceId]...)
 	return nil
 }
 
@@ -62,7 +154,8 @@ func (s *InMemoryStorage) ActionEndpoint(id string) (*models.Endpoint, error) {
 }
 
 func (s *InMemoryStorage) ActionSpecs() ([]*models.ActionSpec, error) {
-
+	s.rlock()
+	defer s.mu.RUnlock()
 	var specs []*models.ActionSpec
 	for _, spec := range s.actionSpecs {
 		specs = append(specs, spec)
@@ -76,13 +169,17 @@ func (s *InMemoryStorage) ArchiveInstance(workflowId string, archiveInstance boo
 }
 
 func (s *InMemoryStorage) CreateNewInstance(workflowId string, instanceId string, pipeline *data.Pipeline) error {
-
-	s.instances[instanceId] = pipeline
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(instanceId)
+	s.instances[instanceId] = clonePipeline(pipeline)
+	s.pipelineVersions[instanceId] = 1
 	return nil
 }
 
 func (s *InMemoryStorage) DeleteAction(id string) error {
-
+	s.lock()
+	defer s.mu.Unlock()
 	if _, ok := s.actionSpecs[id]; !ok {
 		return errors.New("action not found")
 	}
@@ -90,7 +187,9 @@ func (s *InMemoryStorage) DeleteAction(id string) error {
 	return nil
 }
 func (s *InMemoryStorage) DeletePendingStep(instanceId string, pendingStep *PendingStep) (err error) {
-
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(instanceId)
 	pSteps, ok := s.pendingSteps[instanceId]
 	if !ok {
 		return
@@ -104,8 +203,66 @@ func (s *InMemoryStorage) DeletePendingStep(instanceId string, pendingStep *Pend
 	return
 }
 
-func (s *InMemoryStorage) DeleteStepChangeEvent(instanceId, eventId string) (err error) {
+func (s *InMemoryStorage) DeleteSchedule(id string) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.schedule(id)
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteSignal(instanceId, id string) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(instanceId)
+	signals := s.signals[instanceId]
+	for i, signal := range signals {
+		if signal.Id == id {
+			s.signals[instanceId] = append(signals[:i], signals[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
 
+func (s *InMemoryStorage) DeleteTrigger(id string) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.trigger(id)
+	delete(s.triggers, id)
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteTask(id, owner string) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.tasks()
+	for i, task := range s.tasks {
+		if task.Id == id && task.LeaseOwner == owner {
+			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteTimer(id string) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.timers()
+	for i, timer := range s.timers {
+		if timer.Id == id {
+			heap.Remove(&s.timers, i)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteStepChangeEvent(instanceId, eventId string) (err error) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(instanceId)
 	events, ok := s.stepChangeEvents[instanceId]
 	if !ok {
 		return
@@ -120,26 +277,112 @@ func (s *InMemoryStorage) DeleteStepChangeEvent(instanceId, eventId string) (err
 	return nil
 }
 
-func (s *InMemoryStorage) GetPipeline(id string) (*data.Pipeline, error) {
+func (s *InMemoryStorage) ExtendInstanceLock(id, owner string, lease time.Duration) (bool, error) {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	lock, ok := s.lockedInstances[id]
+	if !ok || lock.owner != owner {
+		return false, nil
+	}
+	lock.until = time.Now().Add(lease)
+	return true, nil
+}
+
+func (s *InMemoryStorage) ExtendTaskLease(id, owner string, lease time.Duration) (bool, error) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.tasks()
+	for i, task := range s.tasks {
+		if task.Id == id && task.LeaseOwner == owner {
+			taskCopy := copyTask(task)
+			taskCopy.LeaseUntil = time.Now().Add(lease)
+			s.tasks[i] = taskCopy
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
+func (s *InMemoryStorage) GetChildInstances(instanceId string) (children []*WorkflowState, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, state := range s.workflowStates {
+		if state.Parent != nil && state.Parent.InstanceId == instanceId {
+			children = append(children, copyWorkflowState(state))
+		}
+	}
+	return
+}
+
+func (s *InMemoryStorage) GetDueTimers(before time.Time, limit int) (due []*Timer, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	// walk the heap and skip the subtrees that fire after the given time
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(s.timers) || len(due) >= limit || s.timers[i].FireAt.After(before) {
+			return
+		}
+		timerCopy := *s.timers[i]
+		due = append(due, &timerCopy)
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return
+}
+
+func (s *InMemoryStorage) GetExpiredLocks(before time.Time) (instanceIds []string, err error) {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	for id, lock := range s.lockedInstances {
+		if lock.until.Before(before) {
+			instanceIds = append(instanceIds, id)
+		}
+	}
+	return
+}
+
+func (s *InMemoryStorage) GetInstancesWithStepChangeEvents() (instanceIds []string, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for id, events := range s.stepChangeEvents {
+		if len(events) > 0 {
+			instanceIds = append(instanceIds, id)
+		}
+	}
+	return
+}
+
+func (s *InMemoryStorage) GetPipeline(id string) (*VersionedPipeline, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
 	pipeline, ok := s.instances[id]
 	if !ok {
 		return nil, errors.New("pipeline not found")
 	}
-	return pipeline, nil
+	return &VersionedPipeline{Pipeline: clonePipeline(pipeline), Version: s.pipelineVersions[id]}, nil
 }
 
 func (s *InMemoryStorage) GetState(instanceId string) (*WorkflowState, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	return s.getState(instanceId)
+}
+
+func (s *InMemoryStorage) getState(instanceId string) (*WorkflowState, error) {
 
 	state, ok := s.workflowStates[instanceId]
 	if !ok {
-		return nil, errors.New("workflow state not found")
+		return nil, ErrWorkflowStateNotFound(instanceId)
 	}
-	return state, nil
+	return copyWorkflowState(state), nil
 }
 
 func (s *InMemoryStorage) GetAndRemoveNextPendingStep(instanceId string) (*PendingStep, error) {
-
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(instanceId)
 	steps, ok := s.pendingSteps[instanceId]
 	if !ok || len(steps) == 0 {
 		return nil, nil
@@ -148,54 +391,129 @@ func (s *InMemoryStorage) GetAndRemoveNextPendingStep(instanceId string) (*Pendi
 	step := steps[0]
 	s.pendingSteps[instanceId] = steps[1:]
 	// Return the removed step
-	return step, nil
+	stepCopy := *step
+	return &stepCopy, nil
 }
 
 func (s *InMemoryStorage) GetPendingSteps(instanceId string) (steps []*PendingStep, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	steps = make([]*PendingStep, 0, len(s.pendingSteps[instanceId]))
+	for _, step := range s.pendingSteps[instanceId] {
+		stepCopy := *step
+		steps = append(steps, &stepCopy)
+	}
+	return
+}
 
-	steps = s.pendingSteps[instanceId]
-	if steps == nil {
-		steps = make([]*PendingStep, 0)
+func (s *InMemoryStorage) GetDueSchedules(before time.Time) (due []*Schedule, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, schedule := range s.schedules {
+		if (!schedule.Paused && !schedule.NextRunAt.After(before)) || schedule.Queued > 0 {
+			due = append(due, copySchedule(schedule))
+		}
 	}
 	return
 }
 
-func (s *InMemoryStorage) GetStepChangeEvents(instanceId string) (events []*events.StepChangeEvent, err error) {
+func (s *InMemoryStorage) GetSchedule(id string) (*Schedule, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound(id)
+	}
+	return copySchedule(schedule), nil
+}
 
-	events = s.stepChangeEvents[instanceId]
+func (s *InMemoryStorage) GetSignals(instanceId string) ([]*Signal, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	signals := make([]*Signal, 0, len(s.signals[instanceId]))
+	for _, signal := range s.signals[instanceId] {
+		signals = append(signals, copySignal(signal))
+	}
+	return signals, nil
+}
 
+func (s *InMemoryStorage) GetRunningStepStates(startedBefore time.Time) (running []*StepState, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, stepStatesMap := range s.stepStates {
+		for _, stepStateArr := range stepStatesMap {
+			for _, stepState := range stepStateArr {
+				if stepState.Status == models.StatusRunning && stepState.StartedAt.Before(startedBefore) {
+					running = append(running, copyStepState(stepState))
+				}
+			}
+		}
+	}
 	return
 }
 
-func (s *InMemoryStorage) GetStepStates(instanceId string) (map[string][]*StepState, error) {
+func (s *InMemoryStorage) GetStepChangeEvents(instanceId string) (events []*events.StepChangeEvent, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, event := range s.stepChangeEvents[instanceId] {
+		events = append(events, copyStepChangeEvent(event))
+	}
+
+	return
+}
 
-	// stepStatesMap := s.stepStates[instanceId]
-	// if stepStatesMap == nil {
-	// 	stepStatesMap = make(map[string][]*StepState, 0)
-	// 	s.stepStates[instanceId] = append(s.stepStates[instanceId], stepStatesMap)
-	// }
+func (s *InMemoryStorage) GetStepStates(instanceId string) (map[string][]*StepState, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
 	stepStates, exists := s.stepStates[instanceId]
 	if !exists {
-		return nil, errors.New("instance not found")
+		if _, ok := s.instances[instanceId]; !ok {
+			return nil, errors.New("instance not found")
+		}
+		// No step of the instance started yet
+		return make(map[string][]*StepState), nil
+	}
+	stepStatesCopy := make(map[string][]*StepState, len(stepStates))
+	for stepId, stepStateArr := range stepStates {
+		for _, stepState := range stepStateArr {
+			stepStatesCopy[stepId] = append(stepStatesCopy[stepId], copyStepState(stepState))
+		}
 	}
-	return stepStates, nil
-	// return nil, nil
+	return stepStatesCopy, nil
 }
 
 func (s *InMemoryStorage) GetStepState(instanceId, stepId string, iteration int) (*StepState, error) {
-
+	s.rlock()
+	defer s.mu.RUnlock()
 	stepStates, exists := s.stepStates[instanceId]
 	if !exists {
 		return nil, errors.New("instance not found")
 	}
-	steps, exists := stepStates[stepId]
-	if !exists || iteration >= len(steps) {
-		return nil, errors.New("step state not found")
+	for _, stepState := range stepStates[stepId] {
+		if stepState.Iteration == iteration {
+			return copyStepState(stepState), nil
+		}
 	}
-	return steps[iteration], nil
+	return nil, ErrStepStateNotFound(stepId)
+}
+
+func (s *InMemoryStorage) GetTrigger(id string) (*Trigger, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	trigger, ok := s.triggers[id]
+	if !ok {
+		return nil, ErrTriggerNotFound(id)
+	}
+	return copyTrigger(trigger), nil
 }
 
 func (s *InMemoryStorage) GetWorkflow(workflowId string, version int) (*models.Workflow, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	return s.getWorkflow(workflowId, version)
+}
+
+func (s *InMemoryStorage) getWorkflow(workflowId string, version int) (*models.Workflow, error) {
 
 	versions, ok := s.workflows[workflowId]
 	if !ok {
@@ -208,22 +526,63 @@ func (s *InMemoryStorage) GetWorkflow(workflowId string, version int) (*models.W
 	return workflow, nil
 }
 
+func (s *InMemoryStorage) GetWorkflowOptions(workflowId string, version int) (*WorkflowOptions, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	options, ok := s.workflowOptions[workflowId][version]
+	if !ok {
+		return &WorkflowOptions{WorkflowId: workflowId, WorkflowVersion: version}, nil
+	}
+	return options, nil
+}
+
 func (s *InMemoryStorage) GetWorkflowByInstance(id string) (wf *models.Workflow, err error) {
-	// Assume instanceId is somehow linked to a workflowId; not implemented here
+	s.rlock()
+	defer s.mu.RUnlock()
 	var workflowState *WorkflowState
-	workflowState, err = s.GetState(id)
+	workflowState, err = s.getState(id)
 	if err != nil {
 		return
 	}
-	return s.GetWorkflow(workflowState.WorkflowId, workflowState.WorkflowVersion)
+	return s.getWorkflow(workflowState.WorkflowId, workflowState.WorkflowVersion)
+}
+
+func (s *InMemoryStorage) HasTasks(instanceId string) (bool, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, task := range s.tasks {
+		if task.InstanceId == instanceId {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (s *InMemoryStorage) ListActions() ([]*models.ActionSpec, error) {
 	return s.ActionSpecs()
 }
 
-func (s *InMemoryStorage) ListWorkflows() ([]*models.Workflow, error) {
+func (s *InMemoryStorage) ListSchedules() (schedules []*Schedule, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, copySchedule(schedule))
+	}
+	return
+}
 
+func (s *InMemoryStorage) ListTriggers() (triggers []*Trigger, err error) {
+	s.rlock()
+	defer s.mu.RUnlock()
+	for _, trigger := range s.triggers {
+		triggers = append(triggers, copyTrigger(trigger))
+	}
+	return
+}
+
+func (s *InMemoryStorage) ListWorkflows() ([]*models.Workflow, error) {
+	s.rlock()
+	defer s.mu.RUnlock()
 	var workflows []*models.Workflow
 	for _, versions := range s.workflows {
 		for _, workflow := range versions {
@@ -234,7 +593,8 @@ func (s *InMemoryStorage) ListWorkflows() ([]*models.Workflow, error) {
 }
 
 func (s *InMemoryStorage) ListWorkflowVersions(workflowID string) ([]*models.Workflow, error) {
-
+	s.rlock()
+	defer s.mu.RUnlock()
 	versions := make([]*models.Workflow, 0)
 	for _, wf := range s.workflows[workflowID] {
 		versions = append(versions, wf)
@@ -242,50 +602,212 @@ func (s *InMemoryStorage) ListWorkflowVersions(workflowID string) ([]*models.Wor
 	return versions, nil
 }
 
-func (s *InMemoryStorage) LockInstance(id string) (bool, error) {
+func (s *InMemoryStorage) LeaseTasks(owner string, limit int, lease time.Duration) (leased []*Task, err error) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.tasks()
+	now := time.Now()
+	for i, task := range s.tasks {
+		if len(leased) >= limit {
+			break
+		}
+		if task.LeaseUntil.After(now) {
+			continue
+		}
+		taskCopy := copyTask(task)
+		taskCopy.LeaseOwner = owner
+		taskCopy.LeaseUntil = now.Add(lease)
+		taskCopy.Attempts++
+		s.tasks[i] = taskCopy
+		// hand out a copy so that the worker does not share the stored task
+		leased = append(leased, copyTask(taskCopy))
+	}
+	return
+}
 
-	if s.lockedInstances[id] {
+func (s *InMemoryStorage) LockInstance(id, owner string, lease time.Duration) (bool, error) {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	now := time.Now()
+	if lock, ok := s.lockedInstances[id]; ok && !lock.until.Before(now) {
 		return false, nil
 	}
-	s.lockedInstances[id] = true
+	s.lockedInstances[id] = &instanceLock{owner: owner, until: now.Add(lease)}
 	return true, nil
 }
 
-func (s *InMemoryStorage) SaveAction(action *models.ActionSpec) error {
+// Purge deletes the data of the instances that completed or failed before the given time and are not locked.
+// The data of a child instance is purged independently of its parent.
+func (s *InMemoryStorage) Purge(finishedBefore time.Time) (purged int, err error) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	for instanceId, finishedAt := range s.finishedAt {
+		if !finishedAt.Before(finishedBefore) {
+			continue
+		}
+		if _, locked := s.lockedInstances[instanceId]; locked {
+			continue
+		}
+		s.undo.instance(instanceId)
+		s.undo.timers()
+		s.undo.tasks()
+		delete(s.instances, instanceId)
+		delete(s.pipelineVersions, instanceId)
+		delete(s.workflowStates, instanceId)
+		delete(s.stepStates, instanceId)
+		delete(s.stepChangeEvents, instanceId)
+		delete(s.pendingSteps, instanceId)
+		delete(s.signals, instanceId)
+		delete(s.finishedAt, instanceId)
+		var timers timerHeap
+		for _, timer := range s.timers {
+			if timer.InstanceId != instanceId {
+				timers = append(timers, timer)
+			}
+		}
+		heap.Init(&timers)
+		s.timers = timers
+		var tasks []*Task
+		for _, task := range s.tasks {
+			if task.InstanceId != instanceId {
+				tasks = append(tasks, task)
+			}
+		}
+		s.tasks = tasks
+		purged++
+	}
+	return
+}
 
+func (s *InMemoryStorage) PruneTriggerMessages(before time.Time) (pruned int, err error) {
+	s.lock()
+	defer s.mu.Unlock()
+	for key, processedAt := range s.triggerMessages {
+		if processedAt.Before(before) {
+			s.undo.triggerMessage(key)
+			delete(s.triggerMessages, key)
+			pruned++
+		}
+	}
+	return
+}
+
+func (s *InMemoryStorage) SaveAction(action *models.ActionSpec) error {
+	s.lock()
+	defer s.mu.Unlock()
 	s.actionSpecs[action.Id] = action
 	return nil
 }
 
-func (s *InMemoryStorage) SaveStepChangeEvent(stepEvent *events.StepChangeEvent) error {
+func (s *InMemoryStorage) SaveSchedule(schedule *Schedule) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.schedule(schedule.Id)
+	version := 0
+	if stored, ok := s.schedules[schedule.Id]; ok {
+		version = stored.Version
+	}
+	if schedule.Version != 0 && schedule.Version != version {
+		return ErrScheduleVersionConflict(schedule.Id)
+	}
+	schedule.Version = version + 1
+	s.schedules[schedule.Id] = copySchedule(schedule)
+	return nil
+}
 
-	s.stepChangeEvents[stepEvent.InstanceId] = append(s.stepChangeEvents[stepEvent.InstanceId], stepEvent)
+func (s *InMemoryStorage) SaveTrigger(trigger *Trigger) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.trigger(trigger.Id)
+	s.triggers[trigger.Id] = copyTrigger(trigger)
 	return nil
 }
 
-func (s *InMemoryStorage) SavePipeline(pipeline *data.Pipeline) error {
+func (s *InMemoryStorage) SaveSignal(signal *Signal) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(signal.InstanceId)
+	s.signals[signal.InstanceId] = append(s.signals[signal.InstanceId], copySignal(signal))
+	return nil
+}
 
-	s.instances[pipeline.Id()] = pipeline
+func (s *InMemoryStorage) SaveStepChangeEvent(stepEvent *events.StepChangeEvent) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(stepEvent.InstanceId)
+	s.stepChangeEvents[stepEvent.InstanceId] = append(s.stepChangeEvents[stepEvent.InstanceId], copyStepChangeEvent(stepEvent))
 	return nil
 }
 
-func (s *InMemoryStorage) SaveState(workflowState *WorkflowState) error {
+func (s *InMemoryStorage) SavePipeline(pipeline *VersionedPipeline) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(pipeline.Id())
+	if _, ok := s.instances[pipeline.Id()]; ok && s.pipelineVersions[pipeline.Id()] != pipeline.Version {
+		return ErrVersionConflict("pipeline", pipeline.Id())
+	}
+	s.instances[pipeline.Id()] = clonePipeline(pipeline.Pipeline)
+	pipeline.Version++
+	s.pipelineVersions[pipeline.Id()] = pipeline.Version
+	return nil
+}
 
-	s.workflowStates[workflowState.InstanceId] = workflowState
+func (s *InMemoryStorage) SaveState(workflowState *WorkflowState) error {
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(workflowState.InstanceId)
+	version := 0
+	if stored, ok := s.workflowStates[workflowState.InstanceId]; ok {
+		version = stored.InstanceVersion
+	}
+	if version != workflowState.InstanceVersion {
+		return ErrVersionConflict("state", workflowState.InstanceId)
+	}
+	workflowState.InstanceVersion++
+	s.workflowStates[workflowState.InstanceId] = copyWorkflowState(workflowState)
+	// The finished instances are purged once the purge timeout passed
+	if workflowState.Status == models.StatusCompleted || workflowState.Status == models.StatusFailed {
+		if _, ok := s.finishedAt[workflowState.InstanceId]; !ok {
+			s.finishedAt[workflowState.InstanceId] = time.Now()
+		}
+	} else {
+		delete(s.finishedAt, workflowState.InstanceId)
+	}
 	return nil
 }
 
 func (s *InMemoryStorage) SaveStepState(stepState *StepState) error {
-
+	s.lock()
+	defer s.mu.Unlock()
+	s.undo.instance(stepState.InstanceId)
 	if _, exists := s.stepStates[stepState.InstanceId]; !exists {
 		s.stepStates[stepState.InstanceId] = make(map[string][]*StepState)
 	}
-	s.stepStates[stepState.InstanceId][stepState.StepId] = append(s.stepStates[stepState.InstanceId][stepState.StepId], stepState)
+	steps := s.stepStates[stepState.InstanceId][stepState.StepId]
+	for i, existing := range steps {
+		if existing.Iteration == stepState.Iteration {
+			if stepState.Version != 0 && existing.Version != stepState.Version {
+				return ErrVersionConflict("step state "+stepState.StepId, stepState.InstanceId)
+			}
+			// A new start of the step replaces the stored step state
+			stepState.Version = existing.Version + 1
+			steps[i] = copyStepState(stepState)
+			return nil
+		}
+	}
+	if stepState.Version != 0 {
+		return ErrVersionConflict("step state "+stepState.StepId, stepState.InstanceId)
+	}
+	stepState.Version++
+	s.stepStates[stepState.InstanceId][stepState.StepId] = append(steps, copyStepState(stepState))
 	return nil
 }
 
 func (s *InMemoryStorage) SaveWorkflow(workflow *models.Workflow) error {
-
+	s.lock()
+	defer s.mu.Unlock()
 	if _, ok := s.workflows[workflow.Id]; !ok {
 		s.workflows[workflow.Id] = make(map[int]*models.Workflow)
 	}
@@ -293,17 +815,29 @@ func (s *InMemoryStorage) SaveWorkflow(workflow *models.Workflow) error {
 	return nil
 }
 
-func (s *InMemoryStorage) UnlockInstance(id string) error {
+func (s *InMemoryStorage) SaveWorkflowOptions(options *WorkflowOptions) error {
+	s.lock()
+	defer s.mu.Unlock()
+	if _, ok := s.workflowOptions[options.WorkflowId]; !ok {
+		s.workflowOptions[options.WorkflowId] = make(map[int]*WorkflowOptions)
+	}
+	s.workflowOptions[options.WorkflowId][options.WorkflowVersion] = options
+	return nil
+}
 
-	if !s.lockedInstances[id] {
-		return errors.New("instance is not locked")
+func (s *InMemoryStorage) UnlockInstance(id, owner string) error {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	if lock, ok := s.lockedInstances[id]; !ok || lock.owner != owner {
+		return ErrLockNotOwned(id)
 	}
 	delete(s.lockedInstances, id)
 	return nil
 }
 
 func (s *InMemoryStorage) DeleteWorkflow(workflowID string, version int) error {
-
+	s.lock()
+	defer s.mu.Unlock()
 	if _, ok := s.workflows[workflowID]; !ok {
 		return errors.New("workflow not found")
 	}
@@ -315,7 +849,350 @@ func (s *InMemoryStorage) Config() *config.StorageConfig {
 	return &config.StorageConfig{
 		Type: config.InMemoryStorageType,
 		Provider: &config.Provider{
-			Local: &config.LocalStorage{},
+			Local: &config.LocalStorage{PurgeTimeout: int(s.purgeTimeout / time.Second)},
 		},
 	}
 }
+
+// WithTx runs f while no one else reads or writes the InMemoryStorage. The data f changed is restored as it was
+// before f if f fails. Calling WithTx on the Storage passed to f runs the function in the same transaction.
+// f must only use the Storage passed to it and must not call remote endpoints, as the InMemoryStorage is locked until
+// f returns. Using the InMemoryStorage itself from f panics, as it would wait for the transaction to end. The remote
+// calls are queued as tasks instead and made by the workers once the transaction is committed.
+func (s *InMemoryStorage) WithTx(f func(tx Storage) error) (err error) {
+	if s.inTx {
+		return f(s)
+	}
+	s.lock()
+	defer s.mu.Unlock()
+	s.txGoroutine.Store(goroutineId())
+	defer s.txGoroutine.Store(0)
+	undo := newInMemoryUndo(s.inMemoryData)
+	defer func() {
+		if r := recover(); r != nil {
+			undo.restore()
+			panic(r)
+		}
+		if err != nil {
+			undo.restore()
+		}
+	}()
+	// The transaction has a mutex of its own as the one of the storage is held until it ends
+	err = f(&InMemoryStorage{
+		inMemoryData:    s.inMemoryData,
+		mu:              &sync.RWMutex{},
+		inTx:            true,
+		undo:            undo,
+		txGoroutine:     &atomic.Uint64{},
+		lockMutex:       s.lockMutex,
+		purgeTimeout:    s.purgeTimeout,
+		lockedInstances: s.lockedInstances,
+	})
+	return
+}
+
+// lock locks the InMemoryStorage for writing.
+func (s *InMemoryStorage) lock() {
+	if !s.mu.TryLock() {
+		s.checkReentry()
+		s.mu.Lock()
+	}
+}
+
+// rlock locks the InMemoryStorage for reading.
+func (s *InMemoryStorage) rlock() {
+	if !s.mu.TryRLock() {
+		s.checkReentry()
+		s.mu.RLock()
+	}
+}
+
+// checkReentry panics if the goroutine running a transaction on the InMemoryStorage uses the InMemoryStorage instead
+// of the Storage passed to the transaction.
+func (s *InMemoryStorage) checkReentry() {
+	if id := s.txGoroutine.Load(); id != 0 && id == goroutineId() {
+		panic("in memory storage used within its own transaction, use the Storage passed to the transaction instead")
+	}
+}
+
+// goroutineId returns the id of the calling goroutine as printed at the top of its stack trace.
+func goroutineId() (id uint64) {
+	var buf [64]byte
+	stack := buf[:goruntime.Stack(buf[:], false)]
+	// The stack starts with "goroutine <id> ["
+	fields := bytes.Fields(stack)
+	if len(fields) > 1 {
+		id, _ = strconv.ParseUint(string(fields[1]), 10, 64)
+	}
+	return
+}
+
+// inMemoryUndo keeps the data a transaction changed as it was before the change, to restore it if the transaction
+// fails. The data of an instance, a schedule, a trigger, a processed message, the timers and the tasks are copied the first time the transaction
+// changes them, the data the transaction did not change is not copied. The stored objects are not copied as they are
+// replaced instead of changed.
+type inMemoryUndo struct {
+	data             *inMemoryData
+	instances        map[string]bool
+	pipelines        map[string]saved[*data.Pipeline]
+	pipelineVersions map[string]saved[int]
+	workflowStates   map[string]saved[*WorkflowState]
+	stepStates       map[string]saved[map[string][]*StepState]
+	stepChangeEvents map[string]saved[[]*events.StepChangeEvent]
+	pendingSteps     map[string]saved[[]*PendingStep]
+	signals          map[string]saved[[]*Signal]
+	finishedAt       map[string]saved[time.Time]
+	schedules        map[string]saved[*Schedule]
+	triggers         map[string]saved[*Trigger]
+	triggerMessages  map[string]saved[time.Time]
+	savedTimers      *timerHeap
+	savedTasks       *[]*Task
+}
+
+// saved is the value of a key before the transaction changed it. ok is false if the key was not set.
+type saved[V any] struct {
+	value V
+	ok    bool
+}
+
+func newInMemoryUndo(storeData *inMemoryData) *inMemoryUndo {
+	return &inMemoryUndo{
+		data:             storeData,
+		instances:        make(map[string]bool),
+		pipelines:        make(map[string]saved[*data.Pipeline]),
+		pipelineVersions: make(map[string]saved[int]),
+		workflowStates:   make(map[string]saved[*WorkflowState]),
+		stepStates:       make(map[string]saved[map[string][]*StepState]),
+		stepChangeEvents: make(map[string]saved[[]*events.StepChangeEvent]),
+		pendingSteps:     make(map[string]saved[[]*PendingStep]),
+		signals:          make(map[string]saved[[]*Signal]),
+		finishedAt:       make(map[string]saved[time.Time]),
+		schedules:        make(map[string]saved[*Schedule]),
+		triggers:         make(map[string]saved[*Trigger]),
+		triggerMessages:  make(map[string]saved[time.Time]),
+	}
+}
+
+// instance keeps the data of the instance before the transaction changes it for the first time.
+func (u *inMemoryUndo) instance(instanceId string) {
+	if u == nil || u.instances[instanceId] {
+		return
+	}
+	u.instances[instanceId] = true
+	save(u.pipelines, u.data.instances, instanceId, nil)
+	save(u.pipelineVersions, u.data.pipelineVersions, instanceId, nil)
+	save(u.workflowStates, u.data.workflowStates, instanceId, nil)
+	save(u.stepStates, u.data.stepStates, instanceId, func(stepStatesMap map[string][]*StepState) map[string][]*StepState {
+		stepStatesCopy := make(map[string][]*StepState, len(stepStatesMap))
+		for stepId, stepStateArr := range stepStatesMap {
+			stepStatesCopy[stepId] = append([]*StepState{}, stepStateArr...)
+		}
+		return stepStatesCopy
+	})
+	save(u.stepChangeEvents, u.data.stepChangeEvents, instanceId, func(stepChangeEvents []*events.StepChangeEvent) []*events.StepChangeEvent {
+		return append([]*events.StepChangeEvent{}, stepChangeEvents...)
+	})
+	save(u.pendingSteps, u.data.pendingSteps, instanceId, func(pendingSteps []*PendingStep) []*PendingStep {
+		return append([]*PendingStep{}, pendingSteps...)
+	})
+	save(u.signals, u.data.signals, instanceId, func(signals []*Signal) []*Signal {
+		return append([]*Signal{}, signals...)
+	})
+	save(u.finishedAt, u.data.finishedAt, instanceId, nil)
+}
+
+// schedule keeps the schedule before the transaction changes it for the first time.
+func (u *inMemoryUndo) schedule(id string) {
+	if u == nil {
+		return
+	}
+	save(u.schedules, u.data.schedules, id, nil)
+}
+
+// trigger keeps the trigger before the transaction changes it for the first time.
+func (u *inMemoryUndo) trigger(id string) {
+	if u == nil {
+		return
+	}
+	save(u.triggers, u.data.triggers, id, nil)
+}
+
+// triggerMessage keeps the record of a processed message before the transaction changes it for the first time.
+func (u *inMemoryUndo) triggerMessage(key string) {
+	if u == nil {
+		return
+	}
+	save(u.triggerMessages, u.data.triggerMessages, key, nil)
+}
+
+// timers keeps the timers before the transaction changes them for the first time.
+func (u *inMemoryUndo) timers() {
+	if u == nil || u.savedTimers != nil {
+		return
+	}
+	timers := append(timerHeap{}, u.data.timers...)
+	u.savedTimers = &timers
+}
+
+// tasks keeps the tasks before the transaction changes them for the first time.
+func (u *inMemoryUndo) tasks() {
+	if u == nil || u.savedTasks != nil {
+		return
+	}
+	tasks := append([]*Task{}, u.data.tasks...)
+	u.savedTasks = &tasks
+}
+
+// restore puts back the data the transaction changed.
+func (u *inMemoryUndo) restore() {
+	restoreSaved(u.data.instances, u.pipelines)
+	restoreSaved(u.data.pipelineVersions, u.pipelineVersions)
+	restoreSaved(u.data.workflowStates, u.workflowStates)
+	restoreSaved(u.data.stepStates, u.stepStates)
+	restoreSaved(u.data.stepChangeEvents, u.stepChangeEvents)
+	restoreSaved(u.data.pendingSteps, u.pendingSteps)
+	restoreSaved(u.data.signals, u.signals)
+	restoreSaved(u.data.finishedAt, u.finishedAt)
+	restoreSaved(u.data.schedules, u.schedules)
+	restoreSaved(u.data.triggers, u.triggers)
+	restoreSaved(u.data.triggerMessages, u.triggerMessages)
+	if u.savedTimers != nil {
+		u.data.timers = *u.savedTimers
+	}
+	if u.savedTasks != nil {
+		u.data.tasks = *u.savedTasks
+	}
+}
+
+// save keeps the value of the key unless it was kept before. The value is copied with copyValue if it is changed in
+// place.
+func save[V any](undo map[string]saved[V], values map[string]V, key string, copyValue func(V) V) {
+	if _, ok := undo[key]; ok {
+		return
+	}
+	value, ok := values[key]
+	if ok && copyValue != nil {
+		value = copyValue(value)
+	}
+	undo[key] = saved[V]{value: value, ok: ok}
+}
+
+// restoreSaved sets the kept values back and deletes the keys that were not set.
+func restoreSaved[V any](values map[string]V, undo map[string]saved[V]) {
+	for key, kept := range undo {
+		if kept.ok {
+			values[key] = kept.value
+		} else {
+			delete(values, key)
+		}
+	}
+}
+
+// clonePipeline returns a deep copy of the pipeline.
+func clonePipeline(pipeline *data.Pipeline) *data.Pipeline {
+	if pipeline == nil {
+		return nil
+	}
+	return pipeline.Clone()
+}
+
+// copyWorkflowState returns a deep copy of the workflow state.
+func copyWorkflowState(state *WorkflowState) *WorkflowState {
+	stateCopy := *state
+	if state.Parent != nil {
+		parentCopy := *state.Parent
+		stateCopy.Parent = &parentCopy
+	}
+	if state.Compensation != nil {
+		compensationCopy := *state.Compensation
+		compensationCopy.Steps = make([]*CompensationStep, 0, len(state.Compensation.Steps))
+		for _, step := range state.Compensation.Steps {
+			stepCopy := *step
+			compensationCopy.Steps = append(compensationCopy.Steps, &stepCopy)
+		}
+		stateCopy.Compensation = &compensationCopy
+	}
+	return &stateCopy
+}
+
+// copyStepState returns a deep copy of the step state.
+func copyStepState(stepState *StepState) *StepState {
+	stepStateCopy := *stepState
+	stepStateCopy.Input = clonePipeline(stepState.Input)
+	stepStateCopy.Output = clonePipeline(stepState.Output)
+	stepStateCopy.Attempts = nil
+	for _, attempt := range stepState.Attempts {
+		attemptCopy := *attempt
+		stepStateCopy.Attempts = append(stepStateCopy.Attempts, &attemptCopy)
+	}
+	return &stepStateCopy
+}
+
+// copyStepChangeEvent returns a copy of the StepChangeEvent with a copy of its data.
+func copyStepChangeEvent(event *events.StepChangeEvent) *events.StepChangeEvent {
+	eventCopy := *event
+	eventCopy.Data = copyMap(event.Data)
+	return &eventCopy
+}
+
+// copyTask returns a copy of the task with a copy of its StepChangeEvent.
+func copyTask(task *Task) *Task {
+	taskCopy := *task
+	if task.Event != nil {
+		taskCopy.Event = copyStepChangeEvent(task.Event)
+	}
+	return &taskCopy
+}
+
+// copySchedule returns a copy of the schedule with a copy of its input.
+func copySchedule(schedule *Schedule) *Schedule {
+	scheduleCopy := *schedule
+	scheduleCopy.Input = copyMap(schedule.Input)
+	return &scheduleCopy
+}
+
+// copyTrigger returns a copy of the trigger with a copy of its input mapping.
+func copyTrigger(trigger *Trigger) *Trigger {
+	triggerCopy := *trigger
+	triggerCopy.Input = copyMap(trigger.Input)
+	return &triggerCopy
+}
+
+// copySignal returns a copy of the signal with a copy of its payload.
+func copySignal(signal *Signal) *Signal {
+	signalCopy := *signal
+	signalCopy.Payload = copyMap(signal.Payload)
+	return &signalCopy
+}
+
+// copyMap returns a copy of the map. The values are not copied.
+func copyMap[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	mapCopy := make(map[string]V, len(m))
+	for k, v := range m {
+		mapCopy[k] = v
+	}
+	return mapCopy
+}
+
+// timerHeap is a min heap of timers ordered by the time they fire.
+type timerHeap []*Timer
+
+func (th timerHeap) Len() int { return len(th) }
+
+func (th timerHeap) Less(i, j int) bool { return th[i].FireAt.Before(th[j].FireAt) }
+
+func (th timerHeap) Swap(i, j int) { th[i], th[j] = th[j], th[i] }
+
+func (th *timerHeap) Push(x any) { *th = append(*th, x.(*Timer)) }
+
+func (th *timerHeap) Pop() any {
+	old := *th
+	n := len(old)
+	timer := old[n-1]
+	old[n-1] = nil
+	*th = old[:n-1]
+	return timer
+}
@@ -0,0 +1,492 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestSaveStateVersionConflict(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	state := &WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning}
+	err := storage.SaveState(state)
+	if err != nil || state.InstanceVersion != 1 {
+		t.Fatalf("expected the state to be created with version 1, got %d %v", state.InstanceVersion, err)
+	}
+	stale := *state
+	state.Status = models.StatusCompleted
+	err = storage.SaveState(state)
+	if err != nil || state.InstanceVersion != 2 {
+		t.Fatalf("expected the state to be saved with version 2, got %d %v", state.InstanceVersion, err)
+	}
+	err = storage.SaveState(&stale)
+	if !IsVersionConflict(err) {
+		t.Errorf("expected a version conflict for the stale state, got %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1"})
+	if !IsVersionConflict(err) {
+		t.Errorf("expected a version conflict for a second new state, got %v", err)
+	}
+}
+
+func TestSaveStepStateVersionConflict(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	stepState := &StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning}
+	err := storage.SaveStepState(stepState)
+	if err != nil || stepState.Version != 1 {
+		t.Fatalf("expected the step state to be created with version 1, got %d %v", stepState.Version, err)
+	}
+	stale := *stepState
+	err = storage.SaveStepState(stepState)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveStepState(&stale)
+	if !IsVersionConflict(err) {
+		t.Errorf("expected a version conflict for the stale step state, got %v", err)
+	}
+	// A new start of the step replaces the stored step state
+	restarted := &StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning}
+	err = storage.SaveStepState(restarted)
+	if err != nil || restarted.Version != 3 {
+		t.Errorf("expected the restarted step state to be saved with version 3, got %d %v", restarted.Version, err)
+	}
+}
+
+func TestRetryOnConflict(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveState(&WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var attempts int
+	err = retryOnConflict(func() (err error) {
+		attempts++
+		state, err := storage.GetState("instance-1")
+		if err != nil {
+			return
+		}
+		updated := *state
+		if attempts == 1 {
+			// Another writer saves the state after it was read
+			err = storage.SaveState(state)
+			if err != nil {
+				return
+			}
+		}
+		err = storage.SaveState(&updated)
+		return
+	})
+	if err != nil {
+		t.Errorf("expected the write to succeed once the state was read again, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestWithTxRollback(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveState(&WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	errFailed := errors.New("failed")
+	err = storage.WithTx(func(tx Storage) (err error) {
+		var state *WorkflowState
+		state, err = tx.GetState("instance-1")
+		if err != nil {
+			return
+		}
+		state.Status = models.StatusCompleted
+		err = tx.SaveState(state)
+		if err != nil {
+			return
+		}
+		err = tx.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning})
+		if err != nil {
+			return
+		}
+		err = tx.AddTask(&Task{Id: "task-1", InstanceId: "instance-1", Type: TaskTypeExecute})
+		if err != nil {
+			return
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+	state, _ := storage.GetState("instance-1")
+	if state.Status != models.StatusRunning || state.InstanceVersion != 1 {
+		t.Errorf("expected the state to be rolled back, got %v with version %d", state.Status, state.InstanceVersion)
+	}
+	stepState, _ := storage.GetStepState("instance-1", "step-1", 0)
+	if stepState != nil {
+		t.Errorf("expected the step state to be rolled back, got %v", stepState)
+	}
+	tasks, _ := storage.LeaseTasks("owner-1", 1, time.Minute)
+	if len(tasks) != 0 {
+		t.Errorf("expected the task to be rolled back, got %v", tasks)
+	}
+}
+
+func TestWithTxRollbackOnlyTouchedInstances(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	for _, instanceId := range []string{"instance-1", "instance-2"} {
+		err := storage.SaveStepState(&StepState{InstanceId: instanceId, StepId: "step-1", Status: models.StatusRunning})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	var undo *inMemoryUndo
+	errFailed := errors.New("failed")
+	err := storage.WithTx(func(tx Storage) (err error) {
+		undo = tx.(*InMemoryStorage).undo
+		var stepState *StepState
+		stepState, err = tx.GetStepState("instance-1", "step-1", 0)
+		if err != nil {
+			return
+		}
+		// The step state is replaced in the slice of the stored step states
+		stepState.Status = models.StatusCompleted
+		err = tx.SaveStepState(stepState)
+		if err != nil {
+			return
+		}
+		err = tx.SaveStepChangeEvent(&events.StepChangeEvent{EventId: "event-1", InstanceId: "instance-1", StepId: "step-1"})
+		if err != nil {
+			return
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+	if len(undo.instances) != 1 || !undo.instances["instance-1"] {
+		t.Errorf("expected only the changed instance to be copied, got %v", undo.instances)
+	}
+	stepState, _ := storage.GetStepState("instance-1", "step-1", 0)
+	if stepState == nil || stepState.Status != models.StatusRunning || stepState.Version != 1 {
+		t.Errorf("expected the step state to be rolled back, got %v", stepState)
+	}
+	stepChangeEvents, _ := storage.GetStepChangeEvents("instance-1")
+	if len(stepChangeEvents) != 0 {
+		t.Errorf("expected the event to be rolled back, got %v", stepChangeEvents)
+	}
+	stepState, _ = storage.GetStepState("instance-2", "step-1", 0)
+	if stepState == nil || stepState.Status != models.StatusRunning {
+		t.Errorf("expected the untouched instance to be kept, got %v", stepState)
+	}
+}
+
+func TestWithTxRollbackTriggers(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveTrigger(&Trigger{Id: "trigger-1", Topic: "chan://orders", WorkflowId: "workflow-1"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	added, err := storage.AddTriggerMessage("trigger-1", "message-1")
+	if err != nil || !added {
+		t.Fatalf("expected the message to be added, got %v %v", added, err)
+	}
+	errFailed := errors.New("failed")
+	err = storage.WithTx(func(tx Storage) (err error) {
+		err = tx.SaveTrigger(&Trigger{Id: "trigger-1", Topic: "chan://payments", WorkflowId: "workflow-1"})
+		if err != nil {
+			return
+		}
+		err = tx.SaveTrigger(&Trigger{Id: "trigger-2", Topic: "chan://orders", WorkflowId: "workflow-2"})
+		if err != nil {
+			return
+		}
+		_, err = tx.AddTriggerMessage("trigger-1", "message-2")
+		if err != nil {
+			return
+		}
+		_, err = tx.PruneTriggerMessages(time.Now().Add(time.Minute))
+		if err != nil {
+			return
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+	triggers, _ := storage.ListTriggers()
+	if len(triggers) != 1 || triggers[0].Topic != "chan://orders" {
+		t.Errorf("expected the triggers to be rolled back, got %v", triggers)
+	}
+	// The pruned message is restored and the added one is removed
+	added, _ = storage.AddTriggerMessage("trigger-1", "message-1")
+	if added {
+		t.Error("expected the pruned message to be restored")
+	}
+	added, _ = storage.AddTriggerMessage("trigger-1", "message-2")
+	if !added {
+		t.Error("expected the added message to be rolled back")
+	}
+}
+
+func TestWithTxReentryPanics(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	errFailed := errors.New("failed")
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected using the storage within its own transaction to panic")
+			}
+		}()
+		_ = storage.WithTx(func(tx Storage) error {
+			err := tx.SaveState(&WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning})
+			if err != nil {
+				return err
+			}
+			// The storage itself is used instead of tx
+			_, _ = storage.GetState("instance-1")
+			return errFailed
+		})
+	}()
+	// The transaction is rolled back and the storage is unlocked
+	_, err := storage.GetState("instance-1")
+	if !IsWorkflowStateNotFound(err) {
+		t.Errorf("expected the transaction to be rolled back, got %v", err)
+	}
+}
+
+func TestWithTxCommit(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	err := storage.WithTx(func(tx Storage) error {
+		// A nested transaction joins the transaction of the caller
+		return tx.WithTx(func(nested Storage) error {
+			return nested.SaveState(&WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning})
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	state, err := storage.GetState("instance-1")
+	if err != nil || state.Status != models.StatusRunning {
+		t.Errorf("expected the state to be committed, got %v %v", state, err)
+	}
+}
+
+func TestInMemoryStorageConcurrentAccess(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instanceId := fmt.Sprintf("instance-%d", i)
+			for j := 0; j < 20; j++ {
+				err := storage.WithTx(func(tx Storage) error {
+					return tx.SaveStepState(&StepState{InstanceId: instanceId, StepId: "step-1", Iteration: j})
+				})
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+					return
+				}
+				_ = storage.AddTask(&Task{Id: CreateId(), InstanceId: instanceId, Type: TaskTypeExecute})
+				_, _ = storage.GetStepStates(instanceId)
+				_, _ = storage.LeaseTasks(instanceId, 1, time.Minute)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		stepStates, err := storage.GetStepStates(fmt.Sprintf("instance-%d", i))
+		if err != nil || len(stepStates["step-1"]) != 20 {
+			t.Errorf("expected 20 step states for instance %d, got %d %v", i, len(stepStates["step-1"]), err)
+		}
+	}
+}
+
+func TestInMemoryStorageReturnsCopies(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	state := &WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning, Parent: &ParentLink{InstanceId: "parent-1"}}
+	err := storage.SaveState(state)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// Changes of the caller are not visible until they are saved
+	state.Status = models.StatusFailed
+	state.Parent.StepId = "step-1"
+	stored, _ := storage.GetState("instance-1")
+	if stored.Status != models.StatusRunning || stored.Parent.StepId != "" {
+		t.Errorf("expected the stored state to be unchanged, got %v %v", stored.Status, stored.Parent)
+	}
+	stored.Status = models.StatusCompleted
+	stored, _ = storage.GetState("instance-1")
+	if stored.Status != models.StatusRunning {
+		t.Errorf("expected the stored state to be unchanged, got %v", stored.Status)
+	}
+	err = storage.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Attempts: []*Attempt{{Number: 1}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stepState, _ := storage.GetStepState("instance-1", "step-1", 0)
+	stepState.Attempts[0].Number = 2
+	stepState, _ = storage.GetStepState("instance-1", "step-1", 0)
+	if stepState.Attempts[0].Number != 1 {
+		t.Errorf("expected the stored attempt to be unchanged, got %d", stepState.Attempts[0].Number)
+	}
+}
+
+func TestSavePipelineVersionConflict(t *testing.T) {
+	storages := map[string]Storage{
+		"inmemory": NewInMemoryStorage(nil),
+		"sqlite":   newSQLiteStorage(t, filepath.Join(t.TempDir(), "orcaloop.db")),
+	}
+	for name, storage := range storages {
+		err := storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		first, _ := storage.GetPipeline("instance-1")
+		second, _ := storage.GetPipeline("instance-1")
+		first.Set("var-1", "first")
+		err = storage.SavePipeline(first)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if first.Version != second.Version+1 {
+			t.Errorf("%s: expected the saved pipeline to carry the new version, got %d after %d", name, first.Version, second.Version)
+		}
+		// The saved pipeline is current and can be saved again
+		err = storage.SavePipeline(first)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		second.Set("var-1", "second")
+		err = storage.SavePipeline(second)
+		if !IsVersionConflict(err) {
+			t.Errorf("%s: expected a version conflict for the stale pipeline, got %v", name, err)
+		}
+		// The version is tracked by the storage, not in the variables of the pipeline
+		stored, _ := storage.GetPipeline("instance-1")
+		if len(stored.Map()) != 2 {
+			t.Errorf("%s: expected only the variables of the instance, got %v", name, stored.Map())
+		}
+		stored.Set("var-1", "third")
+		err = storage.SavePipeline(stored)
+		if err != nil {
+			t.Errorf("%s: expected the pipeline read again to be saved, got %v", name, err)
+		}
+	}
+}
+
+func TestInMemoryStorageConcurrentReaders(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	err := storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var wg sync.WaitGroup
+	// Two readers change what they read while a writer saves the instance, run with -race
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(reader string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				pipeline, err := storage.GetPipeline("instance-1")
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+					return
+				}
+				pipeline.Set("reader", reader)
+				state, _ := storage.GetState("instance-1")
+				state.Status = models.StatusFailed
+				stepStates, _ := storage.GetStepStates("instance-1")
+				for _, stepState := range stepStates["step-1"] {
+					stepState.Status = models.StatusFailed
+				}
+			}
+		}(fmt.Sprintf("reader-%d", i))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			err := retryOnConflict(func() (err error) {
+				pipeline, err := storage.GetPipeline("instance-1")
+				if err != nil {
+					return
+				}
+				pipeline.Set("writer", j)
+				return storage.SavePipeline(pipeline)
+			})
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	pipeline, _ := storage.GetPipeline("instance-1")
+	if pipeline.Has("reader") {
+		t.Error("expected the changes of the readers not to be stored")
+	}
+	state, _ := storage.GetState("instance-1")
+	stepState, _ := storage.GetStepState("instance-1", "step-1", 0)
+	if state.Status != models.StatusRunning || stepState.Status != models.StatusRunning {
+		t.Errorf("expected the stored states to be unchanged, got %v %v", state.Status, stepState.Status)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	for _, state := range []*WorkflowState{
+		{InstanceId: "completed", Status: models.StatusCompleted},
+		{InstanceId: "failed", Status: models.StatusFailed},
+		{InstanceId: "running", Status: models.StatusRunning},
+		{InstanceId: "locked", Status: models.StatusCompleted},
+	} {
+		err := storage.SaveState(state)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		_ = storage.SaveStepState(&StepState{InstanceId: state.InstanceId, StepId: "step-1"})
+		_ = storage.AddTimer(&Timer{Id: state.InstanceId, InstanceId: state.InstanceId, FireAt: time.Now()})
+	}
+	_, _ = storage.LockInstance("locked", "owner-1", time.Minute)
+	purged, err := storage.Purge(time.Now().Add(-time.Minute))
+	if err != nil || purged != 0 {
+		t.Errorf("expected no instance to be purged before the timeout, got %d %v", purged, err)
+	}
+	purged, err = storage.Purge(time.Now().Add(time.Second))
+	if err != nil || purged != 2 {
+		t.Fatalf("expected 2 instances to be purged, got %d %v", purged, err)
+	}
+	for _, instanceId := range []string{"completed", "failed"} {
+		if _, err = storage.GetState(instanceId); err == nil {
+			t.Errorf("expected the state of %s to be purged", instanceId)
+		}
+		if _, err = storage.GetStepStates(instanceId); err == nil {
+			t.Errorf("expected the step states of %s to be purged", instanceId)
+		}
+	}
+	for _, instanceId := range []string{"running", "locked"} {
+		if _, err = storage.GetState(instanceId); err != nil {
+			t.Errorf("expected the state of %s to be kept, got %v", instanceId, err)
+		}
+	}
+	timers, _ := storage.GetDueTimers(time.Now(), 10)
+	if len(timers) != 2 {
+		t.Errorf("expected the timers of the kept instances only, got %d", len(timers))
+	}
+}
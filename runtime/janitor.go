@@ -0,0 +1,69 @@
+package runtime
+
+import (
+	"time"
+
+	"oss.nandlabs.io/golly/lifecycle"
+)
+
+// DefaultPurgeInterval is the interval at which the InMemoryJanitor purges the finished instances.
+const DefaultPurgeInterval = time.Minute
+
+// InMemoryJanitor is a lifecycle component that purges the completed and failed instances of an InMemoryStorage
+// once its purge timeout passed. Without it the memory held by the finished instances is never released.
+type InMemoryJanitor struct {
+	*lifecycle.SimpleComponent
+	storage  *InMemoryStorage
+	interval time.Duration
+	done     chan struct{}
+}
+
+// NewInMemoryJanitor creates a new InMemoryJanitor purging the storage at the given interval.
+func NewInMemoryJanitor(storage *InMemoryStorage, interval time.Duration) *InMemoryJanitor {
+	ij := &InMemoryJanitor{
+		storage:  storage,
+		interval: interval,
+	}
+	ij.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-inmemory-janitor",
+		StartFunc: ij.start,
+		StopFunc:  ij.stop,
+	}
+	return ij
+}
+
+func (ij *InMemoryJanitor) start() (err error) {
+	ij.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ij.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ij.done:
+				return
+			case <-ticker.C:
+				ij.purge()
+			}
+		}
+	}()
+	return
+}
+
+func (ij *InMemoryJanitor) stop() (err error) {
+	if ij.done != nil {
+		close(ij.done)
+	}
+	return
+}
+
+// purge deletes the instances that finished before the purge timeout.
+func (ij *InMemoryJanitor) purge() {
+	purged, err := ij.storage.Purge(time.Now().Add(-ij.storage.PurgeTimeout()))
+	if err != nil {
+		logger.ErrorF("Unable to purge the finished instances: %v", err)
+		return
+	}
+	if purged > 0 {
+		logger.InfoF("Purged %d finished instances", purged)
+	}
+}
@@ -0,0 +1,224 @@
+package runtime
+
+import (
+	"fmt"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// JoinPolicy decides when a parallel step resolves.
+type JoinPolicy string
+
+const (
+	// JoinAll resolves once all branches finished.
+	JoinAll JoinPolicy = "all"
+	// JoinAny resolves once a branch completed successfully.
+	JoinAny JoinPolicy = "any"
+	// JoinRace resolves with the first branch that finished.
+	JoinRace JoinPolicy = "race"
+	// JoinQuorum resolves once the quorum of branches completed successfully.
+	JoinQuorum JoinPolicy = "quorum"
+)
+
+// Join holds the join policy of a step of type models.StepTypeParallel.
+// The branches that are still running once the parallel step resolved are cancelled.
+//
+// Fields:
+// - Policy: The join policy. Defaults to JoinAll.
+// - Quorum: The number of branches that have to complete successfully for the JoinQuorum policy.
+// - TolerateFailures: Failed branches do not fail the parallel step as long as the policy can still be met.
+// Without it, the first failed branch fails the parallel step.
+type Join struct {
+	Policy           JoinPolicy `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Quorum           int        `json:"quorum,omitempty" yaml:"quorum,omitempty"`
+	TolerateFailures bool       `json:"tolerate_failures,omitempty" yaml:"tolerate_failures,omitempty"`
+}
+
+// Validate checks the join policy against the number of branches of the parallel step.
+func (j *Join) Validate(branches int) (err error) {
+	switch j.Policy {
+	case "", JoinAll, JoinAny, JoinRace:
+		if j.Quorum != 0 {
+			err = fmt.Errorf("quorum is only supported for the %s policy", JoinQuorum)
+		}
+	case JoinQuorum:
+		if j.Quorum < 1 || j.Quorum > branches {
+			err = fmt.Errorf("quorum must be between 1 and the %d branches", branches)
+		}
+	default:
+		err = fmt.Errorf("unknown join policy %s", j.Policy)
+	}
+	return
+}
+
+// resolve returns true once the parallel step resolved, along with the status it resolved with.
+func (j *Join) resolve(branches, completed, failed int) (resolved bool, status models.Status) {
+	status = models.StatusCompleted
+	switch j.Policy {
+	case JoinAny:
+		resolved = completed > 0 || failed == branches
+		if completed == 0 {
+			status = models.StatusFailed
+		}
+	case JoinRace:
+		resolved = completed+failed > 0
+		if completed == 0 && !j.TolerateFailures {
+			status = models.StatusFailed
+		}
+	case JoinQuorum:
+		resolved = completed >= j.Quorum || branches-failed < j.Quorum
+		if completed < j.Quorum {
+			status = models.StatusFailed
+		}
+	default:
+		resolved = completed+failed == branches
+		if failed > 0 && !j.TolerateFailures {
+			status = models.StatusFailed
+		}
+	}
+	return
+}
+
+// getJoin returns the join policy of the parallel step or nil if there is none.
+func getJoin(storage Storage, instanceId, stepId string) (join *Join, err error) {
+	var stepOptions *StepOptions
+	stepOptions, err = getStepOptions(storage, instanceId, stepId)
+	if err != nil || stepOptions == nil {
+		return
+	}
+	join = stepOptions.Join
+	return
+}
+
+// resolveJoin checks the join policy of a running parallel step against its finished branches.
+// Once the step resolved, the running branches are cancelled and the step completes or fails. A failure is handled by
+// the enclosing try steps before the instance fails.
+// It returns true if the step resolved and true if its failure was caught.
+func resolveJoin(storage Storage, workflow *models.Workflow, join *Join, stepState *StepState, stepStates map[string][]*StepState) (resolved, caught bool, err error) {
+	var completed, failed int
+	var childError string
+	for _, stepStateArr := range stepStates {
+		for _, childState := range stepStateArr {
+			if childState.ParentStep != stepState.StepId {
+				continue
+			}
+			switch childState.Status {
+			case models.StatusCompleted, models.StatusSkipped:
+				completed++
+			case models.StatusFailed:
+				failed++
+				if childError == "" && childState.Output != nil {
+					childError = childState.Output.GetError()
+				}
+			}
+		}
+	}
+	var status models.Status
+	resolved, status = join.resolve(stepState.ChildCount, completed, failed)
+	if !resolved {
+		return
+	}
+	logger.InfoF("Parallel step %s of instance %s resolved with status %v", stepState.StepId, stepState.InstanceId, status)
+	err = cancelBranches(storage, workflow, stepState, stepStates)
+	if err != nil {
+		return
+	}
+	if status == models.StatusFailed {
+		caught, err = failStep(storage, workflow, stepState, fmt.Sprintf("join policy of step %s failed: %s", stepState.StepId, childError))
+		return
+	}
+	stepState.Status = models.StatusCompleted
+	err = storage.SaveStepState(stepState)
+	return
+}
+
+// cancelBranches fails the running descendants of a resolved parallel step and removes their pending steps.
+// The actions of the cancelled steps are notified by the workers once the transaction is committed and the child
+// instances of cancelled workflow steps are cancelled.
+func cancelBranches(storage Storage, workflow *models.Workflow, stepState *StepState, stepStates map[string][]*StepState) (err error) {
+	var options *WorkflowOptions
+	var children []*WorkflowState
+	var pendingSteps []*PendingStep
+	options, err = storage.GetWorkflowOptions(workflow.Id, workflow.Version)
+	if err != nil {
+		return
+	}
+	wfm := NewWorkflowManager(storage)
+	errMsg := fmt.Sprintf("cancelled as parallel step %s resolved", stepState.StepId)
+	cancelled := map[string]bool{stepState.StepId: true}
+	// Cancel level by level until no running descendant is left
+	for found := true; found; {
+		found = false
+		for _, stepStateArr := range stepStates {
+			for _, childState := range stepStateArr {
+				if childState.Status != models.StatusRunning || !cancelled[childState.ParentStep] || cancelled[childState.StepId] {
+					continue
+				}
+				found = true
+				cancelled[childState.StepId] = true
+				step := options.findStep(workflow, childState.StepId)
+				if step != nil && step.Type == models.StepTypeAction {
+					err = queueCancel(storage, childState)
+					if err != nil {
+						return
+					}
+				}
+				if step != nil && step.Type == StepTypeWorkflow {
+					if children == nil {
+						children, err = storage.GetChildInstances(childState.InstanceId)
+						if err != nil {
+							return
+						}
+					}
+					for _, child := range children {
+						if child.Parent == nil || child.Parent.StepId != childState.StepId || child.Parent.Iteration != childState.Iteration || !child.IsActive() {
+							continue
+						}
+						cancelErr := wfm.Cancel(child.InstanceId, true)
+						if cancelErr != nil {
+							logger.ErrorF("Unable to cancel child instance %s: %v", child.InstanceId, cancelErr)
+						}
+					}
+				}
+				logger.InfoF("Cancelling step %s of instance %s", childState.StepId, childState.InstanceId)
+				childState.Status = models.StatusFailed
+				childState.Output = data.NewPipelineFrom(map[string]any{data.ErrorKey: errMsg})
+				err = storage.SaveStepState(childState)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	pendingSteps, err = storage.GetPendingSteps(stepState.InstanceId)
+	if err != nil {
+		return
+	}
+	for _, pendingStep := range pendingSteps {
+		if !cancelled[pendingStep.ParentId] {
+			continue
+		}
+		err = storage.DeletePendingStep(stepState.InstanceId, pendingStep)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// toleratesFailure returns true if the failed step is a branch of a running parallel step that tolerates failures.
+func toleratesFailure(storage Storage, workflow *models.Workflow, failedState *StepState) (tolerated bool, err error) {
+	var options *WorkflowOptions
+	if failedState.ParentStep == "" {
+		return
+	}
+	options, err = storage.GetWorkflowOptions(workflow.Id, workflow.Version)
+	if err != nil {
+		return
+	}
+	parent := options.findStep(workflow, failedState.ParentStep)
+	stepOptions := options.Step(failedState.ParentStep)
+	tolerated = parent != nil && parent.Type == models.StepTypeParallel && stepOptions != nil && stepOptions.Join != nil && stepOptions.Join.TolerateFailures
+	return
+}
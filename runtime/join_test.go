@@ -0,0 +1,176 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestJoinValidate(t *testing.T) {
+	tests := map[string]struct {
+		join  *Join
+		valid bool
+	}{
+		"default":               {join: &Join{}, valid: true},
+		"any":                   {join: &Join{Policy: JoinAny}, valid: true},
+		"race":                  {join: &Join{Policy: JoinRace}, valid: true},
+		"quorum":                {join: &Join{Policy: JoinQuorum, Quorum: 3}, valid: true},
+		"quorum too small":      {join: &Join{Policy: JoinQuorum}},
+		"quorum too large":      {join: &Join{Policy: JoinQuorum, Quorum: 4}},
+		"quorum without policy": {join: &Join{Policy: JoinAny, Quorum: 2}},
+		"unknown policy":        {join: &Join{Policy: "first"}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.join.Validate(3)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected the join to be invalid")
+			}
+		})
+	}
+}
+
+func TestJoinResolve(t *testing.T) {
+	tests := map[string]struct {
+		join      *Join
+		completed int
+		failed    int
+		resolved  bool
+		status    models.Status
+	}{
+		"all pending":             {join: &Join{}, completed: 2},
+		"all completed":           {join: &Join{}, completed: 3, resolved: true, status: models.StatusCompleted},
+		"all with failure":        {join: &Join{}, completed: 2, failed: 1, resolved: true, status: models.StatusFailed},
+		"all tolerating failure":  {join: &Join{TolerateFailures: true}, completed: 2, failed: 1, resolved: true, status: models.StatusCompleted},
+		"any pending":             {join: &Join{Policy: JoinAny}, failed: 2},
+		"any completed":           {join: &Join{Policy: JoinAny}, completed: 1, failed: 1, resolved: true, status: models.StatusCompleted},
+		"any all failed":          {join: &Join{Policy: JoinAny}, failed: 3, resolved: true, status: models.StatusFailed},
+		"race pending":            {join: &Join{Policy: JoinRace}},
+		"race completed":          {join: &Join{Policy: JoinRace}, completed: 1, resolved: true, status: models.StatusCompleted},
+		"race failed":             {join: &Join{Policy: JoinRace}, failed: 1, resolved: true, status: models.StatusFailed},
+		"race tolerating failure": {join: &Join{Policy: JoinRace, TolerateFailures: true}, failed: 1, resolved: true, status: models.StatusCompleted},
+		"quorum pending":          {join: &Join{Policy: JoinQuorum, Quorum: 2}, completed: 1, failed: 1},
+		"quorum met":              {join: &Join{Policy: JoinQuorum, Quorum: 2}, completed: 2, resolved: true, status: models.StatusCompleted},
+		"quorum out of reach":     {join: &Join{Policy: JoinQuorum, Quorum: 2}, completed: 1, failed: 2, resolved: true, status: models.StatusFailed},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resolved, status := tt.join.resolve(3, tt.completed, tt.failed)
+			if resolved != tt.resolved {
+				t.Fatalf("expected resolved %v, got %v", tt.resolved, resolved)
+			}
+			if resolved && status != tt.status {
+				t.Errorf("expected status %v, got %v", tt.status, status)
+			}
+		})
+	}
+}
+
+// branchResult is the status an action reports for a branch of a parallel step.
+type branchResult struct {
+	stepId string
+	status models.Status
+}
+
+func TestJoinCancelsLosers(t *testing.T) {
+	tests := map[string]struct {
+		join      *Join
+		results   []branchResult
+		status    models.Status
+		cancelled []string
+	}{
+		"any": {
+			join:      &Join{Policy: JoinAny},
+			results:   []branchResult{{stepId: "branch-2", status: models.StatusCompleted}},
+			status:    models.StatusCompleted,
+			cancelled: []string{"branch-1", "branch-3"},
+		},
+		"any tolerating failures": {
+			join:      &Join{Policy: JoinAny, TolerateFailures: true},
+			results:   []branchResult{{stepId: "branch-1", status: models.StatusFailed}, {stepId: "branch-3", status: models.StatusCompleted}},
+			status:    models.StatusCompleted,
+			cancelled: []string{"branch-2"},
+		},
+		"quorum": {
+			join:      &Join{Policy: JoinQuorum, Quorum: 2},
+			results:   []branchResult{{stepId: "branch-1", status: models.StatusCompleted}, {stepId: "branch-3", status: models.StatusCompleted}},
+			status:    models.StatusCompleted,
+			cancelled: []string{"branch-2"},
+		},
+		"quorum out of reach": {
+			join:      &Join{Policy: JoinQuorum, Quorum: 3, TolerateFailures: true},
+			results:   []branchResult{{stepId: "branch-2", status: models.StatusFailed}},
+			status:    models.StatusFailed,
+			cancelled: []string{"branch-1", "branch-3"},
+		},
+		"race": {
+			join:      &Join{Policy: JoinRace},
+			results:   []branchResult{{stepId: "branch-3", status: models.StatusCompleted}},
+			status:    models.StatusCompleted,
+			cancelled: []string{"branch-1", "branch-2"},
+		},
+		"race lost by failure": {
+			join:      &Join{Policy: JoinRace},
+			results:   []branchResult{{stepId: "branch-1", status: models.StatusFailed}},
+			status:    models.StatusFailed,
+			cancelled: []string{"branch-2", "branch-3"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			storage := NewInMemoryStorage(nil)
+			wfm := NewWorkflowManager(storage)
+			parallel := &models.Step{Id: "parallel-1", Type: models.StepTypeParallel, Parallel: &models.Parallel{
+				Steps: []*models.Step{
+					{Id: "branch-1", Type: StepTypeWait},
+					{Id: "branch-2", Type: StepTypeWait},
+					{Id: "branch-3", Type: StepTypeWait},
+				},
+			}}
+			err := wfm.Save(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1, Steps: []*models.Step{parallel}})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Steps: map[string]*StepOptions{
+				"parallel-1": {Join: tt.join},
+				"branch-1":   {Wait: &WaitSignal{Signal: "branch-1"}},
+				"branch-2":   {Wait: &WaitSignal{Signal: "branch-2"}},
+				"branch-3":   {Wait: &WaitSignal{Signal: "branch-3"}},
+			}})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			instanceId, err := wfm.Start("workflow-1", 1, nil)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			runTasks(t, storage)
+			for _, result := range tt.results {
+				err = wfm.CompleteStep(instanceId, result.stepId, 0, result.status, map[string]any{data.ErrorKey: "branch failed"})
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				runTasks(t, storage)
+			}
+			stepState, err := storage.GetStepState(instanceId, "parallel-1", 0)
+			if err != nil || stepState.Status != tt.status {
+				t.Errorf("expected the parallel step to resolve with %v, got %v %v", tt.status, stepState, err)
+			}
+			workflowState, err := storage.GetState(instanceId)
+			if err != nil || workflowState.Status != tt.status {
+				t.Errorf("expected the instance to finish with %v, got %v %v", tt.status, workflowState, err)
+			}
+			for _, stepId := range tt.cancelled {
+				stepState, err = storage.GetStepState(instanceId, stepId, 0)
+				if err != nil || stepState.Status != models.StatusFailed || !strings.Contains(stepState.Output.GetError(), "cancelled") {
+					t.Errorf("expected branch %s to be cancelled, got %v %v", stepId, stepState, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// WorkflowOptions holds the runtime options of a workflow that are not part of the workflow definition.
+// The options are registered along with the workflow and are identified by the workflow id and version.
+//
+// Fields:
+// - WorkflowId: The unique identifier of the workflow.
+// - WorkflowVersion: The version of the workflow.
+// - TimeoutMs: The time in milliseconds after which a running instance is timed out. Zero means no timeout.
+// - Recovery: How the instances left behind by a crashed process are recovered. Defaults to RecoveryRedrive.
+// - Steps: The options of the individual steps keyed by the step id.
+type WorkflowOptions struct {
+	WorkflowId      string                  `json:"workflow_id" yaml:"workflow_id"`
+	WorkflowVersion int                     `json:"workflow_version" yaml:"workflow_version"`
+	TimeoutMs       int64                   `json:"timeout_ms,omitempty" yaml:"timeout_ms,omitempty"`
+	Recovery        RecoveryPolicy          `json:"recovery,omitempty" yaml:"recovery,omitempty"`
+	Steps           map[string]*StepOptions `json:"steps,omitempty" yaml:"steps,omitempty"`
+}
+
+// StepOptions holds the runtime options of a single step.
+//
+// Fields:
+// - Retry: The retry policy applied when the action of the step fails.
+// - TimeoutMs: The time in milliseconds a step may stay running before it is failed. Zero means no timeout.
+// - Workflow: The workflow started by a step of type StepTypeWorkflow.
+// - Wait: The signal a step of type StepTypeWait waits for.
+// - Delay: The delay of a step of type StepTypeDelay.
+// - Compensate: The action that undoes a completed action step when the instance fails.
+// - Try: The blocks of a step of type StepTypeTry.
+// - While: The loop of a step of type StepTypeWhile.
+// - ForEach: The parallelism and results of a step of type models.StepTypeForLoop.
+// - Join: The join policy of a step of type models.StepTypeParallel.
+// - Workers: The number of branches of a step of type models.StepTypeParallel started at the same time. Zero starts
+// all branches at once.
+type StepOptions struct {
+	Retry      *RetryPolicy      `json:"retry,omitempty" yaml:"retry,omitempty"`
+	TimeoutMs  int64             `json:"timeout_ms,omitempty" yaml:"timeout_ms,omitempty"`
+	Workflow   *SubWorkflow      `json:"workflow,omitempty" yaml:"workflow,omitempty"`
+	Wait       *WaitSignal       `json:"wait,omitempty" yaml:"wait,omitempty"`
+	Delay      *Delay            `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Compensate *CompensateAction `json:"compensate,omitempty" yaml:"compensate,omitempty"`
+	Try        *TryCatch         `json:"try,omitempty" yaml:"try,omitempty"`
+	While      *WhileLoop        `json:"while,omitempty" yaml:"while,omitempty"`
+	ForEach    *ForEach          `json:"for_each,omitempty" yaml:"for_each,omitempty"`
+	Join       *Join             `json:"join,omitempty" yaml:"join,omitempty"`
+	Workers    int               `json:"workers,omitempty" yaml:"workers,omitempty"`
+}
+
+// Step returns the options of the step with the given id.
+// It returns nil if there are no options registered for the step.
+func (wo *WorkflowOptions) Step(id string) (stepOptions *StepOptions) {
+	if wo == nil || wo.Steps == nil {
+		return
+	}
+	stepOptions = wo.Steps[id]
+	return
+}
+
+// Validate checks the options against the workflow they are registered for.
+func (wo *WorkflowOptions) Validate(workflow *models.Workflow) (err error) {
+	if wo.TimeoutMs < 0 {
+		err = errors.New("workflow timeout must not be negative")
+		return
+	}
+	switch wo.Recovery {
+	case "", RecoveryRedrive, RecoveryFail:
+	default:
+		err = fmt.Errorf("unknown recovery policy %s", wo.Recovery)
+		return
+	}
+	err = wo.validateStepTypes(workflow.Steps)
+	if err != nil {
+		return
+	}
+	for stepId, stepOptions := range wo.Steps {
+		step := wo.findStep(workflow, stepId)
+		if step == nil {
+			err = fmt.Errorf("options defined for unknown step %s", stepId)
+			return
+		}
+		if stepOptions == nil {
+			continue
+		}
+		if stepOptions.Workflow != nil {
+			if step.Type != StepTypeWorkflow {
+				err = fmt.Errorf("workflow is only supported for workflow steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Workflow.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid workflow for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.Wait != nil {
+			if step.Type != StepTypeWait {
+				err = fmt.Errorf("wait is only supported for wait steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Wait.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid wait for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.Delay != nil {
+			if step.Type != StepTypeDelay {
+				err = fmt.Errorf("delay is only supported for delay steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Delay.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid delay for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.Try != nil {
+			if step.Type != StepTypeTry {
+				err = fmt.Errorf("try is only supported for try steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Try.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid try for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.While != nil {
+			if step.Type != StepTypeWhile {
+				err = fmt.Errorf("while is only supported for while steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.While.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid while for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.ForEach != nil {
+			if step.Type != models.StepTypeForLoop {
+				err = fmt.Errorf("for_each is only supported for for loop steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.ForEach.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid for_each for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.Join != nil {
+			if step.Type != models.StepTypeParallel {
+				err = fmt.Errorf("join is only supported for parallel steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Join.Validate(len(step.Parallel.Steps))
+			if err != nil {
+				err = fmt.Errorf("invalid join for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.Workers != 0 {
+			if step.Type != models.StepTypeParallel {
+				err = fmt.Errorf("workers are only supported for parallel steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			if stepOptions.Workers < 0 {
+				err = fmt.Errorf("workers of step %s must not be negative", stepId)
+				return
+			}
+		}
+		if stepOptions.Compensate != nil {
+			if step.Type != models.StepTypeAction {
+				err = fmt.Errorf("compensate is only supported for action steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Compensate.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid compensate for step %s: %w", stepId, err)
+				return
+			}
+		}
+		if stepOptions.TimeoutMs < 0 {
+			err = fmt.Errorf("timeout of step %s must not be negative", stepId)
+			return
+		}
+		if stepOptions.Retry != nil {
+			if step.Type != models.StepTypeAction {
+				err = fmt.Errorf("retry policy is only supported for action steps, step %s is of type %v", stepId, step.Type)
+				return
+			}
+			err = stepOptions.Retry.Validate()
+			if err != nil {
+				err = fmt.Errorf("invalid retry policy for step %s: %w", stepId, err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// validateStepTypes checks that the steps of the runtime step types have their configuration registered.
+func (wo *WorkflowOptions) validateStepTypes(steps []*models.Step) (err error) {
+	for _, step := range steps {
+		switch step.Type {
+		case StepTypeWorkflow:
+			if wo.Step(step.Id) == nil || wo.Step(step.Id).Workflow == nil {
+				err = fmt.Errorf("no workflow configured for step %s", step.Id)
+			}
+		case StepTypeWait:
+			if wo.Step(step.Id) == nil || wo.Step(step.Id).Wait == nil {
+				err = fmt.Errorf("no signal configured for step %s", step.Id)
+			}
+		case StepTypeDelay:
+			if wo.Step(step.Id) == nil || wo.Step(step.Id).Delay == nil {
+				err = fmt.Errorf("no delay configured for step %s", step.Id)
+			}
+		case StepTypeTry:
+			if wo.Step(step.Id) == nil || wo.Step(step.Id).Try == nil {
+				err = fmt.Errorf("no try block configured for step %s", step.Id)
+				break
+			}
+			for _, block := range wo.Step(step.Id).Try.blocks() {
+				if err == nil {
+					err = wo.validateStepTypes(block)
+				}
+			}
+		case StepTypeWhile:
+			if wo.Step(step.Id) == nil || wo.Step(step.Id).While == nil {
+				err = fmt.Errorf("no while loop configured for step %s", step.Id)
+				break
+			}
+			err = wo.validateStepTypes(wo.Step(step.Id).While.Steps)
+		case models.StepTypeForLoop:
+			err = wo.validateStepTypes(step.For.Steps)
+		case models.StepTypeParallel:
+			err = wo.validateStepTypes(step.Parallel.Steps)
+		case models.StepTypeIf:
+			err = wo.validateStepTypes(step.If.Steps)
+			for _, elseIf := range step.If.ElseIfs {
+				if err == nil {
+					err = wo.validateStepTypes(elseIf.Steps)
+				}
+			}
+			if err == nil && step.If.Else != nil {
+				err = wo.validateStepTypes(step.If.Else.Steps)
+			}
+		case models.StepTypeSwitch:
+			for _, caseItem := range step.Switch.Cases {
+				if err == nil {
+					err = wo.validateStepTypes(caseItem.Steps)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// findStep returns the step with the given id, including the steps of the blocks of try steps.
+// It returns nil if the step does not exist.
+func (wo *WorkflowOptions) findStep(workflow *models.Workflow, id string) (step *models.Step) {
+	step = wo.searchSteps(workflow.Steps, id)
+	return
+}
+
+func (wo *WorkflowOptions) searchSteps(steps []*models.Step, id string) (found *models.Step) {
+	for _, step := range steps {
+		if step.Id == id {
+			return step
+		}
+		var children [][]*models.Step
+		switch step.Type {
+		case models.StepTypeForLoop:
+			children = append(children, step.For.Steps)
+		case models.StepTypeParallel:
+			children = append(children, step.Parallel.Steps)
+		case models.StepTypeIf:
+			children = append(children, step.If.Steps)
+			for _, elseIf := range step.If.ElseIfs {
+				children = append(children, elseIf.Steps)
+			}
+			if step.If.Else != nil {
+				children = append(children, step.If.Else.Steps)
+			}
+		case models.StepTypeSwitch:
+			for _, caseItem := range step.Switch.Cases {
+				children = append(children, caseItem.Steps)
+			}
+		case StepTypeTry:
+			if wo.Step(step.Id) != nil && wo.Step(step.Id).Try != nil {
+				children = wo.Step(step.Id).Try.blocks()
+			}
+		case StepTypeWhile:
+			if wo.Step(step.Id) != nil && wo.Step(step.Id).While != nil {
+				children = append(children, wo.Step(step.Id).While.Steps)
+			}
+		}
+		for _, childSteps := range children {
+			found = wo.searchSteps(childSteps, id)
+			if found != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// getStep returns the step with the given id of the workflow, including the steps of the blocks of try steps.
+func getStep(storage Storage, workflow *models.Workflow, id string) (step *models.Step, err error) {
+	var workflowOptions *WorkflowOptions
+	workflowOptions, err = storage.GetWorkflowOptions(workflow.Id, workflow.Version)
+	if err != nil {
+		return
+	}
+	step = workflowOptions.findStep(workflow, id)
+	return
+}
+
+// getStepOptions returns the options of a step for the workflow the instance belongs to.
+func getStepOptions(storage Storage, instanceId, stepId string) (stepOptions *StepOptions, err error) {
+	var workflowState *WorkflowState
+	var workflowOptions *WorkflowOptions
+	workflowState, err = storage.GetState(instanceId)
+	if err != nil {
+		return
+	}
+	workflowOptions, err = storage.GetWorkflowOptions(workflowState.WorkflowId, workflowState.WorkflowVersion)
+	if err != nil {
+		return
+	}
+	stepOptions = workflowOptions.Step(stepId)
+	return
+}
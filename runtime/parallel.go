@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"sync"
+
+	"oss.nandlabs.io/golly/errutils"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// runBranches runs the branches of a parallel step with at most workers of them running at the same time.
+// Zero workers runs all branches at once. Every branch runs even if another one failed, as the parallel step only
+// resolves once each of its branches finished. The errors of the failed branches are returned as
+// errutils.MultiError.
+func runBranches(workers int, branches []func() error) (err error) {
+	if workers <= 0 || workers > len(branches) {
+		workers = len(branches)
+	}
+	var mutex sync.Mutex
+	var errs []error
+	queue := make(chan func() error)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for branch := range queue {
+				branchErr := branch()
+				if branchErr != nil {
+					mutex.Lock()
+					errs = append(errs, branchErr)
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, branch := range branches {
+		queue <- branch
+	}
+	close(queue)
+	wg.Wait()
+	if len(errs) > 0 {
+		multiErr := errutils.NewMultiErr(nil)
+		for _, branchErr := range errs {
+			multiErr.Add(branchErr)
+		}
+		err = multiErr
+	}
+	return
+}
+
+// failBranch fails a branch of a parallel step that could not be started, e.g. because the variable it loops over is
+// missing. The parallel step counts on each of its branches to finish, the branch is started so that its failure is
+// handled like the failure of a branch that started.
+func (se *StepExecutor) failBranch(step *models.Step, pipeline *data.Pipeline, cause error) (err error) {
+	stepState := &StepState{
+		InstanceId: pipeline.Id(),
+		StepId:     step.Id,
+		ParentStep: pipeline.GetParent(),
+		Iteration:  getIteration(pipeline),
+		Status:     models.StatusRunning,
+	}
+	var savedState *StepState
+	savedState, err = se.storage.GetStepState(stepState.InstanceId, stepState.StepId, stepState.Iteration)
+	if err != nil && !IsStepStateNotFound(err) {
+		return
+	}
+	if savedState == nil {
+		err = se.start(stepState)
+		if err != nil {
+			return
+		}
+	}
+	err = se.fail(stepState, cause)
+	return
+}
@@ -0,0 +1,217 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/golly/errutils"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestRunBranchesConcurrently(t *testing.T) {
+	const count = 4
+	started := sync.WaitGroup{}
+	started.Add(count)
+	done := make(chan struct{})
+	var branches []func() error
+	for i := 0; i < count; i++ {
+		branches = append(branches, func() error {
+			started.Done()
+			// Blocks until all branches are running
+			started.Wait()
+			return nil
+		})
+	}
+	go func() {
+		defer close(done)
+		if err := runBranches(0, branches); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("branches did not run concurrently")
+	}
+}
+
+func TestRunBranchesWorkers(t *testing.T) {
+	const count, workers = 10, 3
+	var running, maxRunning, ran int32
+	var branches []func() error
+	for i := 0; i < count; i++ {
+		branches = append(branches, func() error {
+			current := atomic.AddInt32(&running, 1)
+			for {
+				peak := atomic.LoadInt32(&maxRunning)
+				if current <= peak || atomic.CompareAndSwapInt32(&maxRunning, peak, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})
+	}
+	if err := runBranches(workers, branches); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ran != count {
+		t.Errorf("expected %d branches to run, got %d", count, ran)
+	}
+	if maxRunning > workers {
+		t.Errorf("expected at most %d branches running at the same time, got %d", workers, maxRunning)
+	}
+}
+
+func TestRunBranchesErrors(t *testing.T) {
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+	started := sync.WaitGroup{}
+	started.Add(3)
+	branch := func(err error) func() error {
+		return func() error {
+			started.Done()
+			// All branches start before one of them fails
+			started.Wait()
+			return err
+		}
+	}
+	err := runBranches(0, []func() error{branch(errFirst), branch(nil), branch(errSecond)})
+	var multiErr *errutils.MultiError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("expected a MultiError, got %v", err)
+	}
+	if len(multiErr.GetAll()) != 2 {
+		t.Errorf("expected 2 errors, got %v", multiErr.GetAll())
+	}
+}
+
+func TestRunBranchesAfterFailure(t *testing.T) {
+	var ran int32
+	var branches []func() error
+	branches = append(branches, func() error {
+		atomic.AddInt32(&ran, 1)
+		return errors.New("failed")
+	})
+	for i := 0; i < 5; i++ {
+		branches = append(branches, func() error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})
+	}
+	err := runBranches(1, branches)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if ran != 6 {
+		t.Errorf("expected the branches after the failed one to run, %d ran", ran)
+	}
+}
+
+// TestParallelStepSharesStorage runs the branches of a parallel step against the same storage, run it with -race.
+func TestParallelStepSharesStorage(t *testing.T) {
+	const count = 8
+	storage := NewInMemoryStorage(nil)
+	parallel := &models.Step{Id: "parallel-1", Type: models.StepTypeParallel, Parallel: &models.Parallel{}}
+	stepOptions := map[string]*StepOptions{}
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("delay-%d", i)
+		parallel.Parallel.Steps = append(parallel.Parallel.Steps, &models.Step{Id: id, Type: StepTypeDelay})
+		stepOptions[id] = &StepOptions{Delay: &Delay{DurationMs: time.Hour.Milliseconds()}}
+	}
+	err := storage.SaveWorkflow(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1, Steps: []*models.Step{parallel}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveWorkflowOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Steps: stepOptions})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pipeline := data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"})
+	err = storage.CreateNewInstance("workflow-1", "instance-1", pipeline)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	se := &StepExecutor{storage: storage}
+	err = se.Execute(parallel, pipeline)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stepStates, err := storage.GetStepStates("instance-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, step := range parallel.Parallel.Steps {
+		if len(stepStates[step.Id]) != 1 || stepStates[step.Id][0].Status != models.StatusRunning {
+			t.Errorf("expected branch %s to be running, got %v", step.Id, stepStates[step.Id])
+		}
+	}
+	timers, err := storage.GetDueTimers(time.Now().Add(2*time.Hour), 100)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(timers) != count {
+		t.Errorf("expected a timer for each of the %d branches, got %d", count, len(timers))
+	}
+}
+
+func TestParallelBranchFailureResolvesParent(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	wfm := NewWorkflowManager(storage)
+	parallel := &models.Step{Id: "parallel-1", Type: models.StepTypeParallel, Parallel: &models.Parallel{
+		Steps: []*models.Step{
+			// The first branch fails before it starts as the variable it loops over is missing
+			{Id: "for-1", Type: models.StepTypeForLoop, For: &models.For{ItemsVar: "missing", Steps: []*models.Step{{Id: "delay-0", Type: StepTypeDelay}}}},
+			{Id: "delay-1", Type: StepTypeDelay},
+			{Id: "delay-2", Type: StepTypeDelay},
+		},
+	}}
+	err := wfm.Save(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1, Steps: []*models.Step{parallel}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Steps: map[string]*StepOptions{
+		"parallel-1": {Workers: 1, Join: &Join{Policy: JoinAll, TolerateFailures: true}},
+		"delay-0":    {Delay: &Delay{DurationMs: 1}},
+		"delay-1":    {Delay: &Delay{DurationMs: 1}},
+		"delay-2":    {Delay: &Delay{DurationMs: 1}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	instanceId, err := wfm.Start("workflow-1", 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	time.Sleep(10 * time.Millisecond)
+	NewTimerScheduler(storage, time.Second).fireDue()
+	runTasks(t, storage)
+	for _, stepId := range []string{"for-1", "delay-1", "delay-2", "parallel-1"} {
+		stepState, err := storage.GetStepState(instanceId, stepId, 0)
+		if err != nil || stepState == nil {
+			t.Fatalf("expected step %s to have a state, got %v %v", stepId, stepState, err)
+		}
+		if stepState.Status == models.StatusRunning {
+			t.Errorf("expected step %s to finish", stepId)
+		}
+	}
+	workflowState, err := storage.GetState(instanceId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if workflowState.Status != models.StatusCompleted {
+		t.Errorf("expected the instance to complete as the join tolerates failures, got %v %s", workflowState.Status, workflowState.Error)
+	}
+}
@@ -0,0 +1,188 @@
+package runtime
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"oss.nandlabs.io/orcaloop/db"
+)
+
+// migrationLockKey is the key of the advisory lock serializing the migrations of concurrently starting services.
+const migrationLockKey = 7307421950
+
+// Migration is a versioned change of the schema of the PostgresStorage.
+//
+// Fields:
+//   - Version: The version of the migration, migrations are applied in the ascending order of their versions
+//   - Name: The name of the directory holding the migration
+//   - SQL: The statements of the migration
+//   - Checksum: The SHA-256 checksum of the statements, an applied migration must never change
+type Migration struct {
+	Version  int
+	Name     string
+	SQL      string
+	Checksum string
+}
+
+// PostgresMigrations returns the migrations embedded in db/postgres in the order of their versions.
+func PostgresMigrations() (migrations []*Migration, err error) {
+	entries, err := fs.ReadDir(db.Postgres, "postgres")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		migration := &Migration{Name: entry.Name()}
+		migration.Version, err = strconv.Atoi(entry.Name())
+		if err != nil {
+			err = fmt.Errorf("invalid migration version %s", entry.Name())
+			return
+		}
+		var files []string
+		files, err = fs.Glob(db.Postgres, path.Join("postgres", entry.Name(), "*.sql"))
+		if err != nil {
+			return
+		}
+		sort.Strings(files)
+		var sb strings.Builder
+		for _, file := range files {
+			var content []byte
+			content, err = fs.ReadFile(db.Postgres, file)
+			if err != nil {
+				return
+			}
+			sb.Write(content)
+			sb.WriteString("\n")
+		}
+		migration.SQL = sb.String()
+		checksum := sha256.Sum256([]byte(migration.SQL))
+		migration.Checksum = hex.EncodeToString(checksum[:])
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			err = fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+			return
+		}
+	}
+	return
+}
+
+// Migrate applies the pending migrations to the schema, creating the schema if it does not exist. The migrations are
+// applied in a single transaction, a failing migration leaves the schema unchanged. The checksums of the migrations
+// applied earlier are verified, a changed migration fails with ErrMigrationChecksum.
+func (s *PostgresStorage) Migrate(schema string) (applied int, err error) {
+	if schema == "" {
+		schema = "public"
+	}
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		logger.ErrorF("Error loading migrations: %v", err)
+		err = errors.New("error loading migrations")
+		return
+	}
+	err = s.WithTx(func(tx Storage) (err error) {
+		applied, err = (&PostgresStorage{SQLStorage: tx.(*SQLStorage)}).migrate(schema, migrations)
+		return
+	})
+	return
+}
+
+func (s *PostgresStorage) migrate(schema string, migrations []*Migration) (applied int, err error) {
+	quotedSchema := pq.QuoteIdentifier(schema)
+	// Services starting at the same time wait for the first one to migrate the schema
+	_, err = s.tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockKey)
+	if err != nil {
+		logger.ErrorF("Error acquiring migration lock: %v", err)
+		err = errors.New("error acquiring migration lock")
+		return
+	}
+	_, err = s.tx.Exec(`CREATE SCHEMA IF NOT EXISTS ` + quotedSchema)
+	if err != nil {
+		logger.ErrorF("Error creating schema %s: %v", schema, err)
+		err = errors.New("error creating schema")
+		return
+	}
+	_, err = s.tx.Exec(`SET LOCAL search_path TO ` + quotedSchema)
+	if err != nil {
+		logger.ErrorF("Error setting search path to schema %s: %v", schema, err)
+		err = errors.New("error setting search path")
+		return
+	}
+	_, err = s.tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version int4 NOT NULL,
+	name varchar NOT NULL,
+	checksum varchar NOT NULL,
+	applied_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+)`)
+	if err != nil {
+		logger.ErrorF("Error creating schema_migrations table: %v", err)
+		err = errors.New("error creating schema_migrations table")
+		return
+	}
+	rows, err := s.tx.Query(`SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		logger.ErrorF("Error fetching applied migrations: %v", err)
+		err = errors.New("error fetching applied migrations")
+		return
+	}
+	checksums := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var checksum string
+		err = rows.Scan(&version, &checksum)
+		if err != nil {
+			rows.Close()
+			logger.ErrorF("Error scanning applied migration: %v", err)
+			err = errors.New("error scanning applied migration")
+			return
+		}
+		checksums[version] = checksum
+	}
+	rows.Close()
+	known := make(map[int]bool)
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		checksum, ok := checksums[migration.Version]
+		if ok {
+			if checksum != migration.Checksum {
+				err = ErrMigrationChecksum(migration.Version)
+				return
+			}
+			continue
+		}
+		_, err = s.tx.Exec(migration.SQL)
+		if err != nil {
+			logger.ErrorF("Error applying migration %s: %v", migration.Name, err)
+			err = fmt.Errorf("error applying migration %s", migration.Name)
+			return
+		}
+		_, err = s.tx.Exec(`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+			migration.Version, migration.Name, migration.Checksum)
+		if err != nil {
+			logger.ErrorF("Error recording migration %s: %v", migration.Name, err)
+			err = errors.New("error recording migration")
+			return
+		}
+		logger.InfoF("Applied migration %s to schema %s", migration.Name, schema)
+		applied++
+	}
+	for version := range checksums {
+		if !known[version] {
+			logger.WarnF("Schema %s has the migration %d unknown to this version of orcaloop", schema, version)
+		}
+	}
+	return
+}
@@ -0,0 +1,28 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPostgresMigrations(t *testing.T) {
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected the embedded migrations")
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("expected migration %s to have version %d, got %d", migration.Name, i+1, migration.Version)
+		}
+		if len(migration.Checksum) != 64 || strings.TrimSpace(migration.SQL) == "" {
+			t.Errorf("expected migration %s to have statements and a checksum", migration.Name)
+		}
+		// The migrations are applied to the configured schema
+		if strings.Contains(migration.SQL, "public.") {
+			t.Errorf("expected migration %s not to reference the public schema", migration.Name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package runtime
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+// PostgresTestDSNEnv is the environment variable holding the connection string of the database used by the tests
+// of the PostgresStorage. The tests are skipped if it is not set.
+const PostgresTestDSNEnv = "ORCALOOP_TEST_POSTGRES_DSN"
+
+func newPostgresStorage(t *testing.T) *PostgresStorage {
+	dsn := os.Getenv(PostgresTestDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", PostgresTestDSNEnv)
+	}
+	storage, err := ConnectPostgres(&config.StorageConfig{
+		Type:     config.PostgresStorageType,
+		Provider: &config.Provider{PostgreSQL: &config.PostgresStorage{ConnectionString: dsn, AutoMigrate: true}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { storage.Database.Close() })
+	return storage
+}
+
+func TestPostgresLockInstance(t *testing.T) {
+	storage := newPostgresStorage(t)
+	instanceId := CreateId()
+	pipeline := data.NewPipelineFrom(map[string]any{data.InstanceIdKey: instanceId, data.WorkflowVersionKey: 1})
+	err := storage.CreateNewInstance("workflow-1", instanceId, pipeline)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	lock, err := storage.LockInstance(instanceId, "owner-1", time.Minute)
+	if err != nil || !lock {
+		t.Fatalf("expected the instance to be locked, got %v %v", lock, err)
+	}
+	lock, err = storage.LockInstance(instanceId, "owner-2", time.Minute)
+	if err != nil || lock {
+		t.Errorf("expected the lock to be held by the first owner, got %v %v", lock, err)
+	}
+	extended, err := storage.ExtendInstanceLock(instanceId, "owner-2", time.Minute)
+	if err != nil || extended {
+		t.Errorf("expected the lock not to be extended for another owner, got %v %v", extended, err)
+	}
+	extended, err = storage.ExtendInstanceLock(instanceId, "owner-1", time.Minute)
+	if err != nil || !extended {
+		t.Errorf("expected the lock to be extended for its owner, got %v %v", extended, err)
+	}
+	err = storage.UnlockInstance(instanceId, "owner-2")
+	if !IsLockNotOwned(err) {
+		t.Errorf("expected a lock not owned error, got %v", err)
+	}
+	err = storage.UnlockInstance(instanceId, "owner-1")
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	err = storage.UnlockInstance(instanceId, "owner-1")
+	if !IsLockNotOwned(err) {
+		t.Errorf("expected a lock not owned error once the instance was unlocked, got %v", err)
+	}
+	// An expired lease is taken over by the next owner
+	lock, err = storage.LockInstance(instanceId, "owner-1", -time.Second)
+	if err != nil || !lock {
+		t.Fatalf("expected the instance to be locked, got %v %v", lock, err)
+	}
+	lock, err = storage.LockInstance(instanceId, "owner-2", time.Minute)
+	if err != nil || !lock {
+		t.Errorf("expected the expired lock to be taken over, got %v %v", lock, err)
+	}
+	err = storage.UnlockInstance(instanceId, "owner-1")
+	if !IsLockNotOwned(err) {
+		t.Errorf("expected a lock not owned error for the previous owner, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package runtime
+
+import (
+	"time"
+
+	"oss.nandlabs.io/golly/lifecycle"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+const (
+	// DefaultRecoveryInterval is the interval at which the RecoverySweeper looks for instances left behind.
+	DefaultRecoveryInterval = time.Minute
+	// DefaultRecoveryTimeout is the time after which a running local action is considered abandoned.
+	DefaultRecoveryTimeout = 5 * time.Minute
+)
+
+// RecoveryPolicy decides how an instance left behind by a crashed process is recovered.
+type RecoveryPolicy string
+
+const (
+	// RecoveryRedrive processes the saved step change events, runs the abandoned local actions again and continues
+	// the instance.
+	RecoveryRedrive RecoveryPolicy = "redrive"
+	// RecoveryFail fails the instance with the ReasonAbandoned reason if one of its local actions was abandoned. The
+	// instances found by their saved step change events or an expired lock are redriven, as they can move on.
+	RecoveryFail RecoveryPolicy = "fail"
+)
+
+// RecoverySweeper is a lifecycle component that recovers the instances left behind by a crashed process.
+// It looks for instances whose lock expired, step change events that were saved but never processed
+// and local actions that are running for longer than the timeout while nobody holds the lock of their instance.
+// An instance is only left behind if nobody holds its lock, it has no queued task and no saved event, the saved
+// events are processed first. The sweep runs once the component starts and then at the given interval.
+type RecoverySweeper struct {
+	*lifecycle.SimpleComponent
+	storage  Storage
+	interval time.Duration
+	timeout  time.Duration
+	done     chan struct{}
+}
+
+// NewRecoverySweeper creates a new RecoverySweeper sweeping at the given interval. Local actions running for longer
+// than the timeout are considered abandoned.
+func NewRecoverySweeper(storage Storage, interval, timeout time.Duration) *RecoverySweeper {
+	rs := &RecoverySweeper{
+		storage:  storage,
+		interval: interval,
+		timeout:  timeout,
+	}
+	rs.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-recovery-sweeper",
+		StartFunc: rs.start,
+		StopFunc:  rs.stop,
+	}
+	return rs
+}
+
+func (rs *RecoverySweeper) start() (err error) {
+	rs.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(rs.interval)
+		defer ticker.Stop()
+		for {
+			rs.sweep()
+			select {
+			case <-rs.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return
+}
+
+func (rs *RecoverySweeper) stop() (err error) {
+	if rs.done != nil {
+		close(rs.done)
+	}
+	return
+}
+
+// sweep recovers the instances left behind.
+func (rs *RecoverySweeper) sweep() {
+	cutoff := time.Now().Add(-rs.timeout)
+	instanceIds, err := rs.storage.GetExpiredLocks(time.Now())
+	if err != nil {
+		logger.ErrorF("Unable to fetch the expired locks: %v", err)
+	}
+	for _, instanceId := range instanceIds {
+		// The expired lock is taken over by the recovery
+		logger.InfoF("Recovering instance %s whose lock expired", instanceId)
+		rs.recover(instanceId, nil)
+	}
+	instanceIds, err = rs.storage.GetInstancesWithStepChangeEvents()
+	if err != nil {
+		logger.ErrorF("Unable to fetch the instances with step change events: %v", err)
+	}
+	for _, instanceId := range instanceIds {
+		rs.recover(instanceId, nil)
+	}
+	stepStates, err := rs.storage.GetRunningStepStates(cutoff)
+	if err != nil {
+		logger.ErrorF("Unable to fetch the running step states: %v", err)
+	}
+	for _, stepState := range stepStates {
+		if !stepState.NextRetryAt.IsZero() {
+			// The step waits for its retry timer
+			continue
+		}
+		rs.recover(stepState.InstanceId, stepState)
+	}
+}
+
+// recover recovers the instance while holding its lock. If the lock is held by someone else, the instance is not
+// abandoned and is left alone. The saved step change events of the instance are processed first, the recovery policy
+// of its workflow only applies to an instance without queued tasks and events.
+// If an abandoned step is given, it is only recovered if it is a local action that is still running.
+func (rs *RecoverySweeper) recover(instanceId string, abandoned *StepState) {
+	stepChangeHandler := &StepChangeHander{storage: rs.storage}
+	_, err := stepChangeHandler.runLocked(instanceId, func() (err error) {
+		var workflowState *WorkflowState
+		var workflow *models.Workflow
+		var options *WorkflowOptions
+		var stepStates map[string][]*StepState
+		var stepChangeEvents []*events.StepChangeEvent
+		var queued bool
+		workflowState, err = rs.storage.GetState(instanceId)
+		if err != nil || workflowState.Status != models.StatusRunning {
+			return
+		}
+		// The saved events move the instance on
+		stepChangeEvents, err = rs.storage.GetStepChangeEvents(instanceId)
+		if err != nil {
+			return
+		}
+		if len(stepChangeEvents) > 0 {
+			logger.InfoF("Processing the step change events left behind for instance %s", instanceId)
+			err = stepChangeHandler.processPending(instanceId)
+			return
+		}
+		// So do the tasks of the instance that are queued or run by a worker
+		queued, err = rs.storage.HasTasks(instanceId)
+		if err != nil || queued {
+			return
+		}
+		workflow, err = rs.storage.GetWorkflowByInstance(instanceId)
+		if err != nil {
+			return
+		}
+		options, err = rs.storage.GetWorkflowOptions(workflow.Id, workflow.Version)
+		if err != nil {
+			return
+		}
+		if abandoned != nil {
+			var step *models.Step
+			var stepState *StepState
+			step, stepState, err = rs.localAction(workflow, options, abandoned)
+			if err != nil || step == nil {
+				return
+			}
+			if options.Recovery == RecoveryFail {
+				logger.InfoF("Failing instance %s whose local action of step %s was abandoned", instanceId, step.Id)
+				err = NewWorkflowManager(rs.storage).stopLocked(instanceId, ReasonAbandoned, true)
+				return
+			}
+			err = rs.redriveAction(step, stepState)
+			return
+		}
+		stepStates, err = rs.storage.GetStepStates(instanceId)
+		if err != nil {
+			return
+		}
+		for _, stepStateArr := range stepStates {
+			for _, stepState := range stepStateArr {
+				step := options.findStep(workflow, stepState.StepId)
+				if stepState.Status == models.StatusRunning && step != nil && isLeaf(step.Type) {
+					// The instance continues once the step reports back
+					return
+				}
+			}
+		}
+		logger.InfoF("Continuing instance %s left behind by a crashed process", instanceId)
+		err = queueExecution(rs.storage, instanceId)
+		return
+	})
+	if err != nil {
+		logger.ErrorF("Unable to recover instance %s: %v", instanceId, err)
+	}
+}
+
+// localAction returns the step and the current state of the abandoned step if it is a local action that is still
+// running.
+func (rs *RecoverySweeper) localAction(workflow *models.Workflow, options *WorkflowOptions, abandoned *StepState) (step *models.Step, stepState *StepState, err error) {
+	var actionSpec *models.ActionSpec
+	stepState, err = rs.storage.GetStepState(abandoned.InstanceId, abandoned.StepId, abandoned.Iteration)
+	if err != nil || stepState == nil || stepState.Status != models.StatusRunning || !stepState.NextRetryAt.IsZero() {
+		return
+	}
+	candidate := options.findStep(workflow, abandoned.StepId)
+	if candidate == nil || candidate.Type != models.StepTypeAction || candidate.Action == nil {
+		return
+	}
+	actionSpec, err = rs.storage.ActionSpec(candidate.Action.Id)
+	if err != nil || actionSpec == nil || actionSpec.Endpoint == nil || actionSpec.Endpoint.Type != models.EndpointTypeLocal {
+		return
+	}
+	step = candidate
+	return
+}
+
+// redriveAction runs the abandoned local action again. Its result is handed over to the StepChangeHander.
+func (rs *RecoverySweeper) redriveAction(step *models.Step, stepState *StepState) (err error) {
+	var pipeline *data.Pipeline
+	logger.InfoF("Running the abandoned local action of step %s for instance %s again", stepState.StepId, stepState.InstanceId)
+	stepState.StartedAt = time.Now()
+	err = rs.storage.SaveStepState(stepState)
+	if err != nil {
+		return
+	}
+	pipeline = stepState.Input
+	if pipeline == nil {
+		var stored *VersionedPipeline
+		stored, err = rs.storage.GetPipeline(stepState.InstanceId)
+		if err != nil {
+			return
+		}
+		pipeline = cloneFor(stored.Pipeline, step, stepState.ParentStep)
+		pipeline.Set(data.StepIterationKey, stepState.Iteration)
+	}
+	err = NewActionExecutor(rs.storage).Execute(step, pipeline)
+	return
+}
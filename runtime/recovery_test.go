@@ -0,0 +1,125 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// newRecoveryInstance saves a running instance of a workflow failing the instances left behind, whose only step
+// calls a local action and is in the given state.
+func newRecoveryInstance(t *testing.T, status models.Status) Storage {
+	t.Helper()
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveAction(&models.ActionSpec{Id: "local", Name: "local", Endpoint: &models.Endpoint{Type: models.EndpointTypeLocal}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveWorkflow(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps:   []*models.Step{{Id: "step-1", Type: models.StepTypeAction, Action: &models.StepAction{Id: "local", Name: "local"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveWorkflowOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Recovery: RecoveryFail})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Status: status, StartedAt: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return storage
+}
+
+func TestRecoveryRedrivesExpiredLock(t *testing.T) {
+	// The process crashed after the step completed and before the instance continued
+	storage := newRecoveryInstance(t, models.StatusCompleted)
+	_, err := storage.LockInstance("instance-1", "crashed", -time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	NewRecoverySweeper(storage, time.Minute, time.Minute).sweep()
+	state, err := storage.GetState("instance-1")
+	if err != nil || state.Status != models.StatusRunning {
+		t.Fatalf("expected the instance to keep running, got %v %v", state, err)
+	}
+	queued, err := storage.HasTasks("instance-1")
+	if err != nil || !queued {
+		t.Errorf("expected the instance to be continued, got %v %v", queued, err)
+	}
+}
+
+func TestRecoveryRedrivesStepChangeEvents(t *testing.T) {
+	// The process crashed before it processed the completion of the step
+	storage := newRecoveryInstance(t, models.StatusRunning)
+	err := storage.SaveStepChangeEvent(&events.StepChangeEvent{
+		EventId:    "event-1",
+		InstanceId: "instance-1",
+		StepId:     "step-1",
+		Status:     models.StatusCompleted,
+		Data:       map[string]any{data.StepIterationKey: 0},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	NewRecoverySweeper(storage, time.Minute, time.Minute).sweep()
+	stepState, err := storage.GetStepState("instance-1", "step-1", 0)
+	if err != nil || stepState.Status != models.StatusCompleted {
+		t.Errorf("expected the event to be processed, got %v %v", stepState, err)
+	}
+	state, err := storage.GetState("instance-1")
+	if err != nil || state.Status == models.StatusFailed {
+		t.Errorf("expected the instance not to be failed, got %v %v", state, err)
+	}
+}
+
+func TestRecoveryAbandonedLocalAction(t *testing.T) {
+	t.Run("fail", func(t *testing.T) {
+		storage := newRecoveryInstance(t, models.StatusRunning)
+		NewRecoverySweeper(storage, time.Minute, time.Minute).sweep()
+		state, err := storage.GetState("instance-1")
+		if err != nil || state.Status != models.StatusFailed || state.Reason != ReasonAbandoned {
+			t.Errorf("expected the instance to be failed as abandoned, got %v %v", state, err)
+		}
+	})
+	t.Run("queued task", func(t *testing.T) {
+		// A worker still runs the action
+		storage := newRecoveryInstance(t, models.StatusRunning)
+		err := storage.AddTask(&Task{Id: "task-1", InstanceId: "instance-1", Type: TaskTypeExecute, LeaseUntil: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		NewRecoverySweeper(storage, time.Minute, time.Minute).sweep()
+		state, err := storage.GetState("instance-1")
+		if err != nil || state.Status != models.StatusRunning {
+			t.Errorf("expected the instance to be left alone, got %v %v", state, err)
+		}
+	})
+	t.Run("locked", func(t *testing.T) {
+		storage := newRecoveryInstance(t, models.StatusRunning)
+		_, err := storage.LockInstance("instance-1", "worker", time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		NewRecoverySweeper(storage, time.Minute, time.Minute).sweep()
+		state, err := storage.GetState("instance-1")
+		if err != nil || state.Status != models.StatusRunning {
+			t.Errorf("expected the instance to be left alone, got %v %v", state, err)
+		}
+	})
+}
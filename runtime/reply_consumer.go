@@ -0,0 +1,139 @@
+package runtime
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+
+	"oss.nandlabs.io/golly/codec"
+	"oss.nandlabs.io/golly/lifecycle"
+	"oss.nandlabs.io/golly/messaging"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+// DeadLetterReasonHeader is the header holding the reason an event was sent to the dead letter topic.
+const DeadLetterReasonHeader = "x-orcaloop-dead-letter-reason"
+
+// ReplyConsumer is a lifecycle component that listens on the reply topic for the StepChangeEvents
+// published by messaging actions. The events are correlated with the running step by instance, step and iteration
+// and dispatched to the StepChangeHander. Events that cannot be handled are sent to the dead letter topic.
+type ReplyConsumer struct {
+	*lifecycle.SimpleComponent
+	wfm             *WorkflowManager
+	manager         messaging.Manager
+	replyTopic      *url.URL
+	deadLetterTopic *url.URL
+	// The messaging manager cannot remove a listener. The listener is registered by the first start and detached
+	// from the consumer while it is stopped, so that restarting the consumer does not register a second one.
+	registered bool
+	listening  atomic.Bool
+}
+
+// NewReplyConsumer creates a new ReplyConsumer for the given messaging configuration.
+func NewReplyConsumer(storage Storage, c *config.MessagingConfig) (rc *ReplyConsumer, err error) {
+	rc = &ReplyConsumer{
+		wfm:     NewWorkflowManager(storage),
+		manager: messaging.GetManager(),
+	}
+	rc.replyTopic, err = url.Parse(c.ReplyTopic)
+	if err != nil {
+		err = fmt.Errorf("invalid reply topic %s: %w", c.ReplyTopic, err)
+		return
+	}
+	if c.DeadLetterTopic != "" {
+		rc.deadLetterTopic, err = url.Parse(c.DeadLetterTopic)
+		if err != nil {
+			err = fmt.Errorf("invalid dead letter topic %s: %w", c.DeadLetterTopic, err)
+			return
+		}
+	}
+	rc.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-reply-consumer",
+		StartFunc: rc.start,
+		StopFunc:  rc.stop,
+	}
+	return
+}
+
+func (rc *ReplyConsumer) start() (err error) {
+	if !rc.registered {
+		err = rc.manager.AddListener(rc.replyTopic, rc.onMessage)
+		if err != nil {
+			return
+		}
+		rc.registered = true
+	}
+	rc.listening.Store(true)
+	logger.InfoF("Listening for step change events on %s", rc.replyTopic)
+	return
+}
+
+// stop detaches the listener of the reply topic. The events it receives until the consumer restarts are dead lettered.
+func (rc *ReplyConsumer) stop() (err error) {
+	rc.listening.Store(false)
+	return
+}
+
+func (rc *ReplyConsumer) onMessage(msg messaging.Message) {
+	body := msg.ReadAsStr()
+	if !rc.listening.Load() {
+		rc.deadLetter(body, "the reply consumer is stopped")
+		return
+	}
+	stepChangeEvent := &events.StepChangeEvent{}
+	err := codec.JsonCodec().DecodeBytes([]byte(body), stepChangeEvent)
+	if err != nil {
+		rc.deadLetter(body, fmt.Sprintf("invalid step change event: %v", err))
+		return
+	}
+	logger.DebugF("Received StepChangeEvent %v", stepChangeEvent)
+	switch stepChangeEvent.Status {
+	case models.StatusCompleted, models.StatusFailed, models.StatusSkipped:
+	default:
+		rc.deadLetter(body, fmt.Sprintf("invalid status %s", stepChangeEvent.Status))
+		return
+	}
+	iteration := toIteration(stepChangeEvent.Data[data.StepIterationKey])
+	err = rc.wfm.CompleteStep(stepChangeEvent.InstanceId, stepChangeEvent.StepId, iteration, stepChangeEvent.Status, stepChangeEvent.Data)
+	if err != nil {
+		logger.ErrorF("Unable to handle StepChangeEvent for step %s of instance %s: %v", stepChangeEvent.StepId, stepChangeEvent.InstanceId, err)
+		rc.deadLetter(body, err.Error())
+	}
+}
+
+// deadLetter forwards the message body to the dead letter topic if one is configured.
+func (rc *ReplyConsumer) deadLetter(body, reason string) {
+	logger.WarnF("Dead lettering step change event: %s", reason)
+	if rc.deadLetterTopic == nil {
+		return
+	}
+	msg, err := rc.manager.NewMessage(rc.deadLetterTopic.Scheme)
+	if err == nil {
+		err = msg.SetStrHeader(DeadLetterReasonHeader, reason)
+	}
+	if err == nil {
+		_, err = msg.SetBodyStr(body)
+	}
+	if err == nil {
+		err = rc.manager.Send(rc.deadLetterTopic, msg)
+	}
+	if err != nil {
+		logger.ErrorF("Unable to send the event to the dead letter topic %s: %v", rc.deadLetterTopic, err)
+	}
+}
+
+// toIteration converts the iteration of a decoded StepChangeEvent to an int.
+func toIteration(v any) (iteration int) {
+	switch i := v.(type) {
+	case int:
+		iteration = i
+	case int64:
+		iteration = int(i)
+	case float64:
+		iteration = int(i)
+	}
+	return
+}
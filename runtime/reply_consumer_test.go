@@ -0,0 +1,232 @@
+package runtime
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/golly/codec"
+	"oss.nandlabs.io/golly/messaging"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+// waitFor polls the condition until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+// sendStr publishes the body to the topic of the in-process messaging provider.
+func sendStr(t *testing.T, topic, body string) {
+	t.Helper()
+	u, _ := url.Parse(topic)
+	manager := messaging.GetManager()
+	msg, err := manager.NewMessage(u.Scheme)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = msg.SetBodyStr(body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = manager.Send(u, msg)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestReplyConsumer(t *testing.T) {
+	// The listeners of the in-process provider outlive the test, each run uses its own topics
+	prefix := "chan://orcaloop-test/" + CreateId()
+	actionTopic := prefix + "/action"
+	replyTopic := prefix + "/replies"
+	deadLetterTopic := prefix + "/dead-letters"
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveAction(&models.ActionSpec{
+		Id:       "publish",
+		Name:     "publish",
+		Endpoint: &models.Endpoint{Type: models.EndpointTypeMessaging, Messaging: &models.MessagingEndpoint{Url: actionTopic}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	wfm := NewWorkflowManager(storage)
+	err = wfm.Save(&models.Workflow{
+		Id:      "reply-workflow",
+		Name:    "reply-workflow",
+		Version: 1,
+		Steps: []*models.Step{{
+			Id:     "step-1",
+			Type:   models.StepTypeAction,
+			Action: &models.StepAction{Id: "publish", Name: "publish"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	manager := messaging.GetManager()
+	actions := make(chan string, 1)
+	actionUrl, _ := url.Parse(actionTopic)
+	err = manager.AddListener(actionUrl, func(msg messaging.Message) { actions <- msg.ReadAsStr() })
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	deadLetters := make(chan string, 4)
+	deadLetterUrl, _ := url.Parse(deadLetterTopic)
+	err = manager.AddListener(deadLetterUrl, func(msg messaging.Message) {
+		reason, _ := msg.GetStrHeader(DeadLetterReasonHeader)
+		deadLetters <- reason
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rc, err := NewReplyConsumer(storage, &config.MessagingConfig{ReplyTopic: replyTopic, DeadLetterTopic: deadLetterTopic})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = rc.start()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer rc.stop()
+	wq := NewWorkQueue(storage, &config.WorkQueueConfig{Workers: 1, PollInterval: 10})
+	wq.start()
+	defer wq.stop()
+
+	instanceId, err := wfm.Start("reply-workflow", 1, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case <-actions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the action to be published")
+	}
+
+	// Messages that are no step change events are dead lettered
+	sendStr(t, replyTopic, "not a step change event")
+	select {
+	case <-deadLetters:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the invalid message to be dead lettered")
+	}
+	// Replies for steps that are not running are dead lettered
+	unknown, _ := codec.JsonCodec().EncodeToBytes(&events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: instanceId,
+		StepId:     "step-2",
+		Status:     models.StatusCompleted,
+		Data:       map[string]any{data.StepIterationKey: 0},
+	})
+	sendStr(t, replyTopic, string(unknown))
+	select {
+	case <-deadLetters:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the reply for an unknown step to be dead lettered")
+	}
+
+	reply, _ := codec.JsonCodec().EncodeToBytes(&events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: instanceId,
+		StepId:     "step-1",
+		Status:     models.StatusCompleted,
+		Data:       map[string]any{data.StepIterationKey: 0, "result": "done"},
+	})
+	sendStr(t, replyTopic, string(reply))
+	completed := waitFor(t, 5*time.Second, func() bool {
+		state, err := storage.GetState(instanceId)
+		return err == nil && state.Status == models.StatusCompleted
+	})
+	if !completed {
+		t.Fatal("expected the instance to complete once the step was replied to")
+	}
+	stepState, err := storage.GetStepState(instanceId, "step-1", 0)
+	if err != nil || stepState.Status != models.StatusCompleted {
+		t.Errorf("expected the step to be completed, got %v %v", stepState, err)
+	}
+	pipeline, err := storage.GetPipeline(instanceId)
+	if err != nil || !pipeline.Has("result") {
+		t.Errorf("expected the reply to be merged into the pipeline, got %v", err)
+	}
+}
+
+// unavailableStorage fails to read step states as if the database was down.
+type unavailableStorage struct {
+	Storage
+}
+
+func (us *unavailableStorage) GetStepState(instanceId, stepId string, iteration int) (*StepState, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+func TestReplyConsumerDeadLettersFailures(t *testing.T) {
+	prefix := "chan://orcaloop-test/" + CreateId()
+	replyTopic := prefix + "/replies"
+	deadLetterTopic := prefix + "/dead-letters"
+	deadLetters := make(chan string, 4)
+	deadLetterUrl, _ := url.Parse(deadLetterTopic)
+	err := messaging.GetManager().AddListener(deadLetterUrl, func(msg messaging.Message) {
+		reason, _ := msg.GetStrHeader(DeadLetterReasonHeader)
+		deadLetters <- reason
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectDeadLetter := func(reason string) {
+		t.Helper()
+		select {
+		case got := <-deadLetters:
+			if got != reason {
+				t.Errorf("expected the reason %q, got %q", reason, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the event to be dead lettered with %q", reason)
+		}
+	}
+	rc, err := NewReplyConsumer(&unavailableStorage{NewInMemoryStorage(nil)}, &config.MessagingConfig{ReplyTopic: replyTopic, DeadLetterTopic: deadLetterTopic})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = rc.start()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	reply, _ := codec.JsonCodec().EncodeToBytes(&events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: "instance-1",
+		StepId:     "step-1",
+		Status:     models.StatusCompleted,
+		Data:       map[string]any{data.StepIterationKey: 0},
+	})
+	// Failures that are not caused by the event itself are dead lettered as well
+	sendStr(t, replyTopic, string(reply))
+	expectDeadLetter("storage unavailable")
+
+	// A stopped consumer does not drop the events it still receives
+	err = rc.stop()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	sendStr(t, replyTopic, string(reply))
+	expectDeadLetter("the reply consumer is stopped")
+
+	// The restarted consumer handles the events again
+	err = rc.start()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer rc.stop()
+	sendStr(t, replyTopic, string(reply))
+	expectDeadLetter("storage unavailable")
+}
@@ -0,0 +1,152 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// BackoffType represents the strategy used to compute the delay between two attempts.
+type BackoffType string
+
+const (
+	// BackoffFixed waits for the same interval between all attempts.
+	BackoffFixed BackoffType = "fixed"
+	// BackoffExponential multiplies the interval with the multiplier after every attempt.
+	BackoffExponential BackoffType = "exponential"
+)
+
+// ErrorClass represents the class of error that caused an action to fail.
+type ErrorClass string
+
+const (
+	// ErrorClassNetwork is used when the action endpoint could not be reached.
+	ErrorClassNetwork ErrorClass = "network"
+	// ErrorClassServer is used when the action endpoint responded with a server error.
+	ErrorClassServer ErrorClass = "server"
+	// ErrorClassHandler is used when the local action handler returned an error.
+	ErrorClassHandler ErrorClass = "handler"
+	// ErrorClassAction is used when the action completed but reported an error in its response.
+	ErrorClassAction ErrorClass = "action"
+)
+
+// ActionError is returned when the invocation of an action fails.
+//
+// Fields:
+// - Class: The class of the error used to decide whether the action can be retried.
+// - Err: The underlying error.
+// - Data: The response of the action if the action reported the error itself.
+type ActionError struct {
+	Class ErrorClass
+	Err   error
+	Data  map[string]any
+}
+
+func (ae *ActionError) Error() string {
+	return fmt.Sprintf("%s error: %v", ae.Class, ae.Err)
+}
+
+func (ae *ActionError) Unwrap() error {
+	return ae.Err
+}
+
+// Attempt represents a failed attempt of an action step.
+//
+// Fields:
+// - Number: The number of the attempt starting from 1.
+// - Class: The class of the error that failed the attempt.
+// - Error: The error message.
+// - FailedAt: The time at which the attempt failed.
+type Attempt struct {
+	Number   int        `json:"number" yaml:"number"`
+	Class    ErrorClass `json:"class" yaml:"class"`
+	Error    string     `json:"error" yaml:"error"`
+	FailedAt time.Time  `json:"failed_at" yaml:"failed_at"`
+}
+
+// RetryPolicy represents the retry configuration of an action step.
+//
+// Fields:
+// - MaxAttempts: The maximum number of attempts including the first one.
+// - Backoff: The backoff strategy. Defaults to fixed.
+// - IntervalMs: The delay before the first retry in milliseconds.
+// - MaxIntervalMs: The upper bound of the delay in milliseconds. Zero means no upper bound.
+// - Multiplier: The multiplier applied to the interval for exponential backoff. Defaults to 2.
+// - Jitter: The fraction (0 to 1) by which the delay is randomly increased or decreased.
+// - RetryOn: The error classes that are retried. All error classes are retried if empty.
+type RetryPolicy struct {
+	MaxAttempts   int          `json:"max_attempts" yaml:"max_attempts"`
+	Backoff       BackoffType  `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	IntervalMs    int64        `json:"interval_ms,omitempty" yaml:"interval_ms,omitempty"`
+	MaxIntervalMs int64        `json:"max_interval_ms,omitempty" yaml:"max_interval_ms,omitempty"`
+	Multiplier    float64      `json:"multiplier,omitempty" yaml:"multiplier,omitempty"`
+	Jitter        float64      `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	RetryOn       []ErrorClass `json:"retry_on,omitempty" yaml:"retry_on,omitempty"`
+}
+
+// Validate checks the retry policy for invalid values.
+func (rp *RetryPolicy) Validate() (err error) {
+	switch {
+	case rp.MaxAttempts < 1:
+		err = errors.New("max_attempts must be at least 1")
+	case rp.Backoff != "" && rp.Backoff != BackoffFixed && rp.Backoff != BackoffExponential:
+		err = fmt.Errorf("unknown backoff %s", rp.Backoff)
+	case rp.IntervalMs < 0 || rp.MaxIntervalMs < 0:
+		err = errors.New("intervals must not be negative")
+	case rp.Jitter < 0 || rp.Jitter > 1:
+		err = errors.New("jitter must be between 0 and 1")
+	}
+	if err != nil {
+		return
+	}
+	for _, class := range rp.RetryOn {
+		switch class {
+		case ErrorClassNetwork, ErrorClassServer, ErrorClassHandler, ErrorClassAction:
+		default:
+			err = fmt.Errorf("unknown error class %s", class)
+			return
+		}
+	}
+	return
+}
+
+// ShouldRetry returns true if another attempt is allowed after the given number of failed attempts
+// and the error class is retryable. A nil policy never retries.
+func (rp *RetryPolicy) ShouldRetry(failedAttempts int, class ErrorClass) bool {
+	if rp == nil || failedAttempts >= rp.MaxAttempts {
+		return false
+	}
+	if len(rp.RetryOn) == 0 {
+		return true
+	}
+	for _, retryOn := range rp.RetryOn {
+		if retryOn == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the time to wait before the next attempt after the given number of failed attempts.
+func (rp *RetryPolicy) Delay(failedAttempts int) (delay time.Duration) {
+	delay = time.Duration(rp.IntervalMs) * time.Millisecond
+	if rp.Backoff == BackoffExponential && failedAttempts > 1 {
+		multiplier := rp.Multiplier
+		if multiplier <= 1 {
+			multiplier = 2
+		}
+		delay = time.Duration(float64(delay) * math.Pow(multiplier, float64(failedAttempts-1)))
+	}
+	if rp.MaxIntervalMs > 0 && delay > time.Duration(rp.MaxIntervalMs)*time.Millisecond {
+		delay = time.Duration(rp.MaxIntervalMs) * time.Millisecond
+	}
+	if rp.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * rp.Jitter * float64(delay))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyValidate(t *testing.T) {
+	tests := map[string]struct {
+		policy *RetryPolicy
+		valid  bool
+	}{
+		"minimal":             {policy: &RetryPolicy{MaxAttempts: 1}, valid: true},
+		"exponential":         {policy: &RetryPolicy{MaxAttempts: 3, Backoff: BackoffExponential, IntervalMs: 10, MaxIntervalMs: 100, Jitter: 0.5}, valid: true},
+		"retry on":            {policy: &RetryPolicy{MaxAttempts: 3, RetryOn: []ErrorClass{ErrorClassNetwork, ErrorClassServer}}, valid: true},
+		"no attempts":         {policy: &RetryPolicy{}},
+		"unknown backoff":     {policy: &RetryPolicy{MaxAttempts: 3, Backoff: "linear"}},
+		"negative interval":   {policy: &RetryPolicy{MaxAttempts: 3, IntervalMs: -1}},
+		"negative max":        {policy: &RetryPolicy{MaxAttempts: 3, MaxIntervalMs: -1}},
+		"negative jitter":     {policy: &RetryPolicy{MaxAttempts: 3, Jitter: -0.1}},
+		"jitter above one":    {policy: &RetryPolicy{MaxAttempts: 3, Jitter: 1.5}},
+		"unknown error class": {policy: &RetryPolicy{MaxAttempts: 3, RetryOn: []ErrorClass{"timeout"}}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected the policy to be invalid")
+			}
+		})
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	tests := map[string]struct {
+		policy         *RetryPolicy
+		failedAttempts int
+		class          ErrorClass
+		retry          bool
+	}{
+		"nil policy":             {failedAttempts: 1, class: ErrorClassNetwork},
+		"attempts left":          {policy: &RetryPolicy{MaxAttempts: 3}, failedAttempts: 2, class: ErrorClassNetwork, retry: true},
+		"attempts exhausted":     {policy: &RetryPolicy{MaxAttempts: 3}, failedAttempts: 3, class: ErrorClassNetwork},
+		"single attempt":         {policy: &RetryPolicy{MaxAttempts: 1}, failedAttempts: 1, class: ErrorClassServer},
+		"retryable class":        {policy: &RetryPolicy{MaxAttempts: 3, RetryOn: []ErrorClass{ErrorClassServer}}, failedAttempts: 1, class: ErrorClassServer, retry: true},
+		"non retryable class":    {policy: &RetryPolicy{MaxAttempts: 3, RetryOn: []ErrorClass{ErrorClassServer}}, failedAttempts: 1, class: ErrorClassAction},
+		"handler not retried on": {policy: &RetryPolicy{MaxAttempts: 3, RetryOn: []ErrorClass{ErrorClassNetwork}}, failedAttempts: 1, class: ErrorClassHandler},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			retry := tt.policy.ShouldRetry(tt.failedAttempts, tt.class)
+			if retry != tt.retry {
+				t.Errorf("expected retry %v, got %v", tt.retry, retry)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := map[string]struct {
+		policy         *RetryPolicy
+		failedAttempts int
+		delay          time.Duration
+	}{
+		"fixed":                        {policy: &RetryPolicy{IntervalMs: 100}, failedAttempts: 3, delay: 100 * time.Millisecond},
+		"exponential first retry":      {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100}, failedAttempts: 1, delay: 100 * time.Millisecond},
+		"exponential default":          {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100}, failedAttempts: 3, delay: 400 * time.Millisecond},
+		"exponential multiplier":       {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100, Multiplier: 3}, failedAttempts: 3, delay: 900 * time.Millisecond},
+		"multiplier below one":         {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100, Multiplier: 0.5}, failedAttempts: 2, delay: 200 * time.Millisecond},
+		"capped by max interval":       {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100, MaxIntervalMs: 250}, failedAttempts: 5, delay: 250 * time.Millisecond},
+		"below max interval":           {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100, MaxIntervalMs: 250}, failedAttempts: 2, delay: 200 * time.Millisecond},
+		"fixed capped by max interval": {policy: &RetryPolicy{IntervalMs: 500, MaxIntervalMs: 250}, failedAttempts: 1, delay: 250 * time.Millisecond},
+		"no interval":                  {policy: &RetryPolicy{Backoff: BackoffExponential}, failedAttempts: 3},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			delay := tt.policy.Delay(tt.failedAttempts)
+			if delay != tt.delay {
+				t.Errorf("expected delay %v, got %v", tt.delay, delay)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	tests := map[string]struct {
+		policy         *RetryPolicy
+		failedAttempts int
+		min            time.Duration
+		max            time.Duration
+	}{
+		"fixed":       {policy: &RetryPolicy{IntervalMs: 100, Jitter: 0.2}, failedAttempts: 1, min: 80 * time.Millisecond, max: 120 * time.Millisecond},
+		"exponential": {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100, Jitter: 0.5}, failedAttempts: 2, min: 100 * time.Millisecond, max: 300 * time.Millisecond},
+		"after cap":   {policy: &RetryPolicy{Backoff: BackoffExponential, IntervalMs: 100, MaxIntervalMs: 200, Jitter: 0.1}, failedAttempts: 5, min: 180 * time.Millisecond, max: 220 * time.Millisecond},
+		"full jitter": {policy: &RetryPolicy{IntervalMs: 100, Jitter: 1}, failedAttempts: 1, min: 0, max: 200 * time.Millisecond},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			varied := false
+			first := tt.policy.Delay(tt.failedAttempts)
+			for i := 0; i < 100; i++ {
+				delay := tt.policy.Delay(tt.failedAttempts)
+				if delay < tt.min || delay > tt.max {
+					t.Fatalf("expected the delay between %v and %v, got %v", tt.min, tt.max, delay)
+				}
+				if delay != first {
+					varied = true
+				}
+			}
+			if !varied {
+				t.Error("expected the jitter to vary the delay")
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package runtime
 
-import "oss.nandlabs.io/golly/uuid"
+import (
+	"oss.nandlabs.io/golly/uuid"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+)
 
 func CreateId() string {
 	uid, _ := uuid.V4()
@@ -9,3 +12,12 @@ func CreateId() string {
 	}
 	return uid.String()
 }
+
+// getIteration returns the iteration of the step the pipeline belongs to, defaulting to 0.
+func getIteration(pipeline *data.Pipeline) (iteration int) {
+	iteration, err := data.ExtractValue[int](pipeline, data.StepIterationKey)
+	if err != nil {
+		iteration = 0
+	}
+	return
+}
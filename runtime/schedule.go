@@ -0,0 +1,293 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"oss.nandlabs.io/golly/lifecycle"
+)
+
+const (
+	// DefaultSchedulePollInterval is the interval at which the Scheduler looks for due schedules.
+	DefaultSchedulePollInterval = time.Second
+	// maxCatchUpRuns is the maximum number of missed runs of a schedule that are caught up in one poll.
+	maxCatchUpRuns = 100
+)
+
+// OverlapPolicy decides what happens when a schedule is due while the instance of its previous run is still active.
+type OverlapPolicy string
+
+const (
+	// OverlapSkip skips the run.
+	OverlapSkip OverlapPolicy = "skip"
+	// OverlapQueue starts the run once the previous instance finished.
+	OverlapQueue OverlapPolicy = "queue"
+	// OverlapAllow starts the run right away.
+	OverlapAllow OverlapPolicy = "allow"
+)
+
+// Schedule starts a workflow periodically, either on a cron expression or at a fixed interval.
+//
+// Fields:
+// - Id: The unique identifier of the schedule.
+// - WorkflowId: The unique identifier of the workflow to start.
+// - WorkflowVersion: The version of the workflow. Zero starts the latest version.
+// - Cron: The cron expression of the schedule. Descriptors such as @daily and @every 1h are supported.
+// - IntervalMs: The interval in milliseconds between two runs, used instead of a cron expression.
+// - Timezone: The IANA time zone the cron expression is evaluated in. Defaults to UTC.
+// - Input: The input of the started instances.
+// - Overlap: The policy applied when the previous instance is still active. Defaults to skip.
+// - CatchUp: Starts the runs missed while the service was down instead of only the latest one.
+// - Paused: No runs are started while the schedule is paused.
+// - NextRunAt: The time of the next run.
+// - LastRunAt: The time of the last run.
+// - LastInstanceId: The instance started by the last run.
+// - Queued: The number of runs waiting for the previous instance to finish.
+// - Version: The version of the schedule, bumped by every save. Version 0 replaces the stored schedule.
+type Schedule struct {
+	Id              string         `json:"id" yaml:"id"`
+	WorkflowId      string         `json:"workflow_id" yaml:"workflow_id"`
+	WorkflowVersion int            `json:"workflow_version,omitempty" yaml:"workflow_version,omitempty"`
+	Cron            string         `json:"cron,omitempty" yaml:"cron,omitempty"`
+	IntervalMs      int64          `json:"interval_ms,omitempty" yaml:"interval_ms,omitempty"`
+	Timezone        string         `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	Input           map[string]any `json:"input,omitempty" yaml:"input,omitempty"`
+	Overlap         OverlapPolicy  `json:"overlap,omitempty" yaml:"overlap,omitempty"`
+	CatchUp         bool           `json:"catch_up,omitempty" yaml:"catch_up,omitempty"`
+	Paused          bool           `json:"paused,omitempty" yaml:"paused,omitempty"`
+	NextRunAt       time.Time      `json:"next_run_at" yaml:"next_run_at"`
+	LastRunAt       time.Time      `json:"last_run_at,omitempty" yaml:"last_run_at,omitempty"`
+	LastInstanceId  string         `json:"last_instance_id,omitempty" yaml:"last_instance_id,omitempty"`
+	Queued          int            `json:"queued,omitempty" yaml:"queued,omitempty"`
+	Version         int            `json:"version" yaml:"version"`
+}
+
+// Validate checks the schedule for missing or invalid values.
+func (s *Schedule) Validate() (err error) {
+	switch {
+	case s.WorkflowId == "":
+		err = errors.New("workflow_id is required")
+	case s.WorkflowVersion < 0:
+		err = errors.New("workflow_version must not be negative")
+	case s.Cron == "" && s.IntervalMs <= 0:
+		err = errors.New("either cron or a positive interval_ms is required")
+	case s.Cron != "" && s.IntervalMs != 0:
+		err = errors.New("only one of cron and interval_ms is allowed")
+	case s.Overlap != "" && s.Overlap != OverlapSkip && s.Overlap != OverlapQueue && s.Overlap != OverlapAllow:
+		err = fmt.Errorf("unknown overlap policy %s", s.Overlap)
+	}
+	if err != nil {
+		return
+	}
+	// Compute a run to check the cron expression and the time zone
+	_, err = s.Next(time.Now())
+	return
+}
+
+// Next returns the time of the first run after the given time.
+func (s *Schedule) Next(after time.Time) (next time.Time, err error) {
+	if s.Cron == "" {
+		next = after.Add(time.Duration(s.IntervalMs) * time.Millisecond)
+		return
+	}
+	var location *time.Location = time.UTC
+	var schedule cron.Schedule
+	if s.Timezone != "" {
+		location, err = time.LoadLocation(s.Timezone)
+		if err != nil {
+			err = fmt.Errorf("invalid timezone %s: %w", s.Timezone, err)
+			return
+		}
+	}
+	schedule, err = cron.ParseStandard(s.Cron)
+	if err != nil {
+		err = fmt.Errorf("invalid cron expression %s: %w", s.Cron, err)
+		return
+	}
+	next = schedule.Next(after.In(location))
+	return
+}
+
+// Scheduler is a lifecycle component that starts the instances of the schedules stored in the Storage once they are due.
+// The replicas sharing the Storage claim a due schedule before starting its runs, each run is started by one of them.
+type Scheduler struct {
+	*lifecycle.SimpleComponent
+	storage  Storage
+	interval time.Duration
+	done     chan struct{}
+}
+
+// NewScheduler creates a new Scheduler polling the storage at the given interval.
+func NewScheduler(storage Storage, interval time.Duration) *Scheduler {
+	s := &Scheduler{
+		storage:  storage,
+		interval: interval,
+	}
+	s.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-scheduler",
+		StartFunc: s.start,
+		StopFunc:  s.stop,
+	}
+	return s
+}
+
+func (s *Scheduler) start() (err error) {
+	s.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.runDue()
+			}
+		}
+	}()
+	return
+}
+
+func (s *Scheduler) stop() (err error) {
+	if s.done != nil {
+		close(s.done)
+	}
+	return
+}
+
+func (s *Scheduler) runDue() {
+	now := time.Now()
+	schedules, err := s.storage.GetDueSchedules(now)
+	if err != nil {
+		logger.ErrorF("Unable to fetch the due schedules: %v", err)
+		return
+	}
+	for _, schedule := range schedules {
+		// The runs are started along with the claim of the schedule
+		err = s.storage.WithTx(func(tx Storage) error {
+			return s.run(tx, schedule, now)
+		})
+		if IsVersionConflict(err) {
+			logger.DebugF("Schedule %s was claimed by another replica", schedule.Id)
+			continue
+		}
+		if err != nil {
+			logger.ErrorF("Schedule %s of workflow %s failed: %v", schedule.Id, schedule.WorkflowId, err)
+		}
+	}
+}
+
+// run starts the due and queued runs of the schedule as per its overlap policy and moves it to the next run.
+// The schedule is claimed first by saving it with the version it was read with, it fails with ErrVersionConflict if
+// the schedule was run or changed in the meantime.
+// An error starting a run is returned so that the claim is rolled back and no run is lost.
+func (s *Scheduler) run(tx Storage, schedule *Schedule, now time.Time) (err error) {
+	var runs int
+	if !schedule.Paused && !schedule.NextRunAt.After(now) {
+		runs, err = s.missedRuns(schedule, now)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.SaveSchedule(schedule)
+	if err != nil {
+		return
+	}
+	var active bool
+	for ; runs > 0 || schedule.Queued > 0; runs-- {
+		active, err = s.isLastRunActive(tx, schedule)
+		if err != nil {
+			return
+		}
+		if runs <= 0 {
+			// Only queued runs are left
+			if active || schedule.Paused {
+				break
+			}
+			schedule.Queued--
+		} else if active {
+			switch schedule.Overlap {
+			case OverlapQueue:
+				schedule.Queued++
+				continue
+			case OverlapAllow:
+			default:
+				logger.InfoF("Skipping run of schedule %s as instance %s is still active", schedule.Id, schedule.LastInstanceId)
+				continue
+			}
+		}
+		err = s.startRun(tx, schedule, now)
+		if err != nil {
+			// The claim is rolled back along with the runs started so far, the schedule runs again on the next poll
+			return
+		}
+	}
+	err = tx.SaveSchedule(schedule)
+	return
+}
+
+// missedRuns returns the number of runs due until now and moves the schedule to the next run after now.
+// Without catch up, the missed runs are collapsed into a single run.
+func (s *Scheduler) missedRuns(schedule *Schedule, now time.Time) (runs int, err error) {
+	next := schedule.NextRunAt
+	for !next.After(now) {
+		runs++
+		next, err = schedule.Next(next)
+		if err != nil {
+			return
+		}
+		if runs == maxCatchUpRuns {
+			// Skip the remaining missed runs
+			next, err = schedule.Next(now)
+			if err != nil {
+				return
+			}
+		}
+	}
+	schedule.NextRunAt = next
+	if !schedule.CatchUp && runs > 1 {
+		logger.InfoF("Schedule %s missed %d runs, starting only the latest one", schedule.Id, runs-1)
+		runs = 1
+	}
+	return
+}
+
+func (s *Scheduler) isLastRunActive(tx Storage, schedule *Schedule) (active bool, err error) {
+	var workflowState *WorkflowState
+	if schedule.LastInstanceId == "" {
+		return
+	}
+	workflowState, err = tx.GetState(schedule.LastInstanceId)
+	if err != nil {
+		if IsWorkflowStateNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	active = workflowState.IsActive()
+	return
+}
+
+func (s *Scheduler) startRun(tx Storage, schedule *Schedule, now time.Time) (err error) {
+	var instanceId string
+	version := schedule.WorkflowVersion
+	if version == 0 {
+		version, err = latestVersion(tx, schedule.WorkflowId)
+		if err != nil {
+			return
+		}
+	}
+	input := make(map[string]any)
+	for k, v := range schedule.Input {
+		input[k] = v
+	}
+	logger.InfoF("Schedule %s starts workflow %s version %d", schedule.Id, schedule.WorkflowId, version)
+	schedule.LastRunAt = now
+	instanceId, err = NewWorkflowManager(tx).Start(schedule.WorkflowId, version, input)
+	if instanceId != "" {
+		schedule.LastInstanceId = instanceId
+	}
+	return
+}
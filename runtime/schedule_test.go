@@ -0,0 +1,94 @@
+package runtime
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestSchedulerClaimsSchedule(t *testing.T) {
+	storages := map[string]Storage{
+		"inmemory": NewInMemoryStorage(nil),
+		"sqlite":   newSQLiteStorage(t, filepath.Join(t.TempDir(), "orcaloop.db")),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			err := storage.SaveWorkflow(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			now := time.Now()
+			err = storage.SaveSchedule(&Schedule{Id: "schedule-1", WorkflowId: "workflow-1", IntervalMs: time.Hour.Milliseconds(), Overlap: OverlapAllow, NextRunAt: now.Add(-time.Minute)})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			// Both replicas read the due schedule before either of them runs it
+			first, _ := storage.GetDueSchedules(now)
+			second, _ := storage.GetDueSchedules(now)
+			if len(first) != 1 || len(second) != 1 {
+				t.Fatalf("expected the schedule to be due, got %d %d", len(first), len(second))
+			}
+			replica1, replica2 := NewScheduler(storage, time.Second), NewScheduler(storage, time.Second)
+			err = storage.WithTx(func(tx Storage) error { return replica1.run(tx, first[0], now) })
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			err = storage.WithTx(func(tx Storage) error { return replica2.run(tx, second[0], now) })
+			if !IsVersionConflict(err) {
+				t.Fatalf("expected the second replica to lose the claim, got %v", err)
+			}
+			schedule, err := storage.GetSchedule("schedule-1")
+			if err != nil || schedule.LastInstanceId == "" || !schedule.NextRunAt.After(now) {
+				t.Fatalf("expected the schedule to be run once, got %v %v", schedule, err)
+			}
+			tasks, err := storage.LeaseTasks("owner-1", 10, time.Minute)
+			if err != nil || len(tasks) != 1 || tasks[0].InstanceId != schedule.LastInstanceId {
+				t.Errorf("expected only the instance of the winning replica to be started, got %v %v", tasks, err)
+			}
+		})
+	}
+}
+
+func TestSchedulerRollsBackFailedRun(t *testing.T) {
+	storages := map[string]Storage{
+		"inmemory": NewInMemoryStorage(nil),
+		"sqlite":   newSQLiteStorage(t, filepath.Join(t.TempDir(), "orcaloop.db")),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			err := storage.SaveWorkflow(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			now := time.Now()
+			due := now.Add(-time.Minute)
+			// The version of the workflow does not exist, the run cannot be started
+			err = storage.SaveSchedule(&Schedule{Id: "schedule-1", WorkflowId: "workflow-1", WorkflowVersion: 2, IntervalMs: time.Hour.Milliseconds(), NextRunAt: due})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			schedules, err := storage.GetDueSchedules(now)
+			if err != nil || len(schedules) != 1 {
+				t.Fatalf("expected the schedule to be due, got %v %v", schedules, err)
+			}
+			scheduler := NewScheduler(storage, time.Second)
+			err = storage.WithTx(func(tx Storage) error { return scheduler.run(tx, schedules[0], now) })
+			if err == nil {
+				t.Fatal("expected the run to fail")
+			}
+			schedule, err := storage.GetSchedule("schedule-1")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if schedule.NextRunAt.After(now) || !schedule.LastRunAt.IsZero() {
+				t.Errorf("expected the claim to be rolled back, got next run %v last run %v", schedule.NextRunAt, schedule.LastRunAt)
+			}
+			schedules, err = storage.GetDueSchedules(now)
+			if err != nil || len(schedules) != 1 {
+				t.Errorf("expected the schedule to be due again, got %v %v", schedules, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package runtime
+
+import (
+	"errors"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// WaitSignal holds the configuration of a step of type StepTypeWait.
+// The step keeps running until the signal is received. The TimeoutMs of the step options bounds the wait.
+//
+// Fields:
+// - Signal: The name of the signal the step waits for.
+// - Variable: The pipeline variable the payload of the signal is stored in. The payload is merged into the pipeline if empty.
+type WaitSignal struct {
+	Signal   string `json:"signal" yaml:"signal"`
+	Variable string `json:"variable,omitempty" yaml:"variable,omitempty"`
+}
+
+// Signal represents an external event delivered to a workflow instance.
+// Signals are buffered in the Storage until a step waits for them.
+//
+// Fields:
+// - Id: The unique identifier of the signal.
+// - InstanceId: The unique identifier of the instance.
+// - Name: The name of the signal.
+// - Payload: The data of the signal.
+// - ReceivedAt: The time at which the signal was received.
+type Signal struct {
+	Id         string         `json:"id" yaml:"id"`
+	InstanceId string         `json:"instance_id" yaml:"instance_id"`
+	Name       string         `json:"name" yaml:"name"`
+	Payload    map[string]any `json:"payload,omitempty" yaml:"payload,omitempty"`
+	ReceivedAt time.Time      `json:"received_at" yaml:"received_at"`
+}
+
+// Validate checks the wait configuration for missing values.
+func (ws *WaitSignal) Validate() (err error) {
+	if ws.Signal == "" {
+		err = errors.New("signal is required")
+	}
+	return
+}
+
+// event creates the StepChangeEvent that completes the waiting step with the payload of the signal.
+func (ws *WaitSignal) event(stepState *StepState, signal *Signal) *events.StepChangeEvent {
+	eventData := make(map[string]any)
+	if ws.Variable != "" {
+		eventData[ws.Variable] = signal.Payload
+	} else {
+		for k, v := range signal.Payload {
+			eventData[k] = v
+		}
+	}
+	eventData[data.StepIterationKey] = stepState.Iteration
+	return &events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: stepState.InstanceId,
+		StepId:     stepState.StepId,
+		Status:     models.StatusCompleted,
+		Data:       eventData,
+	}
+}
+
+// startWait completes the wait step right away if its signal was received before the step started.
+func startWait(storage Storage, stepState *StepState) (err error) {
+	var stepOptions *StepOptions
+	var signals []*Signal
+	stepOptions, err = getStepOptions(storage, stepState.InstanceId, stepState.StepId)
+	if err != nil {
+		return
+	}
+	if stepOptions == nil || stepOptions.Wait == nil {
+		err = errors.New("no signal configured for step " + stepState.StepId)
+		return
+	}
+	signals, err = storage.GetSignals(stepState.InstanceId)
+	if err != nil {
+		return
+	}
+	for _, signal := range signals {
+		if signal.Name != stepOptions.Wait.Signal {
+			continue
+		}
+		logger.InfoF("Step %s of instance %s received the buffered signal %s", stepState.StepId, stepState.InstanceId, signal.Name)
+		err = storage.DeleteSignal(signal.InstanceId, signal.Id)
+		if err != nil {
+			return
+		}
+		stepChangeHandler := &StepChangeHander{storage: storage}
+		err = stepChangeHandler.Handle(stepOptions.Wait.event(stepState, signal))
+		return
+	}
+	logger.InfoF("Step %s of instance %s is waiting for signal %s", stepState.StepId, stepState.InstanceId, stepOptions.Wait.Signal)
+	return
+}
+
+// deliverSignal completes a running wait step with the oldest buffered signal it waits for.
+// It must be called while holding the lock of the instance and returns false if no signal was delivered.
+func (sh *StepChangeHander) deliverSignal(instanceId string) (delivered bool, err error) {
+	var signals []*Signal
+	var workflowState *WorkflowState
+	var workflow *models.Workflow
+	var workflowOptions *WorkflowOptions
+	var stepStates map[string][]*StepState
+	signals, err = sh.storage.GetSignals(instanceId)
+	if err != nil || len(signals) == 0 {
+		return
+	}
+	workflowState, err = sh.storage.GetState(instanceId)
+	if err != nil || !workflowState.IsActive() {
+		return
+	}
+	workflow, err = sh.storage.GetWorkflowByInstance(instanceId)
+	if err != nil {
+		return
+	}
+	workflowOptions, err = sh.storage.GetWorkflowOptions(workflowState.WorkflowId, workflowState.WorkflowVersion)
+	if err != nil {
+		return
+	}
+	stepStates, err = sh.storage.GetStepStates(instanceId)
+	if err != nil {
+		return
+	}
+	for _, signal := range signals {
+		for _, stepStateArr := range stepStates {
+			for _, stepState := range stepStateArr {
+				if stepState.Status != models.StatusRunning {
+					continue
+				}
+				step := workflowOptions.findStep(workflow, stepState.StepId)
+				wait := workflowOptions.Step(stepState.StepId)
+				if step == nil || step.Type != StepTypeWait || wait == nil || wait.Wait == nil || wait.Wait.Signal != signal.Name {
+					continue
+				}
+				logger.InfoF("Delivering signal %s to step %s of instance %s", signal.Name, stepState.StepId, instanceId)
+				delivered = true
+				err = sh.processStepChange(wait.Wait.event(stepState, signal), func(tx Storage) error {
+					return tx.DeleteSignal(instanceId, signal.Id)
+				})
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package runtime
+
+import (
+	"testing"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// newSignalInstance starts an instance of a workflow that waits for the signal first and then for the signal second.
+func newSignalInstance(t *testing.T, storage Storage) (wfm *WorkflowManager, instanceId string) {
+	t.Helper()
+	wfm = NewWorkflowManager(storage)
+	err := wfm.Save(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps:   []*models.Step{{Id: "wait-1", Type: StepTypeWait}, {Id: "wait-2", Type: StepTypeWait}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "workflow-1", WorkflowVersion: 1, Steps: map[string]*StepOptions{
+		"wait-1": {Wait: &WaitSignal{Signal: "first"}},
+		"wait-2": {Wait: &WaitSignal{Signal: "second", Variable: "second"}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	instanceId, err = wfm.Start("workflow-1", 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	return
+}
+
+func TestSignalAfterWait(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	wfm, instanceId := newSignalInstance(t, storage)
+	stepState, err := storage.GetStepState(instanceId, "wait-1", 0)
+	if err != nil || stepState.Status != models.StatusRunning {
+		t.Fatalf("expected the step to wait for the signal, got %v %v", stepState, err)
+	}
+	err = wfm.Signal(instanceId, "first", map[string]any{"first": "payload"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	stepState, err = storage.GetStepState(instanceId, "wait-1", 0)
+	if err != nil || stepState.Status != models.StatusCompleted {
+		t.Errorf("expected the signal to complete the step, got %v %v", stepState, err)
+	}
+	pipeline, err := storage.GetPipeline(instanceId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if first, _ := pipeline.Get("first"); first != "payload" {
+		t.Errorf("expected the payload to be merged into the pipeline, got %v", first)
+	}
+	stepState, err = storage.GetStepState(instanceId, "wait-2", 0)
+	if err != nil || stepState.Status != models.StatusRunning {
+		t.Errorf("expected the next step to wait for its signal, got %v %v", stepState, err)
+	}
+	signals, err := storage.GetSignals(instanceId)
+	if err != nil || len(signals) != 0 {
+		t.Errorf("expected the delivered signal to be deleted, got %v %v", signals, err)
+	}
+}
+
+func TestSignalBeforeWait(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	wfm, instanceId := newSignalInstance(t, storage)
+	// The second signal arrives while the instance still waits for the first one
+	err := wfm.Signal(instanceId, "second", map[string]any{"value": "payload"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	stepState, err := storage.GetStepState(instanceId, "wait-1", 0)
+	if err != nil || stepState.Status != models.StatusRunning {
+		t.Errorf("expected the step to keep waiting for its own signal, got %v %v", stepState, err)
+	}
+	signals, err := storage.GetSignals(instanceId)
+	if err != nil || len(signals) != 1 {
+		t.Fatalf("expected the signal to be buffered, got %v %v", signals, err)
+	}
+	err = wfm.Signal(instanceId, "first", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	workflowState, err := storage.GetState(instanceId)
+	if err != nil || workflowState.Status != models.StatusCompleted {
+		t.Fatalf("expected the buffered signal to complete the instance, got %v %v", workflowState, err)
+	}
+	pipeline, err := storage.GetPipeline(instanceId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	second, _ := pipeline.Get("second")
+	if payload, ok := second.(map[string]any); !ok || payload["value"] != "payload" {
+		t.Errorf("expected the payload to be stored in the variable of the step, got %v", second)
+	}
+	signals, err = storage.GetSignals(instanceId)
+	if err != nil || len(signals) != 0 {
+		t.Errorf("expected the delivered signals to be deleted, got %v %v", signals, err)
+	}
+	// The completed instance does not take signals anymore
+	err = wfm.Signal(instanceId, "first", nil)
+	if !IsInvalidInstanceState(err) {
+		t.Errorf("expected the signal to be rejected, got %v", err)
+	}
+}
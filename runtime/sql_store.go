@@ -0,0 +1,1822 @@
+package runtime
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"oss.nandlabs.io/golly/codec"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+// sqlPlaceholder matches the $N placeholders of the queries of the SQLStorage.
+var sqlPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// sqlDialect holds what differs between the databases of a SQLStorage. The queries are written for Postgres and
+// rewritten by the dialect of the other databases.
+//
+// Fields:
+//   - storageType: The type of the storage returned by Config.
+//   - placeholder: The prefix of the numbered placeholders replacing the $ of the queries, e.g. ? for ?1.
+//   - utcTimes: Whether the times are stored in UTC, e.g. because they are compared as text.
+//   - lockClause: The clause locking the tasks selected to be leased.
+//   - insertOrder: The ordering of the rows created at the same time in the order they were inserted.
+type sqlDialect struct {
+	storageType string
+	placeholder string
+	utcTimes    bool
+	lockClause  string
+	insertOrder string
+}
+
+// rebind replaces the $N placeholders of the query with the placeholders of the dialect.
+func (d *sqlDialect) rebind(query string) string {
+	if d.placeholder == "$" {
+		return query
+	}
+	return sqlPlaceholder.ReplaceAllString(query, d.placeholder+"${1}")
+}
+
+// encodeTime returns the time passed to the queries of the dialect.
+func (d *sqlDialect) encodeTime(t time.Time) time.Time {
+	if d.utcTimes {
+		return t.UTC()
+	}
+	return t
+}
+
+// SQLStorage is a Storage keeping its data in a database/sql database. The PostgresStorage and the SQLiteStorage
+// share it with their own dialect.
+type SQLStorage struct {
+	Database *sql.DB
+	dialect  *sqlDialect
+	tx       *sql.Tx // the transaction of the Storage passed to WithTx
+}
+
+// Implementation of the Storage interface methods
+func (s *SQLStorage) ActionSpec(id string) (actionSpec *models.ActionSpec, err error) {
+	query := `SELECT id, name, description, endpoint FROM actions WHERE id = $1 AND is_deleted = $2`
+	sqlStatement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch action spec: %v", err)
+		err = errors.New("error preparing statement to fetch action spec")
+		return
+	}
+	defer sqlStatement.Close()
+	row := sqlStatement.QueryRow(id, false)
+	actionSpec = &models.ActionSpec{}
+	var endpointJSON []byte
+	err = row.Scan(&actionSpec.Id, &actionSpec.Name, &actionSpec.Description, &endpointJSON)
+	if err != nil {
+		logger.Error("Error scanning action spec: %v", err)
+		err = errors.New("error scanning action spec")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(endpointJSON, &actionSpec.Endpoint)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling action spec endpoint: %v", err)
+		err = errors.New("error unmarshalling action spec endpoint")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) ActionSpecs() (actionSpecs []*models.ActionSpec, err error) {
+	query := `SELECT id, name, description, endpoint FROM actions WHERE is_deleted = $1`
+	actionSpecs, err = s.queryActionSpecs(query, false)
+	return
+}
+
+func (s *SQLStorage) AddPendingSteps(instanceId string, pendingStep ...*PendingStep) (err error) {
+	query := `INSERT INTO pending_steps (id, instance_id, step_id, data) VALUES ($1, $2, $3, $4)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to add pending step: %v", err)
+		err = errors.New("error preparing statement to add pending step")
+		return
+	}
+	defer statement.Close()
+	for _, step := range pendingStep {
+		var pendingStepJSON []byte
+		pendingStepJSON, err = codec.JsonCodec().EncodeToBytes(step)
+		if err != nil {
+			logger.ErrorF("Error marshalling pending step: %v", err)
+			err = errors.New("error marshalling pending step")
+			return
+		}
+		_, err = statement.Exec(step.Id, instanceId, step.StepId, pendingStepJSON)
+		if err != nil {
+			logger.ErrorF("Error executing query: %v", err)
+			err = errors.New("error adding pending step/s")
+			return
+		}
+	}
+	return
+}
+
+func (s *SQLStorage) AddTask(task *Task) (err error) {
+	query := `INSERT INTO tasks (id, instance_id, task_type, event, attempts, lease_until, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to add task: %v", err)
+		err = errors.New("error preparing statement to add task")
+		return
+	}
+	defer statement.Close()
+	var eventJSON []byte
+	if task.Event != nil {
+		eventJSON, err = codec.JsonCodec().EncodeToBytes(task.Event)
+		if err != nil {
+			logger.ErrorF("Error marshalling task event: %v", err)
+			err = errors.New("error marshalling task event")
+			return
+		}
+	}
+	_, err = statement.Exec(task.Id, task.InstanceId, string(task.Type), eventJSON, task.Attempts, s.dialect.encodeTime(task.LeaseUntil), s.dialect.encodeTime(task.CreatedAt))
+	if err != nil {
+		logger.ErrorF("Error executing query to add task: %v", err)
+		err = errors.New("error adding task")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) AddTimer(timer *Timer) (err error) {
+	query := `INSERT INTO timers (id, instance_id, step_id, iteration, timer_type, fire_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to add timer: %v", err)
+		err = errors.New("error preparing statement to add timer")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(timer.Id, timer.InstanceId, timer.StepId, timer.Iteration, string(timer.Type), s.dialect.encodeTime(timer.FireAt))
+	if err != nil {
+		logger.ErrorF("Error executing query to add timer: %v", err)
+		err = errors.New("error adding timer")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) AddTriggerMessage(triggerID, messageID string) (added bool, err error) {
+	query := `INSERT INTO trigger_messages (trigger_id, message_id, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to add trigger message: %v", err)
+		err = errors.New("error preparing statement to add trigger message")
+		return
+	}
+	defer statement.Close()
+	result, err := statement.Exec(triggerID, messageID, s.dialect.encodeTime(time.Now()))
+	if err != nil {
+		logger.ErrorF("Error executing query to add trigger message: %v", err)
+		err = errors.New("error adding trigger message")
+		return
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error fetching the affected rows of the trigger message: %v", err)
+		err = errors.New("error adding trigger message")
+		return
+	}
+	added = rows > 0
+	return
+}
+
+func (s *SQLStorage) ActionEndpoint(id string) (endpoint *models.Endpoint, err error) {
+	query := `SELECT endpoint FROM actions WHERE id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch action endpoint: %v", err)
+		err = errors.New("error preparing statement to fetch action endpoint")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(id)
+	var endpointJSON []byte
+	err = row.Scan(&endpointJSON)
+	if err != nil {
+		logger.ErrorF("Error scanning row for action endpoint: %v", err)
+		err = errors.New("error scanning action endpoint")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(endpointJSON, &endpoint)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling endpoint: %v", err)
+		err = errors.New("error unmarshalling action endpoint")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) ArchiveInstance(workflowID string, archiveInstance bool) error {
+	// to be implemented
+	return nil
+}
+
+func (s *SQLStorage) CreateNewInstance(workflowID string, instanceID string, pipeline *data.Pipeline) (err error) {
+	query := `INSERT INTO workflow_data (instance_id, workflow_id, workflow_version, pipeline_data, pipeline_version) VALUES ($1, $2, $3, $4, 1)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to create a new instance: %v", err)
+		err = errors.New("error preparing statement to create a new instance")
+		return
+	}
+	defer statement.Close()
+	mappedData := pipeline.Map()
+	pipelineJSON, err := codec.JsonCodec().EncodeToBytes(mappedData)
+	if err != nil {
+		logger.ErrorF("Error marshalling pipeline data: %v", err)
+		err = errors.New("error marshalling pipeline data")
+		return
+	}
+	logger.InfoF("Creating new instance with ID: %s, Workflow ID: %s, Version: %d", instanceID, workflowID, pipeline.GetWorkflowVersion())
+	_, err = statement.Exec(instanceID, workflowID, pipeline.GetWorkflowVersion(), pipelineJSON)
+	if err != nil {
+		logger.ErrorF("Error executing query to create new instance: %v", err)
+		err = errors.New("error creating new instance")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteAction(id string) (err error) {
+	query := `UPDATE actions set is_deleted = $1 WHERE id = $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete action: %v", err)
+		err = errors.New("error preparing statement to delete action")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(true, id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete action: %v", err)
+		err = errors.New("error deleting action")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeletePendingStep(instanceID string, pendingStep *PendingStep) (err error) {
+	query := `Delete from pending_steps WHERE id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete pending step: %v", err)
+		err = errors.New("error preparing statement to delete pending step")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(pendingStep.Id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete pending step: %v", err)
+		err = errors.New("error deleting pending step")
+		return
+	}
+	return nil
+}
+
+func (s *SQLStorage) DeleteSchedule(id string) (err error) {
+	query := `DELETE FROM schedules WHERE id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete schedule: %v", err)
+		err = errors.New("error preparing statement to delete schedule")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete schedule: %v", err)
+		err = errors.New("error deleting schedule")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteSignal(instanceID, id string) (err error) {
+	query := `DELETE FROM signals WHERE instance_id = $1 AND id = $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete signal: %v", err)
+		err = errors.New("error preparing statement to delete signal")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(instanceID, id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete signal: %v", err)
+		err = errors.New("error deleting signal")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteTrigger(id string) (err error) {
+	query := `DELETE FROM triggers WHERE id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete trigger: %v", err)
+		err = errors.New("error preparing statement to delete trigger")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete trigger: %v", err)
+		err = errors.New("error deleting trigger")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteTask(id, owner string) (err error) {
+	query := `DELETE FROM tasks WHERE id = $1 AND lease_owner = $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete task: %v", err)
+		err = errors.New("error preparing statement to delete task")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(id, owner)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete task: %v", err)
+		err = errors.New("error deleting task")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteTimer(id string) (err error) {
+	query := `DELETE FROM timers WHERE id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete timer: %v", err)
+		err = errors.New("error preparing statement to delete timer")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete timer: %v", err)
+		err = errors.New("error deleting timer")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteWorkflow(workflowID string, version int) (err error) {
+	query := `Update workflows set is_deleted = $1 WHERE workflow_id = $2 AND version = $3`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete a workflow: %v", err)
+		err = errors.New("error preparing statement to delete a workflow")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(true, workflowID, version)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete a workflow: %v", err)
+		err = errors.New("error deleting workflow")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) DeleteStepChangeEvent(instanceID, eventID string) (err error) {
+	// soft delete
+	query := `UPDATE step_change_event SET is_deleted = $1 WHERE instance_id = $2 AND event_id = $3`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete step change event: %v", err)
+		err = errors.New("error preparing statement to delete step change event")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(true, instanceID, eventID)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete step change event: %v", err)
+		err = errors.New("error deleting step change event")
+		return
+	}
+	return nil
+}
+
+// ExtendInstanceLock extends the lease of the lock with a conditional update, the row is only updated while the owner
+// holds the lock.
+func (s *SQLStorage) ExtendInstanceLock(instanceID, owner string, lease time.Duration) (extended bool, err error) {
+	query := `UPDATE workflow_data SET lock_until = $1 WHERE instance_id = $2 AND is_locked = true AND lock_owner = $3`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to extend instance lock: %v", err)
+		err = errors.New("error preparing statement to extend instance lock")
+		return
+	}
+	defer statement.Close()
+	result, err := statement.Exec(s.dialect.encodeTime(time.Now().Add(lease)), instanceID, owner)
+	if err != nil {
+		logger.ErrorF("Error executing query to extend instance lock: %v", err)
+		err = errors.New("error extending instance lock")
+		return
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error reading the rows affected by the instance lock: %v", err)
+		err = errors.New("error extending instance lock")
+		return
+	}
+	extended = rows > 0
+	return
+}
+
+func (s *SQLStorage) ExtendTaskLease(id, owner string, lease time.Duration) (extended bool, err error) {
+	query := `UPDATE tasks SET lease_until = $1 WHERE id = $2 AND lease_owner = $3`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to extend task lease: %v", err)
+		err = errors.New("error preparing statement to extend task lease")
+		return
+	}
+	defer statement.Close()
+	result, err := statement.Exec(s.dialect.encodeTime(time.Now().Add(lease)), id, owner)
+	if err != nil {
+		logger.ErrorF("Error executing query to extend task lease: %v", err)
+		err = errors.New("error extending task lease")
+		return
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error reading the rows affected by the task lease: %v", err)
+		err = errors.New("error extending task lease")
+		return
+	}
+	extended = rows > 0
+	return
+}
+
+func (s *SQLStorage) GetChildInstances(instanceID string) (children []*WorkflowState, err error) {
+	query := `SELECT ` + workflowStateColumns + ` FROM workflow_state WHERE parent_instance_id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get child instances: %v", err)
+		err = errors.New("error preparing statement to get child instances")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(instanceID)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch child instances: %v", err)
+		err = errors.New("error fetching child instances")
+		return
+	}
+	defer rows.Close()
+	children = make([]*WorkflowState, 0)
+	for rows.Next() {
+		var state *WorkflowState
+		state, err = scanWorkflowState(rows)
+		if err != nil {
+			logger.ErrorF("Error scanning row for child instance: %v", err)
+			err = errors.New("error scanning child instance")
+			return
+		}
+		children = append(children, state)
+	}
+	return
+}
+
+func (s *SQLStorage) GetDueTimers(before time.Time, limit int) (timers []*Timer, err error) {
+	query := `SELECT id, instance_id, step_id, iteration, timer_type, fire_at FROM timers WHERE fire_at <= $1 ORDER BY fire_at ASC LIMIT $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get due timers: %v", err)
+		err = errors.New("error preparing statement to get due timers")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(s.dialect.encodeTime(before), limit)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch due timers: %v", err)
+		err = errors.New("error fetching due timers")
+		return
+	}
+	defer rows.Close()
+	timers = make([]*Timer, 0)
+	for rows.Next() {
+		timer := &Timer{}
+		var timerType string
+		err = rows.Scan(&timer.Id, &timer.InstanceId, &timer.StepId, &timer.Iteration, &timerType, &timer.FireAt)
+		if err != nil {
+			logger.ErrorF("Error scanning row for timer: %v", err)
+			err = errors.New("error scanning timer")
+			return
+		}
+		timer.Type = TimerType(timerType)
+		timers = append(timers, timer)
+	}
+	return
+}
+
+func (s *SQLStorage) GetExpiredLocks(before time.Time) (instanceIds []string, err error) {
+	// the locks taken before the lock_until column was added have no lease and are expired as well
+	instanceIds, err = s.queryInstanceIds(`SELECT instance_id FROM workflow_data WHERE is_locked = true AND (lock_until IS NULL OR lock_until < $1)`, s.dialect.encodeTime(before))
+	return
+}
+
+func (s *SQLStorage) GetInstancesWithStepChangeEvents() (instanceIds []string, err error) {
+	instanceIds, err = s.queryInstanceIds(`SELECT DISTINCT instance_id FROM step_change_event WHERE is_deleted = false`)
+	return
+}
+
+func (s *SQLStorage) GetPipeline(id string) (pipelineData *VersionedPipeline, err error) {
+	query := `SELECT pipeline_data, pipeline_version FROM workflow_data WHERE instance_id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch pipeline data: %v", err)
+		err = errors.New("error preparing statement to fetch pipeline data")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(id)
+	var pipelineJSON []byte
+	var version int
+	err = row.Scan(&pipelineJSON, &version)
+	if err != nil {
+		logger.ErrorF("Error scanning row for pipeline data: %v", err)
+		err = errors.New("error scanning pipeline data")
+		return
+	}
+	var pipelineDataMap map[string]any
+	err = codec.JsonCodec().DecodeBytes(pipelineJSON, &pipelineDataMap)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling pipeline data: %v", err)
+		err = errors.New("error unmarshalling pipeline data")
+		return
+	}
+	pipelineData = &VersionedPipeline{Pipeline: data.NewPipelineFrom(pipelineDataMap), Version: version}
+	return
+}
+
+func (s *SQLStorage) GetState(instanceID string) (state *WorkflowState, err error) {
+	query := `SELECT ` + workflowStateColumns + ` FROM workflow_state WHERE instance_id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get workflow state: %v", err)
+		err = errors.New("error preparing statement to get workflow state")
+		return
+	}
+	defer statement.Close()
+	state, err = scanWorkflowState(statement.QueryRow(instanceID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrWorkflowStateNotFound(instanceID)
+			return
+		}
+		logger.ErrorF("Error scanning row for workflow state: %v", err)
+		err = errors.New("error scanning workflow state")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) GetAndRemoveNextPendingStep(instanceID string) (pendingStep *PendingStep, err error) {
+	// fetch the earliest pending step based on the created timestamp
+	query := `SELECT data FROM pending_steps WHERE instance_id = $1 AND is_deleted = $2 ORDER BY created_at ASC` + s.dialect.insertOrder + ` LIMIT 1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get next pending step: %v", err)
+		err = errors.New("error preparing statement to get next pending step")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(instanceID, false)
+	pendingStep = &PendingStep{}
+	var pendingStepJSON []byte
+	err = row.Scan(&pendingStepJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no pending steps found
+			return nil, nil
+		}
+		logger.ErrorF("Error scanning row for pending step: %v", err)
+		err = errors.New("error scanning pending step")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(pendingStepJSON, pendingStep)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling pending step: %v", err)
+		err = errors.New("error unmarshalling pending step")
+		return
+	}
+	query = `UPDATE pending_steps SET is_deleted = $1 WHERE id = $2`
+	statement, err = s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to delete pending step: %v", err)
+		err = errors.New("error preparing statement to delete pending step")
+		return
+	}
+	defer statement.Close()
+	_, err = statement.Exec(true, pendingStep.Id)
+	if err != nil {
+		logger.ErrorF("Error executing query to delete pending step: %v", err)
+		err = errors.New("error deleting pending step")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) GetPendingSteps(instanceID string) (pendingSteps []*PendingStep, err error) {
+	query := `SELECT data FROM pending_steps WHERE instance_id = $1 AND is_deleted = $2 ORDER BY created_at ASC` + s.dialect.insertOrder
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get pending steps: %v", err)
+		err = errors.New("error preparing statement to get pending steps")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(instanceID, false)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch pending steps: %v", err)
+		err = errors.New("error fetching pending steps")
+		return
+	}
+	defer rows.Close()
+	pendingSteps = make([]*PendingStep, 0)
+	for rows.Next() {
+		pendingStep := &PendingStep{}
+		var pendingStepJSON []byte
+		err = rows.Scan(&pendingStepJSON)
+		if err != nil {
+			logger.ErrorF("Error scanning row for pending step: %v", err)
+			err = errors.New("error scanning pending step")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(pendingStepJSON, pendingStep)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling pending step: %v", err)
+			err = errors.New("error unmarshalling pending step")
+			return
+		}
+		pendingSteps = append(pendingSteps, pendingStep)
+	}
+	return
+}
+
+func (s *SQLStorage) GetDueSchedules(before time.Time) (schedules []*Schedule, err error) {
+	query := `SELECT schedule, version FROM schedules WHERE (next_run_at <= $1 AND paused = false) OR queued > 0`
+	schedules, err = s.querySchedules(query, s.dialect.encodeTime(before))
+	return
+}
+
+func (s *SQLStorage) GetSchedule(id string) (schedule *Schedule, err error) {
+	var schedules []*Schedule
+	query := `SELECT schedule, version FROM schedules WHERE id = $1`
+	schedules, err = s.querySchedules(query, id)
+	if err != nil {
+		return
+	}
+	if len(schedules) == 0 {
+		err = ErrScheduleNotFound(id)
+		return
+	}
+	schedule = schedules[0]
+	return
+}
+
+func (s *SQLStorage) GetTrigger(id string) (trigger *Trigger, err error) {
+	var triggers []*Trigger
+	query := `SELECT data FROM triggers WHERE id = $1`
+	triggers, err = s.queryTriggers(query, id)
+	if err != nil {
+		return
+	}
+	if len(triggers) == 0 {
+		err = ErrTriggerNotFound(id)
+		return
+	}
+	trigger = triggers[0]
+	return
+}
+
+func (s *SQLStorage) GetSignals(instanceID string) (signals []*Signal, err error) {
+	query := `SELECT id, instance_id, name, payload, received_at FROM signals WHERE instance_id = $1 ORDER BY received_at ASC`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get signals: %v", err)
+		err = errors.New("error preparing statement to get signals")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(instanceID)
+	if err != nil {
+		logger.ErrorF("Error executing query to get signals: %v", err)
+		err = errors.New("error fetching signals")
+		return
+	}
+	defer rows.Close()
+	signals = make([]*Signal, 0)
+	for rows.Next() {
+		signal := &Signal{}
+		var payloadJSON []byte
+		err = rows.Scan(&signal.Id, &signal.InstanceId, &signal.Name, &payloadJSON, &signal.ReceivedAt)
+		if err != nil {
+			logger.ErrorF("Error scanning row for signal: %v", err)
+			err = errors.New("error scanning signal")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(payloadJSON, &signal.Payload)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling signal payload: %v", err)
+			err = errors.New("error unmarshalling signal payload")
+			return
+		}
+		signals = append(signals, signal)
+	}
+	return
+}
+
+func (s *SQLStorage) GetRunningStepStates(startedBefore time.Time) (stepStates []*StepState, err error) {
+	query := `SELECT step_state, version FROM step_state WHERE status = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get running step states: %v", err)
+		err = errors.New("error preparing statement to get running step states")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(models.StatusRunning.String())
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch running step states: %v", err)
+		err = errors.New("error fetching running step states")
+		return
+	}
+	defer rows.Close()
+	stepStates = make([]*StepState, 0)
+	for rows.Next() {
+		stepState := &StepState{}
+		var stepStateJSON []byte
+		var version int
+		err = rows.Scan(&stepStateJSON, &version)
+		if err != nil {
+			logger.ErrorF("Error scanning row for step state: %v", err)
+			err = errors.New("error scanning step state")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(stepStateJSON, stepState)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling step state: %v", err)
+			err = errors.New("error unmarshalling step state")
+			return
+		}
+		// the version is kept in its own column
+		stepState.Version = version
+		// the start time is only kept in the document
+		if stepState.StartedAt.Before(startedBefore) {
+			stepStates = append(stepStates, stepState)
+		}
+	}
+	return
+}
+
+func (s *SQLStorage) GetStepChangeEvents(instanceID string) (stepChangeEvents []*events.StepChangeEvent, err error) {
+	query := `SELECT instance_id, event_id, step_id, status, data FROM step_change_event WHERE instance_id = $1 AND is_deleted = $2 ORDER BY created_at ASC` + s.dialect.insertOrder
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get step change events: %v", err)
+		err = errors.New("error preparing statement to get step change events")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(instanceID, false)
+	if err != nil {
+		logger.ErrorF("Error executing query to get step change events: %v", err)
+		err = errors.New("error fetching step change events")
+		return
+	}
+	defer rows.Close()
+	stepChangeEvents = make([]*events.StepChangeEvent, 0)
+	for rows.Next() {
+		stepChangeEvent := &events.StepChangeEvent{}
+		var status string
+		var stepChangeEventDataJSON []byte
+		err = rows.Scan(&stepChangeEvent.InstanceId, &stepChangeEvent.EventId, &stepChangeEvent.StepId, &status, &stepChangeEventDataJSON)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				// no step change events found
+				return
+			}
+			logger.ErrorF("Error scanning row for step change event: %v", err)
+			err = errors.New("error scanning step change event")
+			return
+		}
+		stepChangeEvent.Status = models.StringToStatus[status]
+		err = codec.JsonCodec().DecodeBytes(stepChangeEventDataJSON, &stepChangeEvent.Data)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling step change event data: %v", err)
+			err = errors.New("error unmarshalling step change event data")
+			return
+		}
+		stepChangeEvents = append(stepChangeEvents, stepChangeEvent)
+	}
+	return
+}
+
+func (s *SQLStorage) GetStepState(instanceID, stepID string, iteration int) (stepState *StepState, err error) {
+	query := `SELECT step_state, version FROM step_state WHERE instance_id = $1 AND step_id = $2 AND iteration = $3`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get step state: %v", err)
+		err = errors.New("error preparing statement to get step state")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(instanceID, stepID, iteration)
+	stepState = &StepState{}
+	var stepStateJSON []byte
+	var version int
+	err = row.Scan(&stepStateJSON, &version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no step state found
+			return nil, nil
+		}
+		logger.ErrorF("Error scanning row for step state: %v", err)
+		err = errors.New("error scanning step state")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(stepStateJSON, stepState)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling step state: %v", err)
+		err = errors.New("error unmarshalling step state")
+		return
+	}
+	// the version is kept in its own column
+	stepState.Version = version
+	return
+}
+
+func (s *SQLStorage) GetStepStates(instanceID string) (stepState map[string][]*StepState, err error) {
+	query := `SELECT step_state, version FROM step_state WHERE instance_id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to get step states: %v", err)
+		err = errors.New("error preparing statement to get step states")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(instanceID)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch step states: %v", err)
+		err = errors.New("error fetching step states")
+		return
+	}
+	defer rows.Close()
+	stepState = make(map[string][]*StepState)
+	for rows.Next() {
+		stepStateItem := &StepState{}
+		var stepStateJSON []byte
+		var version int
+		err = rows.Scan(&stepStateJSON, &version)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				// no step state found
+				return nil, nil
+			}
+			logger.ErrorF("Error scanning row for step state: %v", err)
+			err = errors.New("error scanning step state")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(stepStateJSON, stepStateItem)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling step state: %v", err)
+			err = errors.New("error unmarshalling step state")
+			return
+		}
+		// the version is kept in its own column
+		stepStateItem.Version = version
+		if _, ok := stepState[stepStateItem.StepId]; !ok {
+			stepState[stepStateItem.StepId] = make([]*StepState, 0)
+		}
+		stepState[stepStateItem.StepId] = append(stepState[stepStateItem.StepId], stepStateItem)
+	}
+	return
+}
+
+func (s *SQLStorage) GetWorkflow(workflowID string, version int) (workflow *models.Workflow, err error) {
+	query := `SELECT workflow_document FROM workflows WHERE workflow_id = $1 AND version = $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch workflow: %v", err)
+		err = errors.New("error preparing statement to fetch workflow")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(workflowID, version)
+	workflow = &models.Workflow{}
+	var workflowDocumentJSON []byte
+	err = row.Scan(&workflowDocumentJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no workflow found
+			err = errors.New("workflow not found")
+			return
+		}
+		logger.ErrorF("Error scanning row for workflow: %v", err)
+		err = errors.New("error scanning workflow")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(workflowDocumentJSON, workflow)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling workflow document: %v", err)
+		err = errors.New("error unmarshalling workflow document")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) GetWorkflowOptions(workflowID string, version int) (options *WorkflowOptions, err error) {
+	query := `SELECT options FROM workflow_options WHERE workflow_id = $1 AND version = $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch workflow options: %v", err)
+		err = errors.New("error preparing statement to fetch workflow options")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(workflowID, version)
+	options = &WorkflowOptions{WorkflowId: workflowID, WorkflowVersion: version}
+	var optionsJSON []byte
+	err = row.Scan(&optionsJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no options registered for the workflow
+			err = nil
+			return
+		}
+		logger.ErrorF("Error scanning row for workflow options: %v", err)
+		err = errors.New("error scanning workflow options")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(optionsJSON, options)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling workflow options: %v", err)
+		err = errors.New("error unmarshalling workflow options")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) GetWorkflowByInstance(instanceID string) (workflow *models.Workflow, err error) {
+	query := `select workflow_id, workflow_version from workflow_data where instance_id = $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement fetch workflow by instance: %v", err)
+		err = errors.New("error preparing statement to fetch workflow by instance")
+		return
+	}
+	defer statement.Close()
+	row := statement.QueryRow(instanceID)
+	var workflowID, workflowVersion string
+	err = row.Scan(&workflowID, &workflowVersion)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no workflow found
+			return nil, nil
+		}
+		logger.ErrorF("Error scanning row workflowID: %v", err)
+		err = errors.New("error scanning workflowID")
+		return
+	}
+	query = `select workflow_document from workflows where workflow_id = $1 AND version = $2`
+	statement, err = s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch workflows by workflowID: %v", err)
+		err = errors.New("error preparing statement to fetch workflows by workflowID")
+		return
+	}
+	defer statement.Close()
+	row = statement.QueryRow(workflowID, workflowVersion)
+	workflow = &models.Workflow{}
+	var workflowDocumentJSON []byte
+	err = row.Scan(&workflowDocumentJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// no workflow found
+			return nil, nil
+		}
+		logger.ErrorF("Error scanning row for workflow: %v", err)
+		err = errors.New("error scanning workflow")
+		return
+	}
+	err = codec.JsonCodec().DecodeBytes(workflowDocumentJSON, workflow)
+	if err != nil {
+		logger.ErrorF("Error unmarshalling workflow document: %v", err)
+		err = errors.New("error unmarshalling workflow document")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) ListWorkflows() (workflows []*models.Workflow, err error) {
+	query := `SELECT workflow_document FROM workflows ORDER BY workflow_id ASC, version ASC`
+	workflows, err = s.queryWorkflows(query)
+	return
+}
+
+func (s *SQLStorage) ListWorkflowVersions(workflowID string) (workflows []*models.Workflow, err error) {
+	query := `SELECT workflow_document FROM workflows WHERE workflow_id = $1 ORDER BY version ASC`
+	workflows, err = s.queryWorkflows(query, workflowID)
+	return
+}
+
+func (s *SQLStorage) ListSchedules() (schedules []*Schedule, err error) {
+	query := `SELECT schedule, version FROM schedules ORDER BY created_at ASC`
+	schedules, err = s.querySchedules(query)
+	return
+}
+
+func (s *SQLStorage) ListTriggers() (triggers []*Trigger, err error) {
+	query := `SELECT data FROM triggers ORDER BY created_at ASC`
+	triggers, err = s.queryTriggers(query)
+	return
+}
+
+func (s *SQLStorage) HasTasks(instanceID string) (has bool, err error) {
+	var instanceIds []string
+	instanceIds, err = s.queryInstanceIds(`SELECT instance_id FROM tasks WHERE instance_id = $1 LIMIT 1`, instanceID)
+	has = len(instanceIds) > 0
+	return
+}
+
+func (s *SQLStorage) ListActions() (actions []*models.ActionSpec, err error) {
+	query := `SELECT id, name, description, endpoint FROM actions`
+	actions, err = s.queryActionSpecs(query)
+	return
+}
+
+func (s *SQLStorage) PruneTriggerMessages(before time.Time) (pruned int, err error) {
+	query := `DELETE FROM trigger_messages WHERE created_at < $1`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to prune trigger messages: %v", err)
+		err = errors.New("error preparing statement to prune trigger messages")
+		return
+	}
+	defer statement.Close()
+	result, err := statement.Exec(s.dialect.encodeTime(before))
+	if err != nil {
+		logger.ErrorF("Error executing query to prune trigger messages: %v", err)
+		err = errors.New("error pruning trigger messages")
+		return
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error fetching the affected rows of the pruned trigger messages: %v", err)
+		err = errors.New("error pruning trigger messages")
+		return
+	}
+	pruned = int(rows)
+	return
+}
+
+func (s *SQLStorage) SaveAction(action *models.ActionSpec) (err error) {
+	checkQuery := `SELECT COUNT(*) FROM actions WHERE id = $1`
+	statement, err := s.PrepareStatement(checkQuery)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to check action existence: %v", err)
+		err = errors.New("error preparing statement to check action existence")
+		return
+	}
+	defer statement.Close()
+	var count int
+	err = statement.QueryRow(action.Id).Scan(&count)
+	if err != nil {
+		logger.ErrorF("Error executing query to check action existence: %v", err)
+		err = errors.New("error checking action existence")
+		return
+	}
+	if count > 0 {
+		logger.InfoF("Action with ID %s already exists", action.Id)
+		return
+	}
+	query := `Insert into actions (id, name, description, endpoint) VALUES ($1, $2, $3, $4)`
+	statement, err = s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save action: %v", err)
+		err = errors.New("error preparing statement to save action")
+		return
+	}
+	defer statement.Close()
+	endpointJSON, err := codec.JsonCodec().EncodeToBytes(action.Endpoint)
+	if err != nil {
+		logger.ErrorF("Error marshalling endpoint: %v", err)
+		err = errors.New("error marshalling endpoint")
+		return
+	}
+	_, err = statement.Exec(action.Id, action.Name, action.Description, endpointJSON)
+	if err != nil {
+		logger.ErrorF("Error executing query to save action: %v", err)
+		err = errors.New("error saving action")
+		return
+	}
+	return
+}
+
+// LeaseTasks leases the tasks whose lease expired. The tasks are selected with the lockClause of the dialect, so the
+// workers of several replicas lease tasks at the same time without leasing the same task twice.
+func (s *SQLStorage) LeaseTasks(owner string, limit int, lease time.Duration) (tasks []*Task, err error) {
+	query := `UPDATE tasks SET lease_owner = $1, lease_until = $2, attempts = attempts + 1
+		WHERE id IN (SELECT id FROM tasks WHERE lease_until <= $3 ORDER BY created_at ASC LIMIT $4` + s.dialect.lockClause + `)
+		RETURNING id, instance_id, task_type, event, attempts, lease_owner, lease_until, created_at`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to lease tasks: %v", err)
+		err = errors.New("error preparing statement to lease tasks")
+		return
+	}
+	defer statement.Close()
+	now := s.dialect.encodeTime(time.Now())
+	rows, err := statement.Query(owner, now.Add(lease), now, limit)
+	if err != nil {
+		logger.ErrorF("Error executing query to lease tasks: %v", err)
+		err = errors.New("error leasing tasks")
+		return
+	}
+	defer rows.Close()
+	tasks = make([]*Task, 0)
+	for rows.Next() {
+		task := &Task{}
+		var taskType string
+		var eventJSON []byte
+		err = rows.Scan(&task.Id, &task.InstanceId, &taskType, &eventJSON, &task.Attempts, &task.LeaseOwner, &task.LeaseUntil, &task.CreatedAt)
+		if err != nil {
+			logger.ErrorF("Error scanning row for task: %v", err)
+			err = errors.New("error scanning task")
+			return
+		}
+		task.Type = TaskType(taskType)
+		if eventJSON != nil {
+			task.Event = &events.StepChangeEvent{}
+			err = codec.JsonCodec().DecodeBytes(eventJSON, task.Event)
+			if err != nil {
+				logger.ErrorF("Error unmarshalling task event: %v", err)
+				err = errors.New("error unmarshalling task event")
+				return
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return
+}
+
+// LockInstance locks the instance with a conditional update. The row is only updated if the instance is not locked
+// or the lease of the lock expired, so only one of the concurrent callers gets the lock.
+func (s *SQLStorage) LockInstance(instanceID, owner string, lease time.Duration) (isLocked bool, err error) {
+	query := `UPDATE workflow_data SET is_locked = true, lock_owner = $1, lock_until = $2, locked_at = CURRENT_TIMESTAMP
+		WHERE instance_id = $3 AND (is_locked = false OR lock_until IS NULL OR lock_until < $4)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to lock instance: %v", err)
+		err = errors.New("error preparing statement to lock instance")
+		return
+	}
+	defer statement.Close()
+	now := s.dialect.encodeTime(time.Now())
+	result, err := statement.Exec(owner, now.Add(lease), instanceID, now)
+	if err != nil {
+		logger.ErrorF("Error executing query to lock instance: %v", err)
+		err = errors.New("error locking instance")
+		return
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error reading the rows affected by the lock: %v", err)
+		err = errors.New("error locking instance")
+		return
+	}
+	isLocked = rows > 0
+	return
+}
+
+func (s *SQLStorage) SaveSchedule(schedule *Schedule) (err error) {
+	// A schedule without version replaces the stored one, otherwise the stored schedule must still have the same version
+	query := `UPDATE schedules SET workflow_id = $2, schedule = $3, next_run_at = $4, paused = $5, queued = $6, version = version + 1,
+		updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND version = $7 RETURNING version`
+	if schedule.Version == 0 {
+		query = `INSERT INTO schedules (id, workflow_id, schedule, next_run_at, paused, queued, version) VALUES ($1, $2, $3, $4, $5, $6, $7 + 1) 
+		ON CONFLICT(id) DO UPDATE set workflow_id=$2, schedule=$3, next_run_at=$4, paused=$5, queued=$6, version = schedules.version + 1, updated_at=CURRENT_TIMESTAMP RETURNING version`
+	}
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save schedule: %v", err)
+		err = errors.New("error preparing statement to save schedule")
+		return
+	}
+	defer statement.Close()
+	scheduleJSON, err := codec.JsonCodec().EncodeToBytes(schedule)
+	if err != nil {
+		logger.ErrorF("Error marshalling schedule: %v", err)
+		err = errors.New("error marshalling schedule")
+		return
+	}
+	var version int
+	err = statement.QueryRow(schedule.Id, schedule.WorkflowId, scheduleJSON, s.dialect.encodeTime(schedule.NextRunAt), schedule.Paused, schedule.Queued, schedule.Version).Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrScheduleVersionConflict(schedule.Id)
+			return
+		}
+		logger.ErrorF("Error executing query to save schedule: %v", err)
+		err = errors.New("error saving schedule")
+		return
+	}
+	schedule.Version = version
+	return
+}
+
+func (s *SQLStorage) SaveTrigger(trigger *Trigger) (err error) {
+	query := `INSERT INTO triggers (id, topic, data) VALUES ($1, $2, $3) 
+		ON CONFLICT(id) DO UPDATE set topic=$2, data=$3, updated_at=CURRENT_TIMESTAMP`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save trigger: %v", err)
+		err = errors.New("error preparing statement to save trigger")
+		return
+	}
+	defer statement.Close()
+	triggerJSON, err := codec.JsonCodec().EncodeToBytes(trigger)
+	if err != nil {
+		logger.ErrorF("Error marshalling trigger: %v", err)
+		err = errors.New("error marshalling trigger")
+		return
+	}
+	_, err = statement.Exec(trigger.Id, trigger.Topic, triggerJSON)
+	if err != nil {
+		logger.ErrorF("Error executing query to save trigger: %v", err)
+		err = errors.New("error saving trigger")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) SaveSignal(signal *Signal) (err error) {
+	query := `INSERT INTO signals (id, instance_id, name, payload, received_at) VALUES ($1, $2, $3, $4, $5)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save signal: %v", err)
+		err = errors.New("error preparing statement to save signal")
+		return
+	}
+	defer statement.Close()
+	payloadJSON, err := codec.JsonCodec().EncodeToBytes(signal.Payload)
+	if err != nil {
+		logger.ErrorF("Error marshalling signal payload: %v", err)
+		err = errors.New("error marshalling signal payload")
+		return
+	}
+	_, err = statement.Exec(signal.Id, signal.InstanceId, signal.Name, payloadJSON, s.dialect.encodeTime(signal.ReceivedAt))
+	if err != nil {
+		logger.ErrorF("Error executing query to save signal: %v", err)
+		err = errors.New("error saving signal")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) SaveStepChangeEvent(stepEvent *events.StepChangeEvent) (err error) {
+	query := `INSERT INTO step_change_event (instance_id, event_id, step_id, status, data) VALUES ($1, $2, $3, $4, $5)`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save step change event: %v", err)
+		err = errors.New("error preparing statement to save step change event")
+		return
+	}
+	defer statement.Close()
+	stepEventDataJSON, err := codec.JsonCodec().EncodeToBytes(stepEvent.Data)
+	if err != nil {
+		logger.ErrorF("Error marshalling step event data: %v", err)
+		err = errors.New("error marshalling step event data")
+		return
+	}
+	_, err = statement.Exec(stepEvent.InstanceId, stepEvent.EventId, stepEvent.StepId, stepEvent.Status.String(), stepEventDataJSON)
+	if err != nil {
+		logger.ErrorF("Error executing query to save step change event: %v", err)
+		err = errors.New("error saving step change event")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) SavePipeline(pipeline *VersionedPipeline) (err error) {
+	query := `UPDATE workflow_data SET pipeline_data = $1, pipeline_version = pipeline_version + 1 WHERE instance_id = $2 AND pipeline_version = $3`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save pipeline: %v", err)
+		err = errors.New("error preparing statement to save pipeline")
+		return
+	}
+	defer statement.Close()
+	mappedData := pipeline.Map()
+	pipelineJSON, err := codec.JsonCodec().EncodeToBytes(mappedData)
+	if err != nil {
+		logger.ErrorF("Error marshalling pipeline data: %v", err)
+		err = errors.New("error marshalling pipeline data")
+		return
+	}
+	var result sql.Result
+	result, err = statement.Exec(pipelineJSON, pipeline.Id(), pipeline.Version)
+	if err != nil {
+		logger.ErrorF("Error executing query to save pipeline: %v", err)
+		err = errors.New("error saving pipeline data")
+		return
+	}
+	err = s.checkVersion(result, "pipeline", pipeline.Id())
+	if err != nil {
+		return
+	}
+	pipeline.Version++
+	return
+}
+
+func (s *SQLStorage) SaveState(workflowState *WorkflowState) (err error) {
+	// A state that was never saved is created, otherwise the stored state must still have the same version
+	query := `UPDATE workflow_state SET instance_version = $2 + 1, status = $3, reason = $4, error = $5, compensation = $6, updated_at = CURRENT_TIMESTAMP WHERE instance_id = $1 AND instance_version = $2`
+	if workflowState.InstanceVersion == 0 {
+		query = `Insert into workflow_state (instance_id, instance_version, status, reason, error, compensation, workflow_id, workflow_version, parent_instance_id, parent_step_id, parent_iteration) VALUES ($1, $2 + 1, $3, $4, $5, $6, $7, $8, $9, $10, $11) on conflict(instance_id, workflow_id, workflow_version) do nothing`
+	}
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save state: %v", err)
+		err = errors.New("error preparing statement to save state")
+		return
+	}
+	defer statement.Close()
+	logger.InfoF("Saving state: %v", workflowState)
+	var compensationJSON []byte
+	if workflowState.Compensation != nil {
+		compensationJSON, err = codec.JsonCodec().EncodeToBytes(workflowState.Compensation)
+		if err != nil {
+			logger.ErrorF("Error marshalling compensation: %v", err)
+			err = errors.New("error marshalling compensation")
+			return
+		}
+	}
+	args := []any{workflowState.InstanceId, workflowState.InstanceVersion, workflowState.Status.String(), string(workflowState.Reason), workflowState.Error, compensationJSON}
+	if workflowState.InstanceVersion == 0 {
+		var parentInstanceId, parentStepId sql.NullString
+		var parentIteration sql.NullInt64
+		if workflowState.Parent != nil {
+			parentInstanceId = sql.NullString{String: workflowState.Parent.InstanceId, Valid: true}
+			parentStepId = sql.NullString{String: workflowState.Parent.StepId, Valid: true}
+			parentIteration = sql.NullInt64{Int64: int64(workflowState.Parent.Iteration), Valid: true}
+		}
+		args = append(args, workflowState.WorkflowId, workflowState.WorkflowVersion, parentInstanceId, parentStepId, parentIteration)
+	}
+	var result sql.Result
+	result, err = statement.Exec(args...)
+	if err != nil {
+		logger.ErrorF("Error executing query to save state: %v", err)
+		err = errors.New("error saving workflow state")
+		return
+	}
+	err = s.checkVersion(result, "state", workflowState.InstanceId)
+	if err != nil {
+		return
+	}
+	workflowState.InstanceVersion++
+	return
+}
+
+func (s *SQLStorage) SaveStepState(stepState *StepState) (err error) {
+	// A new start of the step replaces the stored step state, otherwise the stored step state must still have the
+	// same version
+	query := `UPDATE step_state set parent_step = $4, child_count = $5, status = $6, step_state = $7, version = version + 1
+		WHERE instance_id = $1 AND step_id = $2 AND iteration = $3 AND version = $8 RETURNING version`
+	if stepState.Version == 0 {
+		query = `INSERT INTO step_state (instance_id, step_id, iteration, parent_step, child_count, status, step_state, version) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8 + 1) 
+		ON Conflict(instance_id, step_id, iteration) 
+		DO UPDATE set parent_step=$4, child_count=$5, status=$6, step_state=$7, version = step_state.version + 1 RETURNING version`
+	}
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save step state: %v", err)
+		err = errors.New("error preparing statement to save step state")
+		return
+	}
+	defer statement.Close()
+	var stepStateJSON []byte
+	stepStateJSON, err = codec.JsonCodec().EncodeToBytes(stepState)
+	if err != nil {
+		logger.ErrorF("Error marshalling step state data: %v", err)
+		err = errors.New("error marshalling step state data")
+		return
+	}
+	var version int
+	err = statement.QueryRow(stepState.InstanceId, stepState.StepId, stepState.Iteration, stepState.ParentStep, stepState.ChildCount, stepState.Status.String(), stepStateJSON, stepState.Version).Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrVersionConflict("step state "+stepState.StepId, stepState.InstanceId)
+			return
+		}
+		logger.ErrorF("Error executing query to save step state: %v", err)
+		err = errors.New("error saving step state")
+		return
+	}
+	stepState.Version = version
+	return
+}
+
+func (s *SQLStorage) SaveWorkflow(workflow *models.Workflow) (err error) {
+	checkQuery := `SELECT COUNT(*) FROM workflows WHERE workflow_id = $1 AND version = $2`
+	statement, err := s.PrepareStatement(checkQuery)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to check workflow existence: %v", err)
+		err = errors.New("error preparing statement to check workflow existence")
+		return
+	}
+	defer statement.Close()
+	var count int
+	err = statement.QueryRow(workflow.Id, workflow.Version).Scan(&count)
+	if err != nil {
+		logger.ErrorF("Error executing query to check workflow existence: %v", err)
+		err = errors.New("error checking workflow existence")
+		return
+	}
+	if count > 0 {
+		logger.InfoF("Workflow with ID %s and version %d already exists", workflow.Id, workflow.Version)
+		return
+	}
+	query := `INSERT INTO workflows (workflow_id, version, name, description, workflow_document) VALUES ($1, $2, $3, $4, $5)`
+	statement, err = s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save workflow: %v", err)
+		err = errors.New("error preparing statement to save workflow")
+		return
+	}
+	defer statement.Close()
+	workflowDocumentJSON, err := codec.JsonCodec().EncodeToBytes(workflow)
+	if err != nil {
+		logger.ErrorF("Error marshalling workflow document: %v", err)
+		err = errors.New("error marshalling workflow document")
+		return
+	}
+	_, err = statement.Exec(workflow.Id, workflow.Version, workflow.Name, workflow.Description, workflowDocumentJSON)
+	if err != nil {
+		logger.ErrorF("Error executing query to save workflow: %v", err)
+		err = errors.New("error saving workflow")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) SaveWorkflowOptions(options *WorkflowOptions) (err error) {
+	query := `INSERT INTO workflow_options (workflow_id, version, options) VALUES ($1, $2, $3) 
+		ON CONFLICT(workflow_id, version) DO UPDATE set options=$3, updated_at=CURRENT_TIMESTAMP`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to save workflow options: %v", err)
+		err = errors.New("error preparing statement to save workflow options")
+		return
+	}
+	defer statement.Close()
+	optionsJSON, err := codec.JsonCodec().EncodeToBytes(options)
+	if err != nil {
+		logger.ErrorF("Error marshalling workflow options: %v", err)
+		err = errors.New("error marshalling workflow options")
+		return
+	}
+	_, err = statement.Exec(options.WorkflowId, options.WorkflowVersion, optionsJSON)
+	if err != nil {
+		logger.ErrorF("Error executing query to save workflow options: %v", err)
+		err = errors.New("error saving workflow options")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) UnlockInstance(instanceID, owner string) (err error) {
+	query := `UPDATE workflow_data SET is_locked = false, lock_owner = NULL, lock_until = NULL, locked_at = NULL
+		WHERE instance_id = $1 AND is_locked = true AND lock_owner = $2`
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to unlock instance: %v", err)
+		err = errors.New("error preparing statement to unlock instance")
+		return
+	}
+	defer statement.Close()
+	result, err := statement.Exec(instanceID, owner)
+	if err != nil {
+		logger.ErrorF("Error executing query to unlock instance: %v", err)
+		err = errors.New("error unlocking instance")
+		return
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error reading the rows affected by the unlock: %v", err)
+		err = errors.New("error unlocking instance")
+		return
+	}
+	if rows == 0 {
+		err = ErrLockNotOwned(instanceID)
+	}
+	return
+}
+
+// PrepareStatement prepares a query written with the $N placeholders of Postgres in the transaction of the
+// SQLStorage, if any.
+func (s *SQLStorage) PrepareStatement(query string) (*sql.Stmt, error) {
+	query = s.dialect.rebind(query)
+	if s.tx != nil {
+		return s.tx.Prepare(query)
+	}
+	return s.Database.Prepare(query)
+}
+
+func (s *SQLStorage) WithTx(f func(tx Storage) error) (err error) {
+	if s.tx != nil {
+		// Join the transaction of the caller
+		err = f(s)
+		return
+	}
+	tx, err := s.Database.Begin()
+	if err != nil {
+		logger.ErrorF("Error beginning transaction: %v", err)
+		err = errors.New("error beginning transaction")
+		return
+	}
+	var finished bool
+	defer func() {
+		if finished {
+			return
+		}
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			logger.ErrorF("Error rolling back transaction: %v", rollbackErr)
+		}
+	}()
+	err = f(&SQLStorage{Database: s.Database, dialect: s.dialect, tx: tx})
+	if err != nil {
+		return
+	}
+	finished = true
+	err = tx.Commit()
+	if err != nil {
+		logger.ErrorF("Error committing transaction: %v", err)
+		err = errors.New("error committing transaction")
+		return
+	}
+	return
+}
+
+func (s *SQLStorage) Config() *config.StorageConfig {
+	c := &config.StorageConfig{
+		Type:     s.dialect.storageType,
+		Provider: &config.Provider{},
+	}
+	switch s.dialect.storageType {
+	case config.PostgresStorageType:
+		c.Provider.PostgreSQL = &config.PostgresStorage{}
+	case config.SQLiteStorageType:
+		c.Provider.SQLite = &config.SQLiteStorage{}
+	}
+	return c
+}
+
+// workflowStateColumns are the columns of the workflow_state table read by scanWorkflowState.
+const workflowStateColumns = `instance_id, workflow_id, workflow_version, instance_version, status, reason, error, parent_instance_id, parent_step_id, parent_iteration, compensation`
+
+// scanWorkflowState scans a row of the workflowStateColumns into a WorkflowState.
+func scanWorkflowState(row interface{ Scan(dest ...any) error }) (state *WorkflowState, err error) {
+	state = &WorkflowState{}
+	var status string
+	var reason, errMsg, parentInstanceId, parentStepId sql.NullString
+	var parentIteration sql.NullInt64
+	var compensationJSON []byte
+	err = row.Scan(&state.InstanceId, &state.WorkflowId, &state.WorkflowVersion, &state.InstanceVersion, &status, &reason, &errMsg, &parentInstanceId, &parentStepId, &parentIteration, &compensationJSON)
+	if err != nil {
+		return
+	}
+	if compensationJSON != nil {
+		state.Compensation = &Compensation{}
+		err = codec.JsonCodec().DecodeBytes(compensationJSON, state.Compensation)
+		if err != nil {
+			return
+		}
+	}
+	state.Status = models.StringToStatus[status]
+	state.Reason = Reason(reason.String)
+	state.Error = errMsg.String
+	if parentInstanceId.Valid {
+		state.Parent = &ParentLink{
+			InstanceId: parentInstanceId.String,
+			StepId:     parentStepId.String,
+			Iteration:  int(parentIteration.Int64),
+		}
+	}
+	return
+}
+
+// checkVersion returns ErrVersionConflict if the update of the versioned row did not affect any row, i.e. the stored
+// version differs from the version that was read.
+func (s *SQLStorage) checkVersion(result sql.Result, kind, instanceID string) (err error) {
+	var rows int64
+	rows, err = result.RowsAffected()
+	if err != nil {
+		logger.ErrorF("Error reading the rows affected by saving the %s: %v", kind, err)
+		err = errors.New("error saving " + kind)
+		return
+	}
+	if rows == 0 {
+		err = ErrVersionConflict(kind, instanceID)
+	}
+	return
+}
+
+// queryActionSpecs runs a query selecting the id, name, description and endpoint columns of the actions table.
+func (s *SQLStorage) queryActionSpecs(query string, args ...any) (actionSpecs []*models.ActionSpec, err error) {
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch action specs: %v", err)
+		err = errors.New("error preparing statement to fetch action specs")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(args...)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch action specs: %v", err)
+		err = errors.New("error fetching action specs")
+		return
+	}
+	defer rows.Close()
+	actionSpecs = make([]*models.ActionSpec, 0)
+	for rows.Next() {
+		actionSpec := &models.ActionSpec{}
+		var description sql.NullString
+		var endpointJSON []byte
+		err = rows.Scan(&actionSpec.Id, &actionSpec.Name, &description, &endpointJSON)
+		if err != nil {
+			logger.ErrorF("Error scanning row for action spec: %v", err)
+			err = errors.New("error scanning action spec")
+			return
+		}
+		actionSpec.Description = description.String
+		if endpointJSON != nil {
+			err = codec.JsonCodec().DecodeBytes(endpointJSON, &actionSpec.Endpoint)
+			if err != nil {
+				logger.ErrorF("Error unmarshalling action spec endpoint: %v", err)
+				err = errors.New("error unmarshalling action spec endpoint")
+				return
+			}
+		}
+		actionSpecs = append(actionSpecs, actionSpec)
+	}
+	return
+}
+
+// queryWorkflows runs a query selecting the workflow_document column of the workflows table.
+func (s *SQLStorage) queryWorkflows(query string, args ...any) (workflows []*models.Workflow, err error) {
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch workflows: %v", err)
+		err = errors.New("error preparing statement to fetch workflows")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(args...)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch workflows: %v", err)
+		err = errors.New("error fetching workflows")
+		return
+	}
+	defer rows.Close()
+	workflows = make([]*models.Workflow, 0)
+	for rows.Next() {
+		workflow := &models.Workflow{}
+		var workflowDocumentJSON []byte
+		err = rows.Scan(&workflowDocumentJSON)
+		if err != nil {
+			logger.ErrorF("Error scanning row for workflow: %v", err)
+			err = errors.New("error scanning workflow")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(workflowDocumentJSON, workflow)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling workflow document: %v", err)
+			err = errors.New("error unmarshalling workflow document")
+			return
+		}
+		workflows = append(workflows, workflow)
+	}
+	return
+}
+
+// querySchedules runs a query selecting the schedule column of the schedules table.
+func (s *SQLStorage) querySchedules(query string, args ...any) (schedules []*Schedule, err error) {
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch schedules: %v", err)
+		err = errors.New("error preparing statement to fetch schedules")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(args...)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch schedules: %v", err)
+		err = errors.New("error fetching schedules")
+		return
+	}
+	defer rows.Close()
+	schedules = make([]*Schedule, 0)
+	for rows.Next() {
+		schedule := &Schedule{}
+		var scheduleJSON []byte
+		var version int
+		err = rows.Scan(&scheduleJSON, &version)
+		if err != nil {
+			logger.ErrorF("Error scanning row for schedule: %v", err)
+			err = errors.New("error scanning schedule")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(scheduleJSON, schedule)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling schedule: %v", err)
+			err = errors.New("error unmarshalling schedule")
+			return
+		}
+		schedule.Version = version
+		schedules = append(schedules, schedule)
+	}
+	return
+}
+
+// queryTriggers runs a query selecting the data column of the triggers table.
+func (s *SQLStorage) queryTriggers(query string, args ...any) (triggers []*Trigger, err error) {
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch triggers: %v", err)
+		err = errors.New("error preparing statement to fetch triggers")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(args...)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch triggers: %v", err)
+		err = errors.New("error fetching triggers")
+		return
+	}
+	defer rows.Close()
+	triggers = make([]*Trigger, 0)
+	for rows.Next() {
+		trigger := &Trigger{}
+		var triggerJSON []byte
+		err = rows.Scan(&triggerJSON)
+		if err != nil {
+			logger.ErrorF("Error scanning row for trigger: %v", err)
+			err = errors.New("error scanning trigger")
+			return
+		}
+		err = codec.JsonCodec().DecodeBytes(triggerJSON, trigger)
+		if err != nil {
+			logger.ErrorF("Error unmarshalling trigger: %v", err)
+			err = errors.New("error unmarshalling trigger")
+			return
+		}
+		triggers = append(triggers, trigger)
+	}
+	return
+}
+
+func (s *SQLStorage) queryInstanceIds(query string, args ...any) (instanceIds []string, err error) {
+	statement, err := s.PrepareStatement(query)
+	if err != nil {
+		logger.ErrorF("Error preparing statement to fetch instance ids: %v", err)
+		err = errors.New("error preparing statement to fetch instance ids")
+		return
+	}
+	defer statement.Close()
+	rows, err := statement.Query(args...)
+	if err != nil {
+		logger.ErrorF("Error executing query to fetch instance ids: %v", err)
+		err = errors.New("error fetching instance ids")
+		return
+	}
+	defer rows.Close()
+	instanceIds = make([]string, 0)
+	for rows.Next() {
+		var instanceId string
+		err = rows.Scan(&instanceId)
+		if err != nil {
+			logger.ErrorF("Error scanning row for instance id: %v", err)
+			err = errors.New("error scanning instance id")
+			return
+		}
+		instanceIds = append(instanceIds, instanceId)
+	}
+	return
+}
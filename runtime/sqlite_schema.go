@@ -0,0 +1,188 @@
+package runtime
+
+// sqliteSchema creates the tables of the SQLiteStorage that do not exist yet. It matches the schema created by the
+// Postgres migrations in db/postgres.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS actions (
+	id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	description TEXT NULL,
+	is_deleted BOOLEAN DEFAULT FALSE NOT NULL,
+	param TEXT NULL,
+	returns TEXT NULL,
+	endpoint TEXT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS workflows (
+	workflow_id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	description TEXT NULL,
+	workflow_document TEXT NULL,
+	is_deleted BOOLEAN DEFAULT FALSE NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (workflow_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS workflow_options (
+	workflow_id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	options TEXT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (workflow_id, version),
+	FOREIGN KEY (workflow_id, version) REFERENCES workflows (workflow_id, version) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS workflow_data (
+	instance_id TEXT NOT NULL,
+	workflow_id TEXT NOT NULL,
+	workflow_version INTEGER NOT NULL,
+	pipeline_data TEXT NULL,
+	pipeline_version INTEGER DEFAULT 0 NOT NULL,
+	is_deleted BOOLEAN DEFAULT FALSE NOT NULL,
+	is_locked BOOLEAN DEFAULT FALSE NOT NULL,
+	lock_owner TEXT NULL,
+	lock_until TIMESTAMP NULL,
+	locked_at TIMESTAMP NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (instance_id)
+);
+
+CREATE TABLE IF NOT EXISTS pending_steps (
+	id TEXT NOT NULL,
+	instance_id TEXT NOT NULL,
+	step_id TEXT NOT NULL,
+	data TEXT NULL,
+	is_deleted BOOLEAN DEFAULT FALSE NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id),
+	FOREIGN KEY (instance_id) REFERENCES workflow_data (instance_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS step_change_event (
+	instance_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	step_id TEXT NOT NULL,
+	status TEXT NULL,
+	data TEXT NULL,
+	is_deleted BOOLEAN DEFAULT FALSE NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (instance_id, event_id),
+	FOREIGN KEY (instance_id) REFERENCES workflow_data (instance_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS step_state (
+	instance_id TEXT NOT NULL,
+	step_id TEXT NOT NULL,
+	iteration INTEGER DEFAULT 0 NOT NULL,
+	parent_step TEXT NULL,
+	child_count INTEGER NULL,
+	status TEXT NULL,
+	step_state TEXT NULL,
+	version INTEGER DEFAULT 0 NOT NULL,
+	PRIMARY KEY (instance_id, step_id, iteration),
+	FOREIGN KEY (instance_id) REFERENCES workflow_data (instance_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS workflow_state (
+	instance_id TEXT NOT NULL,
+	workflow_id TEXT NOT NULL,
+	workflow_version INTEGER NOT NULL,
+	instance_version INTEGER NULL,
+	status TEXT NULL,
+	reason TEXT NULL,
+	error TEXT NULL,
+	parent_instance_id TEXT NULL,
+	parent_step_id TEXT NULL,
+	parent_iteration INTEGER NULL,
+	compensation TEXT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (instance_id, workflow_id, workflow_version),
+	FOREIGN KEY (instance_id) REFERENCES workflow_data (instance_id) ON DELETE CASCADE,
+	FOREIGN KEY (workflow_id, workflow_version) REFERENCES workflows (workflow_id, version) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS workflow_state_parent_instance_id_idx ON workflow_state (parent_instance_id);
+
+CREATE TABLE IF NOT EXISTS timers (
+	id TEXT NOT NULL,
+	instance_id TEXT NOT NULL,
+	step_id TEXT NULL,
+	iteration INTEGER DEFAULT 0 NOT NULL,
+	timer_type TEXT NOT NULL,
+	fire_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id),
+	FOREIGN KEY (instance_id) REFERENCES workflow_data (instance_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS timers_fire_at_idx ON timers (fire_at);
+
+CREATE TABLE IF NOT EXISTS signals (
+	id TEXT NOT NULL,
+	instance_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	payload TEXT NULL,
+	received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id),
+	FOREIGN KEY (instance_id) REFERENCES workflow_data (instance_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS signals_instance_id_idx ON signals (instance_id, received_at);
+
+CREATE TABLE IF NOT EXISTS schedules (
+	id TEXT NOT NULL,
+	workflow_id TEXT NOT NULL,
+	schedule TEXT NOT NULL,
+	next_run_at TIMESTAMP NOT NULL,
+	paused BOOLEAN DEFAULT FALSE NOT NULL,
+	queued INTEGER DEFAULT 0 NOT NULL,
+	version INTEGER DEFAULT 0 NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS schedules_next_run_at_idx ON schedules (next_run_at);
+
+CREATE TABLE IF NOT EXISTS triggers (
+	id TEXT NOT NULL,
+	topic TEXT NOT NULL,
+	data TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS trigger_messages (
+	trigger_id TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	PRIMARY KEY (trigger_id, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS trigger_messages_created_at_idx ON trigger_messages (created_at);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id TEXT NOT NULL,
+	instance_id TEXT NOT NULL,
+	task_type TEXT NOT NULL,
+	event TEXT NULL,
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	lease_owner TEXT NULL,
+	lease_until TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS tasks_lease_until_idx ON tasks (lease_until, created_at);
+`
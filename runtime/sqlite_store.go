@@ -0,0 +1,62 @@
+package runtime
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+// DefaultSQLiteBusyTimeout is the time a write waits for the lock of the database held by another write.
+const DefaultSQLiteBusyTimeout = 5 * time.Second
+
+// SQLiteStorage is a Storage keeping its data in a single SQLite file, e.g. for local development or edge
+// deployments without a Postgres server. Its data survives a restart and the instances are locked with the same
+// conditional updates as in Postgres.
+// SQLite allows a single write at a time, so the transactions take the lock of the database when they begin and the
+// other writes wait for it up to the busy timeout. The times are stored in UTC so that they compare as text.
+type SQLiteStorage struct {
+	*SQLStorage
+}
+
+// sqliteDialect is the dialect of the SQLiteStorage. SQLite has no row locks, the update leasing the tasks is a single
+// write so the concurrent workers never lease the same task twice. Its timestamps have a precision of a second, the
+// rows created in the same second are ordered by their rowid.
+var sqliteDialect = &sqlDialect{
+	storageType: config.SQLiteStorageType,
+	placeholder: "?",
+	utcTimes:    true,
+	insertOrder: ", rowid ASC",
+}
+
+func ConnectSQLite(c *config.StorageConfig) (sStorage *SQLiteStorage, err error) {
+	if c.Provider == nil || c.Provider.SQLite == nil || c.Provider.SQLite.Path == "" {
+		err = errors.New("the path of the sqlite database is required")
+		return
+	}
+	busyTimeout := DefaultSQLiteBusyTimeout
+	if c.Provider.SQLite.BusyTimeoutMs > 0 {
+		busyTimeout = time.Duration(c.Provider.SQLite.BusyTimeoutMs) * time.Millisecond
+	}
+	// WAL lets the reads run alongside the write, the transactions are immediate so that they never fail to
+	// upgrade a read lock
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=%d&_foreign_keys=on&_journal_mode=WAL&_txlock=immediate&_loc=auto", c.Provider.SQLite.Path, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		logger.ErrorF("Error creating the sqlite schema: %v", err)
+		err = errors.New("error creating the sqlite schema")
+		return
+	}
+	logger.InfoF("Connected to SQLite database %s", c.Provider.SQLite.Path)
+	sStorage = &SQLiteStorage{
+		SQLStorage: &SQLStorage{Database: db, dialect: sqliteDialect},
+	}
+	return
+}
@@ -0,0 +1,157 @@
+package runtime
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+// newSQLiteStorage connects to a new SQLite database with a workflow and an instance of it.
+func newSQLiteStorage(t *testing.T, path string) *SQLiteStorage {
+	storage, err := ConnectSQLite(&config.StorageConfig{
+		Type:     config.SQLiteStorageType,
+		Provider: &config.Provider{SQLite: &config.SQLiteStorage{Path: path}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { storage.Database.Close() })
+	return storage
+}
+
+func createSQLiteInstance(t *testing.T, storage *SQLiteStorage, instanceId string) {
+	err := storage.SaveWorkflow(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", instanceId, data.NewPipelineFrom(map[string]any{data.InstanceIdKey: instanceId}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: instanceId, WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestSQLiteLockInstance(t *testing.T) {
+	storage := newSQLiteStorage(t, filepath.Join(t.TempDir(), "orcaloop.db"))
+	createSQLiteInstance(t, storage, "instance-1")
+	locked, err := storage.LockInstance("instance-1", "owner-1", time.Minute)
+	if err != nil || !locked {
+		t.Fatalf("expected the instance to be locked, got %v %v", locked, err)
+	}
+	locked, err = storage.LockInstance("instance-1", "owner-2", time.Minute)
+	if err != nil || locked {
+		t.Errorf("expected the lock to be held by owner-1, got %v %v", locked, err)
+	}
+	err = storage.UnlockInstance("instance-1", "owner-2")
+	if !IsLockNotOwned(err) {
+		t.Errorf("expected ErrLockNotOwned, got %v", err)
+	}
+	err = storage.UnlockInstance("instance-1", "owner-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// An expired lease can be taken over
+	_, err = storage.LockInstance("instance-1", "owner-1", -time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expired, err := storage.GetExpiredLocks(time.Now())
+	if err != nil || len(expired) != 1 || expired[0] != "instance-1" {
+		t.Errorf("expected the lock of instance-1 to be expired, got %v %v", expired, err)
+	}
+	locked, err = storage.LockInstance("instance-1", "owner-2", time.Minute)
+	if err != nil || !locked {
+		t.Errorf("expected the expired lock to be taken over, got %v %v", locked, err)
+	}
+}
+
+func TestSQLiteVersionConflict(t *testing.T) {
+	storage := newSQLiteStorage(t, filepath.Join(t.TempDir(), "orcaloop.db"))
+	createSQLiteInstance(t, storage, "instance-1")
+	state, err := storage.GetState("instance-1")
+	if err != nil || state.InstanceVersion != 1 || state.Status != models.StatusRunning {
+		t.Fatalf("expected the running state with version 1, got %v %v", state, err)
+	}
+	stale := *state
+	state.Status = models.StatusCompleted
+	err = storage.SaveState(state)
+	if err != nil || state.InstanceVersion != 2 {
+		t.Fatalf("expected the state to be saved with version 2, got %d %v", state.InstanceVersion, err)
+	}
+	err = storage.SaveState(&stale)
+	if !IsVersionConflict(err) {
+		t.Errorf("expected a version conflict for the stale state, got %v", err)
+	}
+	stepState := &StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning}
+	err = storage.SaveStepState(stepState)
+	if err != nil || stepState.Version != 1 {
+		t.Fatalf("expected the step state to be created with version 1, got %d %v", stepState.Version, err)
+	}
+	staleStep := *stepState
+	err = storage.SaveStepState(stepState)
+	if err != nil || stepState.Version != 2 {
+		t.Fatalf("expected the step state to be saved with version 2, got %d %v", stepState.Version, err)
+	}
+	err = storage.SaveStepState(&staleStep)
+	if !IsVersionConflict(err) {
+		t.Errorf("expected a version conflict for the stale step state, got %v", err)
+	}
+}
+
+func TestSQLiteWithTx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orcaloop.db")
+	storage := newSQLiteStorage(t, path)
+	createSQLiteInstance(t, storage, "instance-1")
+	errFailed := errors.New("failed")
+	err := storage.WithTx(func(tx Storage) error {
+		err := tx.AddTask(&Task{Id: "task-1", InstanceId: "instance-1", Type: TaskTypeExecute, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+	err = storage.WithTx(func(tx Storage) error {
+		// A nested transaction joins the transaction of the caller
+		return tx.WithTx(func(nested Storage) error {
+			return nested.AddTask(&Task{Id: "task-2", InstanceId: "instance-1", Type: TaskTypeExecute, CreatedAt: time.Now()})
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// The committed data survives a restart
+	storage.Database.Close()
+	storage = newSQLiteStorage(t, path)
+	tasks, err := storage.LeaseTasks("owner-1", 10, time.Minute)
+	if err != nil || len(tasks) != 1 || tasks[0].Id != "task-2" {
+		t.Fatalf("expected only the committed task to be leased, got %v %v", tasks, err)
+	}
+	tasks, err = storage.LeaseTasks("owner-2", 10, time.Minute)
+	if err != nil || len(tasks) != 0 {
+		t.Errorf("expected the leased task to be invisible, got %v %v", tasks, err)
+	}
+	// The leased task still belongs to the instance
+	queued, err := storage.HasTasks("instance-1")
+	if err != nil || !queued {
+		t.Errorf("expected the instance to have a task, got %v %v", queued, err)
+	}
+	queued, err = storage.HasTasks("instance-2")
+	if err != nil || queued {
+		t.Errorf("expected the other instance to have no task, got %v %v", queued, err)
+	}
+	state, err := storage.GetState("instance-1")
+	if err != nil || state.Status != models.StatusRunning {
+		t.Errorf("expected the state to survive the restart, got %v %v", state, err)
+	}
+}
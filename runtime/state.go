@@ -1,6 +1,8 @@
 package runtime
 
 import (
+	"time"
+
 	"oss.nandlabs.io/orcaloop-sdk/data"
 	"oss.nandlabs.io/orcaloop-sdk/models"
 )
@@ -11,11 +13,14 @@ import (
 //
 // Fields:
 // - InstanceId: The unique identifier of the instance.
-// - InstanceVersion: The version of the instance.
+// - InstanceVersion: The version of the instance, bumped by every save. An instance with version 0 was never saved.
 // - WorkflowId: The unique identifier of the workflow.
 // - WorkflowVersion: The version of the workflow.
 // - Status: The current status of the workflow.
+// - Reason: The reason the workflow was stopped by the runtime, if any.
 // - Error: Any error that may have occurred during the execution of the workflow.
+// - Parent: The step of the parent instance that started the instance, if it is a child instance.
+// - Compensation: The compensation phase of a failed instance, if any of its completed steps had to be compensated.
 
 type WorkflowState struct {
 	InstanceId      string        `json:"id" yaml:"id"`
@@ -23,7 +28,39 @@ type WorkflowState struct {
 	WorkflowId      string        `json:"workflow_id" yaml:"workflow_id"`
 	WorkflowVersion int           `json:"workflow_version" yaml:"workflow_version"`
 	Status          models.Status `json:"status" yaml:"status"`
+	Reason          Reason        `json:"reason,omitempty" yaml:"reason,omitempty"`
 	Error           string        `json:"error" yaml:"error"`
+	Parent          *ParentLink   `json:"parent,omitempty" yaml:"parent,omitempty"`
+	Compensation    *Compensation `json:"compensation,omitempty" yaml:"compensation,omitempty"`
+}
+
+// Reason represents why the runtime stopped a workflow instance.
+type Reason string
+
+const (
+	// ReasonTimedOut is used when the instance exceeded its timeout.
+	ReasonTimedOut Reason = "TimedOut"
+	// ReasonPaused is used while the instance is paused.
+	ReasonPaused Reason = "Paused"
+	// ReasonCancelled is used when the instance was cancelled.
+	ReasonCancelled Reason = "Cancelled"
+	// ReasonTerminated is used when the instance was terminated.
+	ReasonTerminated Reason = "Terminated"
+	// ReasonAbandoned is used when the recovery failed an instance left behind by a crashed process.
+	ReasonAbandoned Reason = "Abandoned"
+	// ReasonStalled is used when a task of the instance failed more than DefaultTaskMaxAttempts times.
+	ReasonStalled Reason = "Stalled"
+)
+
+// IsPaused returns true if the instance is paused.
+// A paused instance is pending with the ReasonPaused reason.
+func (ws *WorkflowState) IsPaused() bool {
+	return ws.Status == models.StatusPending && ws.Reason == ReasonPaused
+}
+
+// IsActive returns true if the instance is running or paused.
+func (ws *WorkflowState) IsActive() bool {
+	return ws.Status == models.StatusRunning || ws.IsPaused()
 }
 
 // StepState represents the state of a step in a pipeline execution.
@@ -38,13 +75,27 @@ type WorkflowState struct {
 // - Status: The current status of the step.
 // - Input: The input data for the step, represented as a Pipeline object.
 // - Output: The output data from the step, represented as a Pipeline object.
+// - Attempts: The failed attempts of the step.
+// - NextRetryAt: The time at which the step is retried next. Zero if no retry is scheduled.
+// - StartedAt: The time at which the step started running or was last retried.
+// - CompletedAt: The time at which the step completed.
+// - Block: The block of a try step that is running.
+// - NextIteration: The next iteration started by a for loop that runs its iterations in parallel.
+// - Version: The version of the step state, bumped by every save. Version 0 is a new start replacing the stored one.
 type StepState struct {
-	InstanceId string         `json:"instance_id" yaml:"instance_id"`
-	StepId     string         `json:"step_id" yaml:"step_id"`
-	Iteration  int            `json:"iteration" yaml:"iteration"`
-	ParentStep string         `json:"parent_step" yaml:"parent_step"`
-	ChildCount int            `json:"child_count" yaml:"child_count"`
-	Status     models.Status  `json:"status" yaml:"status"`
-	Input      *data.Pipeline `json:"input" yaml:"input"`
-	Output     *data.Pipeline `json:"output" yaml:"output"`
+	InstanceId    string         `json:"instance_id" yaml:"instance_id"`
+	StepId        string         `json:"step_id" yaml:"step_id"`
+	Iteration     int            `json:"iteration" yaml:"iteration"`
+	ParentStep    string         `json:"parent_step" yaml:"parent_step"`
+	ChildCount    int            `json:"child_count" yaml:"child_count"`
+	Status        models.Status  `json:"status" yaml:"status"`
+	Input         *data.Pipeline `json:"input" yaml:"input"`
+	Output        *data.Pipeline `json:"output" yaml:"output"`
+	Attempts      []*Attempt     `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	NextRetryAt   time.Time      `json:"next_retry_at,omitempty" yaml:"next_retry_at,omitempty"`
+	StartedAt     time.Time      `json:"started_at,omitempty" yaml:"started_at,omitempty"`
+	CompletedAt   time.Time      `json:"completed_at,omitempty" yaml:"completed_at,omitempty"`
+	Block         TryBlock       `json:"block,omitempty" yaml:"block,omitempty"`
+	NextIteration int            `json:"next_iteration,omitempty" yaml:"next_iteration,omitempty"`
+	Version       int            `json:"version" yaml:"version"`
 }
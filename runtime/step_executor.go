@@ -2,11 +2,11 @@ package runtime
 
 import (
 	"strconv"
-	"sync"
+	"time"
 
 	"oss.nandlabs.io/golly/assertion"
-	"oss.nandlabs.io/golly/errutils"
 	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
 	"oss.nandlabs.io/orcaloop-sdk/models"
 )
 
@@ -14,22 +14,29 @@ type StepExecutor struct {
 	storage Storage
 }
 
+// Execute starts the step. A step that fails once it started is failed with the error, a step that fails to start
+// returns the error so that the task executing it is retried.
 func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err error) {
 	// Start the execution of the step
-	instanceId := pipeline.Id()
 	parentId := pipeline.GetParent()
-	iteration, err := data.ExtractValue[int](pipeline, data.StepIterationKey)
-	if err != nil {
-		iteration = 0
-	}
+	iteration := getIteration(pipeline)
 	logger.DebugF("Executing Step %s with parent %s and iteration %d", step.Id, parentId, iteration)
 	stepState := &StepState{
-		InstanceId: instanceId,
+		InstanceId: pipeline.Id(),
 		StepId:     step.Id,
 		ParentStep: parentId,
 		Iteration:  iteration,
 		Status:     models.StatusRunning,
 	}
+	err = se.execute(step, stepState, pipeline)
+	if err != nil {
+		err = se.fail(stepState, err)
+	}
+	return
+}
+
+func (se *StepExecutor) execute(step *models.Step, stepState *StepState, pipeline *data.Pipeline) (err error) {
+	instanceId := stepState.InstanceId
 	switch step.Type {
 	case models.StepTypeForLoop:
 		var items []any = step.For.ItemsArr
@@ -44,7 +51,7 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 			}
 		}
 		stepState.ChildCount = len(items) * len(step.For.Steps)
-		err = se.storage.SaveStepState(stepState)
+		err = se.start(stepState)
 		if err != nil {
 			return
 		}
@@ -52,6 +59,15 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 			stepState.Status = models.StatusSkipped
 			return
 		}
+		var forEach *ForEach
+		forEach, err = getForEach(se.storage, instanceId, step.Id)
+		if err != nil {
+			return
+		}
+		if forEach != nil && forEach.Parallelism > 1 {
+			err = se.startForEach(step, stepState, forEach, len(items), pipeline)
+			return
+		}
 		// Execute the steps for each item in the array
 		var pendingSteps []*PendingStep
 		var childPipeline *data.Pipeline
@@ -112,7 +128,10 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 		}
 		if len(steps) > 0 {
 			stepState.ChildCount = len(steps)
-			err = se.storage.SaveStepState(stepState)
+			err = se.start(stepState)
+			if err != nil {
+				return
+			}
 			for _, childStep := range steps {
 				childPipeline := cloneFor(pipeline, childStep, step.Id)
 				err = se.Execute(childStep, childPipeline)
@@ -122,25 +141,34 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 			}
 		}
 	case models.StepTypeParallel:
+		var stepOptions *StepOptions
+		var workers int
+		stepOptions, err = getStepOptions(se.storage, instanceId, step.Id)
+		if err != nil {
+			return
+		}
+		if stepOptions != nil {
+			workers = stepOptions.Workers
+		}
 		stepState.ChildCount = len(step.Parallel.Steps)
-		err = se.storage.SaveStepState(stepState)
-		wg := sync.WaitGroup{}
-		var multiErr = errutils.NewMultiErr(nil)
+		err = se.start(stepState)
+		if err != nil {
+			return
+		}
+		// Every branch gets its own pipeline, cloned before the branches start
+		branches := make([]func() error, 0, len(step.Parallel.Steps))
 		for _, childStep := range step.Parallel.Steps {
+			childStep := childStep
 			childPipeline := cloneFor(pipeline, childStep, step.Id)
-			wg.Add(1)
-			go func(multiErr *errutils.MultiError) {
-				defer wg.Done()
-				err := se.Execute(childStep, childPipeline)
+			branches = append(branches, func() (err error) {
+				err = se.Execute(childStep, childPipeline)
 				if err != nil {
-					multiErr.Add(err)
+					err = se.failBranch(childStep, childPipeline, err)
 				}
-			}(multiErr)
-			wg.Wait()
-			if multiErr.HasErrors() {
-				err = multiErr
-			}
+				return
+			})
 		}
+		err = runBranches(workers, branches)
 	case models.StepTypeSwitch:
 		var value any
 		value, err = data.ExtractValue[any](pipeline, step.Switch.Variable)
@@ -166,7 +194,10 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 		}
 		if len(steps) > 0 {
 			stepState.ChildCount = len(steps)
-			err = se.storage.SaveStepState(stepState)
+			err = se.start(stepState)
+			if err != nil {
+				return
+			}
 			for _, childStep := range steps {
 				childPipeline := cloneFor(pipeline, childStep, step.Id)
 				err = se.Execute(childStep, childPipeline)
@@ -175,9 +206,49 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 				}
 			}
 		}
+	case StepTypeWorkflow:
+		stepState.ChildCount = 0
+		err = se.start(stepState)
+		if err != nil {
+			return
+		}
+		err = startChild(se.storage, step, pipeline)
+		if err != nil {
+			return
+		}
+	case StepTypeWait:
+		stepState.ChildCount = 0
+		err = se.start(stepState)
+		if err != nil {
+			return
+		}
+		err = startWait(se.storage, stepState)
+		if err != nil {
+			return
+		}
+	case StepTypeDelay:
+		stepState.ChildCount = 0
+		err = se.start(stepState)
+		if err != nil {
+			return
+		}
+		err = startDelay(se.storage, stepState, pipeline)
+		if err != nil {
+			return
+		}
+	case StepTypeTry:
+		err = se.startTry(step, stepState, pipeline)
+		if err != nil {
+			return
+		}
+	case StepTypeWhile:
+		err = se.startWhile(step, stepState, pipeline)
+		if err != nil {
+			return
+		}
 	case models.StepTypeAction:
 		stepState.ChildCount = 0
-		err = se.storage.SaveStepState(stepState)
+		err = se.start(stepState)
 		if err != nil {
 			return
 		}
@@ -190,6 +261,50 @@ func (se *StepExecutor) Execute(step *models.Step, pipeline *data.Pipeline) (err
 	return
 }
 
+// fail fails a step that started but could not be executed, e.g. because its action is not found. The failure is
+// handled like the failure reported by an action, it is caught by an enclosing try step or fails the instance.
+// Otherwise the step would stay running and the instance would wait for it forever. The error is returned as is if
+// the step did not start.
+func (se *StepExecutor) fail(stepState *StepState, cause error) (err error) {
+	var savedState *StepState
+	savedState, err = se.storage.GetStepState(stepState.InstanceId, stepState.StepId, stepState.Iteration)
+	if err != nil && !IsStepStateNotFound(err) {
+		return
+	}
+	if savedState == nil || savedState.Status != models.StatusRunning {
+		err = cause
+		return
+	}
+	logger.ErrorF("Step %s of instance %s failed: %v", stepState.StepId, stepState.InstanceId, cause)
+	event := &events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: stepState.InstanceId,
+		StepId:     stepState.StepId,
+		Status:     models.StatusFailed,
+		Data: map[string]any{
+			data.ErrorKey:         cause.Error(),
+			data.StepIterationKey: stepState.Iteration,
+		},
+	}
+	stepChangeHandler := &StepChangeHander{storage: se.storage}
+	err = stepChangeHandler.Handle(event)
+	return
+}
+
+// start saves the state of a step that started running and arms the timeout of the step.
+func (se *StepExecutor) start(stepState *StepState) (err error) {
+	stepState.StartedAt = time.Now()
+	err = se.storage.WithTx(func(tx Storage) (err error) {
+		err = tx.SaveStepState(stepState)
+		if err != nil {
+			return
+		}
+		err = startStepTimer(tx, stepState)
+		return
+	})
+	return
+}
+
 func cloneFor(pipeline *data.Pipeline, step *models.Step, parent string) (clone *data.Pipeline) {
 	clone = pipeline.Clone()
 	clone.Set(data.StepIdKey, step.Id)
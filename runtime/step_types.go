@@ -0,0 +1,24 @@
+package runtime
+
+import "oss.nandlabs.io/orcaloop-sdk/models"
+
+// The step types the runtime supports in addition to the ones defined by the sdk.
+// Their configuration is registered in the StepOptions of the step.
+const (
+	// StepTypeWorkflow starts another workflow as a child instance and waits for it to complete.
+	StepTypeWorkflow models.StepType = "workflow"
+	// StepTypeWait waits until a signal is delivered to the instance.
+	StepTypeWait models.StepType = "wait"
+	// StepTypeDelay waits for a duration or until a point in time.
+	StepTypeDelay models.StepType = "delay"
+	// StepTypeTry runs a block of steps and handles their failures with catch and finally blocks.
+	StepTypeTry models.StepType = "try"
+	// StepTypeWhile repeats its steps as long as a condition holds.
+	StepTypeWhile models.StepType = "while"
+)
+
+// isLeaf returns true for the step types that have no child steps.
+// A running leaf step completes once its StepChangeEvent is received.
+func isLeaf(stepType models.StepType) bool {
+	return stepType == models.StepTypeAction || stepType == StepTypeWorkflow || stepType == StepTypeWait || stepType == StepTypeDelay
+}
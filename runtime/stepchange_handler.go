@@ -1,71 +1,153 @@
 package runtime
 
 import (
+	"sync"
+	"time"
+
 	"oss.nandlabs.io/orcaloop-sdk/data"
 	"oss.nandlabs.io/orcaloop-sdk/events"
 	"oss.nandlabs.io/orcaloop-sdk/models"
 )
 
+// DefaultLockLease is the time an instance stays locked unless it is unlocked by the owner of the lock. The owner
+// extends the lease with heartbeats while it holds the lock. Once the lease expired, e.g. because the process holding
+// the lock crashed, the instance can be locked again.
+const DefaultLockLease = 5 * time.Minute
+
 type StepChangeHander struct {
 	storage Storage
+	lease   time.Duration // the lease of the instance locks, DefaultLockLease if not set
 }
 
 func (sh *StepChangeHander) Handle(stepChangeEvent *events.StepChangeEvent) (err error) {
 	var lock bool
-	if err != nil {
-		return
+	lock, err = sh.runLocked(stepChangeEvent.InstanceId, func() error {
+		return sh.processStepChange(stepChangeEvent, nil)
+	})
+	if err == nil && !lock {
+		// Save the event as the instance is already locked
+		err = sh.storage.SaveStepChangeEvent(stepChangeEvent)
 	}
+	return
+}
+
+// runLocked runs f while holding the lock of the instance, a heartbeat extends the lease of the lock until f is done.
+// The StepChangeEvents saved while the lock was held are processed before the instance is unlocked.
+// It returns false without running f if the instance is locked by someone else.
+func (sh *StepChangeHander) runLocked(instanceId string, f func() error) (lock bool, err error) {
 	// Lock the instance
-	lock, err = sh.storage.LockInstance(stepChangeEvent.InstanceId)
-	if err != nil {
+	owner := CreateId()
+	lease := sh.lease
+	if lease == 0 {
+		lease = DefaultLockLease
+	}
+	lock, err = sh.storage.LockInstance(instanceId, owner, lease)
+	if err != nil || !lock {
 		return
 	}
-	if lock {
-		defer func() {
-			logger.DebugF("Unlocking instance %s", stepChangeEvent.InstanceId)
-			var pendingStepChangeEvents []*events.StepChangeEvent
-			// Get all pending step change events
-			for {
-				pendingStepChangeEvents, err = sh.storage.GetStepChangeEvents(stepChangeEvent.InstanceId)
-				if err != nil {
-					return
-				}
-				if len(pendingStepChangeEvents) == 0 {
-					break
-				}
-				for _, pendingStepChangeEvent := range pendingStepChangeEvents {
-					err = sh.processStepChange(pendingStepChangeEvent)
-					if err != nil {
-						return
-					}
-					err = sh.storage.DeleteStepChangeEvent(pendingStepChangeEvent.InstanceId, pendingStepChangeEvent.EventId)
-					if err != nil {
-						return
-					}
-				}
-				if err != nil {
-					return
+	heartbeat := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeat:
+				return
+			case <-ticker.C:
+				extended, err := sh.storage.ExtendInstanceLock(instanceId, owner, lease)
+				if err != nil || !extended {
+					logger.ErrorF("Unable to extend the lock of instance %s: %v", instanceId, err)
 				}
 			}
-			// unlock instance at the end
-			err = sh.storage.UnlockInstance(stepChangeEvent.InstanceId)
-			logger.DebugF("Instance %s unlocked with error %v", stepChangeEvent.InstanceId, err)
-		}()
-		err = sh.processStepChange(stepChangeEvent)
-	} else {
-		// Save the event as the instance is already locked
-		err = sh.storage.SaveStepChangeEvent(stepChangeEvent)
-		// Return without processing
+		}
+	}()
+	defer func() {
+		logger.DebugF("Unlocking instance %s", instanceId)
+		if err == nil {
+			err = sh.processPending(instanceId)
+		}
+		close(heartbeat)
+		wg.Wait()
+		// unlock instance at the end
+		unlockErr := sh.storage.UnlockInstance(instanceId, owner)
+		logger.DebugF("Instance %s unlocked with error %v", instanceId, unlockErr)
+		if err == nil {
+			err = unlockErr
+		}
+	}()
+	err = f()
+	return
+}
+
+// processPending processes the StepChangeEvents and signals that were saved for the instance while it was locked.
+func (sh *StepChangeHander) processPending(instanceId string) (err error) {
+	var pendingStepChangeEvents []*events.StepChangeEvent
+	for {
+		pendingStepChangeEvents, err = sh.storage.GetStepChangeEvents(instanceId)
+		if err != nil {
+			return
+		}
+		if len(pendingStepChangeEvents) == 0 {
+			// Deliver the signals that were received while the instance was locked
+			var delivered bool
+			delivered, err = sh.deliverSignal(instanceId)
+			if err != nil || !delivered {
+				return
+			}
+			continue
+		}
+		for _, pendingStepChangeEvent := range pendingStepChangeEvents {
+			// The event is deleted along with the transition it caused
+			err = sh.processStepChange(pendingStepChangeEvent, func(tx Storage) error {
+				return tx.DeleteStepChangeEvent(pendingStepChangeEvent.InstanceId, pendingStepChangeEvent.EventId)
+			})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// processStepChange applies the StepChangeEvent and the writes of done, if any, in one transaction. The instance
+// continues with its next step once the transaction is committed.
+func (sh *StepChangeHander) processStepChange(stepChangeEvent *events.StepChangeEvent, done func(tx Storage) error) (err error) {
+	var workflow *models.Workflow
+	var pipeline *VersionedPipeline
+	var next bool
+	err = sh.storage.WithTx(func(tx Storage) (err error) {
+		txHandler := &StepChangeHander{storage: tx}
+		workflow, next, err = txHandler.applyStepChange(stepChangeEvent)
+		if err != nil || done == nil {
+			return
+		}
+		err = done(tx)
+		return
+	})
+	if err != nil || !next {
 		return
 	}
+	// The pipeline is read again as the transition may have saved it, e.g. with the error caught by a try step
+	pipeline, err = sh.storage.GetPipeline(stepChangeEvent.InstanceId)
+	if err != nil {
+		return
+	}
+	// Execute Next Step
+	workfFlowExecutor := &WorkflowExecutor{
+		storage: sh.storage,
+	}
+	err = workfFlowExecutor.Execute(workflow, pipeline)
 	return
 }
 
-func (sh *StepChangeHander) processStepChange(stepChangeEvent *events.StepChangeEvent) (err error) {
+// applyStepChange saves the transition of the step reported by the StepChangeEvent. It returns true if the instance
+// continues with its next step.
+func (sh *StepChangeHander) applyStepChange(stepChangeEvent *events.StepChangeEvent) (workflow *models.Workflow, next bool, err error) {
 	logger.DebugF("Processing StepChangeEvent %v", stepChangeEvent)
-	var pipeline *data.Pipeline
+	var pipeline *VersionedPipeline
 	var stepState *StepState
-	var workflow *models.Workflow
 	pipeline, err = sh.storage.GetPipeline(stepChangeEvent.InstanceId)
 	if err != nil {
 		return
@@ -84,12 +166,24 @@ func (sh *StepChangeHander) processStepChange(stepChangeEvent *events.StepChange
 	if err != nil {
 		return
 	}
+	if stepState == nil {
+		err = ErrStepStateNotFound(stepChangeEvent.StepId)
+		return
+	}
+	if stepState.Status != models.StatusRunning {
+		// The step was already finished, e.g. it timed out before the action reported back
+		logger.InfoF("Ignoring StepChangeEvent %s as step %s of instance %s is not running", stepChangeEvent.EventId, stepChangeEvent.StepId, stepChangeEvent.InstanceId)
+		return
+	}
 	stepState.Output = outputPipeline
 	// step = utils.GetStepById(stepChangeEvent.StepId, workflow)
 	// if err != nil {
 	// 	return
 	// }
 	stepState.Status = stepChangeEvent.Status
+	if stepState.Status == models.StatusCompleted {
+		stepState.CompletedAt = time.Now()
+	}
 	err = sh.storage.SaveStepState(stepState)
 	if err != nil {
 		return
@@ -101,15 +195,29 @@ func (sh *StepChangeHander) processStepChange(stepChangeEvent *events.StepChange
 	}
 	switch stepChangeEvent.Status {
 	case models.StatusCompleted, models.StatusSkipped:
-		// Execute Next Step
-		workfFlowExecutor := &WorkflowExecutor{
-			storage: sh.storage,
-		}
-		err = workfFlowExecutor.Execute(workflow, pipeline)
+		err = advanceForEach(sh.storage, workflow, stepState)
 		if err != nil {
 			return
 		}
+		next = true
 	case models.StatusFailed:
+		var caught, tolerated bool
+		tolerated, err = toleratesFailure(sh.storage, workflow, stepState)
+		if err != nil {
+			return
+		}
+		if !tolerated {
+			caught, err = catchFailure(sh.storage, workflow, stepState)
+			if err != nil {
+				return
+			}
+		}
+		if caught || tolerated {
+			// Continue with the catch or finally block of the enclosing try step, or let the join policy of the
+			// enclosing parallel step decide
+			next = true
+			return
+		}
 		// Fail the instance
 		var workflowState *WorkflowState
 		workflowState, err = sh.storage.GetState(stepChangeEvent.InstanceId)
@@ -122,7 +230,7 @@ func (sh *StepChangeHander) processStepChange(stepChangeEvent *events.StepChange
 			workflowState.Error = errMsg.(string)
 		}
 		workflowState.Status = models.StatusFailed
-		err = sh.storage.SaveState(workflowState)
+		err = finishInstance(sh.storage, workflowState)
 	}
 	return
 }
@@ -0,0 +1,134 @@
+package runtime
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunLockedProcessesOneAtATime(t *testing.T) {
+	const handlers = 20
+	storage := NewInMemoryStorage(nil)
+	sh := &StepChangeHander{storage: storage}
+	var active, overlaps, processed int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < handlers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lock, err := sh.runLocked("instance-1", func() error {
+					if atomic.AddInt32(&active, 1) > 1 {
+						atomic.AddInt32(&overlaps, 1)
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt32(&processed, 1)
+					atomic.AddInt32(&active, -1)
+					return nil
+				})
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+					return
+				}
+				if lock {
+					return
+				}
+				// The instance is busy, try again like a saved event would be
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+	if overlaps != 0 {
+		t.Errorf("expected the events to be processed one at a time, %d overlapped", overlaps)
+	}
+	if processed != handlers {
+		t.Errorf("expected %d events to be processed, got %d", handlers, processed)
+	}
+}
+
+func TestRunLockedBusy(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	sh := &StepChangeHander{storage: storage}
+	var nested bool
+	lock, err := sh.runLocked("instance-1", func() (err error) {
+		nested, err = sh.runLocked("instance-1", func() error {
+			t.Error("the instance was locked twice")
+			return nil
+		})
+		return
+	})
+	if err != nil || !lock {
+		t.Fatalf("expected the instance to be locked, got %v %v", lock, err)
+	}
+	if nested {
+		t.Error("expected the nested lock to fail")
+	}
+}
+
+func TestUnlockInstanceOwner(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	lock, err := storage.LockInstance("instance-1", "owner-1", time.Minute)
+	if err != nil || !lock {
+		t.Fatalf("expected the instance to be locked, got %v %v", lock, err)
+	}
+	err = storage.UnlockInstance("instance-1", "owner-2")
+	if !IsLockNotOwned(err) {
+		t.Errorf("expected a lock not owned error, got %v", err)
+	}
+	lock, _ = storage.LockInstance("instance-1", "owner-2", time.Minute)
+	if lock {
+		t.Error("expected the lock to be held by the first owner")
+	}
+	err = storage.UnlockInstance("instance-1", "owner-1")
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLockInstanceExpiredLease(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	lock, err := storage.LockInstance("instance-1", "owner-1", -time.Second)
+	if err != nil || !lock {
+		t.Fatalf("expected the instance to be locked, got %v %v", lock, err)
+	}
+	expired, _ := storage.GetExpiredLocks(time.Now())
+	if len(expired) != 1 {
+		t.Errorf("expected the lock to be expired, got %v", expired)
+	}
+	lock, err = storage.LockInstance("instance-1", "owner-2", time.Minute)
+	if err != nil || !lock {
+		t.Fatalf("expected the expired lock to be taken over, got %v %v", lock, err)
+	}
+	err = storage.UnlockInstance("instance-1", "owner-1")
+	if !IsLockNotOwned(err) {
+		t.Errorf("expected a lock not owned error for the previous owner, got %v", err)
+	}
+}
+
+func TestRunLockedExtendsLease(t *testing.T) {
+	const lease = 30 * time.Millisecond
+	storage := NewInMemoryStorage(nil)
+	sh := &StepChangeHander{storage: storage, lease: lease}
+	var stolen bool
+	lock, err := sh.runLocked("instance-1", func() (err error) {
+		// Outlive the lease a few times, the heartbeat keeps the instance locked
+		for i := 0; i < 5; i++ {
+			time.Sleep(lease)
+			var other bool
+			other, err = storage.LockInstance("instance-1", "owner-2", time.Minute)
+			if err != nil {
+				return
+			}
+			stolen = stolen || other
+		}
+		return
+	})
+	if err != nil || !lock {
+		t.Fatalf("expected the instance to be locked, got %v %v", lock, err)
+	}
+	if stolen {
+		t.Error("expected the lease to be extended while the lock was held")
+	}
+}
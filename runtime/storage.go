@@ -1,6 +1,8 @@
 package runtime
 
 import (
+	"time"
+
 	"oss.nandlabs.io/golly/managers"
 	"oss.nandlabs.io/orcaloop-sdk/data"
 	"oss.nandlabs.io/orcaloop-sdk/models"
@@ -15,6 +17,12 @@ type Storage interface {
 	Config() *config.StorageConfig
 	//ActionEndpoint
 	ActionEndpoint(id string) (*models.Endpoint, error)
+	// AddTask queues a task
+	AddTask(task *Task) error
+	// AddTimer adds a timer
+	AddTimer(timer *Timer) error
+	// AddTriggerMessage records a message processed by the trigger. It returns false if the message was already recorded
+	AddTriggerMessage(triggerId, messageId string) (bool, error)
 	//Add Pending Step
 	AddPendingSteps(instanceId string, pendingStep ...*PendingStep) error
 	// ActionSpec returns the spec of the action
@@ -29,48 +37,110 @@ type Storage interface {
 	DeleteAction(id string) error
 	// DeletePendingStep deletes the pending step
 	DeletePendingStep(instanceId string, pendingStep *PendingStep) error
+	// DeleteSchedule deletes the schedule
+	DeleteSchedule(id string) error
+	// DeleteSignal deletes the signal
+	DeleteSignal(instanceId, id string) error
+	// DeleteTrigger deletes the trigger
+	DeleteTrigger(id string) error
+	// DeleteTask deletes the task if it is leased by the owner
+	DeleteTask(id, owner string) error
+	// DeleteTimer deletes the timer
+	DeleteTimer(id string) error
 	// Delete Workflow deletes a workflow configuration
 	DeleteWorkflow(workflowID string, version int) error
 	// DeleteStepChangeEvent deletes the step change event
 	DeleteStepChangeEvent(instanceId, eventId string) error
-	// GetPipeline retrieves the pipeline configuration of a workflow
-	GetPipeline(id string) (*data.Pipeline, error)
+	// ExtendInstanceLock extends the lease of the lock of the instance by the given duration from now. It returns false
+	// if the instance is not locked by the owner anymore
+	ExtendInstanceLock(id, owner string, lease time.Duration) (bool, error)
+	// ExtendTaskLease extends the lease of the task by the given duration from now. It returns false if the task is
+	// not leased by the owner anymore
+	ExtendTaskLease(id, owner string, lease time.Duration) (bool, error)
+	// GetChildInstances retrieves the states of the child instances started by the instance
+	GetChildInstances(instanceId string) ([]*WorkflowState, error)
+	// GetDueTimers retrieves up to limit timers that fire before the given time
+	GetDueTimers(before time.Time, limit int) ([]*Timer, error)
+	// GetExpiredLocks retrieves the ids of the instances whose lock expired before the given time
+	GetExpiredLocks(before time.Time) ([]string, error)
+	// GetInstancesWithStepChangeEvents retrieves the ids of the instances with saved step change events
+	GetInstancesWithStepChangeEvents() ([]string, error)
+	// GetPipeline retrieves the pipeline configuration of a workflow along with its version
+	GetPipeline(id string) (*VersionedPipeline, error)
 	//GetState retrieves the state of a workflow
 	GetState(instanceId string) (*WorkflowState, error)
 	// GetAndRemoveNextPendingStep retrieves the next pending step
 	GetAndRemoveNextPendingStep(instanceId string) (*PendingStep, error)
 	// GetPendingSteps retrieves the pending steps
 	GetPendingSteps(instanceId string) ([]*PendingStep, error)
+	// GetDueSchedules retrieves the schedules that are not paused and due before the given time or have queued runs
+	GetDueSchedules(before time.Time) ([]*Schedule, error)
+	// GetSchedule retrieves the schedule
+	GetSchedule(id string) (*Schedule, error)
+	// GetSignals retrieves the buffered signals of the instance in the order they were received
+	GetSignals(instanceId string) ([]*Signal, error)
+	// GetRunningStepStates retrieves the states of the running steps of all instances that started before the given time
+	GetRunningStepStates(startedBefore time.Time) ([]*StepState, error)
 	//GetStepChangeEvent retrieves the state change events
 	GetStepChangeEvents(instanceId string) ([]*events.StepChangeEvent, error)
 	//GetStepContext provides step context
 	GetStepState(instanceId, stepId string, iteration int) (*StepState, error)
 	// Get StepStates retrieves the states of all steps in a workflow
 	GetStepStates(instanceId string) (map[string][]*StepState, error)
+	// GetTrigger retrieves the trigger
+	GetTrigger(id string) (*Trigger, error)
 	// GetWorkflow retrieves a stored workflow configuration
 	GetWorkflow(workflowID string, version int) (*models.Workflow, error)
+	// GetWorkflowOptions retrieves the options of a workflow. Empty options are returned if none are registered
+	GetWorkflowOptions(workflowID string, version int) (*WorkflowOptions, error)
 	// GetWorkflowByInstance Id retrieves a stored workflow configuration
 	GetWorkflowByInstance(id string) (*models.Workflow, error)
+	// HasTasks returns true if a task of the instance is queued or leased
+	HasTasks(instanceId string) (bool, error)
+	// LeaseTasks leases up to limit tasks whose lease expired, in the order they were queued, for the given duration
+	LeaseTasks(owner string, limit int, lease time.Duration) ([]*Task, error)
 	// ListWorkflows returns a list of all workflows
 	ListWorkflows() ([]*models.Workflow, error)
 	// ListWorkflowVersions returns a list of all versions of a workflow
 	ListWorkflowVersions(workflowID string) ([]*models.Workflow, error)
 	// ListActions returns a list of all actions
 	ListActions() ([]*models.ActionSpec, error)
-	// LockInstance locks an instance
-	LockInstance(id string) (bool, error)
+	// ListSchedules returns a list of all schedules
+	ListSchedules() ([]*Schedule, error)
+	// ListTriggers returns a list of all triggers
+	ListTriggers() ([]*Trigger, error)
+	// LockInstance locks an instance for the owner until the lease expires. It returns false if the instance is
+	// locked by someone else whose lease did not expire yet
+	LockInstance(id, owner string, lease time.Duration) (bool, error)
+	// PruneTriggerMessages deletes the records of the messages processed by the triggers before the given time
+	PruneTriggerMessages(before time.Time) (int, error)
 	// SaveAction saves the action
 	SaveAction(action *models.ActionSpec) error
+	// SaveSchedule creates or updates the schedule. A schedule with a version is only updated if the stored schedule still
+	// has the same version, otherwise an ErrScheduleVersionConflict error is returned. The version is bumped on success.
+	SaveSchedule(schedule *Schedule) error
+	// SaveSignal buffers the signal until a step waits for it
+	SaveSignal(signal *Signal) error
 	// SaveStepChangeEvent saves the step change event
 	SaveStepChangeEvent(stepEvent *events.StepChangeEvent) error
-	// SavePipeline updates the pipeline configuration of a workflow
-	SavePipeline(pipeline *data.Pipeline) error
-	// SaveState updates the state of a workflow
+	// SavePipeline updates the pipeline configuration of a workflow.
+	// It fails with ErrVersionConflict if the pipeline was saved since it was read and bumps its version otherwise.
+	SavePipeline(pipeline *VersionedPipeline) error
+	// SaveState updates the state of a workflow, a state with version 0 is created.
+	// It fails with ErrVersionConflict if the state was saved since it was read and bumps its version otherwise.
 	SaveState(workflowState *WorkflowState) error
-	// SaveStepState Saves the step state. If the step state does not exist, it creates a new one
+	// SaveStepState Saves the step state. If the step state does not exist or has version 0, it creates a new one.
+	// It fails with ErrVersionConflict if the step state was saved since it was read and bumps its version otherwise.
 	SaveStepState(stepState *StepState) error
+	// SaveTrigger creates or updates the trigger
+	SaveTrigger(trigger *Trigger) error
 	// SaveWorkflow stores the workflow configuration
 	SaveWorkflow(workflow *models.Workflow) error
-	// UnlockInstance unlocks an instance
-	UnlockInstance(id string) error
+	// SaveWorkflowOptions stores the options of a workflow
+	SaveWorkflowOptions(options *WorkflowOptions) error
+	// UnlockInstance unlocks an instance locked by the owner. An ErrLockNotOwned error is returned otherwise
+	UnlockInstance(id, owner string) error
+	// WithTx runs f in a transaction. The writes done through the Storage passed to f are committed if f returns nil
+	// and rolled back otherwise. WithTx called on the Storage of a transaction runs f in that transaction
+	WithTx(f func(tx Storage) error) error
 }
@@ -27,6 +27,13 @@ func GetStorage(c *config.StorageConfig) (s Storage, err error) {
 				if err != nil {
 					return
 				}
+			case config.SQLiteStorageType:
+				var sqliteStorage *SQLiteStorage
+				sqliteStorage, err = ConnectSQLite(c)
+				if err != nil {
+					return
+				}
+				store = sqliteStorage
 			default:
 				err = fmt.Errorf("unknown storage type: %s", c.Type)
 			}
@@ -0,0 +1,171 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// SubWorkflow holds the configuration of a step of type StepTypeWorkflow.
+//
+// Fields:
+// - WorkflowId: The unique identifier of the workflow started as a child instance.
+// - WorkflowVersion: The version of the workflow. Zero starts the latest version.
+// - Input: Maps the variables of the child input to the variables of the parent pipeline.
+// - Output: Maps the variables of the parent pipeline to the variables of the child pipeline once the child completes.
+type SubWorkflow struct {
+	WorkflowId      string            `json:"workflow_id" yaml:"workflow_id"`
+	WorkflowVersion int               `json:"workflow_version,omitempty" yaml:"workflow_version,omitempty"`
+	Input           map[string]string `json:"input,omitempty" yaml:"input,omitempty"`
+	Output          map[string]string `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// ParentLink links a child instance to the step of the parent instance that started it.
+//
+// Fields:
+// - InstanceId: The unique identifier of the parent instance.
+// - StepId: The identifier of the workflow step in the parent instance.
+// - Iteration: The iteration of the workflow step in the parent instance.
+type ParentLink struct {
+	InstanceId string `json:"instance_id" yaml:"instance_id"`
+	StepId     string `json:"step_id" yaml:"step_id"`
+	Iteration  int    `json:"iteration" yaml:"iteration"`
+}
+
+// Validate checks the sub workflow configuration for missing or invalid values.
+func (sw *SubWorkflow) Validate() (err error) {
+	switch {
+	case sw.WorkflowId == "":
+		err = errors.New("workflow_id is required")
+	case sw.WorkflowVersion < 0:
+		err = errors.New("workflow_version must not be negative")
+	}
+	return
+}
+
+// startChild starts the child instance of a workflow step with the input mapped from the pipeline of the parent.
+func startChild(storage Storage, step *models.Step, pipeline *data.Pipeline) (err error) {
+	var stepOptions *StepOptions
+	var childId string
+	instanceId := pipeline.Id()
+	stepOptions, err = getStepOptions(storage, instanceId, step.Id)
+	if err != nil {
+		return
+	}
+	if stepOptions == nil || stepOptions.Workflow == nil {
+		err = fmt.Errorf("no workflow configured for step %s", step.Id)
+		return
+	}
+	subWorkflow := stepOptions.Workflow
+	version := subWorkflow.WorkflowVersion
+	if version == 0 {
+		version, err = latestVersion(storage, subWorkflow.WorkflowId)
+		if err != nil {
+			return
+		}
+	}
+	input := make(map[string]any)
+	for childVar, parentVar := range subWorkflow.Input {
+		if !pipeline.Has(parentVar) {
+			continue
+		}
+		input[childVar], err = pipeline.Get(parentVar)
+		if err != nil {
+			return
+		}
+	}
+	wfm := NewWorkflowManager(storage)
+	childId, err = wfm.start(subWorkflow.WorkflowId, version, input, &ParentLink{
+		InstanceId: instanceId,
+		StepId:     step.Id,
+		Iteration:  getIteration(pipeline),
+	})
+	if err != nil {
+		return
+	}
+	logger.InfoF("Started child instance %s of workflow %s for step %s of instance %s", childId, subWorkflow.WorkflowId, step.Id, instanceId)
+	return
+}
+
+// latestVersion returns the highest registered version of the workflow.
+func latestVersion(storage Storage, workflowId string) (version int, err error) {
+	var workflows []*models.Workflow
+	workflows, err = storage.ListWorkflowVersions(workflowId)
+	if err != nil {
+		return
+	}
+	for _, workflow := range workflows {
+		if workflow.Version > version {
+			version = workflow.Version
+		}
+	}
+	if version == 0 {
+		err = ErrWorkFlowNotFound(workflowId)
+	}
+	return
+}
+
+// finishInstance saves the final state of an instance.
+// The compensation of the completed steps of a failed instance is planned along with the final state and run by the
+// workers once it is committed.
+// If the instance is the child of a workflow step, the step of the parent instance is completed with the mapped output
+// or failed with the error of the child.
+func finishInstance(storage Storage, workflowState *WorkflowState) (err error) {
+	// The final state is saved along with the compensation and the report to the parent instance
+	err = storage.WithTx(func(tx Storage) (err error) {
+		if workflowState.Status == models.StatusFailed {
+			err = planCompensation(tx, workflowState)
+			if err != nil {
+				return
+			}
+		}
+		err = tx.SaveState(workflowState)
+		if err != nil || workflowState.Parent == nil {
+			return
+		}
+		parent := workflowState.Parent
+		eventData := map[string]any{data.StepIterationKey: parent.Iteration}
+		switch workflowState.Status {
+		case models.StatusCompleted:
+			var stepOptions *StepOptions
+			var pipeline *VersionedPipeline
+			stepOptions, err = getStepOptions(tx, parent.InstanceId, parent.StepId)
+			if err != nil {
+				return
+			}
+			pipeline, err = tx.GetPipeline(workflowState.InstanceId)
+			if err != nil {
+				return
+			}
+			if stepOptions != nil && stepOptions.Workflow != nil {
+				for parentVar, childVar := range stepOptions.Workflow.Output {
+					if !pipeline.Has(childVar) {
+						continue
+					}
+					eventData[parentVar], err = pipeline.Get(childVar)
+					if err != nil {
+						return
+					}
+				}
+			}
+		case models.StatusFailed:
+			eventData[data.ErrorKey] = fmt.Sprintf("child instance %s failed: %s", workflowState.InstanceId, workflowState.Error)
+		default:
+			return
+		}
+		logger.InfoF("Reporting status %v of child instance %s to instance %s", workflowState.Status, workflowState.InstanceId, parent.InstanceId)
+		// The parent instance is continued by the workers once the final state of the child is committed
+		err = queueStepChange(tx, &events.StepChangeEvent{
+			EventId:    CreateId(),
+			InstanceId: parent.InstanceId,
+			StepId:     parent.StepId,
+			Status:     workflowState.Status,
+			Data:       eventData,
+		})
+		return
+	})
+	return
+}
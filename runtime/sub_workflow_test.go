@@ -0,0 +1,120 @@
+package runtime
+
+import (
+	"testing"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// newSubWorkflowInstance starts an instance of a workflow whose only step runs a child workflow waiting for the
+// signal go. It returns the ids of the parent and the child instance.
+func newSubWorkflowInstance(t *testing.T, storage Storage) (parentId, childId string) {
+	t.Helper()
+	wfm := NewWorkflowManager(storage)
+	err := wfm.Save(&models.Workflow{Id: "child", Name: "child", Version: 1, Steps: []*models.Step{{Id: "wait-1", Type: StepTypeWait}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "child", WorkflowVersion: 1, Steps: map[string]*StepOptions{
+		"wait-1": {Wait: &WaitSignal{Signal: "go"}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.Save(&models.Workflow{Id: "parent", Name: "parent", Version: 1, Steps: []*models.Step{{Id: "call", Type: StepTypeWorkflow}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wfm.SaveOptions(&WorkflowOptions{WorkflowId: "parent", WorkflowVersion: 1, Steps: map[string]*StepOptions{
+		"call": {Workflow: &SubWorkflow{WorkflowId: "child", Input: map[string]string{"x": "in"}, Output: map[string]string{"out": "y"}}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	parentId, err = wfm.Start("parent", 1, map[string]any{"in": "input"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	children, err := storage.GetChildInstances(parentId)
+	if err != nil || len(children) != 1 {
+		t.Fatalf("expected one child instance, got %v %v", children, err)
+	}
+	childId = children[0].InstanceId
+	if children[0].Parent == nil || children[0].Parent.StepId != "call" {
+		t.Errorf("expected the child to be linked to the step, got %+v", children[0].Parent)
+	}
+	return
+}
+
+func TestSubWorkflowCompletes(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	parentId, childId := newSubWorkflowInstance(t, storage)
+	childPipeline, err := storage.GetPipeline(childId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if x, _ := childPipeline.Get("x"); x != "input" {
+		t.Errorf("expected the input to be mapped to the child, got %v", x)
+	}
+	stepState, err := storage.GetStepState(parentId, "call", 0)
+	if err != nil || stepState.Status != models.StatusRunning {
+		t.Fatalf("expected the step to wait for the child, got %v %v", stepState, err)
+	}
+	err = NewWorkflowManager(storage).Signal(childId, "go", map[string]any{"y": "output"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	childState, err := storage.GetState(childId)
+	if err != nil || childState.Status != models.StatusCompleted {
+		t.Fatalf("expected the child to complete, got %v %v", childState, err)
+	}
+	parentState, err := storage.GetState(parentId)
+	if err != nil || parentState.Status != models.StatusCompleted {
+		t.Fatalf("expected the parent to complete along with the child, got %v %v", parentState, err)
+	}
+	pipeline, err := storage.GetPipeline(parentId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if out, _ := pipeline.Get("out"); out != "output" {
+		t.Errorf("expected the output of the child to be mapped to the parent, got %v", out)
+	}
+}
+
+func TestSubWorkflowFails(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	parentId, childId := newSubWorkflowInstance(t, storage)
+	err := NewWorkflowManager(storage).Terminate(childId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	stepState, err := storage.GetStepState(parentId, "call", 0)
+	if err != nil || stepState.Status != models.StatusFailed {
+		t.Errorf("expected the step to fail along with the child, got %v %v", stepState, err)
+	}
+	parentState, err := storage.GetState(parentId)
+	if err != nil || parentState.Status != models.StatusFailed {
+		t.Errorf("expected the parent to fail along with the child, got %v %v", parentState, err)
+	}
+}
+
+func TestSubWorkflowStoppedWithParent(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	parentId, childId := newSubWorkflowInstance(t, storage)
+	err := NewWorkflowManager(storage).Cancel(parentId, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	childState, err := storage.GetState(childId)
+	if err != nil || childState.Status != models.StatusFailed || childState.Reason != ReasonCancelled {
+		t.Errorf("expected the child to be cancelled along with the parent, got %v %v", childState, err)
+	}
+	parentState, err := storage.GetState(parentId)
+	if err != nil || parentState.Status != models.StatusFailed || parentState.Reason != ReasonCancelled {
+		t.Errorf("expected the parent to stay cancelled, got %v %v", parentState, err)
+	}
+}
@@ -0,0 +1,252 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"oss.nandlabs.io/golly/lifecycle"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+const (
+	// DefaultTimerPollInterval is the interval at which the TimerScheduler looks for due timers.
+	DefaultTimerPollInterval = time.Second
+	// timerBatchSize is the maximum number of due timers fetched in one poll.
+	timerBatchSize = 100
+)
+
+// TimerType represents the action taken when a timer fires.
+type TimerType string
+
+const (
+	// TimerTypeRetry re-executes the action of a step that is waiting for a retry.
+	TimerTypeRetry TimerType = "retry"
+	// TimerTypeStepTimeout fails a step that is still running.
+	TimerTypeStepTimeout TimerType = "step-timeout"
+	// TimerTypeWorkflowTimeout times out an instance that is still running.
+	TimerTypeWorkflowTimeout TimerType = "workflow-timeout"
+	// TimerTypeWakeUp completes a delay step once the delay ended.
+	TimerTypeWakeUp TimerType = "wake-up"
+	// TimerTypeIteration starts the next iteration of a while loop once the delay between iterations ended.
+	TimerTypeIteration TimerType = "iteration"
+)
+
+// Timer represents a durable timer of a workflow instance.
+//
+// Fields:
+// - Id: The unique identifier of the timer.
+// - InstanceId: The unique identifier of the instance.
+// - StepId: The identifier of the step the timer belongs to. Empty for instance timers.
+// - Iteration: The iteration of the step the timer belongs to.
+// - Type: The type of the timer.
+// - FireAt: The time at which the timer fires.
+type Timer struct {
+	Id         string    `json:"id" yaml:"id"`
+	InstanceId string    `json:"instance_id" yaml:"instance_id"`
+	StepId     string    `json:"step_id" yaml:"step_id"`
+	Iteration  int       `json:"iteration" yaml:"iteration"`
+	Type       TimerType `json:"type" yaml:"type"`
+	FireAt     time.Time `json:"fire_at" yaml:"fire_at"`
+}
+
+// TimerScheduler is a lifecycle component that fires the timers stored in the Storage once they are due.
+// As the timers are persisted, they survive a restart of the service.
+type TimerScheduler struct {
+	*lifecycle.SimpleComponent
+	storage  Storage
+	interval time.Duration
+	done     chan struct{}
+}
+
+// NewTimerScheduler creates a new TimerScheduler polling the storage at the given interval.
+func NewTimerScheduler(storage Storage, interval time.Duration) *TimerScheduler {
+	ts := &TimerScheduler{
+		storage:  storage,
+		interval: interval,
+	}
+	ts.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-timer-scheduler",
+		StartFunc: ts.start,
+		StopFunc:  ts.stop,
+	}
+	return ts
+}
+
+func (ts *TimerScheduler) start() (err error) {
+	ts.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ts.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ts.done:
+				return
+			case <-ticker.C:
+				ts.fireDue()
+			}
+		}
+	}()
+	return
+}
+
+func (ts *TimerScheduler) stop() (err error) {
+	if ts.done != nil {
+		close(ts.done)
+	}
+	return
+}
+
+func (ts *TimerScheduler) fireDue() {
+	timers, err := ts.storage.GetDueTimers(time.Now(), timerBatchSize)
+	if err != nil {
+		logger.ErrorF("Unable to fetch the due timers: %v", err)
+		return
+	}
+	for _, timer := range timers {
+		var fired bool
+		fired, err = ts.fire(timer)
+		if err != nil {
+			logger.ErrorF("Timer %s of type %s for instance %s failed: %v", timer.Id, timer.Type, timer.InstanceId, err)
+		}
+		if !fired {
+			// keep the timer to try again with the next poll
+			continue
+		}
+		err = ts.storage.DeleteTimer(timer.Id)
+		if err != nil {
+			logger.ErrorF("Unable to delete timer %s: %v", timer.Id, err)
+		}
+	}
+}
+
+// fire handles the timer as per its type. It returns false if the timer could not be handled yet.
+func (ts *TimerScheduler) fire(timer *Timer) (fired bool, err error) {
+	logger.DebugF("Firing timer %v", timer)
+	fired = true
+	switch timer.Type {
+	case TimerTypeRetry:
+		fired, err = ts.retry(timer)
+	case TimerTypeStepTimeout:
+		err = ts.timeoutStep(timer)
+	case TimerTypeWorkflowTimeout:
+		fired, err = ts.timeoutWorkflow(timer)
+	case TimerTypeWakeUp:
+		err = ts.wakeUp(timer)
+	case TimerTypeIteration:
+		fired, err = ts.iterate(timer)
+	default:
+		err = fmt.Errorf("unknown timer type %s", timer.Type)
+	}
+	return
+}
+
+func (ts *TimerScheduler) retry(timer *Timer) (fired bool, err error) {
+	var stepState *StepState
+	var workflowState *WorkflowState
+	var workflow *models.Workflow
+	workflowState, err = ts.storage.GetState(timer.InstanceId)
+	if err != nil {
+		return
+	}
+	if workflowState.IsPaused() {
+		// Keep the timer so that the step is retried once the instance is resumed
+		return
+	}
+	fired = true
+	// Read the step state again if the handler of a late event saved it in the meantime
+	err = retryOnConflict(func() (err error) {
+		stepState, err = ts.storage.GetStepState(timer.InstanceId, timer.StepId, timer.Iteration)
+		if err != nil || stepState == nil || stepState.Status != models.StatusRunning {
+			stepState = nil
+			return
+		}
+		stepState.NextRetryAt = time.Time{}
+		stepState.StartedAt = time.Now()
+		err = ts.storage.SaveStepState(stepState)
+		return
+	})
+	if err != nil || stepState == nil {
+		return
+	}
+	if workflowState.Status != models.StatusRunning {
+		logger.InfoF("Skipping retry of step %s as instance %s is not running", timer.StepId, timer.InstanceId)
+		return
+	}
+	workflow, err = ts.storage.GetWorkflowByInstance(timer.InstanceId)
+	if err != nil {
+		return
+	}
+	step, err := getStep(ts.storage, workflow, timer.StepId)
+	if err != nil {
+		return
+	}
+	if step == nil {
+		err = errors.New("Unable to find step with id " + timer.StepId)
+		return
+	}
+	logger.InfoF("Retrying step %s of instance %s, attempt %d", timer.StepId, timer.InstanceId, len(stepState.Attempts)+1)
+	err = NewActionExecutor(ts.storage).Execute(step, stepState.Input)
+	return
+}
+
+func (ts *TimerScheduler) timeoutStep(timer *Timer) (err error) {
+	var stepState *StepState
+	stepState, err = ts.storage.GetStepState(timer.InstanceId, timer.StepId, timer.Iteration)
+	if err != nil || stepState == nil || stepState.Status != models.StatusRunning {
+		return
+	}
+	logger.InfoF("Step %s of instance %s timed out", timer.StepId, timer.InstanceId)
+	event := &events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: timer.InstanceId,
+		StepId:     timer.StepId,
+		Status:     models.StatusFailed,
+		Data: map[string]any{
+			data.ErrorKey:         fmt.Sprintf("step %s timed out", timer.StepId),
+			data.StepIterationKey: timer.Iteration,
+		},
+	}
+	stepChangeHandler := &StepChangeHander{storage: ts.storage}
+	err = stepChangeHandler.Handle(event)
+	return
+}
+
+func (ts *TimerScheduler) timeoutWorkflow(timer *Timer) (fired bool, err error) {
+	stepChangeHandler := &StepChangeHander{storage: ts.storage}
+	// The instance is busy if it cannot be locked, try again with the next poll
+	fired, err = stepChangeHandler.runLocked(timer.InstanceId, func() (err error) {
+		var workflowState *WorkflowState
+		workflowState, err = ts.storage.GetState(timer.InstanceId)
+		if err != nil || !workflowState.IsActive() {
+			return
+		}
+		logger.InfoF("Instance %s timed out", timer.InstanceId)
+		workflowState.Status = models.StatusFailed
+		workflowState.Reason = ReasonTimedOut
+		workflowState.Error = fmt.Sprintf("instance %s timed out", timer.InstanceId)
+		err = finishInstance(ts.storage, workflowState)
+		return
+	})
+	return
+}
+
+// startStepTimer adds a timeout timer for the step state if the step has a timeout configured.
+func startStepTimer(storage Storage, stepState *StepState) (err error) {
+	var stepOptions *StepOptions
+	stepOptions, err = getStepOptions(storage, stepState.InstanceId, stepState.StepId)
+	if err != nil || stepOptions == nil || stepOptions.TimeoutMs == 0 {
+		return
+	}
+	err = storage.AddTimer(&Timer{
+		Id:         CreateId(),
+		InstanceId: stepState.InstanceId,
+		StepId:     stepState.StepId,
+		Iteration:  stepState.Iteration,
+		Type:       TimerTypeStepTimeout,
+		FireAt:     time.Now().Add(time.Duration(stepOptions.TimeoutMs) * time.Millisecond),
+	})
+	return
+}
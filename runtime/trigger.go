@@ -0,0 +1,299 @@
+package runtime
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oss.nandlabs.io/golly/codec"
+	"oss.nandlabs.io/golly/lifecycle"
+	"oss.nandlabs.io/golly/messaging"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+)
+
+const (
+	// DefaultTriggerRefreshInterval is the interval at which the TriggerConsumer listens on the topics of new triggers.
+	DefaultTriggerRefreshInterval = 10 * time.Second
+	// MessageIdHeader is the message header holding the id used to detect redelivered messages.
+	MessageIdHeader = "x-message-id"
+	// DefaultTriggerMessageRetention is the time the ids of the processed messages are kept to detect redeliveries.
+	DefaultTriggerMessageRetention = 24 * time.Hour
+)
+
+// messageIdHeaders are the headers looked up for the id of a message, the MessageIdHeader set by the publisher first
+// and then the ids set by the messaging providers.
+var messageIdHeaders = []string{MessageIdHeader, "message-id", "message_id", "messageId"}
+
+// Trigger starts a workflow for the messages received on a topic.
+//
+// Fields:
+// - Id: The unique identifier of the trigger.
+// - Topic: The url of the topic the trigger listens on.
+// - Filter: The condition evaluated against the message body. All messages start the workflow if empty.
+// - Input: Maps the variables of the workflow input to the variables of the message body. The whole body is the input if empty.
+// - WorkflowId: The unique identifier of the workflow to start.
+// - WorkflowVersion: The version of the workflow. Zero starts the latest version.
+// - DedupBody: Identifies the messages without an id by the hash of their body, messages with the same body start the
+// workflow only once within the retention time. Messages without an id are not deduplicated if false.
+type Trigger struct {
+	Id              string            `json:"id" yaml:"id"`
+	Topic           string            `json:"topic" yaml:"topic"`
+	Filter          string            `json:"filter,omitempty" yaml:"filter,omitempty"`
+	Input           map[string]string `json:"input,omitempty" yaml:"input,omitempty"`
+	WorkflowId      string            `json:"workflow_id" yaml:"workflow_id"`
+	WorkflowVersion int               `json:"workflow_version,omitempty" yaml:"workflow_version,omitempty"`
+	DedupBody       bool              `json:"dedup_body,omitempty" yaml:"dedup_body,omitempty"`
+}
+
+// Validate checks the trigger for missing or invalid values.
+func (t *Trigger) Validate() (err error) {
+	switch {
+	case t.WorkflowId == "":
+		err = errors.New("workflow_id is required")
+	case t.WorkflowVersion < 0:
+		err = errors.New("workflow_version must not be negative")
+	case t.Topic == "":
+		err = errors.New("topic is required")
+	}
+	if err != nil {
+		return
+	}
+	_, err = url.Parse(t.Topic)
+	if err != nil {
+		err = fmt.Errorf("invalid topic %s: %w", t.Topic, err)
+	}
+	return
+}
+
+// input returns the workflow input for the message body or false if the body does not pass the filter.
+func (t *Trigger) input(body map[string]any) (input map[string]any, ok bool, err error) {
+	pipeline := data.NewPipelineFrom(body)
+	if t.Filter != "" {
+		ok, err = pipeline.EvaluateCondition(t.Filter)
+		if err != nil || !ok {
+			return
+		}
+	}
+	ok = true
+	input = make(map[string]any)
+	if len(t.Input) == 0 {
+		for k, v := range body {
+			input[k] = v
+		}
+		return
+	}
+	for inputVar, bodyVar := range t.Input {
+		if !pipeline.Has(bodyVar) {
+			continue
+		}
+		input[inputVar], err = pipeline.Get(bodyVar)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// TriggerConsumer is a lifecycle component that listens on the topics of the triggers stored in the Storage
+// and starts their workflows for the received messages.
+// A message with an id starts a workflow at most once per trigger, even if it is redelivered. Messages are identified
+// by their MessageIdHeader or the id set by the messaging provider, and by the hash of their body for the triggers that
+// opt in with DedupBody. The ids are kept for the retention time and recorded along with the start of the workflow.
+type TriggerConsumer struct {
+	*lifecycle.SimpleComponent
+	storage   Storage
+	manager   messaging.Manager
+	interval  time.Duration
+	retention time.Duration
+	topics    map[string]bool
+	mutex     sync.Mutex
+	running   atomic.Bool
+	done      chan struct{}
+}
+
+// NewTriggerConsumer creates a new TriggerConsumer looking for new triggers at the given interval.
+func NewTriggerConsumer(storage Storage, interval time.Duration) *TriggerConsumer {
+	tc := &TriggerConsumer{
+		storage:   storage,
+		manager:   messaging.GetManager(),
+		interval:  interval,
+		retention: DefaultTriggerMessageRetention,
+		topics:    make(map[string]bool),
+	}
+	tc.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-trigger-consumer",
+		StartFunc: tc.start,
+		StopFunc:  tc.stop,
+	}
+	return tc
+}
+
+func (tc *TriggerConsumer) start() (err error) {
+	tc.running.Store(true)
+	err = tc.listen()
+	if err != nil {
+		return
+	}
+	tc.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-tc.done:
+				return
+			case <-ticker.C:
+				listenErr := tc.listen()
+				if listenErr != nil {
+					logger.ErrorF("Unable to listen on the trigger topics: %v", listenErr)
+				}
+				tc.prune()
+			}
+		}
+	}()
+	return
+}
+
+func (tc *TriggerConsumer) stop() (err error) {
+	tc.running.Store(false)
+	if tc.done != nil {
+		close(tc.done)
+	}
+	return
+}
+
+// listen adds a listener for every topic of the stored triggers that is not listened on yet.
+func (tc *TriggerConsumer) listen() (err error) {
+	var triggers []*Trigger
+	triggers, err = tc.storage.ListTriggers()
+	if err != nil {
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	for _, trigger := range triggers {
+		if tc.topics[trigger.Topic] {
+			continue
+		}
+		var u *url.URL
+		u, err = url.Parse(trigger.Topic)
+		if err != nil {
+			return
+		}
+		topic := trigger.Topic
+		err = tc.manager.AddListener(u, func(msg messaging.Message) {
+			tc.onMessage(topic, msg)
+		})
+		if err != nil {
+			return
+		}
+		tc.topics[topic] = true
+		logger.InfoF("Listening for trigger messages on %s", topic)
+	}
+	return
+}
+
+func (tc *TriggerConsumer) onMessage(topic string, msg messaging.Message) {
+	if !tc.running.Load() {
+		return
+	}
+	triggers, err := tc.storage.ListTriggers()
+	if err != nil {
+		logger.ErrorF("Unable to fetch the triggers of topic %s: %v", topic, err)
+		return
+	}
+	payload := msg.ReadAsStr()
+	body := make(map[string]any)
+	err = codec.JsonCodec().DecodeBytes([]byte(payload), &body)
+	if err != nil {
+		logger.WarnF("Ignoring invalid message on topic %s: %v", topic, err)
+		return
+	}
+	messageId := getMessageId(msg)
+	for _, trigger := range triggers {
+		if trigger.Topic != topic {
+			continue
+		}
+		triggerMessageId := messageId
+		if triggerMessageId == "" && trigger.DedupBody {
+			triggerMessageId = hashBody(payload)
+		}
+		err = tc.fire(trigger, triggerMessageId, body)
+		if err != nil {
+			logger.ErrorF("Trigger %s failed to start workflow %s: %v", trigger.Id, trigger.WorkflowId, err)
+		}
+	}
+}
+
+// fire starts the workflow of the trigger unless the message does not pass the filter or was already processed.
+// The message is recorded in the same transaction that starts the workflow, a redelivery of a message whose workflow
+// failed to start tries again. Messages without an id are not recorded.
+func (tc *TriggerConsumer) fire(trigger *Trigger, messageId string, body map[string]any) (err error) {
+	var input map[string]any
+	var ok bool
+	var instanceId string
+	input, ok, err = trigger.input(body)
+	if err != nil || !ok {
+		return
+	}
+	err = tc.storage.WithTx(func(tx Storage) (err error) {
+		if messageId != "" {
+			ok, err = tx.AddTriggerMessage(trigger.Id, messageId)
+			if err != nil || !ok {
+				return
+			}
+		}
+		version := trigger.WorkflowVersion
+		if version == 0 {
+			version, err = latestVersion(tx, trigger.WorkflowId)
+			if err != nil {
+				return
+			}
+		}
+		instanceId, err = NewWorkflowManager(tx).Start(trigger.WorkflowId, version, input)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if !ok {
+		logger.InfoF("Ignoring redelivered message %s for trigger %s", messageId, trigger.Id)
+		return
+	}
+	logger.InfoF("Trigger %s started instance %s of workflow %s", trigger.Id, instanceId, trigger.WorkflowId)
+	return
+}
+
+// prune deletes the ids of the messages processed before the retention time.
+func (tc *TriggerConsumer) prune() {
+	pruned, err := tc.storage.PruneTriggerMessages(time.Now().Add(-tc.retention))
+	if err != nil {
+		logger.ErrorF("Unable to prune the processed trigger messages: %v", err)
+		return
+	}
+	if pruned > 0 {
+		logger.DebugF("Pruned %d processed trigger messages", pruned)
+	}
+}
+
+// getMessageId returns the id of the message from its headers or an empty string if it has none.
+func getMessageId(msg messaging.Message) (messageId string) {
+	for _, header := range messageIdHeaders {
+		if id, ok := msg.GetStrHeader(header); ok && id != "" {
+			messageId = id
+			return
+		}
+	}
+	return
+}
+
+// hashBody returns the id of a message without an id for the triggers that deduplicate by the body.
+func hashBody(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,110 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/golly/messaging"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func newTriggerMessage(t *testing.T, body string, headers map[string]string) messaging.Message {
+	t.Helper()
+	msg, err := messaging.GetManager().NewMessage("chan")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for k, v := range headers {
+		err = msg.SetStrHeader(k, v)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	_, err = msg.SetBodyStr(body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return msg
+}
+
+func TestTriggerDeduplicatesMessages(t *testing.T) {
+	const topic = "chan://orcaloop-test/trigger"
+	const dedupTopic = "chan://orcaloop-test/trigger-dedup"
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveWorkflow(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveTrigger(&Trigger{Id: "trigger-1", Topic: topic, WorkflowId: "workflow-1", WorkflowVersion: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveTrigger(&Trigger{Id: "trigger-2", Topic: dedupTopic, WorkflowId: "workflow-1", WorkflowVersion: 1, DedupBody: true})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tc := NewTriggerConsumer(storage, time.Second)
+	tc.running.Store(true)
+	started := func() int {
+		tasks, err := storage.LeaseTasks(CreateId(), 100, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return len(tasks)
+	}
+	// Messages without id are not deduplicated by default, the same body may be a new message
+	tc.onMessage(topic, newTriggerMessage(t, `{"order": 1}`, nil))
+	tc.onMessage(topic, newTriggerMessage(t, `{"order": 1}`, nil))
+	if count := started(); count != 2 {
+		t.Errorf("expected each message without id to start an instance, got %d", count)
+	}
+	// Triggers opting in tell messages without id apart by their body
+	tc.onMessage(dedupTopic, newTriggerMessage(t, `{"order": 1}`, nil))
+	tc.onMessage(dedupTopic, newTriggerMessage(t, `{"order": 1}`, nil))
+	tc.onMessage(dedupTopic, newTriggerMessage(t, `{"order": 2}`, nil))
+	if count := started(); count != 2 {
+		t.Errorf("expected the redelivered message without id to start one instance, got %d", count)
+	}
+	// The id of the message wins over its body
+	tc.onMessage(dedupTopic, newTriggerMessage(t, `{"order": 3}`, map[string]string{MessageIdHeader: "message-1"}))
+	tc.onMessage(dedupTopic, newTriggerMessage(t, `{"order": 4}`, map[string]string{MessageIdHeader: "message-1"}))
+	if count := started(); count != 1 {
+		t.Errorf("expected the redelivered message with id to start one instance, got %d", count)
+	}
+	// The pruned ids no longer suppress a message
+	tc.retention = -time.Minute
+	tc.prune()
+	tc.onMessage(dedupTopic, newTriggerMessage(t, `{"order": 1}`, nil))
+	if count := started(); count != 1 {
+		t.Errorf("expected the message to start an instance once its id was pruned, got %d", count)
+	}
+}
+
+func TestTriggerRedeliversFailedStart(t *testing.T) {
+	const topic = "chan://orcaloop-test/trigger-failed"
+	storage := NewInMemoryStorage(nil)
+	// The workflow does not exist yet, the first delivery fails to start it
+	err := storage.SaveTrigger(&Trigger{Id: "trigger-1", Topic: topic, WorkflowId: "workflow-1", WorkflowVersion: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tc := NewTriggerConsumer(storage, time.Second)
+	tc.running.Store(true)
+	headers := map[string]string{MessageIdHeader: "message-1"}
+	tc.onMessage(topic, newTriggerMessage(t, `{"order": 1}`, headers))
+	err = storage.SaveWorkflow(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tc.onMessage(topic, newTriggerMessage(t, `{"order": 1}`, headers))
+	tasks, err := storage.LeaseTasks(CreateId(), 100, time.Minute)
+	if err != nil || len(tasks) != 1 {
+		t.Errorf("expected the redelivered message to start the workflow, got %v %v", tasks, err)
+	}
+	// The message is recorded along with the start
+	tc.onMessage(topic, newTriggerMessage(t, `{"order": 1}`, headers))
+	tasks, err = storage.LeaseTasks(CreateId(), 100, time.Minute)
+	if err != nil || len(tasks) != 0 {
+		t.Errorf("expected the message to start the workflow once, got %v %v", tasks, err)
+	}
+}
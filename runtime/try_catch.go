@@ -0,0 +1,360 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+const (
+	// ErrorCodeKey is the output variable in which a failed action reports the code of its error.
+	ErrorCodeKey = "error_code"
+	// DefaultErrorVar is the pipeline variable holding the error caught by a try step if none is configured.
+	DefaultErrorVar = "error"
+)
+
+// TryBlock represents the block of a try step that is running.
+type TryBlock string
+
+const (
+	// BlockTry is used while the steps of the try block are running.
+	BlockTry TryBlock = "try"
+	// BlockCatch is used while the steps of a catch block are running.
+	BlockCatch TryBlock = "catch"
+	// BlockFinally is used while the steps of the finally block are running.
+	BlockFinally TryBlock = "finally"
+)
+
+// TryCatch holds the configuration of a step of type StepTypeTry.
+// The steps of each block run one after the other. A failure in the try block runs the first matching catch block
+// and lets the workflow continue. The finally block runs after the try or catch block, even if the failure was not
+// caught, in which case the try step fails once the finally block completed.
+//
+// Fields:
+// - Steps: The steps of the try block.
+// - Catches: The catch blocks, matched in order against the error of the failed step.
+// - Finally: The steps of the finally block.
+// - ErrorVar: The pipeline variable the message of the caught error is set in. Defaults to DefaultErrorVar.
+type TryCatch struct {
+	Steps    []*models.Step `json:"steps" yaml:"steps"`
+	Catches  []*Catch       `json:"catches,omitempty" yaml:"catches,omitempty"`
+	Finally  []*models.Step `json:"finally,omitempty" yaml:"finally,omitempty"`
+	ErrorVar string         `json:"error_var,omitempty" yaml:"error_var,omitempty"`
+}
+
+// Catch is a catch block of a try step.
+// A catch block without code and pattern catches all errors.
+//
+// Fields:
+// - Code: The error code reported by the failed step in the ErrorCodeKey variable.
+// - Pattern: The regular expression matched against the error message of the failed step.
+// - Steps: The steps of the catch block.
+type Catch struct {
+	Code    string         `json:"code,omitempty" yaml:"code,omitempty"`
+	Pattern string         `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Steps   []*models.Step `json:"steps,omitempty" yaml:"steps,omitempty"`
+}
+
+// Validate checks the try step configuration for missing or invalid values.
+func (tc *TryCatch) Validate() (err error) {
+	if len(tc.Steps) == 0 {
+		err = errors.New("steps are required")
+		return
+	}
+	for _, catch := range tc.Catches {
+		if catch.Pattern == "" {
+			continue
+		}
+		_, err = regexp.Compile(catch.Pattern)
+		if err != nil {
+			err = fmt.Errorf("invalid pattern %s: %w", catch.Pattern, err)
+			return
+		}
+	}
+	return
+}
+
+// errorVar returns the pipeline variable of the caught error.
+func (tc *TryCatch) errorVar() string {
+	if tc.ErrorVar == "" {
+		return DefaultErrorVar
+	}
+	return tc.ErrorVar
+}
+
+// catch returns the first catch block matching the error or nil if the error is not caught.
+func (tc *TryCatch) catch(code, message string) *Catch {
+	for _, catch := range tc.Catches {
+		if catch.Code != "" && catch.Code != code {
+			continue
+		}
+		if catch.Pattern != "" {
+			matched, err := regexp.MatchString(catch.Pattern, message)
+			if err != nil || !matched {
+				continue
+			}
+		}
+		return catch
+	}
+	return nil
+}
+
+// blocks returns the steps of all blocks of the try step.
+func (tc *TryCatch) blocks() (blocks [][]*models.Step) {
+	blocks = append(blocks, tc.Steps, tc.Finally)
+	for _, catch := range tc.Catches {
+		blocks = append(blocks, catch.Steps)
+	}
+	return
+}
+
+// startTry runs the first step of the try block and queues the remaining ones.
+func (se *StepExecutor) startTry(step *models.Step, stepState *StepState, pipeline *data.Pipeline) (err error) {
+	var stepOptions *StepOptions
+	stepOptions, err = getStepOptions(se.storage, stepState.InstanceId, step.Id)
+	if err != nil {
+		return
+	}
+	if stepOptions == nil || stepOptions.Try == nil {
+		err = fmt.Errorf("no try block configured for step %s", step.Id)
+		return
+	}
+	steps := stepOptions.Try.Steps
+	stepState.Block = BlockTry
+	stepState.ChildCount = len(steps)
+	// The try step starts along with the pending steps of its try block
+	err = se.storage.WithTx(func(tx Storage) (err error) {
+		txExecutor := &StepExecutor{storage: tx}
+		err = txExecutor.start(stepState)
+		if err != nil {
+			return
+		}
+		err = queueBlock(tx, stepState, steps[1:])
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = se.Execute(steps[0], cloneFor(pipeline, steps[0], step.Id))
+	return
+}
+
+// queueBlock adds the steps of a block of the try step as pending steps.
+func queueBlock(storage Storage, stepState *StepState, steps []*models.Step) (err error) {
+	var pendingSteps []*PendingStep
+	for _, step := range steps {
+		pendingSteps = append(pendingSteps, &PendingStep{
+			Id:        CreateId(),
+			ParentId:  stepState.StepId,
+			Iteration: stepState.Iteration,
+			StepId:    step.Id,
+		})
+	}
+	err = storage.AddPendingSteps(stepState.InstanceId, pendingSteps...)
+	return
+}
+
+// enterBlock moves the try step to the next block and queues its steps.
+// The children that finished so far keep counting towards the ChildCount of the try step.
+func enterBlock(storage Storage, stepState *StepState, block TryBlock, steps []*models.Step, finished int) (err error) {
+	logger.InfoF("Step %s of instance %s enters its %s block", stepState.StepId, stepState.InstanceId, block)
+	stepState.Block = block
+	stepState.ChildCount = finished + len(steps)
+	err = storage.SaveStepState(stepState)
+	if err != nil {
+		return
+	}
+	err = queueBlock(storage, stepState, steps)
+	return
+}
+
+// finishTry is called once all children of a running try step finished.
+// It runs the finally block if it did not run yet, otherwise the try step completes or fails with the error that
+// was not caught. It returns true if there are pending steps to continue with.
+func finishTry(storage Storage, workflow *models.Workflow, stepState *StepState, finished int) (running bool, err error) {
+	var stepOptions *StepOptions
+	stepOptions, err = getStepOptions(storage, stepState.InstanceId, stepState.StepId)
+	if err != nil {
+		return
+	}
+	if stepOptions == nil || stepOptions.Try == nil {
+		err = fmt.Errorf("no try block configured for step %s", stepState.StepId)
+		return
+	}
+	if stepState.Block != BlockFinally && len(stepOptions.Try.Finally) > 0 {
+		running = true
+		err = enterBlock(storage, stepState, BlockFinally, stepOptions.Try.Finally, finished)
+		return
+	}
+	if stepState.Output != nil && stepState.Output.GetError() != "" {
+		// The failure was not caught, fail the try step once the finally block completed
+		running, err = failStep(storage, workflow, stepState, stepState.Output.GetError())
+		return
+	}
+	stepState.Status = models.StatusCompleted
+	err = storage.SaveStepState(stepState)
+	return
+}
+
+// catchFailure looks for a try step enclosing the failed step that is running its try block, or its catch block if
+// it has a finally block.
+// The containers between the failed step and the try step are failed and their pending steps removed, the other
+// branches of the failed parallel steps are cancelled. If the failure happened in the try block and a catch block
+// matches the error, it is queued and the error is set in the pipeline.
+// Otherwise the finally block is queued and the try step fails once it completed, or the try step fails right away
+// and the lookup continues with the steps enclosing the try step.
+// It returns true if the workflow can continue.
+func catchFailure(storage Storage, workflow *models.Workflow, failedState *StepState) (caught bool, err error) {
+	var stepStates map[string][]*StepState
+	var options *WorkflowOptions
+	var pendingSteps []*PendingStep
+	stepStates, err = storage.GetStepStates(failedState.InstanceId)
+	if err != nil {
+		return
+	}
+	options, err = storage.GetWorkflowOptions(workflow.Id, workflow.Version)
+	if err != nil {
+		return
+	}
+	var code, message string
+	if failedState.Output != nil {
+		message = failedState.Output.GetError()
+		if failedState.Output.Has(ErrorCodeKey) {
+			code, _ = data.ExtractValue[string](failedState.Output, ErrorCodeKey)
+		}
+	}
+	var tryState *StepState
+	abandoned := map[string]bool{}
+	for parentId := failedState.ParentStep; parentId != ""; {
+		parentState := runningState(stepStates, parentId)
+		if parentState == nil {
+			break
+		}
+		parent := options.findStep(workflow, parentId)
+		if parent != nil && parent.Type == StepTypeTry {
+			if parentState.Block == BlockTry {
+				tryState = parentState
+				break
+			}
+			if parentState.Block == BlockCatch && len(options.Step(parentId).Try.Finally) > 0 {
+				// A failure in the catch block still runs the finally block
+				tryState = parentState
+				break
+			}
+		}
+		// The container failed along with the step
+		abandoned[parentId] = true
+		parentState.Status = models.StatusFailed
+		parentState.Output = data.NewPipelineFrom(map[string]any{data.ErrorKey: message})
+		err = storage.SaveStepState(parentState)
+		if err != nil {
+			return
+		}
+		if parent != nil && parent.Type == models.StepTypeParallel {
+			// The other branches lost along with the parallel step
+			err = cancelBranches(storage, workflow, parentState, stepStates)
+			if err != nil {
+				return
+			}
+		}
+		parentId = parentState.ParentStep
+	}
+	if tryState == nil {
+		return
+	}
+	abandoned[tryState.StepId] = true
+	pendingSteps, err = storage.GetPendingSteps(failedState.InstanceId)
+	if err != nil {
+		return
+	}
+	for _, pendingStep := range pendingSteps {
+		if !abandoned[pendingStep.ParentId] {
+			continue
+		}
+		err = storage.DeletePendingStep(failedState.InstanceId, pendingStep)
+		if err != nil {
+			return
+		}
+	}
+	var finished int
+	for _, stepStateArr := range stepStates {
+		for _, stepState := range stepStateArr {
+			if stepState.ParentStep == tryState.StepId && stepState.Status > models.StatusRunning {
+				finished++
+			}
+		}
+	}
+	tryCatch := options.Step(tryState.StepId).Try
+	var catch *Catch
+	if tryState.Block == BlockTry {
+		catch = tryCatch.catch(code, message)
+	}
+	switch {
+	case catch != nil:
+		var pipeline *VersionedPipeline
+		logger.InfoF("Step %s of instance %s caught error %s of step %s", tryState.StepId, tryState.InstanceId, message, failedState.StepId)
+		pipeline, err = storage.GetPipeline(failedState.InstanceId)
+		if err != nil {
+			return
+		}
+		pipeline.Set(tryCatch.errorVar(), message)
+		err = storage.SavePipeline(pipeline)
+		if err != nil {
+			return
+		}
+		caught = true
+		err = enterBlock(storage, tryState, BlockCatch, catch.Steps, finished)
+	case len(tryCatch.Finally) > 0:
+		// Keep the error to fail the try step after the finally block
+		caught = true
+		tryState.Output = data.NewPipelineFrom(map[string]any{data.ErrorKey: message})
+		err = enterBlock(storage, tryState, BlockFinally, tryCatch.Finally, finished)
+	default:
+		tryState.Status = models.StatusFailed
+		tryState.Output = data.NewPipelineFrom(map[string]any{data.ErrorKey: message, ErrorCodeKey: code})
+		err = storage.SaveStepState(tryState)
+		if err != nil {
+			return
+		}
+		caught, err = catchFailure(storage, workflow, tryState)
+	}
+	return
+}
+
+// failStep fails a container step that is run by the runtime. The failure is handled by the enclosing try steps,
+// if none of them catches it the instance fails.
+// It returns true if the failure was caught.
+func failStep(storage Storage, workflow *models.Workflow, stepState *StepState, message string) (caught bool, err error) {
+	var workflowState *WorkflowState
+	stepState.Status = models.StatusFailed
+	stepState.Output = data.NewPipelineFrom(map[string]any{data.ErrorKey: message})
+	err = storage.SaveStepState(stepState)
+	if err != nil {
+		return
+	}
+	caught, err = catchFailure(storage, workflow, stepState)
+	if err != nil || caught {
+		return
+	}
+	workflowState, err = storage.GetState(stepState.InstanceId)
+	if err != nil {
+		return
+	}
+	workflowState.Status = models.StatusFailed
+	workflowState.Error = message
+	err = finishInstance(storage, workflowState)
+	return
+}
+
+// runningState returns the running state of the step with the given id or nil if the step is not running.
+func runningState(stepStates map[string][]*StepState, stepId string) *StepState {
+	for _, stepState := range stepStates[stepId] {
+		if stepState.Status == models.StatusRunning {
+			return stepState
+		}
+	}
+	return nil
+}
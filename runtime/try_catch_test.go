@@ -0,0 +1,79 @@
+package runtime
+
+import (
+	"testing"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestCatchFailureInCatchBlockRunsFinally(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	workflow := &models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps:   []*models.Step{{Id: "try-1", Type: StepTypeTry}},
+	}
+	err := storage.SaveWorkflow(workflow)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveWorkflowOptions(&WorkflowOptions{
+		WorkflowId:      "workflow-1",
+		WorkflowVersion: 1,
+		Steps: map[string]*StepOptions{"try-1": {Try: &TryCatch{
+			Steps:   []*models.Step{{Id: "try-step", Type: models.StepTypeAction}},
+			Catches: []*Catch{{Steps: []*models.Step{{Id: "catch-step", Type: models.StepTypeAction}}}},
+			Finally: []*models.Step{{Id: "finally-step", Type: models.StepTypeAction}},
+		}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stepStates := []*StepState{
+		{InstanceId: "instance-1", StepId: "try-1", Status: models.StatusRunning, Block: BlockCatch, ChildCount: 2},
+		{InstanceId: "instance-1", StepId: "try-step", ParentStep: "try-1", Status: models.StatusFailed},
+		{
+			InstanceId: "instance-1",
+			StepId:     "catch-step",
+			ParentStep: "try-1",
+			Status:     models.StatusFailed,
+			Output:     data.NewPipelineFrom(map[string]any{data.ErrorKey: "catch failed"}),
+		},
+	}
+	for _, stepState := range stepStates {
+		err = storage.SaveStepState(stepState)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	caught, err := catchFailure(storage, workflow, stepStates[2])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !caught {
+		t.Fatal("expected the finally block to run after the failure in the catch block")
+	}
+	tryState, err := storage.GetStepState("instance-1", "try-1", 0)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if tryState.Status != models.StatusRunning || tryState.Block != BlockFinally {
+		t.Errorf("expected the try step to run its finally block, got %v %s", tryState.Status, tryState.Block)
+	}
+	if tryState.Output == nil || tryState.Output.GetError() != "catch failed" {
+		t.Errorf("expected the error of the catch block to be kept, got %v", tryState.Output)
+	}
+	pendingSteps, err := storage.GetPendingSteps("instance-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(pendingSteps) != 1 || pendingSteps[0].StepId != "finally-step" {
+		t.Errorf("expected the finally step to be pending, got %v", pendingSteps)
+	}
+}
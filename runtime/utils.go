@@ -3,15 +3,36 @@ package runtime
 import (
 	"fmt"
 	"strings"
+
+	"oss.nandlabs.io/orcaloop-sdk/models"
 )
 
 var ErrWorkFlowNotFound = func(id string) error { return fmt.Errorf("workflow definition not found for workflow with id %s", id) }
 var ErrNoPipelineFound = func(id string) error { return fmt.Errorf("pipeline not found for id %s", id) }
 var ErrStepStateNotFound = func(id string) error { return fmt.Errorf("step state not found for step with id %s ", id) }
 var ErrWorkflowStateNotFound = func(id string) error { return fmt.Errorf("workflow state not found for workflow with id %s", id) }
+var ErrStepNotRunning = func(id string, iteration int) error {
+	return fmt.Errorf("step is not running for step with id %s and iteration %d", id, iteration)
+}
+var ErrInvalidInstanceState = func(id string, status models.Status) error {
+	return fmt.Errorf("invalid state for instance with id %s and status %v", id, status)
+}
+var ErrInstanceBusy = func(id string) error { return fmt.Errorf("instance is busy for instance with id %s", id) }
+var ErrScheduleNotFound = func(id string) error { return fmt.Errorf("schedule not found for schedule with id %s", id) }
+var ErrTriggerNotFound = func(id string) error { return fmt.Errorf("trigger not found for trigger with id %s", id) }
+var ErrLockNotOwned = func(id string) error { return fmt.Errorf("lock not owned for instance with id %s", id) }
+var ErrVersionConflict = func(kind, id string) error {
+	return fmt.Errorf("version conflict for %s of instance with id %s", kind, id)
+}
+var ErrScheduleVersionConflict = func(id string) error {
+	return fmt.Errorf("version conflict for schedule with id %s", id)
+}
 var ErrWorkflowAlreadyRegistered = func(id string, v int) error {
 	return fmt.Errorf("workflow already registered with id %s and version %d", id, v)
 }
+var ErrMigrationChecksum = func(v int) error {
+	return fmt.Errorf("migration checksum mismatch for migration with version %d", v)
+}
 
 func IsWorkflowNotFound(err error) bool {
 
@@ -27,3 +48,43 @@ func IsStepStateNotFound(err error) bool {
 
 	return err != nil && strings.HasPrefix(err.Error(), "step state not found for step with id")
 }
+
+func IsStepNotRunning(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "step is not running for step with id")
+}
+
+func IsInvalidInstanceState(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "invalid state for instance with id")
+}
+
+func IsInstanceBusy(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "instance is busy for instance with id")
+}
+
+func IsLockNotOwned(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "lock not owned for instance with id")
+}
+
+func IsVersionConflict(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "version conflict for")
+}
+
+func IsMigrationChecksum(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "migration checksum mismatch for migration")
+}
+
+func IsScheduleNotFound(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "schedule not found for schedule with id")
+}
+
+func IsTriggerNotFound(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "trigger not found for trigger with id")
+}
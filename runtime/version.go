@@ -0,0 +1,33 @@
+package runtime
+
+import (
+	"oss.nandlabs.io/orcaloop-sdk/data"
+)
+
+// DefaultConflictRetries is the number of times a write failing with a version conflict is retried.
+const DefaultConflictRetries = 3
+
+// VersionedPipeline is the pipeline of an instance along with the version it was read with from the Storage.
+// The version is kept out of the pipeline variables so that it is neither passed to the actions nor reported in the
+// status of the instance. Saving the pipeline fails with ErrVersionConflict if the stored pipeline has another version
+// and increments the version otherwise.
+//
+// Fields:
+// - Pipeline: The pipeline of the instance.
+// - Version: The version of the stored pipeline.
+type VersionedPipeline struct {
+	*data.Pipeline
+	Version int
+}
+
+// retryOnConflict runs f again as long as it fails with a version conflict, up to DefaultConflictRetries times.
+// f must read the state it writes so that the retry works with the state stored by the concurrent writer.
+func retryOnConflict(f func() error) (err error) {
+	for i := 0; ; i++ {
+		err = f()
+		if !IsVersionConflict(err) || i >= DefaultConflictRetries {
+			return
+		}
+		logger.DebugF("Retrying after a version conflict: %v", err)
+	}
+}
@@ -1,7 +1,14 @@
 package runtime
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
 	"oss.nandlabs.io/orcaloop-sdk/models"
 
 	"oss.nandlabs.io/orcaloop-sdk/utils"
@@ -73,6 +80,155 @@ func (wfm *WorkflowManager) Save(workflow *models.Workflow) (err error) {
 	return
 }
 
+// SaveOptions registers the runtime options of a workflow.
+// The workflow the options belong to must already be registered and the options are validated against it.
+// It returns an error if the workflow could not be found, the options are invalid or could not be saved.
+func (wfm *WorkflowManager) SaveOptions(options *WorkflowOptions) (err error) {
+
+	var workflow *models.Workflow
+	workflow, err = wfm.store.GetWorkflow(options.WorkflowId, options.WorkflowVersion)
+	if err != nil {
+		return
+	}
+	// Validate options
+	err = options.Validate(workflow)
+	if err != nil {
+		return
+	}
+
+	// Save options
+	err = wfm.store.SaveWorkflowOptions(options)
+
+	return
+}
+
+// SaveSchedule creates or updates a schedule of a workflow.
+// A schedule without id gets a new id. The next run is computed from the current time, while the state of the
+// previous runs of an existing schedule is kept.
+// It returns an error if the schedule is invalid, the workflow could not be found or the schedule could not be saved.
+func (wfm *WorkflowManager) SaveSchedule(schedule *Schedule) (err error) {
+
+	// Validate schedule
+	err = schedule.Validate()
+	if err != nil {
+		return
+	}
+	if schedule.WorkflowVersion == 0 {
+		_, err = latestVersion(wfm.store, schedule.WorkflowId)
+	} else {
+		_, err = wfm.store.GetWorkflow(schedule.WorkflowId, schedule.WorkflowVersion)
+	}
+	if err != nil {
+		return
+	}
+	schedule.Version = 0
+	if schedule.Id == "" {
+		schedule.Id = CreateId()
+	} else {
+		var existing *Schedule
+		existing, err = wfm.store.GetSchedule(schedule.Id)
+		if err != nil && !IsScheduleNotFound(err) {
+			return
+		}
+		if existing != nil {
+			// The update fails with a version conflict if the Scheduler runs the schedule in the meantime
+			schedule.LastRunAt = existing.LastRunAt
+			schedule.LastInstanceId = existing.LastInstanceId
+			schedule.Queued = existing.Queued
+			schedule.Version = existing.Version
+		}
+	}
+	schedule.NextRunAt, err = schedule.Next(time.Now())
+	if err != nil {
+		return
+	}
+
+	// Save schedule
+	err = wfm.store.SaveSchedule(schedule)
+
+	return
+}
+
+// GetSchedule retrieves the schedule with the given id.
+// It returns an ErrScheduleNotFound error if the schedule does not exist.
+func (wfm *WorkflowManager) GetSchedule(id string) (schedule *Schedule, err error) {
+
+	schedule, err = wfm.store.GetSchedule(id)
+
+	return
+}
+
+// GetSchedules returns a list of all schedules.
+func (wfm *WorkflowManager) GetSchedules() (schedules []*Schedule, err error) {
+
+	schedules, err = wfm.store.ListSchedules()
+
+	return
+}
+
+// DeleteSchedule removes the schedule with the given id.
+// The instances already started by the schedule are not affected.
+func (wfm *WorkflowManager) DeleteSchedule(id string) (err error) {
+
+	err = wfm.store.DeleteSchedule(id)
+
+	return
+}
+
+// SaveTrigger creates or updates a trigger of a workflow.
+// A trigger without id gets a new id.
+// It returns an error if the trigger is invalid, the workflow could not be found or the trigger could not be saved.
+func (wfm *WorkflowManager) SaveTrigger(trigger *Trigger) (err error) {
+
+	// Validate trigger
+	err = trigger.Validate()
+	if err != nil {
+		return
+	}
+	if trigger.WorkflowVersion == 0 {
+		_, err = latestVersion(wfm.store, trigger.WorkflowId)
+	} else {
+		_, err = wfm.store.GetWorkflow(trigger.WorkflowId, trigger.WorkflowVersion)
+	}
+	if err != nil {
+		return
+	}
+	if trigger.Id == "" {
+		trigger.Id = CreateId()
+	}
+
+	// Save trigger
+	err = wfm.store.SaveTrigger(trigger)
+
+	return
+}
+
+// GetTrigger retrieves the trigger with the given id.
+// It returns an ErrTriggerNotFound error if the trigger does not exist.
+func (wfm *WorkflowManager) GetTrigger(id string) (trigger *Trigger, err error) {
+
+	trigger, err = wfm.store.GetTrigger(id)
+
+	return
+}
+
+// GetTriggers returns a list of all triggers.
+func (wfm *WorkflowManager) GetTriggers() (triggers []*Trigger, err error) {
+
+	triggers, err = wfm.store.ListTriggers()
+
+	return
+}
+
+// DeleteTrigger removes the trigger with the given id.
+// The instances already started by the trigger are not affected.
+func (wfm *WorkflowManager) DeleteTrigger(id string) (err error) {
+
+	err = wfm.store.DeleteTrigger(id)
+
+	return
+}
+
 // Start initializes and starts the execution of a workflow with the given ID and version.
 // It takes an input map containing the initial data for the workflow.
 //
@@ -85,8 +241,15 @@ func (wfm *WorkflowManager) Save(workflow *models.Workflow) (err error) {
 //   - err: An error if the workflow could not be started, otherwise nil.
 func (wfm *WorkflowManager) Start(id string, version int, input map[string]any) (instanceId string, err error) {
 
-	// Get workflow
-	workflow, err := wfm.GetWorkflow(id, version)
+	instanceId, err = wfm.start(id, version, input, nil)
+	return
+}
+
+// start starts the workflow as a child instance of the parent if a parent is given.
+func (wfm *WorkflowManager) start(id string, version int, input map[string]any, parent *ParentLink) (instanceId string, err error) {
+
+	// Check the workflow exists
+	_, err = wfm.GetWorkflow(id, version)
 	if err != nil {
 		return
 	}
@@ -97,27 +260,459 @@ func (wfm *WorkflowManager) Start(id string, version int, input map[string]any)
 	pipeline.Set(data.InstanceIdKey, instanceId)
 	pipeline.Set(data.WorkflowIdKey, id)
 	pipeline.Set(data.WorkflowVersionKey, version)
-	// Save pipeline
-	// err = wfm.store.SavePipeline(pipeline)
-	err = wfm.store.CreateNewInstance(id, instanceId, pipeline)
+	// The instance is created along with its first task
+	err = wfm.store.WithTx(func(tx Storage) (err error) {
+		// Save pipeline
+		// err = tx.SavePipeline(pipeline)
+		err = tx.CreateNewInstance(id, instanceId, pipeline)
+		if err != nil {
+			return
+		}
+		workflowState := &WorkflowState{
+			InstanceId:      instanceId,
+			WorkflowId:      id,
+			WorkflowVersion: version,
+			Status:          models.StatusRunning,
+			Parent:          parent,
+		}
+		// Save workflow state
+		err = tx.SaveState(workflowState)
+		if err != nil {
+			return
+		}
+		// Arm the workflow timeout
+		var options *WorkflowOptions
+		options, err = tx.GetWorkflowOptions(id, version)
+		if err != nil {
+			return
+		}
+		if options.TimeoutMs > 0 {
+			err = tx.AddTimer(&Timer{
+				Id:         CreateId(),
+				InstanceId: instanceId,
+				Type:       TimerTypeWorkflowTimeout,
+				FireAt:     time.Now().Add(time.Duration(options.TimeoutMs) * time.Millisecond),
+			})
+			if err != nil {
+				return
+			}
+		}
+		// Let the workers execute the instance
+		err = queueExecution(tx, instanceId)
+		return
+	})
+	return
+}
+
+// CompleteStep reports the result of a step whose action completes asynchronously.
+// The step must be running for the given iteration, otherwise an ErrStepNotRunning error is returned.
+//
+// Parameters:
+//   - instanceId: The unique identifier of the workflow instance.
+//   - stepId: The unique identifier of the step.
+//   - iteration: The iteration of the step.
+//   - status: The status of the step reported by the action.
+//   - output: The output of the action that is merged into the pipeline.
+//
+// Returns:
+//   - err: An error if the step could not be completed, otherwise nil.
+func (wfm *WorkflowManager) CompleteStep(instanceId, stepId string, iteration int, status models.Status, output map[string]any) (err error) {
+
+	var stepState *StepState
+	stepState, err = wfm.store.GetStepState(instanceId, stepId, iteration)
+	if err != nil {
+		return
+	}
+	if stepState == nil {
+		err = ErrStepStateNotFound(stepId)
+		return
+	}
+	if stepState.Status != models.StatusRunning || !stepState.NextRetryAt.IsZero() {
+		err = ErrStepNotRunning(stepId, iteration)
+		return
+	}
+	eventData := make(map[string]any)
+	for k, v := range output {
+		eventData[k] = v
+	}
+	eventData[data.StepIterationKey] = iteration
+	stepChangeHandler := &StepChangeHander{storage: wfm.store}
+	err = stepChangeHandler.Handle(&events.StepChangeEvent{
+		EventId:    CreateId(),
+		InstanceId: instanceId,
+		StepId:     stepId,
+		Status:     status,
+		Data:       eventData,
+	})
+	return
+}
+
+// Signal delivers a signal to a running or paused instance.
+// The signal completes a step waiting for it and its payload is added to the pipeline. Signals that arrive before
+// a step waits for them are buffered until the step starts.
+// It returns an ErrInvalidInstanceState error if the instance is neither running nor paused.
+func (wfm *WorkflowManager) Signal(instanceId, name string, payload map[string]any) (err error) {
+
+	var workflowState *WorkflowState
+	workflowState, err = wfm.store.GetState(instanceId)
+	if err != nil {
+		return
+	}
+	if !workflowState.IsActive() {
+		err = ErrInvalidInstanceState(instanceId, workflowState.Status)
+		return
+	}
+	err = wfm.store.SaveSignal(&Signal{
+		Id:         CreateId(),
+		InstanceId: instanceId,
+		Name:       name,
+		Payload:    payload,
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	// If the instance is busy the signal is delivered before the lock is released
+	stepChangeHandler := &StepChangeHander{storage: wfm.store}
+	_, err = stepChangeHandler.runLocked(instanceId, func() (err error) {
+		delivered := true
+		for delivered && err == nil {
+			delivered, err = stepChangeHandler.deliverSignal(instanceId)
+		}
+		return
+	})
+	return
+}
+
+// Pause pauses a running instance.
+// Actions that are already in flight finish, but no new steps are scheduled until the instance is resumed.
+// It returns an ErrInvalidInstanceState error if the instance is not running.
+func (wfm *WorkflowManager) Pause(instanceId string) (err error) {
+
+	err = wfm.runLocked(instanceId, func() (err error) {
+		var workflowState *WorkflowState
+		workflowState, err = wfm.store.GetState(instanceId)
+		if err != nil {
+			return
+		}
+		if workflowState.Status != models.StatusRunning {
+			err = ErrInvalidInstanceState(instanceId, workflowState.Status)
+			return
+		}
+		workflowState.Status = models.StatusPending
+		workflowState.Reason = ReasonPaused
+		err = wfm.store.SaveState(workflowState)
+		return
+	})
+	return
+}
+
+// Resume resumes a paused instance and continues its execution from the stored state.
+// It returns an ErrInvalidInstanceState error if the instance is not paused.
+func (wfm *WorkflowManager) Resume(instanceId string) (err error) {
+
+	err = wfm.runLocked(instanceId, func() (err error) {
+		var workflowState *WorkflowState
+		var workflow *models.Workflow
+		var pipeline *VersionedPipeline
+		workflowState, err = wfm.store.GetState(instanceId)
+		if err != nil {
+			return
+		}
+		if !workflowState.IsPaused() {
+			err = ErrInvalidInstanceState(instanceId, workflowState.Status)
+			return
+		}
+		workflowState.Status = models.StatusRunning
+		workflowState.Reason = ""
+		err = wfm.store.SaveState(workflowState)
+		if err != nil {
+			return
+		}
+		workflow, err = wfm.store.GetWorkflowByInstance(instanceId)
+		if err != nil {
+			return
+		}
+		pipeline, err = wfm.store.GetPipeline(instanceId)
+		if err != nil {
+			return
+		}
+		wfe := WorkflowExecutor{storage: wfm.store}
+		err = wfe.Execute(workflow, pipeline)
+		return
+	})
+	return
+}
+
+// Cancel cancels a running or paused instance along with its child instances.
+// The running steps are failed and, if notifyActions is set, the cancel hook of their action endpoint is called by the
+// workers once the instance is cancelled.
+// It returns an ErrInvalidInstanceState error if the instance is neither running nor paused.
+func (wfm *WorkflowManager) Cancel(instanceId string, notifyActions bool) (err error) {
+
+	err = wfm.stop(instanceId, ReasonCancelled, notifyActions)
+	return
+}
+
+// Terminate terminates a running or paused instance along with its child instances.
+// The running steps are failed without notifying their actions.
+// It returns an ErrInvalidInstanceState error if the instance is neither running nor paused.
+func (wfm *WorkflowManager) Terminate(instanceId string) (err error) {
+
+	err = wfm.stop(instanceId, ReasonTerminated, false)
+	return
+}
+
+// stop fails the running steps and the instance with the given reason.
+func (wfm *WorkflowManager) stop(instanceId string, reason Reason, notifyActions bool) (err error) {
+
+	err = wfm.runLocked(instanceId, func() error {
+		return wfm.stopLocked(instanceId, reason, notifyActions)
+	})
+	return
+}
+
+// stopLocked fails the running steps and the instance while the caller holds the lock of the instance.
+// The steps, the child instances and the instance are stopped in one transaction.
+func (wfm *WorkflowManager) stopLocked(instanceId string, reason Reason, notifyActions bool) (err error) {
+	err = wfm.store.WithTx(func(tx Storage) error {
+		txManager := &WorkflowManager{store: tx}
+		return txManager.stopInTx(instanceId, reason, notifyActions)
+	})
+	return
+}
+
+// stopInTx fails the running steps and the instance in the transaction of the WorkflowManager.
+func (wfm *WorkflowManager) stopInTx(instanceId string, reason Reason, notifyActions bool) (err error) {
+	var workflowState *WorkflowState
+	var workflow *models.Workflow
+	var workflowOptions *WorkflowOptions
+	var stepStates map[string][]*StepState
+	workflowState, err = wfm.store.GetState(instanceId)
+	if err != nil {
+		return
+	}
+	if !workflowState.IsActive() {
+		err = ErrInvalidInstanceState(instanceId, workflowState.Status)
+		return
+	}
+	workflow, err = wfm.store.GetWorkflowByInstance(instanceId)
 	if err != nil {
 		return
 	}
-	workflowState := &WorkflowState{
-		InstanceId:      instanceId,
-		InstanceVersion: 1,
-		WorkflowId:      id,
-		WorkflowVersion: version,
-		Status:          models.StatusRunning,
+	workflowOptions, err = wfm.store.GetWorkflowOptions(workflow.Id, workflow.Version)
+	if err != nil {
+		return
 	}
-	// Save workflow state
-	err = wfm.store.SaveState(workflowState)
+	stepStates, err = wfm.store.GetStepStates(instanceId)
 	if err != nil {
 		return
 	}
-	// Create Workflow Executor
-	wfe := WorkflowExecutor{storage: wfm.store}
-	// Execute workflow
-	err = wfe.Execute(workflow, pipeline)
+	errMsg := fmt.Sprintf("instance %s %s", instanceId, strings.ToLower(string(reason)))
+	for _, stepStateArr := range stepStates {
+		for _, stepState := range stepStateArr {
+			if stepState.Status != models.StatusRunning {
+				continue
+			}
+			step := workflowOptions.findStep(workflow, stepState.StepId)
+			if notifyActions && step != nil && step.Type == models.StepTypeAction {
+				// The action is notified by the workers once the transaction is committed
+				err = queueCancel(wfm.store, stepState)
+				if err != nil {
+					return
+				}
+			}
+			stepState.Status = models.StatusFailed
+			stepState.NextRetryAt = time.Time{}
+			stepState.Output = data.NewPipelineFrom(map[string]any{data.ErrorKey: errMsg})
+			err = wfm.store.SaveStepState(stepState)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = wfm.stopChildren(instanceId, reason, notifyActions)
+	if err != nil {
+		return
+	}
+	logger.InfoF("Stopping instance %s with reason %s", instanceId, reason)
+	workflowState.Status = models.StatusFailed
+	workflowState.Reason = reason
+	workflowState.Error = errMsg
+	err = finishInstance(wfm.store, workflowState)
+	return
+}
+
+// stopChildren stops the active child instances of the instance with the given reason.
+func (wfm *WorkflowManager) stopChildren(instanceId string, reason Reason, notifyActions bool) (err error) {
+
+	var children []*WorkflowState
+	children, err = wfm.store.GetChildInstances(instanceId)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		if !child.IsActive() {
+			continue
+		}
+		err = wfm.stop(child.InstanceId, reason, notifyActions)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Restart restarts a failed instance from the steps that failed.
+// The failed action steps are queued to run again and the failed parents of for, parallel, if and switch steps
+// are set back to running so that they complete once their children do. Completed steps are not run again.
+// The variables are set in the pipeline before the execution continues.
+// It returns an ErrInvalidInstanceState error if the instance has not failed or was cancelled or terminated.
+func (wfm *WorkflowManager) Restart(instanceId string, variables map[string]any) (err error) {
+
+	err = wfm.runLocked(instanceId, func() (err error) {
+		var workflowState *WorkflowState
+		var workflow *models.Workflow
+		var workflowOptions *WorkflowOptions
+		var pipeline *VersionedPipeline
+		var stepStates map[string][]*StepState
+		var pendingSteps []*PendingStep
+		workflowState, err = wfm.store.GetState(instanceId)
+		if err != nil {
+			return
+		}
+		if workflowState.Status != models.StatusFailed || workflowState.Compensation != nil ||
+			workflowState.Reason == ReasonCancelled || workflowState.Reason == ReasonTerminated {
+			// Compensated instances have undone their completed steps and cannot continue, stopped instances were
+			// failed on purpose
+			err = ErrInvalidInstanceState(instanceId, workflowState.Status)
+			return
+		}
+		workflow, err = wfm.store.GetWorkflowByInstance(instanceId)
+		if err != nil {
+			return
+		}
+		workflowOptions, err = wfm.store.GetWorkflowOptions(workflow.Id, workflow.Version)
+		if err != nil {
+			return
+		}
+		stepStates, err = wfm.store.GetStepStates(instanceId)
+		if err != nil {
+			return
+		}
+		// The failed steps are restarted all at once
+		err = wfm.store.WithTx(func(tx Storage) (err error) {
+			for _, stepStateArr := range stepStates {
+				for _, stepState := range stepStateArr {
+					if stepState.Status != models.StatusFailed {
+						continue
+					}
+					step := workflowOptions.findStep(workflow, stepState.StepId)
+					if step == nil {
+						err = errors.New("Unable to find step with id " + stepState.StepId)
+						return
+					}
+					if stepState.ChildCount > 0 {
+						// Wait for the children again
+						stepState.Status = models.StatusRunning
+					} else {
+						stepState.Status = models.StatusPending
+						pendingSteps = append(pendingSteps, wfm.restartStep(workflowOptions, workflow, stepState))
+					}
+					stepState.Output = nil
+					stepState.Attempts = nil
+					stepState.NextRetryAt = time.Time{}
+					err = tx.SaveStepState(stepState)
+					if err != nil {
+						return
+					}
+				}
+			}
+			err = tx.AddPendingSteps(instanceId, pendingSteps...)
+			if err != nil {
+				return
+			}
+			pipeline, err = tx.GetPipeline(instanceId)
+			if err != nil {
+				return
+			}
+			for k, v := range variables {
+				pipeline.Set(k, v)
+			}
+			err = tx.SavePipeline(pipeline)
+			if err != nil {
+				return
+			}
+			if workflowState.Reason == ReasonTimedOut {
+				// The timeout fired already, give the instance a new one
+				var options *WorkflowOptions
+				options, err = tx.GetWorkflowOptions(workflowState.WorkflowId, workflowState.WorkflowVersion)
+				if err != nil {
+					return
+				}
+				if options.TimeoutMs > 0 {
+					err = tx.AddTimer(&Timer{
+						Id:         CreateId(),
+						InstanceId: instanceId,
+						Type:       TimerTypeWorkflowTimeout,
+						FireAt:     time.Now().Add(time.Duration(options.TimeoutMs) * time.Millisecond),
+					})
+					if err != nil {
+						return
+					}
+				}
+			}
+			logger.InfoF("Restarting instance %s with %d failed steps", instanceId, len(pendingSteps))
+			workflowState.Status = models.StatusRunning
+			workflowState.Reason = ""
+			workflowState.Error = ""
+			err = tx.SaveState(workflowState)
+			return
+		})
+		if err != nil {
+			return
+		}
+		wfe := WorkflowExecutor{storage: wfm.store}
+		err = wfe.Execute(workflow, pipeline)
+		return
+	})
+	return
+}
+
+// restartStep creates the pending step that runs a failed step again in the same iteration.
+func (wfm *WorkflowManager) restartStep(workflowOptions *WorkflowOptions, workflow *models.Workflow, stepState *StepState) (pendingStep *PendingStep) {
+	pendingStep = &PendingStep{
+		Id:        CreateId(),
+		ParentId:  stepState.ParentStep,
+		Iteration: stepState.Iteration,
+		StepId:    stepState.StepId,
+	}
+	parent := workflowOptions.findStep(workflow, stepState.ParentStep)
+	if parent == nil {
+		return
+	}
+	switch parent.Type {
+	case models.StepTypeForLoop:
+		pendingStep.VarName = forIndexVar(parent)
+		pendingStep.VarValue = strconv.Itoa(stepState.Iteration)
+	case StepTypeWhile:
+		if whileOptions := workflowOptions.Step(parent.Id); whileOptions != nil && whileOptions.While != nil {
+			pendingStep.VarName = whileOptions.While.indexVar(parent.Id)
+			pendingStep.VarValue = stepState.Iteration
+		}
+	}
+	return
+}
+
+// runLocked runs f while holding the lock of the instance.
+// It returns an ErrInstanceBusy error if the instance is locked by someone else.
+func (wfm *WorkflowManager) runLocked(instanceId string, f func() error) (err error) {
+
+	var lock bool
+	stepChangeHandler := &StepChangeHander{storage: wfm.store}
+	lock, err = stepChangeHandler.runLocked(instanceId, f)
+	if err == nil && !lock {
+		err = ErrInstanceBusy(instanceId)
+	}
 	return
 }
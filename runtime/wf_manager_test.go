@@ -0,0 +1,346 @@
+package runtime
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/golly/messaging"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestRestartStoppedInstance(t *testing.T) {
+	for _, reason := range []Reason{ReasonCancelled, ReasonTerminated} {
+		storage := NewInMemoryStorage(nil)
+		wfm := NewWorkflowManager(storage)
+		err := wfm.Save(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusFailed, Reason: reason})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		err = wfm.Restart("instance-1", nil)
+		if !IsInvalidInstanceState(err) {
+			t.Errorf("expected the %s instance not to be restarted, got %v", reason, err)
+		}
+	}
+}
+
+func TestRestartStepInWhileLoop(t *testing.T) {
+	workflow := &models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps:   []*models.Step{{Id: "while-1", Type: StepTypeWhile}},
+	}
+	workflowOptions := &WorkflowOptions{
+		WorkflowId:      "workflow-1",
+		WorkflowVersion: 1,
+		Steps: map[string]*StepOptions{"while-1": {While: &WhileLoop{
+			Condition: "true",
+			IndexVar:  "i",
+			Steps:     []*models.Step{{Id: "step-1", Type: models.StepTypeAction}},
+		}}},
+	}
+	wfm := NewWorkflowManager(NewInMemoryStorage(nil))
+	pendingStep := wfm.restartStep(workflowOptions, workflow, &StepState{
+		InstanceId: "instance-1",
+		StepId:     "step-1",
+		ParentStep: "while-1",
+		Iteration:  2,
+	})
+	if pendingStep.ParentId != "while-1" || pendingStep.Iteration != 2 {
+		t.Errorf("expected the step to restart in iteration 2 of the loop, got %+v", pendingStep)
+	}
+	if pendingStep.VarName != "i" || pendingStep.VarValue != 2 {
+		t.Errorf("expected the index of the iteration to be restored, got %s=%v", pendingStep.VarName, pendingStep.VarValue)
+	}
+}
+
+func TestCancelNotifiesActionAfterCommit(t *testing.T) {
+	// The listeners of the in-process provider outlive the test, each run uses its own topic
+	topic := "chan://orcaloop-test/" + CreateId() + "/action"
+	storage := NewInMemoryStorage(nil)
+	err := storage.SaveAction(&models.ActionSpec{
+		Id:       "publish",
+		Name:     "publish",
+		Endpoint: &models.Endpoint{Type: models.EndpointTypeMessaging, Messaging: &models.MessagingEndpoint{Url: topic}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	wfm := NewWorkflowManager(storage)
+	err = wfm.Save(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps: []*models.Step{{
+			Id:     "step-1",
+			Type:   models.StepTypeAction,
+			Action: &models.StepAction{Id: "publish", Name: "publish"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cancelled := make(chan string, 1)
+	topicUrl, _ := url.Parse(topic)
+	err = messaging.GetManager().AddListener(topicUrl, func(msg messaging.Message) {
+		header, _ := msg.GetStrHeader(CancelHeader)
+		cancelled <- header
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = wfm.Cancel("instance-1", true)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("expected the action not to be notified while the instance is cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	wq := NewWorkQueue(storage, nil)
+	tasks, err := storage.LeaseTasks(wq.owner, 1, time.Minute)
+	if err != nil || len(tasks) != 1 || tasks[0].Type != TaskTypeCancel {
+		t.Fatalf("expected a cancel task, got %v %v", tasks, err)
+	}
+	wq.process(tasks[0])
+	select {
+	case header := <-cancelled:
+		if header != "true" {
+			t.Errorf("expected the cancel header to be set, got %s", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the action to be notified")
+	}
+}
+
+// newAsyncInstance saves a running instance of a workflow whose only step calls an action reporting back through
+// the step completion route, the step is running.
+func newAsyncInstance(t *testing.T) (Storage, *WorkflowManager) {
+	t.Helper()
+	storage := NewInMemoryStorage(nil)
+	wfm := NewWorkflowManager(storage)
+	err := wfm.Save(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps: []*models.Step{{
+			Id:     "step-1",
+			Type:   models.StepTypeAction,
+			Action: &models.StepAction{Id: "async", Name: "async"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveStepState(&StepState{InstanceId: "instance-1", StepId: "step-1", Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return storage, wfm
+}
+
+func TestCompleteStep(t *testing.T) {
+	storage, wfm := newAsyncInstance(t)
+	err := wfm.CompleteStep("instance-1", "step-1", 0, models.StatusCompleted, map[string]any{"result": "done"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	pipeline, err := storage.GetPipeline("instance-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	result, _ := pipeline.Get("result")
+	if result != "done" {
+		t.Errorf("expected the output of the action in the pipeline, got %v", result)
+	}
+	workflowState, err := storage.GetState("instance-1")
+	if err != nil || workflowState.Status != models.StatusCompleted {
+		t.Errorf("expected the instance to complete, got %v %v", workflowState, err)
+	}
+	// The callback is not accepted twice
+	err = wfm.CompleteStep("instance-1", "step-1", 0, models.StatusCompleted, nil)
+	if !IsStepNotRunning(err) {
+		t.Errorf("expected the completed step to be rejected, got %v", err)
+	}
+}
+
+func TestCompleteStepFailed(t *testing.T) {
+	storage, wfm := newAsyncInstance(t)
+	err := wfm.CompleteStep("instance-1", "step-1", 0, models.StatusFailed, map[string]any{data.ErrorKey: "rejected"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	workflowState, err := storage.GetState("instance-1")
+	if err != nil || workflowState.Status != models.StatusFailed {
+		t.Errorf("expected the instance to fail, got %v %v", workflowState, err)
+	}
+}
+
+func TestCompleteStepRejected(t *testing.T) {
+	tests := map[string]struct {
+		stepId    string
+		iteration int
+		retry     bool
+		check     func(error) bool
+	}{
+		"unknown step":      {stepId: "step-2", check: IsStepStateNotFound},
+		"unknown iteration": {stepId: "step-1", iteration: 1, check: IsStepStateNotFound},
+		"retry pending":     {stepId: "step-1", retry: true, check: IsStepNotRunning},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			storage, wfm := newAsyncInstance(t)
+			if tt.retry {
+				stepState, err := storage.GetStepState("instance-1", "step-1", 0)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				stepState.NextRetryAt = time.Now().Add(time.Minute)
+				err = storage.SaveStepState(stepState)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			err := wfm.CompleteStep("instance-1", tt.stepId, tt.iteration, models.StatusCompleted, nil)
+			if !tt.check(err) {
+				t.Errorf("expected the callback to be rejected, got %v", err)
+			}
+			workflowState, err := storage.GetState("instance-1")
+			if err != nil || workflowState.Status != models.StatusRunning {
+				t.Errorf("expected the instance to keep running, got %v %v", workflowState, err)
+			}
+		})
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	storage, wfm := newAsyncInstance(t)
+	err := wfm.Pause("instance-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	workflowState, err := storage.GetState("instance-1")
+	if err != nil || !workflowState.IsPaused() {
+		t.Fatalf("expected the instance to be paused, got %v %v", workflowState, err)
+	}
+	err = wfm.Pause("instance-1")
+	if !IsInvalidInstanceState(err) {
+		t.Errorf("expected the paused instance not to be paused again, got %v", err)
+	}
+	// The action in flight finishes while the instance is paused, the instance does not continue
+	err = wfm.CompleteStep("instance-1", "step-1", 0, models.StatusCompleted, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	workflowState, err = storage.GetState("instance-1")
+	if err != nil || !workflowState.IsPaused() {
+		t.Fatalf("expected the instance to stay paused, got %v %v", workflowState, err)
+	}
+	err = wfm.Resume("instance-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	workflowState, err = storage.GetState("instance-1")
+	if err != nil || workflowState.Status != models.StatusCompleted || workflowState.Reason != "" {
+		t.Errorf("expected the resumed instance to complete, got %v %v", workflowState, err)
+	}
+	err = wfm.Resume("instance-1")
+	if !IsInvalidInstanceState(err) {
+		t.Errorf("expected the completed instance not to be resumed, got %v", err)
+	}
+}
+
+func TestStopInstance(t *testing.T) {
+	tests := map[string]struct {
+		paused bool
+		reason Reason
+		stop   func(wfm *WorkflowManager) error
+	}{
+		"cancel running":    {reason: ReasonCancelled, stop: func(wfm *WorkflowManager) error { return wfm.Cancel("instance-1", false) }},
+		"cancel paused":     {paused: true, reason: ReasonCancelled, stop: func(wfm *WorkflowManager) error { return wfm.Cancel("instance-1", false) }},
+		"terminate running": {reason: ReasonTerminated, stop: func(wfm *WorkflowManager) error { return wfm.Terminate("instance-1") }},
+		"terminate paused":  {paused: true, reason: ReasonTerminated, stop: func(wfm *WorkflowManager) error { return wfm.Terminate("instance-1") }},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			storage, wfm := newAsyncInstance(t)
+			if tt.paused {
+				err := wfm.Pause("instance-1")
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			err := tt.stop(wfm)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			workflowState, err := storage.GetState("instance-1")
+			if err != nil || workflowState.Status != models.StatusFailed || workflowState.Reason != tt.reason {
+				t.Errorf("expected the instance to fail with reason %s, got %v %v", tt.reason, workflowState, err)
+			}
+			stepState, err := storage.GetStepState("instance-1", "step-1", 0)
+			if err != nil || stepState.Status != models.StatusFailed {
+				t.Errorf("expected the running step to fail, got %v %v", stepState, err)
+			}
+			// The actions are not notified
+			queued, err := storage.HasTasks("instance-1")
+			if err != nil || queued {
+				t.Errorf("expected no task to be queued, got %v %v", queued, err)
+			}
+			// A stopped instance is final
+			err = tt.stop(wfm)
+			if !IsInvalidInstanceState(err) {
+				t.Errorf("expected the stopped instance not to be stopped again, got %v", err)
+			}
+			err = wfm.Pause("instance-1")
+			if !IsInvalidInstanceState(err) {
+				t.Errorf("expected the stopped instance not to be paused, got %v", err)
+			}
+			err = wfm.Resume("instance-1")
+			if !IsInvalidInstanceState(err) {
+				t.Errorf("expected the stopped instance not to be resumed, got %v", err)
+			}
+			err = wfm.CompleteStep("instance-1", "step-1", 0, models.StatusCompleted, nil)
+			if !IsStepNotRunning(err) {
+				t.Errorf("expected the callback of the stopped step to be rejected, got %v", err)
+			}
+		})
+	}
+}
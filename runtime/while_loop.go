@@ -0,0 +1,269 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+// DefaultMaxIterations is the maximum number of iterations of a while loop if none is configured.
+const DefaultMaxIterations = 100
+
+// WhileLoop holds the configuration of a step of type StepTypeWhile.
+// The steps of the loop run one after the other in every iteration. The children of an iteration are tracked with
+// the number of the iteration, starting from 0.
+//
+// Fields:
+// - Condition: The condition evaluated against the pipeline before every iteration.
+// - Until: Runs the steps before the condition is evaluated and repeats them until the condition is true.
+// - MaxIterations: The number of iterations after which the loop fails. Defaults to DefaultMaxIterations.
+// - DelayMs: The time in milliseconds to wait between two iterations.
+// - IndexVar: The pipeline variable holding the number of the iteration. Defaults to idx-<step id>.
+// - Steps: The steps of the loop.
+type WhileLoop struct {
+	Condition     string         `json:"condition" yaml:"condition"`
+	Until         bool           `json:"until,omitempty" yaml:"until,omitempty"`
+	MaxIterations int            `json:"max_iterations,omitempty" yaml:"max_iterations,omitempty"`
+	DelayMs       int64          `json:"delay_ms,omitempty" yaml:"delay_ms,omitempty"`
+	IndexVar      string         `json:"index_var,omitempty" yaml:"index_var,omitempty"`
+	Steps         []*models.Step `json:"steps" yaml:"steps"`
+}
+
+// Validate checks the while loop configuration for missing or invalid values.
+func (wl *WhileLoop) Validate() (err error) {
+	switch {
+	case wl.Condition == "":
+		err = errors.New("condition is required")
+	case len(wl.Steps) == 0:
+		err = errors.New("steps are required")
+	case wl.MaxIterations < 0:
+		err = errors.New("max_iterations must not be negative")
+	case wl.DelayMs < 0:
+		err = errors.New("delay_ms must not be negative")
+	}
+	return
+}
+
+func (wl *WhileLoop) maxIterations() int {
+	if wl.MaxIterations == 0 {
+		return DefaultMaxIterations
+	}
+	return wl.MaxIterations
+}
+
+func (wl *WhileLoop) indexVar(stepId string) string {
+	if wl.IndexVar == "" {
+		return "idx-" + stepId
+	}
+	return wl.IndexVar
+}
+
+// repeat evaluates the condition of the loop and returns true if another iteration is due.
+func (wl *WhileLoop) repeat(pipeline *data.Pipeline) (repeat bool, err error) {
+	repeat, err = pipeline.EvaluateCondition(wl.Condition)
+	if wl.Until {
+		repeat = !repeat
+	}
+	return
+}
+
+// getWhileLoop returns the configuration of the while loop step.
+func getWhileLoop(storage Storage, instanceId, stepId string) (whileLoop *WhileLoop, err error) {
+	var stepOptions *StepOptions
+	stepOptions, err = getStepOptions(storage, instanceId, stepId)
+	if err != nil {
+		return
+	}
+	if stepOptions == nil || stepOptions.While == nil {
+		err = fmt.Errorf("no while loop configured for step %s", stepId)
+		return
+	}
+	whileLoop = stepOptions.While
+	return
+}
+
+// startWhile runs the first iteration of the loop unless the condition of a while loop is false already,
+// in which case the step is skipped.
+func (se *StepExecutor) startWhile(step *models.Step, stepState *StepState, pipeline *data.Pipeline) (err error) {
+	var whileLoop *WhileLoop
+	var repeat bool = true
+	whileLoop, err = getWhileLoop(se.storage, stepState.InstanceId, step.Id)
+	if err != nil {
+		return
+	}
+	if !whileLoop.Until {
+		repeat, err = whileLoop.repeat(pipeline)
+		if err != nil {
+			return
+		}
+	}
+	if !repeat {
+		var workflow *models.Workflow
+		var instancePipeline *VersionedPipeline
+		logger.InfoF("Skipping while loop of step %s as its condition is false", step.Id)
+		stepState.Status = models.StatusSkipped
+		err = se.storage.SaveStepState(stepState)
+		if err != nil {
+			return
+		}
+		// Continue with the next step
+		workflow, err = se.storage.GetWorkflowByInstance(stepState.InstanceId)
+		if err != nil {
+			return
+		}
+		instancePipeline, err = se.storage.GetPipeline(stepState.InstanceId)
+		if err != nil {
+			return
+		}
+		wfe := WorkflowExecutor{storage: se.storage}
+		err = wfe.Execute(workflow, instancePipeline)
+		return
+	}
+	stepState.ChildCount = len(whileLoop.Steps)
+	// The loop starts along with the pending steps of its first iteration
+	err = se.storage.WithTx(func(tx Storage) (err error) {
+		txExecutor := &StepExecutor{storage: tx}
+		err = txExecutor.start(stepState)
+		if err != nil {
+			return
+		}
+		err = queueIteration(tx, stepState, whileLoop, 0, whileLoop.Steps[1:])
+		return
+	})
+	if err != nil {
+		return
+	}
+	firstStep := whileLoop.Steps[0]
+	childPipeline := cloneFor(pipeline, firstStep, step.Id)
+	childPipeline.Set(whileLoop.indexVar(step.Id), 0)
+	childPipeline.Set(data.StepIterationKey, 0)
+	err = se.Execute(firstStep, childPipeline)
+	return
+}
+
+// queueIteration adds the steps of an iteration of the loop as pending steps.
+func queueIteration(storage Storage, stepState *StepState, whileLoop *WhileLoop, iteration int, steps []*models.Step) (err error) {
+	var pendingSteps []*PendingStep
+	for _, step := range steps {
+		pendingSteps = append(pendingSteps, &PendingStep{
+			Id:        CreateId(),
+			ParentId:  stepState.StepId,
+			Iteration: iteration,
+			StepId:    step.Id,
+			VarName:   whileLoop.indexVar(stepState.StepId),
+			VarValue:  iteration,
+		})
+	}
+	err = storage.AddPendingSteps(stepState.InstanceId, pendingSteps...)
+	return
+}
+
+// nextIteration is called once all children of the running while loop finished.
+// It starts the next iteration if the condition holds, right away or with a timer if a delay is configured.
+// Otherwise the loop completes, or fails if it reached the maximum number of iterations.
+// It returns true if there are pending steps to continue with.
+func nextIteration(storage Storage, workflow *models.Workflow, stepState *StepState) (running bool, err error) {
+	var whileLoop *WhileLoop
+	var pipeline *VersionedPipeline
+	var repeat bool
+	whileLoop, err = getWhileLoop(storage, stepState.InstanceId, stepState.StepId)
+	if err != nil {
+		return
+	}
+	pipeline, err = storage.GetPipeline(stepState.InstanceId)
+	if err != nil {
+		return
+	}
+	repeat, err = whileLoop.repeat(pipeline.Pipeline)
+	if err != nil {
+		return
+	}
+	iteration := stepState.ChildCount / len(whileLoop.Steps)
+	if !repeat {
+		logger.InfoF("While loop of step %s completed after %d iterations", stepState.StepId, iteration)
+		stepState.Status = models.StatusCompleted
+		err = storage.SaveStepState(stepState)
+		return
+	}
+	if iteration >= whileLoop.maxIterations() {
+		running, err = failStep(storage, workflow, stepState, fmt.Sprintf("while loop of step %s exceeded %d iterations", stepState.StepId, whileLoop.maxIterations()))
+		return
+	}
+	stepState.ChildCount += len(whileLoop.Steps)
+	err = storage.SaveStepState(stepState)
+	if err != nil {
+		return
+	}
+	if whileLoop.DelayMs > 0 {
+		err = storage.AddTimer(&Timer{
+			Id:         CreateId(),
+			InstanceId: stepState.InstanceId,
+			StepId:     stepState.StepId,
+			Iteration:  stepState.Iteration,
+			Type:       TimerTypeIteration,
+			FireAt:     time.Now().Add(time.Duration(whileLoop.DelayMs) * time.Millisecond),
+		})
+		return
+	}
+	running = true
+	err = queueIteration(storage, stepState, whileLoop, iteration, whileLoop.Steps)
+	return
+}
+
+// iterate starts the iteration of a while loop that waited for its delay.
+func (ts *TimerScheduler) iterate(timer *Timer) (fired bool, err error) {
+	var paused bool
+	stepChangeHandler := &StepChangeHander{storage: ts.storage}
+	// The instance is busy if it cannot be locked, try again with the next poll
+	fired, err = stepChangeHandler.runLocked(timer.InstanceId, func() (err error) {
+		var workflowState *WorkflowState
+		var stepState *StepState
+		var whileLoop *WhileLoop
+		var workflow *models.Workflow
+		var pipeline *VersionedPipeline
+		workflowState, err = ts.storage.GetState(timer.InstanceId)
+		if err != nil {
+			return
+		}
+		if workflowState.IsPaused() {
+			// Keep the timer so that the loop continues once the instance is resumed
+			paused = true
+			return
+		}
+		if workflowState.Status != models.StatusRunning {
+			return
+		}
+		stepState, err = ts.storage.GetStepState(timer.InstanceId, timer.StepId, timer.Iteration)
+		if err != nil || stepState == nil || stepState.Status != models.StatusRunning {
+			return
+		}
+		whileLoop, err = getWhileLoop(ts.storage, timer.InstanceId, timer.StepId)
+		if err != nil {
+			return
+		}
+		iteration := stepState.ChildCount/len(whileLoop.Steps) - 1
+		logger.InfoF("Starting iteration %d of while loop %s for instance %s", iteration, timer.StepId, timer.InstanceId)
+		err = queueIteration(ts.storage, stepState, whileLoop, iteration, whileLoop.Steps)
+		if err != nil {
+			return
+		}
+		workflow, err = ts.storage.GetWorkflowByInstance(timer.InstanceId)
+		if err != nil {
+			return
+		}
+		pipeline, err = ts.storage.GetPipeline(timer.InstanceId)
+		if err != nil {
+			return
+		}
+		wfe := WorkflowExecutor{storage: ts.storage}
+		err = wfe.Execute(workflow, pipeline)
+		return
+	})
+	if paused {
+		fired = false
+	}
+	return
+}
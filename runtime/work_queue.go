@@ -0,0 +1,340 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"oss.nandlabs.io/golly/lifecycle"
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/events"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+const (
+	// DefaultTaskWorkers is the number of workers of the WorkQueue if none is configured.
+	DefaultTaskWorkers = 4
+	// DefaultTaskLeaseTimeout is the time a task stays invisible to the other workers once it was leased, unless the
+	// lease is extended by the heartbeats of the worker processing it.
+	DefaultTaskLeaseTimeout = 30 * time.Second
+	// DefaultTaskPollInterval is the interval at which an idle worker looks for new tasks.
+	DefaultTaskPollInterval = 500 * time.Millisecond
+	// DefaultTaskMaxAttempts is the number of times a task is leased before it is dropped and its instance is failed
+	// with the ReasonStalled reason.
+	DefaultTaskMaxAttempts = 5
+)
+
+// TaskType represents the work done by a task.
+type TaskType string
+
+const (
+	// TaskTypeExecute continues the execution of an instance with its next step.
+	TaskTypeExecute TaskType = "execute"
+	// TaskTypeStepChange hands a StepChangeEvent over to the StepChangeHander.
+	TaskTypeStepChange TaskType = "step-change"
+	// TaskTypeCompensate runs the compensating actions of a failed instance.
+	TaskTypeCompensate TaskType = "compensate"
+	// TaskTypeCancel calls the cancel hook of the action of a cancelled step, the Event of the task holds the step.
+	TaskTypeCancel TaskType = "cancel"
+)
+
+// Task is a unit of work of the WorkQueue persisted in the Storage.
+// A task is leased by one worker at a time. If the worker does not complete the task before its lease expires, e.g.
+// because the replica running it crashed, the task is leased again by another worker.
+//
+// Fields:
+// - Id: The unique identifier of the task.
+// - InstanceId: The unique identifier of the instance the task belongs to.
+// - Type: The type of the task.
+// - Event: The event handled by a task of type TaskTypeStepChange.
+// - Attempts: The number of times the task was leased.
+// - LeaseOwner: The identifier of the WorkQueue holding the lease.
+// - LeaseUntil: The time until which the task is invisible to the other workers.
+// - CreatedAt: The time the task was queued. Tasks are leased in the order they were queued.
+type Task struct {
+	Id         string                  `json:"id" yaml:"id"`
+	InstanceId string                  `json:"instance_id" yaml:"instance_id"`
+	Type       TaskType                `json:"type" yaml:"type"`
+	Event      *events.StepChangeEvent `json:"event,omitempty" yaml:"event,omitempty"`
+	Attempts   int                     `json:"attempts" yaml:"attempts"`
+	LeaseOwner string                  `json:"lease_owner,omitempty" yaml:"lease_owner,omitempty"`
+	LeaseUntil time.Time               `json:"lease_until" yaml:"lease_until"`
+	CreatedAt  time.Time               `json:"created_at" yaml:"created_at"`
+}
+
+// queueExecution queues a task continuing the execution of the instance.
+func queueExecution(storage Storage, instanceId string) (err error) {
+	err = queueTask(storage, &Task{InstanceId: instanceId, Type: TaskTypeExecute}, 0)
+	return
+}
+
+// queueStepChange queues a task handling the StepChangeEvent.
+func queueStepChange(storage Storage, event *events.StepChangeEvent) (err error) {
+	err = queueTask(storage, &Task{InstanceId: event.InstanceId, Type: TaskTypeStepChange, Event: event}, 0)
+	return
+}
+
+// queueCompensation queues a task running the compensating actions of the failed instance.
+func queueCompensation(storage Storage, instanceId string) (err error) {
+	err = queueTask(storage, &Task{InstanceId: instanceId, Type: TaskTypeCompensate}, 0)
+	return
+}
+
+// queueCancel queues a task calling the cancel hook of the action of the cancelled step.
+func queueCancel(storage Storage, stepState *StepState) (err error) {
+	err = queueTask(storage, &Task{
+		InstanceId: stepState.InstanceId,
+		Type:       TaskTypeCancel,
+		Event: &events.StepChangeEvent{
+			EventId:    CreateId(),
+			InstanceId: stepState.InstanceId,
+			StepId:     stepState.StepId,
+			Status:     models.StatusFailed,
+			Data:       map[string]any{data.StepIterationKey: stepState.Iteration},
+		},
+	}, 0)
+	return
+}
+
+// queueTask stores the task, it becomes visible to the workers after the delay.
+func queueTask(storage Storage, task *Task, delay time.Duration) (err error) {
+	task.Id = CreateId()
+	task.CreatedAt = time.Now()
+	task.LeaseUntil = task.CreatedAt.Add(delay)
+	logger.DebugF("Queueing task %s of type %s for instance %s", task.Id, task.Type, task.InstanceId)
+	err = storage.AddTask(task)
+	return
+}
+
+// WorkQueue is a lifecycle component that processes the tasks stored in the Storage with a pool of workers.
+// The workers of all replicas share the tasks, each task is processed by the worker holding its lease.
+type WorkQueue struct {
+	*lifecycle.SimpleComponent
+	storage  Storage
+	owner    string
+	workers  int
+	lease    time.Duration
+	interval time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWorkQueue creates a new WorkQueue. The defaults are used for the values missing in the configuration.
+func NewWorkQueue(storage Storage, c *config.WorkQueueConfig) *WorkQueue {
+	wq := &WorkQueue{
+		storage:  storage,
+		owner:    CreateId(),
+		workers:  DefaultTaskWorkers,
+		lease:    DefaultTaskLeaseTimeout,
+		interval: DefaultTaskPollInterval,
+	}
+	if c != nil {
+		if c.Workers > 0 {
+			wq.workers = c.Workers
+		}
+		if c.LeaseTimeout > 0 {
+			wq.lease = time.Duration(c.LeaseTimeout) * time.Second
+		}
+		if c.PollInterval > 0 {
+			wq.interval = time.Duration(c.PollInterval) * time.Millisecond
+		}
+	}
+	wq.SimpleComponent = &lifecycle.SimpleComponent{
+		CompId:    "orcaloop-work-queue",
+		StartFunc: wq.start,
+		StopFunc:  wq.stop,
+	}
+	return wq
+}
+
+func (wq *WorkQueue) start() (err error) {
+	wq.done = make(chan struct{})
+	for i := 0; i < wq.workers; i++ {
+		wq.wg.Add(1)
+		go wq.work()
+	}
+	return
+}
+
+func (wq *WorkQueue) stop() (err error) {
+	if wq.done != nil {
+		close(wq.done)
+		// Let the workers finish the tasks they are processing
+		wq.wg.Wait()
+	}
+	return
+}
+
+// work leases and processes one task after the other until the WorkQueue is stopped.
+func (wq *WorkQueue) work() {
+	defer wq.wg.Done()
+	for {
+		select {
+		case <-wq.done:
+			return
+		default:
+		}
+		tasks, err := wq.storage.LeaseTasks(wq.owner, 1, wq.lease)
+		if err != nil {
+			logger.ErrorF("Unable to lease tasks: %v", err)
+		}
+		if len(tasks) == 0 {
+			select {
+			case <-wq.done:
+				return
+			case <-time.After(wq.interval):
+			}
+			continue
+		}
+		wq.process(tasks[0])
+	}
+}
+
+// process runs the task while a heartbeat extends its lease. The task is deleted once it is done, a task that failed
+// is leased again once its lease expired.
+func (wq *WorkQueue) process(task *Task) {
+	if task.Attempts > DefaultTaskMaxAttempts {
+		wq.drop(task)
+		return
+	}
+	heartbeat := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(wq.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeat:
+				return
+			case <-ticker.C:
+				extended, err := wq.storage.ExtendTaskLease(task.Id, wq.owner, wq.lease)
+				if err != nil || !extended {
+					logger.ErrorF("Unable to extend the lease of task %s: %v", task.Id, err)
+				}
+			}
+		}
+	}()
+	done, err := wq.run(task)
+	close(heartbeat)
+	if err != nil {
+		logger.ErrorF("Task %s of type %s for instance %s failed: %v", task.Id, task.Type, task.InstanceId, err)
+		return
+	}
+	if !done {
+		// The instance is busy, queue the task again so that the retries do not count as failed attempts
+		err = queueTask(wq.storage, &Task{InstanceId: task.InstanceId, Type: task.Type, Event: task.Event}, wq.interval)
+		if err != nil {
+			logger.ErrorF("Unable to queue task %s again: %v", task.Id, err)
+			return
+		}
+	}
+	wq.complete(task)
+}
+
+// drop deletes a task that failed too often and fails its instance with the ReasonStalled reason, so that the
+// instance shows why it stopped and can be restarted. The task is kept if the instance is busy.
+func (wq *WorkQueue) drop(task *Task) {
+	logger.ErrorF("Dropping task %s of type %s for instance %s after %d attempts", task.Id, task.Type, task.InstanceId, task.Attempts-1)
+	err := NewWorkflowManager(wq.storage).stop(task.InstanceId, ReasonStalled, true)
+	if IsInstanceBusy(err) {
+		logger.WarnF("Instance %s is busy, dropping task %s once its lease expired", task.InstanceId, task.Id)
+		return
+	}
+	if err != nil && !IsInvalidInstanceState(err) {
+		logger.ErrorF("Unable to fail instance %s of task %s: %v", task.InstanceId, task.Id, err)
+	}
+	wq.complete(task)
+}
+
+func (wq *WorkQueue) complete(task *Task) {
+	err := wq.storage.DeleteTask(task.Id, wq.owner)
+	if err != nil {
+		logger.ErrorF("Unable to delete task %s: %v", task.Id, err)
+	}
+}
+
+// run does the work of the task as per its type. It returns false if the task could not be done yet.
+func (wq *WorkQueue) run(task *Task) (done bool, err error) {
+	logger.DebugF("Running task %v", task)
+	switch task.Type {
+	case TaskTypeExecute:
+		done, err = wq.execute(task)
+	case TaskTypeStepChange:
+		done = true
+		stepChangeHandler := &StepChangeHander{storage: wq.storage}
+		err = stepChangeHandler.Handle(task.Event)
+	case TaskTypeCancel:
+		done = true
+		err = wq.cancel(task)
+	case TaskTypeCompensate:
+		stepChangeHandler := &StepChangeHander{storage: wq.storage}
+		done, err = stepChangeHandler.runLocked(task.InstanceId, func() error {
+			return compensate(wq.storage, task.InstanceId)
+		})
+	default:
+		done = true
+		err = fmt.Errorf("unknown task type %s", task.Type)
+	}
+	return
+}
+
+// execute continues the execution of a running instance.
+func (wq *WorkQueue) execute(task *Task) (done bool, err error) {
+	stepChangeHandler := &StepChangeHander{storage: wq.storage}
+	done, err = stepChangeHandler.runLocked(task.InstanceId, func() (err error) {
+		var workflowState *WorkflowState
+		var workflow *models.Workflow
+		var pipeline *VersionedPipeline
+		workflowState, err = wq.storage.GetState(task.InstanceId)
+		if err != nil {
+			return
+		}
+		if workflowState.Status != models.StatusRunning {
+			logger.InfoF("Skipping task %s as instance %s is not running", task.Id, task.InstanceId)
+			return
+		}
+		workflow, err = wq.storage.GetWorkflowByInstance(task.InstanceId)
+		if err != nil {
+			return
+		}
+		pipeline, err = wq.storage.GetPipeline(task.InstanceId)
+		if err != nil {
+			return
+		}
+		wfe := WorkflowExecutor{storage: wq.storage}
+		err = wfe.Execute(workflow, pipeline)
+		return
+	})
+	return
+}
+
+// cancel calls the cancel hook of the action of the step cancelled by the task. The hook is notified on a best effort
+// basis, a failure is logged as the step is failed already.
+func (wq *WorkQueue) cancel(task *Task) (err error) {
+	var workflow *models.Workflow
+	var step *models.Step
+	workflow, err = wq.storage.GetWorkflowByInstance(task.InstanceId)
+	if err != nil {
+		return
+	}
+	step, err = getStep(wq.storage, workflow, task.Event.StepId)
+	if err != nil {
+		return
+	}
+	if step == nil {
+		err = errors.New("Unable to find step with id " + task.Event.StepId)
+		return
+	}
+	stepState := &StepState{
+		InstanceId: task.InstanceId,
+		StepId:     step.Id,
+		Iteration:  getIteration(data.NewPipelineFrom(task.Event.Data)),
+	}
+	actionExecutor := &ActionExecutor{storage: wq.storage}
+	cancelErr := actionExecutor.Cancel(step, stepState)
+	if cancelErr != nil {
+		logger.ErrorF("Unable to cancel the action of step %s for instance %s: %v", stepState.StepId, stepState.InstanceId, cancelErr)
+	}
+	return
+}
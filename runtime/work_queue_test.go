@@ -0,0 +1,99 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"oss.nandlabs.io/orcaloop-sdk/data"
+	"oss.nandlabs.io/orcaloop-sdk/models"
+)
+
+func TestDropTaskFailsInstance(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	err := NewWorkflowManager(storage).Save(&models.Workflow{Id: "workflow-1", Name: "workflow-1", Version: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.CreateNewInstance("workflow-1", "instance-1", data.NewPipelineFrom(map[string]any{data.InstanceIdKey: "instance-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.SaveState(&WorkflowState{InstanceId: "instance-1", WorkflowId: "workflow-1", WorkflowVersion: 1, Status: models.StatusRunning})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = storage.AddTask(&Task{Id: CreateId(), InstanceId: "instance-1", Type: TaskTypeExecute, Attempts: DefaultTaskMaxAttempts})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	wq := NewWorkQueue(storage, nil)
+	tasks, err := storage.LeaseTasks(wq.owner, 1, time.Minute)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("expected the task to be leased, got %v %v", tasks, err)
+	}
+	wq.process(tasks[0])
+	workflowState, err := storage.GetState("instance-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if workflowState.Status != models.StatusFailed || workflowState.Reason != ReasonStalled {
+		t.Errorf("expected the instance to fail with reason %s, got %v %s", ReasonStalled, workflowState.Status, workflowState.Reason)
+	}
+	tasks, _ = storage.LeaseTasks(wq.owner, 1, -time.Minute)
+	if len(tasks) != 0 {
+		t.Errorf("expected the task to be deleted, got %v", tasks)
+	}
+}
+
+// runTasks processes the tasks that are due until none is left.
+func runTasks(t *testing.T, storage Storage) {
+	wq := NewWorkQueue(storage, nil)
+	for i := 0; i < 100; i++ {
+		tasks, err := storage.LeaseTasks(wq.owner, 1, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(tasks) == 0 {
+			return
+		}
+		wq.process(tasks[0])
+	}
+	t.Fatal("expected the tasks to run out")
+}
+
+func TestStepFailingAfterStartFailsInstance(t *testing.T) {
+	storage := NewInMemoryStorage(nil)
+	wfm := NewWorkflowManager(storage)
+	err := wfm.Save(&models.Workflow{
+		Id:      "workflow-1",
+		Name:    "workflow-1",
+		Version: 1,
+		Steps: []*models.Step{{
+			Id:     "step-1",
+			Type:   models.StepTypeAction,
+			Action: &models.StepAction{Id: "missing", Name: "missing"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	instanceId, err := wfm.Start("workflow-1", 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	runTasks(t, storage)
+	stepState, err := storage.GetStepState(instanceId, "step-1", 0)
+	if err != nil || stepState == nil {
+		t.Fatalf("expected the step state, got %v %v", stepState, err)
+	}
+	if stepState.Status != models.StatusFailed {
+		t.Errorf("expected the step to fail, got %v", stepState.Status)
+	}
+	workflowState, err := storage.GetState(instanceId)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if workflowState.Status != models.StatusFailed || workflowState.Error == "" {
+		t.Errorf("expected the instance to fail with the missing action, got %v %s", workflowState.Status, workflowState.Error)
+	}
+}
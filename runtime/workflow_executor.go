@@ -6,7 +6,6 @@ import (
 	"oss.nandlabs.io/golly/textutils"
 	"oss.nandlabs.io/orcaloop-sdk/data"
 	"oss.nandlabs.io/orcaloop-sdk/models"
-	"oss.nandlabs.io/orcaloop-sdk/utils"
 )
 
 type WorkflowExecutor struct {
@@ -17,10 +16,34 @@ func NewWorkflowExecutor(storage Storage) *WorkflowExecutor {
 	return &WorkflowExecutor{storage: storage}
 }
 
-func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *data.Pipeline) (err error) {
+func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *VersionedPipeline) (err error) {
+	var next *models.Step
+	var again bool
+	// The transitions of the instance are saved in one transaction, the next step starts once it is committed
+	err = wfe.storage.WithTx(func(tx Storage) (err error) {
+		txExecutor := &WorkflowExecutor{storage: tx}
+		next, again, err = txExecutor.advance(workflow, pipeline)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if again {
+		err = wfe.Execute(workflow, pipeline)
+		return
+	}
+	if next != nil {
+		se := StepExecutor{storage: wfe.storage}
+		err = se.Execute(next, pipeline.Pipeline)
+	}
+	return
+}
+
+// advance completes the container steps whose children finished and finishes the instance once all its steps
+// finished. It returns the next step to start, if any, or true if the instance has to be advanced again.
+func (wfe *WorkflowExecutor) advance(workflow *models.Workflow, pipeline *VersionedPipeline) (next *models.Step, again bool, err error) {
 	var instanceId = pipeline.Id()
 	var workflowState *WorkflowState
-	var se = StepExecutor{storage: wfe.storage}
 	// GetWorkflowState
 	workflowState, err = wfe.storage.GetState(instanceId)
 	if err != nil {
@@ -46,14 +69,18 @@ func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *data.P
 			pipeline.Set(pendingStep.VarName, pendingStep.VarValue)
 		}
 		logger.DebugF("Executing pending step %v", pendingStep)
-		step := utils.GetStepById(pendingStep.StepId, workflow)
+		var step *models.Step
+		step, err = getStep(wfe.storage, workflow, pendingStep.StepId)
+		if err != nil {
+			return
+		}
 		if step == nil {
 			err = errors.New("Unable to find step with id " + pendingStep.StepId)
 			return
 		}
 		pipeline.Set(data.ParentIdKey, pendingStep.ParentId)
 		pipeline.Set(data.StepIterationKey, pendingStep.Iteration)
-		err = se.Execute(step, pipeline)
+		next = step
 		// if err != nil {
 		// 	return
 		// }
@@ -80,6 +107,34 @@ func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *data.P
 					logger.DebugF("Step %s failed aborting the workflow", step.Id)
 					return
 				case models.StatusRunning:
+					if isLeaf(step.Type) {
+						// The step has not reported back yet or is waiting for a retry
+						logger.DebugF("Step %s is still running waiting for it to complete", step.Id)
+						return
+					}
+					if step.Type == models.StepTypeParallel {
+						var join *Join
+						join, err = getJoin(wfe.storage, instanceId, step.Id)
+						if err != nil {
+							return
+						}
+						if join != nil {
+							// The join policy decides when the parallel step resolves
+							var resolved, caught bool
+							resolved, caught, err = resolveJoin(wfe.storage, workflow, join, stepState, stepStates)
+							if err != nil || !resolved {
+								return
+							}
+							if caught {
+								again = true
+								return
+							}
+							if stepState.Status != models.StatusCompleted {
+								return
+							}
+							continue
+						}
+					}
 					var completedChildren int
 					// var stepState = stepStates[step.Id]
 					var childError string
@@ -97,6 +152,27 @@ func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *data.P
 					}
 					if completedChildren == stepState.ChildCount {
 						logger.DebugF("All children of step %s completed proceeding to next step", step.Id)
+						if step.Type == StepTypeTry || step.Type == StepTypeWhile {
+							// The step decides how to continue, failures of the children were handled already
+							var running bool
+							if step.Type == StepTypeTry {
+								running, err = finishTry(wfe.storage, workflow, stepState, completedChildren)
+							} else {
+								running, err = nextIteration(wfe.storage, workflow, stepState)
+							}
+							if err != nil {
+								return
+							}
+							if running {
+								again = true
+								return
+							}
+							if stepState.Status != models.StatusCompleted {
+								// The step failed or waits for the delay of the next iteration
+								return
+							}
+							continue
+						}
 						if childError != textutils.EmptyStr {
 							logger.DebugF("Child failed for step %s aborting the workflow", step.Id)
 							stepState.Status = models.StatusFailed
@@ -105,9 +181,16 @@ func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *data.P
 								return
 							}
 							workflowState.Status = models.StatusFailed
-							err = wfe.storage.SaveState(workflowState)
+							workflowState.Error = childError
+							err = finishInstance(wfe.storage, workflowState)
 							return
 						} else {
+							if step.Type == models.StepTypeForLoop {
+								err = collectResults(wfe.storage, step, stepState, stepStates, pipeline)
+								if err != nil {
+									return
+								}
+							}
 							stepState.Status = models.StatusCompleted
 							err = wfe.storage.SaveStepState(stepState)
 							if err != nil {
@@ -117,17 +200,17 @@ func (wfe *WorkflowExecutor) Execute(workflow *models.Workflow, pipeline *data.P
 						}
 					} else {
 						logger.DebugF("Not all children of step %s completed waiting for them to complete", step.Id)
-						break
+						return
 					}
 				}
 			}
 		} else {
-			err = se.Execute(step, pipeline)
+			next = step
 			return
 		}
 	}
 	// This is possible only if all steps are completed
 	workflowState.Status = models.StatusCompleted
-	err = wfe.storage.SaveState(workflowState)
+	err = finishInstance(wfe.storage, workflowState)
 	return
 }
@@ -1,9 +1,19 @@
 package api
 
 import (
+	"time"
+
 	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/runtime"
 )
 
+// RegisterWorkflowRequest is the request for registering a workflow
+type RegisterWorkflowRequest struct {
+	*models.Workflow `json:",inline" yaml:",inline"`
+	// Options are the runtime options of the workflow
+	Options *runtime.WorkflowOptions `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
 type StartWorkflowRequest struct {
 	// WorkflowId is the id of the workflow to start
 	WorkflowId string `json:"workflowId" yaml:"workflowId"`
@@ -40,8 +50,64 @@ type WorkflowStatusResponse struct {
 	*APIBaseResponse
 	// Status is the status of the workflow instance
 	Status string `json:"status,omitempty" yaml:"status,omitempty"`
+	// Reason is the reason the runtime stopped the workflow instance
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
 	//pipeline is the data of the workflow instance
 	Pipeline map[string]any `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	// Steps is the status of the steps of the workflow instance
+	Steps []*StepStatus `json:"steps,omitempty" yaml:"steps,omitempty"`
+	// Parent is the step of the parent instance that started the workflow instance
+	Parent *runtime.ParentLink `json:"parent,omitempty" yaml:"parent,omitempty"`
+	// Children are the ids of the child instances started by the workflow instance
+	Children []string `json:"children,omitempty" yaml:"children,omitempty"`
+	// Compensation is the status of the compensation phase of a failed workflow instance
+	Compensation *CompensationStatus `json:"compensation,omitempty" yaml:"compensation,omitempty"`
+}
+
+// CompensationStatus is the status of the compensation phase of a failed workflow instance
+type CompensationStatus struct {
+	// Status is the status of the compensation phase
+	Status string `json:"status" yaml:"status"`
+	// Error is the error of the first compensating action that failed
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+	// Steps are the compensated steps in the order they are compensated
+	Steps []*CompensationStepStatus `json:"steps,omitempty" yaml:"steps,omitempty"`
+}
+
+// CompensationStepStatus is the status of the compensating action of a step
+type CompensationStepStatus struct {
+	// StepId is the id of the step
+	StepId string `json:"stepId" yaml:"stepId"`
+	// Iteration is the iteration of the step
+	Iteration int `json:"iteration" yaml:"iteration"`
+	// Status is the status of the compensating action
+	Status string `json:"status" yaml:"status"`
+	// Error is the error of the compensating action
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// StepStatus is the status of a step of a workflow instance
+type StepStatus struct {
+	// StepId is the id of the step
+	StepId string `json:"stepId" yaml:"stepId"`
+	// Iteration is the iteration of the step
+	Iteration int `json:"iteration" yaml:"iteration"`
+	// Status is the status of the step
+	Status string `json:"status" yaml:"status"`
+	// Attempts are the failed attempts of the step
+	Attempts []*runtime.Attempt `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	// NextRetryAt is the time at which the step is retried next
+	NextRetryAt *time.Time `json:"nextRetryAt,omitempty" yaml:"nextRetryAt,omitempty"`
+}
+
+// CompleteStepRequest is the request used by asynchronous actions to report the result of a step
+type CompleteStepRequest struct {
+	// Status is the status of the step
+	Status string `json:"status" yaml:"status"`
+	// Iteration is the iteration of the step
+	Iteration int `json:"iteration" yaml:"iteration"`
+	// Data is the output of the action
+	Data map[string]any `json:"data,omitempty" yaml:"data,omitempty"`
 }
 
 // GetActionsResponse is the response for GetActions
@@ -57,3 +123,37 @@ type GetActionResponse struct {
 	// Action is the action
 	ActionSpec *models.ActionSpec `json:"action_spec,omitempty" yaml:"action_spec,omitempty"`
 }
+
+// RestartRequest is the request to restart a failed workflow instance
+type RestartRequest struct {
+	// Variables are set in the pipeline before the instance is restarted
+	Variables map[string]any `json:"variables,omitempty" yaml:"variables,omitempty"`
+}
+
+// GetScheduleResponse is the response for GetSchedule
+type GetScheduleResponse struct {
+	*APIBaseResponse
+	// Schedule is the schedule
+	Schedule *runtime.Schedule `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+}
+
+// GetSchedulesResponse is the response for GetAllSchedules
+type GetSchedulesResponse struct {
+	*APIBaseResponse
+	// Schedules is the list of schedules
+	Schedules []*runtime.Schedule `json:"schedules,omitempty" yaml:"schedules,omitempty"`
+}
+
+// GetTriggerResponse is the response for GetTrigger
+type GetTriggerResponse struct {
+	*APIBaseResponse
+	// Trigger is the trigger
+	Trigger *runtime.Trigger `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+}
+
+// GetTriggersResponse is the response for GetAllTriggers
+type GetTriggersResponse struct {
+	*APIBaseResponse
+	// Triggers is the list of triggers
+	Triggers []*runtime.Trigger `json:"triggers,omitempty" yaml:"triggers,omitempty"`
+}
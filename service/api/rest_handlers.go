@@ -1,14 +1,16 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 
 	"oss.nandlabs.io/golly/lifecycle"
 	"oss.nandlabs.io/golly/rest"
-	"oss.nandlabs.io/orcaloop-sdk/data"
 	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
 	"oss.nandlabs.io/orcaloop/runtime"
 )
 
@@ -16,10 +18,11 @@ type RestHandler struct {
 	storage        runtime.Storage
 	wfm            *runtime.WorkflowManager
 	serviceManager lifecycle.ComponentManager
+	callback       *config.CallbackConfig
 }
 
-func NewRestHandler(storage runtime.Storage, manager lifecycle.ComponentManager) *RestHandler {
-	return &RestHandler{storage: storage, wfm: runtime.NewWorkflowManager(storage), serviceManager: manager}
+func NewRestHandler(storage runtime.Storage, manager lifecycle.ComponentManager, callback *config.CallbackConfig) *RestHandler {
+	return &RestHandler{storage: storage, wfm: runtime.NewWorkflowManager(storage), serviceManager: manager, callback: callback}
 }
 
 func (rh *RestHandler) GetAllWorkflows(ctx rest.ServerContext) {
@@ -113,8 +116,10 @@ func (rh *RestHandler) Start(ctx rest.ServerContext) {
 func (rh *RestHandler) Status(ctx rest.ServerContext) {
 	var err error
 	var req *WorkflowStatusReqeust = &WorkflowStatusReqeust{}
-	var pipeline *data.Pipeline
+	var pipeline *runtime.VersionedPipeline
 	var workflowState *runtime.WorkflowState
+	var stepStates map[string][]*runtime.StepState
+	var children []*runtime.WorkflowState
 	err = ctx.Read(&req)
 	if err != nil || req.InstanceId == "" {
 		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
@@ -135,30 +140,386 @@ func (rh *RestHandler) Status(ctx rest.ServerContext) {
 		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to get pipeline for workflow instance %s", req.InstanceId), err)
 		return
 	}
+	stepStates, err = rh.storage.GetStepStates(req.InstanceId)
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to get step states for workflow instance %s", req.InstanceId), err)
+		return
+	}
+
+	children, err = rh.storage.GetChildInstances(req.InstanceId)
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to get child instances for workflow instance %s", req.InstanceId), err)
+		return
+	}
+	childIds := make([]string, 0, len(children))
+	for _, child := range children {
+		childIds = append(childIds, child.InstanceId)
+	}
 
-	ctx.WriteJSON(&WorkflowStatusResponse{Status: workflowState.Status.String(), Pipeline: pipeline.Map()})
+	ctx.WriteJSON(&WorkflowStatusResponse{
+		Status:       workflowState.Status.String(),
+		Reason:       string(workflowState.Reason),
+		Pipeline:     pipeline.Map(),
+		Steps:        toStepStatuses(stepStates),
+		Parent:       workflowState.Parent,
+		Children:     childIds,
+		Compensation: toCompensationStatus(workflowState.Compensation),
+	})
 	ctx.SetStatusCode(http.StatusOK)
 
 }
 
+func (rh *RestHandler) CompleteStep(ctx rest.ServerContext) {
+	var err error
+	var instanceId, stepId string
+	var req *CompleteStepRequest = &CompleteStepRequest{}
+	if !rh.isCallbackAuthorized(ctx) {
+		RespondWithError(ctx, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	instanceId, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || instanceId == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+	stepId, err = ctx.GetParam("stepId", rest.PathParam)
+	if err != nil || stepId == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid step id", err)
+		return
+	}
+	err = ctx.Read(&req)
+	if err != nil {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
+		return
+	}
+	status, ok := models.StringToStatus[req.Status]
+	if !ok || (status != models.StatusCompleted && status != models.StatusFailed && status != models.StatusSkipped) {
+		RespondWithError(ctx, http.StatusBadRequest, fmt.Sprintf("Invalid status %s", req.Status), nil)
+		return
+	}
+
+	err = rh.wfm.CompleteStep(instanceId, stepId, req.Iteration, status, req.Data)
+	if err != nil {
+		switch {
+		case runtime.IsWorkflowStateNotFound(err), runtime.IsStepStateNotFound(err):
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Step %s not found for workflow instance %s", stepId, instanceId), err)
+		case runtime.IsStepNotRunning(err):
+			RespondWithError(ctx, http.StatusConflict, fmt.Sprintf("Step %s of workflow instance %s is not running", stepId, instanceId), err)
+		default:
+			RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to complete step %s of workflow instance %s", stepId, instanceId), err)
+		}
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusAccepted)
+}
+
+func (rh *RestHandler) Signal(ctx rest.ServerContext) {
+	var err error
+	var instanceId, name string
+	var payload map[string]any
+	instanceId, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || instanceId == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+	name, err = ctx.GetParam("name", rest.PathParam)
+	if err != nil || name == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid signal name", err)
+		return
+	}
+	// The payload is optional
+	err = ctx.Read(&payload)
+	if err != nil && !errors.Is(err, io.EOF) {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
+		return
+	}
+
+	err = rh.wfm.Signal(instanceId, name, payload)
+	if err != nil {
+		switch {
+		case runtime.IsWorkflowStateNotFound(err):
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Workflow instance %s not found", instanceId), err)
+		case runtime.IsInvalidInstanceState(err):
+			RespondWithError(ctx, http.StatusConflict, fmt.Sprintf("Workflow instance %s is not running", instanceId), err)
+		default:
+			RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to deliver signal %s to workflow instance %s", name, instanceId), err)
+		}
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusAccepted)
+}
+
+func (rh *RestHandler) Pause(ctx rest.ServerContext) {
+	rh.changeInstance(ctx, "pause", rh.wfm.Pause)
+}
+
+func (rh *RestHandler) Resume(ctx rest.ServerContext) {
+	rh.changeInstance(ctx, "resume", rh.wfm.Resume)
+}
+
+func (rh *RestHandler) Cancel(ctx rest.ServerContext) {
+	// The cancel hooks of the running actions are only called if requested with ?notify=true
+	notify, _ := ctx.GetParam("notify", rest.QueryParam)
+	rh.changeInstance(ctx, "cancel", func(instanceId string) error {
+		return rh.wfm.Cancel(instanceId, notify == "true")
+	})
+}
+
+func (rh *RestHandler) Terminate(ctx rest.ServerContext) {
+	rh.changeInstance(ctx, "terminate", rh.wfm.Terminate)
+}
+
+func (rh *RestHandler) Restart(ctx rest.ServerContext) {
+	var req *RestartRequest = &RestartRequest{}
+	// The body is optional
+	err := ctx.Read(req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
+		return
+	}
+	rh.changeInstance(ctx, "restart", func(instanceId string) error {
+		return rh.wfm.Restart(instanceId, req.Variables)
+	})
+}
+
+// changeInstance applies the lifecycle operation to the instance in the path and maps its errors to a response.
+func (rh *RestHandler) changeInstance(ctx rest.ServerContext, operation string, apply func(instanceId string) error) {
+	var err error
+	var instanceId string
+	instanceId, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || instanceId == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+
+	err = apply(instanceId)
+	if err != nil {
+		switch {
+		case runtime.IsWorkflowStateNotFound(err):
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Workflow instance %s not found", instanceId), err)
+		case runtime.IsInvalidInstanceState(err), runtime.IsInstanceBusy(err):
+			RespondWithError(ctx, http.StatusConflict, fmt.Sprintf("Unable to %s workflow instance %s", operation, instanceId), err)
+		default:
+			RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to %s workflow instance %s", operation, instanceId), err)
+		}
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusAccepted)
+}
+
 func (rh *RestHandler) RegisterWorflow(ctx rest.ServerContext) {
 	var err error
-	var workflow *models.Workflow = &models.Workflow{}
-	err = ctx.Read(workflow)
+	var req *RegisterWorkflowRequest = &RegisterWorkflowRequest{Workflow: &models.Workflow{}}
+	err = ctx.Read(req)
 	if err != nil {
 		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
 		return
 
 	}
-	err = rh.wfm.Save(workflow)
+	if req.Options == nil {
+		// Steps of the runtime step types need options, validate them even if none are given
+		req.Options = &runtime.WorkflowOptions{}
+	}
+	req.Options.WorkflowId = req.Workflow.Id
+	req.Options.WorkflowVersion = req.Workflow.Version
+	err = req.Options.Validate(req.Workflow)
+	if err != nil {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid workflow options", err)
+		return
+	}
+	err = rh.wfm.Save(req.Workflow)
 	if err != nil {
 		RespondWithError(ctx, http.StatusInternalServerError, "Unable to  to save workflow", err)
 		return
 	}
+	err = rh.wfm.SaveOptions(req.Options)
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, "Unable to save workflow options", err)
+		return
+	}
 	ctx.SetStatusCode(http.StatusAccepted)
 
 }
 
+func (rh *RestHandler) SaveSchedule(ctx rest.ServerContext) {
+	var err error
+	var schedule *runtime.Schedule = &runtime.Schedule{}
+	err = ctx.Read(schedule)
+	if err != nil {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
+		return
+	}
+	if id, _ := ctx.GetParam("id", rest.PathParam); id != "" {
+		schedule.Id = id
+	}
+	err = schedule.Validate()
+	if err != nil {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid schedule", err)
+		return
+	}
+
+	err = rh.wfm.SaveSchedule(schedule)
+	if err != nil {
+		if runtime.IsWorkflowNotFound(err) {
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Workflow %s not found", schedule.WorkflowId), err)
+			return
+		}
+		if runtime.IsVersionConflict(err) {
+			RespondWithError(ctx, http.StatusConflict, fmt.Sprintf("Schedule %s was changed concurrently", schedule.Id), err)
+			return
+		}
+		RespondWithError(ctx, http.StatusInternalServerError, "Unable to save schedule", err)
+		return
+	}
+
+	ctx.WriteJSON(&GetScheduleResponse{Schedule: schedule})
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (rh *RestHandler) GetAllSchedules(ctx rest.ServerContext) {
+	var err error
+	var schedules []*runtime.Schedule
+	schedules, err = rh.wfm.GetSchedules()
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, "Failed to get schedules", err)
+		return
+	}
+
+	ctx.WriteJSON(&GetSchedulesResponse{Schedules: schedules})
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (rh *RestHandler) GetSchedule(ctx rest.ServerContext) {
+	var err error
+	var id string
+	var schedule *runtime.Schedule
+	id, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || id == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+
+	schedule, err = rh.wfm.GetSchedule(id)
+	if err != nil {
+		if runtime.IsScheduleNotFound(err) {
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Schedule %s not found", id), err)
+			return
+		}
+		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch Schedule with id %s", id), err)
+		return
+	}
+
+	ctx.WriteJSON(&GetScheduleResponse{Schedule: schedule})
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (rh *RestHandler) DeleteSchedule(ctx rest.ServerContext) {
+	var err error
+	var id string
+	id, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || id == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+
+	err = rh.wfm.DeleteSchedule(id)
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to delete schedule with id %s", id), err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func (rh *RestHandler) SaveTrigger(ctx rest.ServerContext) {
+	var err error
+	var trigger *runtime.Trigger = &runtime.Trigger{}
+	err = ctx.Read(trigger)
+	if err != nil {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid Input", err)
+		return
+	}
+	if id, _ := ctx.GetParam("id", rest.PathParam); id != "" {
+		trigger.Id = id
+	}
+	err = trigger.Validate()
+	if err != nil {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid trigger", err)
+		return
+	}
+
+	err = rh.wfm.SaveTrigger(trigger)
+	if err != nil {
+		if runtime.IsWorkflowNotFound(err) {
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Workflow %s not found", trigger.WorkflowId), err)
+			return
+		}
+		RespondWithError(ctx, http.StatusInternalServerError, "Unable to save trigger", err)
+		return
+	}
+
+	ctx.WriteJSON(&GetTriggerResponse{Trigger: trigger})
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (rh *RestHandler) GetAllTriggers(ctx rest.ServerContext) {
+	var err error
+	var triggers []*runtime.Trigger
+	triggers, err = rh.wfm.GetTriggers()
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, "Failed to get triggers", err)
+		return
+	}
+
+	ctx.WriteJSON(&GetTriggersResponse{Triggers: triggers})
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (rh *RestHandler) GetTrigger(ctx rest.ServerContext) {
+	var err error
+	var id string
+	var trigger *runtime.Trigger
+	id, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || id == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+
+	trigger, err = rh.wfm.GetTrigger(id)
+	if err != nil {
+		if runtime.IsTriggerNotFound(err) {
+			RespondWithError(ctx, http.StatusNotFound, fmt.Sprintf("Trigger %s not found", id), err)
+			return
+		}
+		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Unable to fetch Trigger with id %s", id), err)
+		return
+	}
+
+	ctx.WriteJSON(&GetTriggerResponse{Trigger: trigger})
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (rh *RestHandler) DeleteTrigger(ctx rest.ServerContext) {
+	var err error
+	var id string
+	id, err = ctx.GetParam("id", rest.PathParam)
+	if err != nil || id == "" {
+		RespondWithError(ctx, http.StatusBadRequest, "Invalid id", err)
+		return
+	}
+
+	err = rh.wfm.DeleteTrigger(id)
+	if err != nil {
+		RespondWithError(ctx, http.StatusInternalServerError, fmt.Sprintf("Failed to delete trigger with id %s", id), err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusNoContent)
+}
+
 func (rh *RestHandler) RegisterAction(ctx rest.ServerContext) {
 	actionSpec := &models.ActionSpec{}
 	err := ctx.Read(actionSpec)
@@ -248,6 +609,23 @@ func (rh *RestHandler) RegisterRoutes(server rest.Server) {
 	server.Get("/workflows/:id/:version", rh.GetWorkflow)
 	server.Post("/instances/start", rh.Start)
 	server.Post("/instances/status", rh.Status)
+	server.Post("/instances/:id/steps/:stepId/complete", rh.CompleteStep)
+	server.Post("/instances/:id/pause", rh.Pause)
+	server.Post("/instances/:id/resume", rh.Resume)
+	server.Post("/instances/:id/cancel", rh.Cancel)
+	server.Post("/instances/:id/terminate", rh.Terminate)
+	server.Post("/instances/:id/restart", rh.Restart)
+	server.Post("/instances/:id/signals/:name", rh.Signal)
+	server.Post("/schedules", rh.SaveSchedule)
+	server.Get("/schedules", rh.GetAllSchedules)
+	server.Get("/schedules/:id", rh.GetSchedule)
+	server.Put("/schedules/:id", rh.SaveSchedule)
+	server.Delete("/schedules/:id", rh.DeleteSchedule)
+	server.Post("/triggers", rh.SaveTrigger)
+	server.Get("/triggers", rh.GetAllTriggers)
+	server.Get("/triggers/:id", rh.GetTrigger)
+	server.Put("/triggers/:id", rh.SaveTrigger)
+	server.Delete("/triggers/:id", rh.DeleteTrigger)
 	server.Post("/actions", rh.RegisterAction)
 	server.Get("/actions/:id", rh.GetAllActions)
 	server.Post("/system/stop", rh.GetAllActions)
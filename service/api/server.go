@@ -24,7 +24,7 @@ func RegisterServer(options *config.Orcaloop, manager lifecycle.ComponentManager
 		storage.SaveAction(item.Spec())
 	}
 	// Register the workflow service
-	resthandler := NewRestHandler(storage, manager)
+	resthandler := NewRestHandler(storage, manager, options.Callback)
 	resthandler.RegisterRoutes(server)
 	manager.Register(server)
 	return
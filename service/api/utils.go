@@ -1,10 +1,14 @@
 package api
 
 import (
+	"crypto/subtle"
 	"strconv"
+	"strings"
 
 	"oss.nandlabs.io/golly/rest"
 	"oss.nandlabs.io/orcaloop-sdk/models"
+	"oss.nandlabs.io/orcaloop/config"
+	"oss.nandlabs.io/orcaloop/runtime"
 )
 
 type APIBaseResponse struct {
@@ -26,3 +30,57 @@ func RespondWithError(ctx rest.ServerContext, code int, message string, err erro
 	ctx.WriteJSON(errObj)
 	ctx.SetStatusCode(code)
 }
+
+func toStepStatuses(stepStates map[string][]*runtime.StepState) (steps []*StepStatus) {
+	for _, states := range stepStates {
+		for _, stepState := range states {
+			stepStatus := &StepStatus{
+				StepId:    stepState.StepId,
+				Iteration: stepState.Iteration,
+				Status:    stepState.Status.String(),
+				Attempts:  stepState.Attempts,
+			}
+			if !stepState.NextRetryAt.IsZero() {
+				nextRetryAt := stepState.NextRetryAt
+				stepStatus.NextRetryAt = &nextRetryAt
+			}
+			steps = append(steps, stepStatus)
+		}
+	}
+	return
+}
+
+// toCompensationStatus converts the compensation phase of an instance, returning nil if there is none.
+func toCompensationStatus(compensation *runtime.Compensation) (status *CompensationStatus) {
+	if compensation == nil {
+		return
+	}
+	status = &CompensationStatus{
+		Status: compensation.Status.String(),
+		Error:  compensation.Error,
+	}
+	for _, step := range compensation.Steps {
+		status.Steps = append(status.Steps, &CompensationStepStatus{
+			StepId:    step.StepId,
+			Iteration: step.Iteration,
+			Status:    step.Status.String(),
+			Error:     step.Error,
+		})
+	}
+	return
+}
+
+// isCallbackAuthorized checks the bearer token sent by an action against the configured callback token.
+func (rh *RestHandler) isCallbackAuthorized(ctx rest.ServerContext) bool {
+	return checkBearerToken(rh.callback, ctx.GetHeader("Authorization"))
+}
+
+// checkBearerToken checks the Authorization header of a callback against the configured token.
+// Callbacks are rejected if no token is configured.
+func checkBearerToken(callback *config.CallbackConfig, authorization string) bool {
+	if callback == nil || callback.Token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(callback.Token)) == 1
+}
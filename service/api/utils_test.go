@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+
+	"oss.nandlabs.io/orcaloop/config"
+)
+
+func TestCheckBearerToken(t *testing.T) {
+	callback := &config.CallbackConfig{Token: "secret"}
+	tests := map[string]struct {
+		callback      *config.CallbackConfig
+		authorization string
+		authorized    bool
+	}{
+		"valid token":      {callback: callback, authorization: "Bearer secret", authorized: true},
+		"no callback":      {authorization: "Bearer secret"},
+		"no token":         {callback: &config.CallbackConfig{}, authorization: "Bearer "},
+		"missing header":   {callback: callback},
+		"wrong token":      {callback: callback, authorization: "Bearer other"},
+		"token prefix":     {callback: callback, authorization: "Bearer secre"},
+		"missing scheme":   {callback: callback, authorization: "secret"},
+		"basic scheme":     {callback: callback, authorization: "Basic secret"},
+		"lowercase scheme": {callback: callback, authorization: "bearer secret"},
+		"trailing content": {callback: callback, authorization: "Bearer secret "},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			authorized := checkBearerToken(tt.callback, tt.authorization)
+			if authorized != tt.authorized {
+				t.Errorf("expected authorized %v, got %v", tt.authorized, authorized)
+			}
+		})
+	}
+}
@@ -3,13 +3,38 @@ package service
 import (
 	"oss.nandlabs.io/golly/lifecycle"
 	"oss.nandlabs.io/orcaloop/config"
+	"oss.nandlabs.io/orcaloop/runtime"
 	"oss.nandlabs.io/orcaloop/service/api"
 )
 
 var orcaloopServiceManager = lifecycle.NewSimpleComponentManager()
 
 func Init(config *config.Orcaloop) (err error) {
+	var storage runtime.Storage
 	err = api.RegisterServer(config, orcaloopServiceManager)
+	if err != nil {
+		return
+	}
+	storage, err = runtime.GetStorage(config.StorageConfig)
+	if err != nil {
+		return
+	}
+	orcaloopServiceManager.Register(runtime.NewWorkQueue(storage, config.WorkQueue))
+	orcaloopServiceManager.Register(runtime.NewRecoverySweeper(storage, runtime.DefaultRecoveryInterval, runtime.DefaultRecoveryTimeout))
+	orcaloopServiceManager.Register(runtime.NewTimerScheduler(storage, runtime.DefaultTimerPollInterval))
+	orcaloopServiceManager.Register(runtime.NewScheduler(storage, runtime.DefaultSchedulePollInterval))
+	orcaloopServiceManager.Register(runtime.NewTriggerConsumer(storage, runtime.DefaultTriggerRefreshInterval))
+	if inMemoryStorage, ok := storage.(*runtime.InMemoryStorage); ok && inMemoryStorage.PurgeTimeout() > 0 {
+		orcaloopServiceManager.Register(runtime.NewInMemoryJanitor(inMemoryStorage, runtime.DefaultPurgeInterval))
+	}
+	if config.Messaging != nil && config.Messaging.ReplyTopic != "" {
+		var replyConsumer *runtime.ReplyConsumer
+		replyConsumer, err = runtime.NewReplyConsumer(storage, config.Messaging)
+		if err != nil {
+			return
+		}
+		orcaloopServiceManager.Register(replyConsumer)
+	}
 	return
 }
 